@@ -1,17 +1,214 @@
 package fsm
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
 
-type Backoff func(attempt int) time.Duration
+// Backoff returns how long to wait before retrying a step, given the
+// attempt that failed (starting at 1) and the error it failed with.
+type Backoff func(attempt int, err error) time.Duration
+
+// AttemptBackoff is a backoff that only depends on the attempt.
+type AttemptBackoff func(attempt int) time.Duration
+
+// Backoff adapts b to a Backoff that ignores the error.
+func (b AttemptBackoff) Backoff() Backoff {
+	return func(attempt int, _ error) time.Duration {
+		return b(attempt)
+	}
+}
+
+func ConstantBackoff(delay time.Duration) Backoff {
+	return func(int, error) time.Duration {
+		return delay
+	}
+}
 
 func LinearBackoff(increment, max time.Duration) Backoff {
-	return func(attempt int) time.Duration {
-		return min(increment*time.Duration(attempt), max)
+	return func(attempt int, _ error) time.Duration {
+		if increment <= 0 || attempt <= 0 {
+			return 0
+		}
+		if time.Duration(attempt) >= max/increment {
+			return max
+		}
+		return increment * time.Duration(attempt)
 	}
 }
 
 func ExponentialBackoff(base, max time.Duration) Backoff {
-	return func(attempt int) time.Duration {
-		return min(base*time.Duration(1<<attempt), max)
+	return func(attempt int, _ error) time.Duration {
+		return grow(base, 2, attempt, max)
+	}
+}
+
+// FullJitterBackoff picks a delay uniformly between zero and the
+// exponential backoff for the attempt, spreading out retries of steps
+// that failed together.
+func FullJitterBackoff(base, max time.Duration) Backoff {
+	return FullJitter(ExponentialBackoff(base, max))
+}
+
+// DecorrelatedJitterBackoff picks a delay uniformly between base and up
+// to three times the previous attempt's bound, so delays grow about as
+// fast as exponential backoff while staying spread out. The bound is
+// derived from the attempt, so no state is kept between retries.
+func DecorrelatedJitterBackoff(base, max time.Duration) Backoff {
+	return func(attempt int, _ error) time.Duration {
+		return between(min(base, max), grow(base, 3, attempt, max))
+	}
+}
+
+// FullJitter picks a delay uniformly between zero and the delay from
+// backoff.
+func FullJitter(backoff Backoff) Backoff {
+	return func(attempt int, err error) time.Duration {
+		return between(0, backoff(attempt, err))
+	}
+}
+
+// CappedBackoff limits the delays from backoff to max.
+func CappedBackoff(backoff Backoff, max time.Duration) Backoff {
+	return func(attempt int, err error) time.Duration {
+		return min(backoff(attempt, err), max)
+	}
+}
+
+// SequenceBackoff waits for each of delays in turn, repeating the last
+// one once they run out.
+func SequenceBackoff(delays ...time.Duration) Backoff {
+	return func(attempt int, _ error) time.Duration {
+		if len(delays) == 0 {
+			return 0
+		}
+		return delays[min(max(attempt-1, 0), len(delays)-1)]
+	}
+}
+
+// ErrorBackoff is the backoff for errors that match, used by
+// PerErrorBackoff.
+type ErrorBackoff struct {
+	Match   func(err error) bool
+	Backoff Backoff
+}
+
+// BackoffOn matches errors that are target, as reported by errors.Is.
+func BackoffOn(target error, backoff Backoff) ErrorBackoff {
+	return ErrorBackoff{
+		Match:   func(err error) bool { return errors.Is(err, target) },
+		Backoff: backoff,
+	}
+}
+
+// PerErrorBackoff uses the backoff of the first case matching the error,
+// or fallback if none of them do.
+func PerErrorBackoff(fallback Backoff, cases ...ErrorBackoff) Backoff {
+	return func(attempt int, err error) time.Duration {
+		for _, c := range cases {
+			if c.Match(err) {
+				return c.Backoff(attempt, err)
+			}
+		}
+		return fallback(attempt, err)
+	}
+}
+
+// grow multiplies base by factor once per attempt, stopping at max
+// instead of overflowing.
+func grow(base time.Duration, factor, attempt int, max time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base
+	for range attempt {
+		if d > max/time.Duration(factor) {
+			return max
+		}
+		d *= time.Duration(factor)
+	}
+	return min(d, max)
+}
+
+func between(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return hi
+	}
+	return lo + rand.N(hi-lo+1)
+}
+
+type BackoffType string
+
+const (
+	BackoffConstant    BackoffType = "constant"
+	BackoffLinear      BackoffType = "linear"
+	BackoffExponential BackoffType = "exponential"
+)
+
+type Jitter string
+
+const (
+	JitterNone         Jitter = ""
+	JitterFull         Jitter = "full"
+	JitterDecorrelated Jitter = "decorrelated"
+)
+
+// BackoffConfig describes a backoff declared in a model. Base is the
+// delay for constant backoffs, the increment for linear ones, and the
+// first delay for exponential ones.
+type BackoffConfig struct {
+	Type   BackoffType
+	Base   time.Duration
+	Max    time.Duration
+	Jitter Jitter
+}
+
+func (c BackoffConfig) Validate() error {
+	if c.Base <= 0 {
+		return fmt.Errorf("backoff base must be positive, got %s", c.Base)
+	}
+	switch c.Type {
+	case BackoffConstant:
+		if c.Max != 0 {
+			return errors.New("constant backoff cannot have a max")
+		}
+	case BackoffLinear, BackoffExponential:
+		if c.Max < c.Base {
+			return fmt.Errorf("backoff max must be at least the base %s, got %s", c.Base, c.Max)
+		}
+	default:
+		return fmt.Errorf("unknown backoff type %q", c.Type)
+	}
+	switch c.Jitter {
+	case JitterNone, JitterFull:
+	case JitterDecorrelated:
+		if c.Type != BackoffExponential {
+			return fmt.Errorf("decorrelated jitter requires exponential backoff, got %s", c.Type)
+		}
+	default:
+		return fmt.Errorf("unknown backoff jitter %q", c.Jitter)
+	}
+	return nil
+}
+
+// Backoff builds the backoff for a valid config.
+func (c BackoffConfig) Backoff() Backoff {
+	var backoff Backoff
+	switch c.Type {
+	case BackoffConstant:
+		backoff = ConstantBackoff(c.Base)
+	case BackoffLinear:
+		backoff = LinearBackoff(c.Base, c.Max)
+	case BackoffExponential:
+		if c.Jitter == JitterDecorrelated {
+			return DecorrelatedJitterBackoff(c.Base, c.Max)
+		}
+		backoff = ExponentialBackoff(c.Base, c.Max)
+	}
+	if c.Jitter == JitterFull {
+		backoff = FullJitter(backoff)
 	}
+	return backoff
 }
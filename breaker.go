@@ -0,0 +1,197 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerConfig configures a state's circuit breaker. The breaker opens
+// when at least Threshold of the last Window steps failed, and pauses the
+// state for Cooldown. It then lets Probes steps through, closing again once
+// they all succeed, or reopening as soon as one fails. The zero config
+// disables the breaker.
+type BreakerConfig struct {
+	Threshold float64
+	Window    int
+	Cooldown  time.Duration
+	Probes    int
+}
+
+func (c BreakerConfig) Enabled() bool {
+	return c.Window > 0
+}
+
+func (c BreakerConfig) Validate() error {
+	if c == (BreakerConfig{}) {
+		return nil
+	}
+	if c.Threshold <= 0 || c.Threshold > 1 {
+		return fmt.Errorf("breaker threshold must be in (0, 1], got %g", c.Threshold)
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("breaker window must be positive, got %d", c.Window)
+	}
+	if c.Cooldown <= 0 {
+		return fmt.Errorf("breaker cooldown must be positive, got %s", c.Cooldown)
+	}
+	if c.Probes < 0 {
+		return fmt.Errorf("breaker probes must not be negative, got %d", c.Probes)
+	}
+	return nil
+}
+
+// Breaker is a circuit breaker over a state's step outcomes. It is safe for
+// concurrent use, including changing its config.
+type Breaker struct {
+	lock     sync.Mutex
+	config   BreakerConfig
+	onChange func(from, to BreakerState)
+
+	state    BreakerState
+	outcomes []bool // Failures among the most recent steps, oldest first
+	openedAt time.Time
+	inflight int
+	passed   int
+	changed  chan struct{} // Closed and replaced when probes may proceed
+}
+
+// NewBreaker creates a closed breaker, calling onChange, if it is set, each
+// time the breaker changes state. Changes are reported in order, while the
+// breaker is locked, so onChange must not call back into the breaker.
+func NewBreaker(config BreakerConfig, onChange func(from, to BreakerState)) *Breaker {
+	b := &Breaker{
+		onChange: onChange,
+		state:    BreakerClosed,
+		changed:  make(chan struct{}),
+	}
+	b.SetConfig(config)
+	return b
+}
+
+// SetConfig replaces the breaker's config, closing it and forgetting any
+// recorded outcomes.
+func (b *Breaker) SetConfig(config BreakerConfig) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if config.Probes == 0 {
+		config.Probes = 1
+	}
+	b.config = config
+	b.transition(BreakerClosed)
+}
+
+func (b *Breaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Allow waits until a step may run. While the breaker is open it waits for
+// the cooldown, and while it is half-open it waits for a free probe. It
+// reports whether the step is a probe, which must be passed back to Record
+// or Abandon.
+func (b *Breaker) Allow(ctx context.Context) (bool, error) {
+	for {
+		b.lock.Lock()
+		if !b.config.Enabled() || b.state == BreakerClosed {
+			b.lock.Unlock()
+			return false, nil
+		}
+
+		var cooldown <-chan time.Time
+		if b.state == BreakerOpen {
+			if remaining := time.Until(b.openedAt.Add(b.config.Cooldown)); remaining > 0 {
+				cooldown = time.After(remaining)
+			} else {
+				b.transition(BreakerHalfOpen)
+				b.lock.Unlock()
+				continue
+			}
+		} else if b.inflight < b.config.Probes-b.passed {
+			b.inflight++
+			b.lock.Unlock()
+			return true, nil
+		}
+		changed := b.changed
+		b.lock.Unlock()
+
+		select {
+		case <-cooldown:
+		case <-changed:
+		case <-ctx.Done():
+			return false, context.Cause(ctx)
+		}
+	}
+}
+
+// Record adds a step's outcome to the breaker.
+func (b *Breaker) Record(probe, failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case !b.config.Enabled():
+	case b.state == BreakerClosed && !probe:
+		b.outcomes = append(b.outcomes, failed)
+		if len(b.outcomes) > b.config.Window {
+			b.outcomes = b.outcomes[1:]
+		}
+		if len(b.outcomes) == b.config.Window && b.failureRate() >= b.config.Threshold {
+			b.transition(BreakerOpen)
+		}
+	case b.state == BreakerHalfOpen && probe:
+		b.inflight--
+		if failed {
+			b.transition(BreakerOpen)
+		} else if b.passed++; b.passed >= b.config.Probes {
+			b.transition(BreakerClosed)
+		}
+	}
+}
+
+// Abandon gives up a step without an outcome, e.g. because it was
+// cancelled, so that a probe can be retried.
+func (b *Breaker) Abandon(probe bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if probe && b.state == BreakerHalfOpen {
+		b.inflight--
+		b.wake()
+	}
+}
+
+func (b *Breaker) failureRate() float64 {
+	var failures int
+	for _, failed := range b.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.outcomes))
+}
+
+func (b *Breaker) transition(to BreakerState) {
+	from := b.state
+	b.state, b.outcomes, b.inflight, b.passed = to, nil, 0, 0
+	if to == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+	b.wake()
+	if from != to && b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
+
+func (b *Breaker) wake() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -26,6 +26,7 @@ func main() {
 	}
 	defer file.Close()
 
+	var models []*fsm.FsmModel
 	decoder := yaml.NewDecoder(file)
 	for {
 		model, err := fsm.ParseModel(decoder)
@@ -34,7 +35,13 @@ func main() {
 		} else if err != nil {
 			log.Fatalf("parse model: %s", err)
 		}
+		models = append(models, model)
+	}
+	if err := fsm.LinkModels(models); err != nil {
+		log.Fatalf("link models: %s", err)
+	}
 
+	for _, model := range models {
 		generated := fsm.Generate(opts.Pkg, model)
 
 		if err := os.MkdirAll(opts.Out, 0755); err != nil {
@@ -3,6 +3,7 @@ package fsm
 import (
 	"context"
 	"log/slog"
+	"maps"
 )
 
 type stateKey struct{}
@@ -63,3 +64,104 @@ func GetAttempt(ctx context.Context) int {
 	}
 	return attempt
 }
+
+type queueItemKey struct{}
+
+// PutQueueItem records the queue item a handler is processing, so that its
+// transitions can acknowledge it.
+func PutQueueItem(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, queueItemKey{}, id)
+}
+
+func GetQueueItem(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(queueItemKey{}).(int64)
+	return id, ok
+}
+
+type idempotencyKeyKey struct{}
+
+// PutIdempotencyKey attaches an idempotency key to a submission. Submitting
+// again with the same key returns the existing task instead of creating a
+// new one, as long as the inputs match.
+func PutIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func GetIdempotencyKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey{}).(string)
+	return key, ok
+}
+
+type priorityKey struct{}
+
+// PutPriority sets the priority of steps enqueued with the context. A task
+// submitted with it starts at that priority, and a transition made with it
+// overrides the priority inherited from the step being handled. Higher
+// priorities are claimed first.
+func PutPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func GetPriority(ctx context.Context) int {
+	priority, ok := ctx.Value(priorityKey{}).(int)
+	if !ok {
+		return 0
+	}
+	return priority
+}
+
+type concurrencyKeyKey struct{}
+
+// PutConcurrencyKey attaches a concurrency key to a submission. Tasks that
+// share a key run one at a time through each of the model's serialized
+// regions, in the order they reach them.
+func PutConcurrencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, concurrencyKeyKey{}, key)
+}
+
+func GetConcurrencyKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(concurrencyKeyKey{}).(string)
+	return key, ok
+}
+
+// Branch identifies one of the parallel branches a task fanned out into.
+type Branch struct {
+	Fanout int64 // Queue item of the step that fanned out
+	Index  int
+}
+
+type branchKey struct{}
+
+// PutBranch records the branch a handler is running in, so that its
+// transitions stay in the branch.
+func PutBranch(ctx context.Context, branch Branch) context.Context {
+	return context.WithValue(ctx, branchKey{}, branch)
+}
+
+// GetBranch returns the branch a handler is running in, if it is running in
+// one.
+func GetBranch(ctx context.Context) (Branch, bool) {
+	branch, ok := ctx.Value(branchKey{}).(Branch)
+	return branch, ok
+}
+
+type metadataKey struct{}
+
+// PutMetadata attaches metadata to a submission, on top of any already
+// attached. It's stored with the task, and handlers of each of its steps
+// see it on their context, so submissions made from a handler pass it on.
+func PutMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	merged := maps.Clone(GetMetadata(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(metadata))
+	}
+	maps.Copy(merged, metadata)
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// GetMetadata returns the metadata attached to the context. It must not be
+// modified.
+func GetMetadata(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return metadata
+}
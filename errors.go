@@ -0,0 +1,68 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTaskNotFound is returned when an operation references a task that
+	// does not exist in the store.
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrTaskCancelled is returned when an operation is attempted on a task
+	// that has been cancelled. It is also the cause of a running handler's
+	// context when the task is cancelled.
+	ErrTaskCancelled = errors.New("task cancelled")
+
+	// ErrTaskFinished is returned when an operation requires a task that is
+	// still in progress, but the task has already reached a terminal state.
+	ErrTaskFinished = errors.New("task finished")
+
+	// ErrClaimLost is returned by a transition when the queue item being
+	// processed has already been acknowledged or removed, or its lease
+	// expired and another worker took it over, so the step can't move the
+	// task on. It is also the cause of a running handler's context when its
+	// lease is lost.
+	ErrClaimLost = errors.New("queue item is no longer claimed")
+
+	// ErrIdempotencyConflict is returned by a submission whose idempotency
+	// key was already used to submit a task with different inputs.
+	ErrIdempotencyConflict = errors.New("idempotency key reused with different inputs")
+
+	// ErrQueueFull is returned when a step can't enter a state whose queue
+	// is at capacity. The error is always a *QueueFullError.
+	ErrQueueFull = errors.New("queue full")
+
+	// ErrNoPendingRetry is returned when retrying a task now that isn't
+	// waiting to retry a failed step.
+	ErrNoPendingRetry = errors.New("no pending retry")
+
+	// ErrUnknownState is returned when an operation references a state the
+	// FSM doesn't have.
+	ErrUnknownState = errors.New("unknown state")
+
+	// ErrChildRunning is returned by the handler of an invoking state while
+	// the task it invoked is still running. The step is parked without
+	// counting an attempt, and runs again once the child finishes.
+	ErrChildRunning = errors.New("child task running")
+
+	// ErrUnscopedTasks is returned when starting an FSM on a store with
+	// tasks from before tasks were scoped to an FSM, unless the FSM adopts
+	// them with WithUnscopedTasks.
+	ErrUnscopedTasks = errors.New("store has tasks without an FSM")
+)
+
+// QueueFullError reports the state whose queue was full.
+type QueueFullError struct {
+	State    State
+	Capacity int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("%s: state = %s, capacity = %d", ErrQueueFull, e.State, e.Capacity)
+}
+
+func (e *QueueFullError) Is(target error) bool {
+	return target == ErrQueueFull
+}
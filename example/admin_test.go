@@ -0,0 +1,232 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func waitForDone(t *testing.T, f example.TestMachineFSM, id fsm.TaskID) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if state, err := f.Wait(ctx, id); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected task %d to finish in %s, got %s", id, example.TestMachineStateDone, state)
+	}
+}
+
+func TestRetryNow(t *testing.T) {
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			if fsm.GetAttempt(ctx) == 0 {
+				return errors.New("first attempt")
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(time.Hour)),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := f.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Attempt == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("expected task to fail once, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The retry skips the hour-long backoff
+	if err := f.RetryNow(t.Context(), id, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(history, func(step fsm.Step) bool { return step.To == fsm.StateRetried })
+	if i < 0 || history[i].From != example.TestMachineStateState1 || history[i].Operator != "alice" || history[i].Attempt != 1 {
+		t.Fatalf("expected alice's retry in the history, got %+v", history)
+	}
+
+	if err := f.RetryNow(t.Context(), id, "alice"); !errors.Is(err, fsm.ErrTaskFinished) {
+		t.Fatalf("expected %v, got %v", fsm.ErrTaskFinished, err)
+	}
+
+	// Steps that haven't failed have nothing to retry
+	if err := f.Pause(t.Context(), example.TestMachineStateState1); err != nil {
+		t.Fatal(err)
+	}
+	id, err = f.Submit(t.Context(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RetryNow(t.Context(), id, "alice"); !errors.Is(err, fsm.ErrNoPendingRetry) {
+		t.Fatalf("expected %v, got %v", fsm.ErrNoPendingRetry, err)
+	}
+}
+
+func TestForceState(t *testing.T) {
+	running := make(chan struct{})
+	lost := make(chan error, 1)
+	values := make(chan int, 1)
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			close(running)
+			<-ctx.Done()
+			lost <- context.Cause(ctx)
+			return ctx.Err()
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			values <- c
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-running
+	if err := f.ForceState2(t.Context(), id, "bob", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stuck handler loses its step to the forced one
+	if err := <-lost; !errors.Is(err, fsm.ErrClaimLost) {
+		t.Fatalf("expected the running handler to lose its claim, got %v", err)
+	}
+	waitForDone(t, f, id)
+	if c := <-values; c != 42 {
+		t.Fatalf("expected the forced inputs, got %d", c)
+	}
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := history[1]
+	if step.From != example.TestMachineStateState1 || step.To != example.TestMachineStateState2 || step.Operator != "bob" {
+		t.Fatalf("expected bob's forced step in the history, got %+v", step)
+	}
+	if params, ok := step.Params.(example.TestMachineState2Params); !ok || params.P0 != 42 {
+		t.Fatalf("expected the forced inputs in the history, got %+v", step.Params)
+	}
+	if history[2].Operator != "" {
+		t.Fatalf("expected the handler's step to have no operator, got %+v", history[2])
+	}
+
+	if err := f.ForceState2(t.Context(), id, "", 42); err == nil {
+		t.Fatal("expected an operator to be required")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	var lock sync.Mutex
+	var values []int
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c*2)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			lock.Lock()
+			values = append(values, c)
+			lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	// Finished tasks restart from the State2 step, with its recorded inputs
+	if err := f.Restart(t.Context(), id, 1, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	lock.Lock()
+	if !slices.Equal(values, []int{6, 6}) {
+		t.Errorf("expected State2 to run twice with 6, got %v", values)
+	}
+	lock.Unlock()
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("expected 5 steps, got %+v", history)
+	}
+	step := history[3]
+	if step.From != example.TestMachineStateDone || step.To != example.TestMachineStateState2 || step.Operator != "carol" {
+		t.Fatalf("expected carol's restart in the history, got %+v", step)
+	}
+
+	if err := f.Restart(t.Context(), id, len(history), "carol"); err == nil {
+		t.Fatal("expected restarting from a missing step to fail")
+	}
+	if err := f.Restart(t.Context(), id+100, 0, "carol"); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Fatalf("expected %v, got %v", fsm.ErrTaskNotFound, err)
+	}
+
+	// Cancelled tasks stay cancelled
+	if err := f.Pause(t.Context(), example.TestMachineStateState1); err != nil {
+		t.Fatal(err)
+	}
+	id, err = f.Submit(t.Context(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Cancel(t.Context(), id, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Restart(t.Context(), id, 0, "carol"); !errors.Is(err, fsm.ErrTaskCancelled) {
+		t.Fatalf("expected %v, got %v", fsm.ErrTaskCancelled, err)
+	}
+}
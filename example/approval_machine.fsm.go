@@ -0,0 +1,1862 @@
+// Generated by fsmgen. DO NOT EDIT.
+package example
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	fsm "github.com/egoodhall/fsm"
+	sqlc "github.com/egoodhall/fsm/gen/sqlc"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ApprovalMachineStateAwait    fsm.State = "Await"
+	ApprovalMachineStateApproved fsm.State = "Approved"
+	ApprovalMachineStateExpired  fsm.State = "Expired"
+)
+
+type ApprovalMachineFSM interface {
+	fsm.SupportsOptions
+	Submit(ctx context.Context, string string, int int) (fsm.TaskID, error)
+	TrySubmit(ctx context.Context, string string, int int) (fsm.TaskID, error)
+	SubmitAt(ctx context.Context, at time.Time, string string, int int) (fsm.TaskID, error)
+	SubmitAfter(ctx context.Context, delay time.Duration, string string, int int) (fsm.TaskID, error)
+	SubmitBatch(ctx context.Context, inputs []ApprovalMachineAwaitParams) ([]fsm.TaskID, error)
+	SubmitSeq(ctx context.Context, inputs iter.Seq[ApprovalMachineAwaitParams]) ([]fsm.TaskID, error)
+	SubmitAndWait(ctx context.Context, string string, int int) (fsm.TaskID, fsm.State, error)
+	Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error)
+	Cancel(ctx context.Context, id fsm.TaskID, reason string) error
+	Pause(ctx context.Context, state fsm.State) error
+	Resume(ctx context.Context, state fsm.State) error
+	PauseAll(ctx context.Context) error
+	ResumeAll(ctx context.Context) error
+	Paused(ctx context.Context, state fsm.State) (bool, error)
+	RetryNow(ctx context.Context, id fsm.TaskID, operator string) error
+	ForceAwait(ctx context.Context, id fsm.TaskID, operator string, P0 string, P1 int) error
+	ForceApproved(ctx context.Context, id fsm.TaskID, operator string, P0 string) error
+	ForceExpired(ctx context.Context, id fsm.TaskID, operator string, P0 string) error
+	Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error
+	Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error)
+	History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error)
+}
+
+type ApprovalMachineAwaitParams struct {
+	P0 string
+	P1 int
+}
+
+type ApprovalMachineApprovedParams struct {
+	P0 string
+}
+
+type ApprovalMachineExpiredParams struct {
+	P0 string
+}
+
+func NewApprovalMachineFSMBuilder() ApprovalMachineFSMBuilder_AwaitStage {
+	return new(approvalMachineFSM)
+}
+
+type ApprovalMachineAwaitTransitions interface {
+	ToApproved(context.Context, string) error
+	ToApprovedAt(context.Context, time.Time, string) error
+	ToApprovedAfter(context.Context, time.Duration, string) error
+}
+
+type ApprovalMachineFSMBuilder_AwaitStage interface {
+	FromAwait(func(context.Context, ApprovalMachineAwaitTransitions, string, int) error) ApprovalMachineFSMBuilder__FinalStage
+}
+
+type ApprovalMachineFSMBuilder_ApprovedStage interface {
+	FromApproved(func(context.Context, string) error) ApprovalMachineFSMBuilder__FinalStage
+}
+
+type ApprovalMachineFSMBuilder_ExpiredStage interface {
+	FromExpired(func(context.Context, string) error) ApprovalMachineFSMBuilder__FinalStage
+}
+
+type ApprovalMachineFSMBuilder__FinalStage interface {
+	BuildAndStart(context.Context, ...fsm.Option) (ApprovalMachineFSM, error)
+}
+
+// FSM type checks
+var _ ApprovalMachineFSM = new(approvalMachineFSM)
+var _ fsm.SupportsOptions = new(approvalMachineFSM)
+var _ ApprovalMachineFSMBuilder_AwaitStage = new(approvalMachineFSM)
+var _ ApprovalMachineFSMBuilder__FinalStage = new(approvalMachineFSM)
+var _ ApprovalMachineAwaitTransitions = new(approvalMachineFSM)
+
+// ApprovalMachineFSM implementation
+type approvalMachineFSM_AwaitParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      string
+	P1      int
+}
+
+type approvalMachineFSM_ApprovedParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      string
+}
+
+type approvalMachineFSM_ExpiredParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      string
+}
+
+type approvalMachineFSM struct {
+	lock sync.Mutex
+	ctx  context.Context
+
+	// Configuration options
+	store         fsm.Store
+	onTransition  fsm.TransitionListener
+	onCompletion  fsm.CompletionListener
+	onRateLimit   fsm.RateLimitListener
+	onBreaker     fsm.BreakerListener
+	middlewares   []fsm.Middleware
+	extractors    []fsm.MetadataExtractor
+	injectors     []fsm.MetadataInjector
+	backoff       fsm.Backoff
+	leaseTTL      time.Duration
+	pollInterval  time.Duration
+	aging         time.Duration
+	batchSize     int
+	namespace     string
+	adoptUnscoped func(fsm.TaskID) bool
+
+	// FSM state transitions
+	awaitState func(context.Context, ApprovalMachineAwaitTransitions, string, int) error
+
+	// FSM state deadlines, after which steps still in the state move on
+	awaitDeadline time.Duration
+
+	// FSM state queues, rate limits, circuit breakers and backoffs
+	awaitQueue   fsm.QueueConfig
+	awaitLimiter *fsm.Limiter
+	awaitBreaker *fsm.Breaker
+	awaitBackoff fsm.Backoff
+
+	// FSM queue signals, and the owner of this instance's leases
+	awaitReady    chan struct{}
+	approvedReady chan struct{}
+	expiredReady  chan struct{}
+	owner         string
+	// Closed and replaced each time steps leave a queue, to wake blocked submissions
+	spaceLock sync.Mutex
+	space     chan struct{}
+
+	// Running tasks and their waiters
+	tasksLock sync.Mutex
+	// A task's next step can start before the handler that moved it there returns
+	running map[fsm.TaskID]map[context.Context]context.CancelCauseFunc
+	waiters map[fsm.TaskID][]chan fsm.State
+}
+
+// FSM builder methods
+
+func (f *approvalMachineFSM) FromAwait(fn func(context.Context, ApprovalMachineAwaitTransitions, string, int) error) ApprovalMachineFSMBuilder__FinalStage {
+	f.awaitState = fn
+	return f
+}
+
+func (f *approvalMachineFSM) BuildAndStart(ctx context.Context, opts ...fsm.Option) (ApprovalMachineFSM, error) {
+	// Check if FSM is already started
+	if !f.lock.TryLock() {
+		return nil, errors.New("FSM already started")
+	}
+
+	// Set context
+	f.ctx = ctx
+
+	// Initialize state queue signals
+	f.awaitReady = make(chan struct{}, 1)
+	f.approvedReady = make(chan struct{}, 1)
+	f.expiredReady = make(chan struct{}, 1)
+	f.owner = rand.Text()
+	f.space = make(chan struct{})
+
+	// Initialize task tracking
+	f.running = make(map[fsm.TaskID]map[context.Context]context.CancelCauseFunc)
+	f.waiters = make(map[fsm.TaskID][]chan fsm.State)
+
+	// Initialize state queues, rate limits, circuit breakers and backoffs
+	// from the model, which options may override
+	f.awaitLimiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.awaitBreaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(ApprovalMachineStateAwait))
+	f.awaitDeadline = 48 * time.Hour
+
+	// Apply options
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.store == nil {
+		if store, err := fsm.InMemory()(); err != nil {
+			return nil, err
+		} else {
+			f.store = store
+		}
+	}
+	if f.backoff == nil {
+		f.backoff = fsm.LinearBackoff(500*time.Millisecond, 30*time.Second)
+	}
+	if f.leaseTTL == 0 {
+		f.leaseTTL = 30 * time.Second
+	}
+	if f.pollInterval == 0 {
+		f.pollInterval = time.Second
+	}
+	if f.aging == 0 {
+		f.aging = time.Minute
+	}
+	if f.batchSize == 0 {
+		f.batchSize = 1000
+	}
+
+	// Adopt tasks stored before tasks were scoped to an FSM
+	if err := f.adoptTasks(f.ctx); err != nil {
+		return nil, err
+	}
+	// Resume tasks stored before their steps were queued in the store
+	if err := f.resumeTasks(f.ctx); err != nil {
+		return nil, err
+	}
+
+	// Start FSM processors. Existing work, including steps whose lease
+	// expired in a process that died, is claimed from the store.
+	// Start 1 awaitProcessor
+	go f.awaitProcessor()
+	// Start 1 approvedProcessor
+	go f.approvedProcessor()
+	// Start 1 expiredProcessor
+	go f.expiredProcessor()
+	// Start the deadline poller
+	go f.deadlines()
+	return f, nil
+}
+
+// adoptTasks scopes the tasks stored before tasks had an FSM, and their
+// concurrency locks, to this FSM and namespace. Only tasks that fit the FSM
+// are adopted, and only those WithUnscopedTasks accepts, since they can't
+// be told apart from other FSMs' tasks that fit too. Without the option, the
+// FSM doesn't start while tasks that fit it exist.
+func (f *approvalMachineFSM) adoptTasks(ctx context.Context) error {
+	return f.store.Tx(ctx, func(q fsm.Q) error {
+		tasks, err := q.ListUnscopedTasks(ctx)
+		if err != nil {
+			return err
+		}
+		var fitting []sqlc.Task
+		for _, task := range tasks {
+			if ok, err := f.fits(ctx, q, task); err != nil {
+				return err
+			} else if ok {
+				fitting = append(fitting, task)
+			}
+		}
+		if len(fitting) == 0 {
+			return nil
+		}
+		if f.adoptUnscoped == nil {
+			return fmt.Errorf("%w: count = %d", fsm.ErrUnscopedTasks, len(fitting))
+		}
+
+		var n int
+		for _, task := range fitting {
+			if !f.adoptUnscoped(fsm.TaskID(task.ID)) {
+				continue
+			}
+			if err := q.AdoptUnscopedTask(ctx, "ApprovalMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			if err := q.AdoptUnscopedLocks(ctx, "ApprovalMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			n++
+		}
+		fsm.Logger(ctx).Info("Adopted unscoped tasks", "count", n, "skipped", len(fitting)-n)
+		return nil
+	})
+}
+
+// fits reports whether an unscoped task could be one of this FSM's: its
+// input decodes as the entrypoint's, and it only went through the FSM's
+// states.
+func (f *approvalMachineFSM) fits(ctx context.Context, q fsm.Q, task sqlc.Task) (bool, error) {
+	if _, err := f.decodeParams(ApprovalMachineStateAwait, task.Data); err != nil {
+		return false, nil
+	}
+	history, err := q.GetHistory(ctx, task.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, step := range history {
+		for _, state := range []fsm.State{fsm.State(step.FromState), fsm.State(step.ToState)} {
+			switch state {
+			case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+				continue
+			}
+			if f.stateError(state) != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// resumeTasks queues the current step of tasks stored before steps were
+// queued in the store. Each task is only resumed once.
+func (f *approvalMachineFSM) resumeTasks(ctx context.Context) error {
+	tasks, err := f.store.Q().ListUnqueuedTasks(ctx, "ApprovalMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		id := fsm.TaskID(task.ID)
+		var state fsm.State
+		now := time.Now()
+		if err := f.store.Tx(ctx, func(q fsm.Q) error {
+			if err := q.DeleteUnqueuedTask(ctx, task.ID); err != nil {
+				return err
+			}
+			transition, err := f.lastTransition(ctx, q, id)
+			if err != nil {
+				return err
+			}
+			state = fsm.State(transition.ToState)
+			if f.isTerminal(state) {
+				return nil
+			}
+			// Tasks that never transitioned start from their input
+			data := transition.Data
+			if transition.ID == 0 {
+				data = task.Data
+			}
+			step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+				TaskID:  task.ID,
+				State:   string(state),
+				Data:    data,
+				ReadyAt: now.UnixMilli(),
+			})
+			if err != nil {
+				return err
+			}
+			return f.scheduleDeadline(ctx, q, task.ID, step, state, now)
+		}); err != nil {
+			return err
+		}
+		if !f.isTerminal(state) {
+			fsm.Logger(ctx).Info("Resuming task", "id", id, "state", state)
+		}
+	}
+	return nil
+}
+
+// FSM options
+
+func (f *approvalMachineFSM) WithStore(store fsm.Store) {
+	f.store = store
+}
+
+func (f *approvalMachineFSM) WithContext(update func(context.Context) context.Context) {
+	f.ctx = update(f.ctx)
+}
+
+func (f *approvalMachineFSM) WithTransitionListener(listener fsm.TransitionListener) {
+	f.onTransition = listener
+}
+
+func (f *approvalMachineFSM) WithCompletionListener(listener fsm.CompletionListener) {
+	f.onCompletion = listener
+}
+
+func (f *approvalMachineFSM) WithRateLimitListener(listener fsm.RateLimitListener) {
+	f.onRateLimit = listener
+}
+
+func (f *approvalMachineFSM) WithBreakerListener(listener fsm.BreakerListener) {
+	f.onBreaker = listener
+}
+
+func (f *approvalMachineFSM) WithMiddleware(middleware fsm.Middleware) {
+	f.middlewares = append(f.middlewares, middleware)
+}
+
+func (f *approvalMachineFSM) WithMetadataExtractor(extractor fsm.MetadataExtractor) {
+	f.extractors = append(f.extractors, extractor)
+}
+
+func (f *approvalMachineFSM) WithMetadataInjector(injector fsm.MetadataInjector) {
+	f.injectors = append(f.injectors, injector)
+}
+
+func (f *approvalMachineFSM) WithBackoff(backoff fsm.Backoff) {
+	f.backoff = backoff
+}
+
+func (f *approvalMachineFSM) WithStateBackoff(state fsm.State, backoff fsm.Backoff) error {
+	switch state {
+	case ApprovalMachineStateAwait:
+		f.awaitBackoff = backoff
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a backoff", state)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) WithQueue(state fsm.State, config fsm.QueueConfig) error {
+	switch state {
+	case ApprovalMachineStateAwait:
+		f.awaitQueue = config
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a queue", state)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) WithLease(ttl time.Duration) {
+	f.leaseTTL = ttl
+}
+
+func (f *approvalMachineFSM) WithPollInterval(interval time.Duration) {
+	f.pollInterval = interval
+}
+
+func (f *approvalMachineFSM) WithPriorityAging(interval time.Duration) {
+	f.aging = interval
+}
+
+func (f *approvalMachineFSM) WithBatchSize(size int) {
+	f.batchSize = size
+}
+
+func (f *approvalMachineFSM) WithNamespace(namespace string) {
+	f.namespace = namespace
+}
+
+func (f *approvalMachineFSM) WithUnscopedTasks(adopt func(fsm.TaskID) bool) {
+	f.adoptUnscoped = adopt
+}
+
+func (f *approvalMachineFSM) WithRate(state fsm.State, rate fsm.Rate, burst int) error {
+	switch state {
+	case ApprovalMachineStateAwait:
+		f.awaitLimiter.SetRate(rate, burst)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a rate limit", state)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) WithBreaker(state fsm.State, config fsm.BreakerConfig) error {
+	switch state {
+	case ApprovalMachineStateAwait:
+		f.awaitBreaker.SetConfig(config)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a circuit breaker", state)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) WithDeadline(state fsm.State, after time.Duration) error {
+	switch state {
+	case ApprovalMachineStateAwait:
+		f.awaitDeadline = after
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a deadline", state)
+	}
+	return nil
+}
+
+// FSM transition methods
+
+func (f *approvalMachineFSM) ToAwait(ctx context.Context, P0 string, P1 int) error {
+	return f.ToAwaitAt(ctx, time.Now(), P0, P1)
+}
+
+func (f *approvalMachineFSM) ToAwaitAfter(ctx context.Context, delay time.Duration, P0 string, P1 int) error {
+	return f.ToAwaitAt(ctx, time.Now().Add(delay), P0, P1)
+}
+
+func (f *approvalMachineFSM) ToAwaitAt(ctx context.Context, at time.Time, P0 string, P1 int) error {
+	msg := approvalMachineFSM_AwaitParams{ID: fsm.GetTaskID(ctx), P0: P0, P1: P1}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ApprovalMachineStateAwait, buf.Bytes(), at)
+}
+
+func (f *approvalMachineFSM) ToApproved(ctx context.Context, P0 string) error {
+	return f.ToApprovedAt(ctx, time.Now(), P0)
+}
+
+func (f *approvalMachineFSM) ToApprovedAfter(ctx context.Context, delay time.Duration, P0 string) error {
+	return f.ToApprovedAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *approvalMachineFSM) ToApprovedAt(ctx context.Context, at time.Time, P0 string) error {
+	msg := approvalMachineFSM_ApprovedParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ApprovalMachineStateApproved, buf.Bytes(), at)
+}
+
+func (f *approvalMachineFSM) ToExpired(ctx context.Context, P0 string) error {
+	return f.ToExpiredAt(ctx, time.Now(), P0)
+}
+
+func (f *approvalMachineFSM) ToExpiredAfter(ctx context.Context, delay time.Duration, P0 string) error {
+	return f.ToExpiredAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *approvalMachineFSM) ToExpiredAt(ctx context.Context, at time.Time, P0 string) error {
+	msg := approvalMachineFSM_ExpiredParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ApprovalMachineStateExpired, buf.Bytes(), at)
+}
+
+func (f *approvalMachineFSM) awaitProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ApprovalMachineStateAwait))
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.awaitBreaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, ApprovalMachineStateAwait, f.awaitReady, f.awaitLimiter)
+		if !ok {
+			f.awaitBreaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.awaitLimiter, item, wait)
+
+		var msg approvalMachineFSM_AwaitParams
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", ApprovalMachineStateAwait, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.awaitBreaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", ApprovalMachineStateAwait)
+			f.ack(ctx, item)
+			f.awaitBreaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", ApprovalMachineStateAwait)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, ApprovalMachineStateAwait, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.awaitState(ctx, f, msg.P0, msg.P1)
+		})
+		f.record(ctx4, f.awaitBreaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
+	}
+}
+
+func (f *approvalMachineFSM) approvedProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ApprovalMachineStateApproved))
+	for {
+		item, _, ok := f.claim(ctx, ApprovalMachineStateApproved, f.approvedReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ApprovalMachineStateApproved))
+	}
+}
+
+func (f *approvalMachineFSM) expiredProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ApprovalMachineStateExpired))
+	for {
+		item, _, ok := f.claim(ctx, ApprovalMachineStateExpired, f.expiredReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ApprovalMachineStateExpired))
+	}
+}
+
+func (f *approvalMachineFSM) scheduleDeadline(ctx context.Context, q fsm.Q, id int64, step int64, state fsm.State, at time.Time) error {
+	var after time.Duration
+	switch state {
+	case ApprovalMachineStateAwait:
+		after = f.awaitDeadline
+	}
+	if after <= 0 {
+		return nil
+	}
+	// Scheduled steps enter their state when they're due
+	return q.ScheduleDeadline(ctx, id, step, string(state), at.Add(after).UnixMilli())
+}
+
+// deadlines moves on the steps still in their state when its deadline
+// passes. Every process sharing the store polls, and each deadline is
+// fired in the same transaction that moves its step on, so it fires once.
+func (f *approvalMachineFSM) deadlines() {
+	for {
+		for _, state := range []fsm.State{ApprovalMachineStateAwait} {
+			for f.ctx.Err() == nil {
+				deadline, err := f.store.Q().GetDueDeadline(f.ctx, string(state), "ApprovalMachine", f.namespace, time.Now().UnixMilli())
+				if err == nil {
+					err = f.fireDeadline(f.ctx, deadline)
+				}
+				if err != nil {
+					if !errors.Is(err, sql.ErrNoRows) && f.ctx.Err() == nil {
+						fsm.Logger(f.ctx).Error("Failed to fire deadline", "state", state, "error", err)
+					}
+					break
+				}
+			}
+		}
+		select {
+		case <-time.After(f.pollInterval):
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *approvalMachineFSM) fireDeadline(ctx context.Context, deadline sqlc.TaskDeadline) error {
+	var item sqlc.QueueItem
+	var toState fsm.State
+	now := time.Now()
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		toState = ""
+		var err error
+		item, err = q.GetQueueItem(ctx, deadline.StepID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// The step moved on in time, or its task was cancelled
+			return q.DeleteDeadline(ctx, deadline.ID)
+		} else if err != nil {
+			return err
+		}
+		if n, err := q.FireDeadline(ctx, deadline.ID); err != nil || n == 0 {
+			return err
+		}
+		to, data, err := f.deadlineTarget(fsm.State(item.State), item.Data)
+		if err != nil {
+			return err
+		}
+
+		// A running handler loses its claim on the step, so it can't move it
+		// on too. Deadlines aren't held back by full queues.
+		if _, err := q.DeleteQueueItem(ctx, item.ID); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    item.TaskID,
+			Attempt:   item.Attempt,
+			FromState: item.State,
+			ToState:   string(to),
+			Data:      data,
+			Deadline:  true,
+		}); err != nil {
+			return err
+		}
+		if err := q.ReleaseConcurrencyLocks(ctx, item.TaskID, f.region(to)); err != nil {
+			return err
+		}
+		step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   item.TaskID,
+			State:    string(to),
+			Data:     data,
+			ReadyAt:  now.UnixMilli(),
+			Priority: item.Priority,
+		})
+		if err != nil {
+			return err
+		}
+		toState = to
+		return f.scheduleDeadline(ctx, q, item.TaskID, step, to, now)
+	}); err != nil || toState == "" {
+		return err
+	}
+
+	id, fromState := fsm.TaskID(item.TaskID), fsm.State(item.State)
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: id = %d, deadline passed in %s", fsm.ErrClaimLost, id, fromState))
+	}
+	f.tasksLock.Unlock()
+
+	fsm.Logger(ctx).Debug("Deadline passed", "id", id, "from", fromState, "to", toState)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signal(toState)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) deadlineTarget(state fsm.State, data []byte) (fsm.State, []byte, error) {
+	var msg any
+	var to fsm.State
+	switch state {
+	case ApprovalMachineStateAwait:
+		var from approvalMachineFSM_AwaitParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&from); err != nil {
+			return "", nil, err
+		}
+		msg, to = approvalMachineFSM_ExpiredParams{ID: from.ID, P0: from.P0}, ApprovalMachineStateExpired
+	default:
+		return "", nil, fmt.Errorf("state %s has no deadline", state)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return "", nil, err
+	}
+	return to, buf.Bytes(), nil
+}
+
+func (f *approvalMachineFSM) claim(ctx context.Context, state fsm.State, ready chan struct{}, limiter *fsm.Limiter) (sqlc.QueueItem, time.Duration, bool) {
+	var waited time.Duration
+	for {
+		wait, err := f.throttle(ctx, limiter)
+		waited += wait
+		if err != nil {
+			return sqlc.QueueItem{}, waited, false
+		}
+
+		// Claims aren't interrupted, since the lease may be taken even if
+		// the claimed item is lost to a cancellation
+		uninterrupted := context.WithoutCancel(ctx)
+		var item sqlc.QueueItem
+		err = f.store.Tx(uninterrupted, func(q fsm.Q) (err error) {
+			region := f.region(state)
+			item, err = q.ClaimQueueItem(uninterrupted, sqlc.ClaimQueueItemParams{
+				Owner:     f.owner,
+				LeaseMs:   f.leaseTTL.Milliseconds(),
+				State:     string(state),
+				Fsm:       "ApprovalMachine",
+				Namespace: f.namespace,
+				Region:    region,
+				AgingMs:   f.aging.Milliseconds(),
+			})
+			if err != nil || region == "" {
+				return err
+			}
+			// The task holds its key's region until it leaves
+			return q.AcquireConcurrencyLock(uninterrupted, region, item.TaskID)
+		})
+		if err == nil && ctx.Err() != nil {
+			f.release(ctx, item)
+			return item, waited, false
+		} else if err == nil {
+			// There may be more, so let another processor look
+			f.signal(state)
+			return item, waited, true
+		}
+
+		// Idle processors don't hold on to tokens, so they can't start a burst
+		// of steps together once work arrives
+		if limiter != nil {
+			limiter.Refund()
+		}
+		if ctx.Err() != nil {
+			return item, waited, false
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			fsm.Logger(ctx).Error("Failed to claim queue item", "state", state, "error", err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return item, waited, false
+		}
+	}
+}
+
+func (f *approvalMachineFSM) heartbeat(ctx context.Context, item sqlc.QueueItem) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(f.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if n, err := f.store.Q().RenewQueueItemLease(ctx, f.leaseTTL.Milliseconds(), item.ID, f.owner); err != nil && ctx.Err() == nil {
+				fsm.Logger(ctx).Error("Failed to renew lease", "id", item.TaskID, "state", item.State, "error", err)
+			} else if err == nil && n == 0 {
+				cancel(fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, item.TaskID, item.State))
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel(nil)
+	}
+}
+
+func (f *approvalMachineFSM) handle(ctx context.Context, state fsm.State, id fsm.TaskID, attempt int, handler func(context.Context) error) error {
+	ctx, err := f.restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	next := handler
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := f.middlewares[i], next
+		next = func(ctx context.Context) error {
+			return middleware(ctx, "ApprovalMachine", state, id, attempt, inner)
+		}
+	}
+	return next(ctx)
+}
+
+func (f *approvalMachineFSM) metadata(ctx context.Context) ([]byte, error) {
+	metadata := make(map[string]string)
+	for _, extract := range f.extractors {
+		maps.Copy(metadata, extract(ctx))
+	}
+	maps.Copy(metadata, fsm.GetMetadata(ctx))
+	return fsm.EncodeMetadata(metadata)
+}
+
+func (f *approvalMachineFSM) restore(ctx context.Context, id fsm.TaskID) (context.Context, error) {
+	data, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return ctx, err
+	}
+	metadata, err := fsm.DecodeMetadata(data)
+	if err != nil || metadata == nil {
+		return ctx, err
+	}
+	ctx = fsm.PutMetadata(ctx, metadata)
+	for _, inject := range f.injectors {
+		ctx = inject(ctx, metadata)
+	}
+	return ctx, nil
+}
+
+func (f *approvalMachineFSM) throttle(ctx context.Context, limiter *fsm.Limiter) (time.Duration, error) {
+	if limiter == nil || !limiter.Limited() {
+		return 0, nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func (f *approvalMachineFSM) throttled(ctx context.Context, limiter *fsm.Limiter, item sqlc.QueueItem, wait time.Duration) {
+	if limiter.Limited() && f.onRateLimit != nil {
+		f.onRateLimit(ctx, fsm.TaskID(item.TaskID), fsm.State(item.State), wait)
+	}
+}
+
+func (f *approvalMachineFSM) record(ctx context.Context, breaker *fsm.Breaker, probe bool, err error) {
+	// Shutdowns, cancellations, lost claims, full queues and parked steps say
+	// nothing about the state's health
+	if err != nil && (ctx.Err() != nil || errors.Is(err, fsm.ErrTaskCancelled) || errors.Is(err, fsm.ErrClaimLost) || errors.Is(err, fsm.ErrQueueFull) || errors.Is(err, fsm.ErrChildRunning)) {
+		breaker.Abandon(probe)
+		return
+	}
+	breaker.Record(probe, err != nil)
+}
+
+func (f *approvalMachineFSM) breakerListener(state fsm.State) func(from, to fsm.BreakerState) {
+	return func(from, to fsm.BreakerState) {
+		fsm.Logger(f.ctx).Info("Circuit breaker changed", "state", state, "from", from, "to", to)
+		if f.onBreaker != nil {
+			f.onBreaker(f.ctx, state, from, to)
+		}
+	}
+}
+
+func (f *approvalMachineFSM) ack(ctx context.Context, item sqlc.QueueItem) {
+	// Finished work is acknowledged even while shutting down
+	if _, err := f.store.Q().AckQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to acknowledge queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.freeSpace()
+}
+
+func (f *approvalMachineFSM) fail(ctx context.Context, item sqlc.QueueItem, cause error) {
+	if f.ctx.Err() != nil {
+		// Shutting down, so hand the step over without counting an attempt
+		f.release(ctx, item)
+		return
+	}
+	attempt := int(item.Attempt) + 1
+	delay := f.stateBackoff(fsm.State(item.State))(attempt, cause)
+	retryAt := time.Now().Add(delay).UnixMilli()
+	fsm.Logger(ctx).Debug("Processing error", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", cause)
+
+	err := f.store.Tx(ctx, func(q fsm.Q) error {
+		if n, err := q.RetryQueueItem(ctx, int64(attempt), retryAt, item.ID, f.owner); err != nil {
+			return err
+		} else if n == 0 {
+			return fsm.ErrClaimLost
+		}
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:        item.TaskID,
+			Attempt:       int64(attempt),
+			FromState:     item.State,
+			ToState:       string(fsm.StateError),
+			Data:          []byte(cause.Error()),
+			NextAttemptAt: &retryAt,
+		})
+	})
+	if errors.Is(err, fsm.ErrClaimLost) {
+		// The task has moved on, or another worker took over the step
+		return
+	} else if err != nil {
+		fsm.Logger(ctx).Debug("Failed to record transition", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", err)
+		f.release(ctx, item)
+		return
+	}
+	f.signalAt(fsm.State(item.State), time.UnixMilli(retryAt))
+}
+
+func (f *approvalMachineFSM) release(ctx context.Context, item sqlc.QueueItem) {
+	if err := f.store.Q().ReleaseQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to release queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.signal(fsm.State(item.State))
+}
+
+func (f *approvalMachineFSM) signal(state fsm.State) {
+	var ready chan struct{}
+	switch state {
+	case ApprovalMachineStateAwait:
+		ready = f.awaitReady
+	case ApprovalMachineStateApproved:
+		ready = f.approvedReady
+	case ApprovalMachineStateExpired:
+		ready = f.expiredReady
+	}
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *approvalMachineFSM) queueConfig(state fsm.State) fsm.QueueConfig {
+	switch state {
+	case ApprovalMachineStateAwait:
+		return f.awaitQueue
+	}
+	return fsm.QueueConfig{}
+}
+
+func (f *approvalMachineFSM) reserve(ctx context.Context, q fsm.Q, state fsm.State) error {
+	config := f.queueConfig(state)
+	if !config.Bounded() {
+		return nil
+	}
+	n, err := q.CountQueueItems(ctx, string(state), "ApprovalMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	if n >= int64(config.Capacity) {
+		return &fsm.QueueFullError{
+			Capacity: config.Capacity,
+			State:    state,
+		}
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) admit(ctx context.Context, block bool, fn func(fsm.Q) error) error {
+	for {
+		f.spaceLock.Lock()
+		space := f.space
+		f.spaceLock.Unlock()
+
+		err := f.store.Tx(ctx, fn)
+		var full *fsm.QueueFullError
+		if !block || !errors.As(err, &full) || !f.queueConfig(full.State).Blocks() {
+			return err
+		}
+
+		// Steps leaving the queue in other processes are only seen by polling
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		case <-space:
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+func (f *approvalMachineFSM) freeSpace() {
+	f.spaceLock.Lock()
+	defer f.spaceLock.Unlock()
+	close(f.space)
+	f.space = make(chan struct{})
+}
+
+func (f *approvalMachineFSM) stateBackoff(state fsm.State) fsm.Backoff {
+	var backoff fsm.Backoff
+	switch state {
+	case ApprovalMachineStateAwait:
+		backoff = f.awaitBackoff
+	}
+	if backoff == nil {
+		return f.backoff
+	}
+	return backoff
+}
+
+func (f *approvalMachineFSM) region(state fsm.State) string {
+	return ""
+}
+
+func (f *approvalMachineFSM) signalRegion(region string) {}
+
+func (f *approvalMachineFSM) signalAt(state fsm.State, at time.Time) {
+	if delay := time.Until(at); delay > 0 {
+		time.AfterFunc(delay, func() {
+			f.signal(state)
+		})
+		return
+	}
+	f.signal(state)
+}
+
+func (f *approvalMachineFSM) transition(ctx context.Context, toState fsm.State, data []byte, at time.Time) error {
+	id := fsm.GetTaskID(ctx)
+	fromState := fsm.GetState(ctx)
+	itemID, ok := fsm.GetQueueItem(ctx)
+	if !ok {
+		return fmt.Errorf("transition to %s outside of a task handler", toState)
+	}
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+	}
+
+	if err := f.admit(ctx, false, func(q fsm.Q) error {
+		if n, err := q.AckQueueItem(ctx, itemID, f.owner); err != nil {
+			return err
+		} else if n == 0 && f.isCancelled(ctx, q, id) {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, id, fromState)
+		}
+		if err := f.reserve(ctx, q, toState); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   int64(fsm.GetAttempt(ctx)),
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+		}); err != nil {
+			return err
+		}
+		// Leaving a serialized region lets the next task with the same key in
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		})
+		if err != nil {
+			return err
+		}
+		return f.scheduleDeadline(ctx, q, int64(id), step, toState, at)
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signalAt(toState, at)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Submit FSM tasks
+
+func (f *approvalMachineFSM) Submit(ctx context.Context, P0 string, P1 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now(), P0, P1)
+}
+
+func (f *approvalMachineFSM) SubmitAfter(ctx context.Context, delay time.Duration, P0 string, P1 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now().Add(delay), P0, P1)
+}
+
+func (f *approvalMachineFSM) SubmitAt(ctx context.Context, at time.Time, P0 string, P1 int) (fsm.TaskID, error) {
+	return f.submit(ctx, at, true, P0, P1)
+}
+
+// TrySubmit never waits for room in a full queue
+
+func (f *approvalMachineFSM) TrySubmit(ctx context.Context, P0 string, P1 int) (fsm.TaskID, error) {
+	return f.submit(ctx, time.Now(), false, P0, P1)
+}
+
+func (f *approvalMachineFSM) submit(ctx context.Context, at time.Time, block bool, P0 string, P1 int) (fsm.TaskID, error) {
+	msg := approvalMachineFSM_AwaitParams{P0: P0, P1: P1}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return 0, err
+	}
+
+	var key, concurrencyKey *string
+	if k, ok := fsm.GetIdempotencyKey(ctx); ok {
+		key = &k
+	}
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The task and its first step are stored together, once there is room
+	if err := f.admit(ctx, block, func(q fsm.Q) error {
+		// A repeated submission returns the task it already created
+		if key != nil {
+			task, err := q.GetTaskByIdempotencyKey(ctx, "ApprovalMachine", f.namespace, key)
+			if err == nil {
+				if !bytes.Equal(task.Data, buf.Bytes()) {
+					return fsm.ErrIdempotencyConflict
+				}
+				msg.ID = fsm.TaskID(task.ID)
+				return nil
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		if err := f.reserve(ctx, q, ApprovalMachineStateAwait); err != nil {
+			return err
+		}
+		task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+			Data:           buf.Bytes(),
+			IdempotencyKey: key,
+			ConcurrencyKey: concurrencyKey,
+			Metadata:       metadata,
+			Fsm:            "ApprovalMachine",
+			Namespace:      f.namespace,
+		})
+		if err != nil {
+			return err
+		}
+		msg.ID = fsm.TaskID(task.ID)
+		step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   task.ID,
+			State:    string(ApprovalMachineStateAwait),
+			Data:     buf.Bytes(),
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		})
+		if err != nil {
+			return err
+		}
+		return f.scheduleDeadline(ctx, q, task.ID, step, ApprovalMachineStateAwait, at)
+	}); err != nil {
+		return 0, err
+	}
+	f.signalAt(ApprovalMachineStateAwait, at)
+	return msg.ID, nil
+}
+
+// Submit FSM tasks in batches
+
+func (f *approvalMachineFSM) SubmitBatch(ctx context.Context, inputs []ApprovalMachineAwaitParams) ([]fsm.TaskID, error) {
+	return f.SubmitSeq(ctx, slices.Values(inputs))
+}
+
+func (f *approvalMachineFSM) SubmitSeq(ctx context.Context, inputs iter.Seq[ApprovalMachineAwaitParams]) ([]fsm.TaskID, error) {
+	if _, ok := fsm.GetIdempotencyKey(ctx); ok {
+		return nil, errors.New("batch submissions can't share an idempotency key")
+	}
+
+	var err error
+	ids := make([]fsm.TaskID, 0)
+	chunk := make([][]byte, 0, f.batchSize)
+	for input := range inputs {
+		msg := approvalMachineFSM_AwaitParams{P0: input.P0, P1: input.P1}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return ids, err
+		}
+		chunk = append(chunk, buf.Bytes())
+		if len(chunk) == f.batchSize {
+			if ids, err = f.submitChunk(ctx, ids, chunk); err != nil {
+				return ids, err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	return f.submitChunk(ctx, ids, chunk)
+}
+
+// submitChunk stores a chunk of a batch in one transaction, and appends its
+// tasks to ids once it commits. When the entrypoint's queue fills up, the
+// tasks that fit are committed first, and the rest wait for room or are
+// rejected like single submissions.
+func (f *approvalMachineFSM) submitChunk(ctx context.Context, ids []fsm.TaskID, chunk [][]byte) ([]fsm.TaskID, error) {
+	if len(chunk) == 0 {
+		return ids, nil
+	}
+	var concurrencyKey *string
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return ids, err
+	}
+
+	for len(chunk) > 0 {
+		now := time.Now()
+		created := make([]fsm.TaskID, 0, len(chunk))
+		if err := f.admit(ctx, true, func(q fsm.Q) error {
+			created = created[:0]
+			for _, data := range chunk {
+				if err := f.reserve(ctx, q, ApprovalMachineStateAwait); err != nil {
+					// Keep the tasks that fit, and stop at the first that doesn't
+					if len(created) > 0 && errors.Is(err, fsm.ErrQueueFull) {
+						return nil
+					}
+					return err
+				}
+				task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+					Data:           data,
+					ConcurrencyKey: concurrencyKey,
+					Metadata:       metadata,
+					Fsm:            "ApprovalMachine",
+					Namespace:      f.namespace,
+				})
+				if err != nil {
+					return err
+				}
+				step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+					TaskID:   task.ID,
+					State:    string(ApprovalMachineStateAwait),
+					Data:     data,
+					ReadyAt:  now.UnixMilli(),
+					Priority: int64(fsm.GetPriority(ctx)),
+				})
+				if err != nil {
+					return err
+				}
+				if err := f.scheduleDeadline(ctx, q, task.ID, step, ApprovalMachineStateAwait, now); err != nil {
+					return err
+				}
+				created = append(created, fsm.TaskID(task.ID))
+			}
+			return nil
+		}); err != nil {
+			return ids, err
+		}
+		f.signal(ApprovalMachineStateAwait)
+		ids = append(ids, created...)
+		chunk = chunk[len(created):]
+	}
+	return ids, nil
+}
+
+// Cancel FSM tasks
+
+func (f *approvalMachineFSM) Cancel(ctx context.Context, id fsm.TaskID, reason string) error {
+	var fromState fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if f.isTerminal(fromState) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, fromState)
+		}
+
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   transition.Attempt,
+			FromState: string(fromState),
+			ToState:   string(fsm.StateCancelled),
+			Data:      []byte(reason),
+		}); err != nil {
+			return err
+		}
+		// Drop any queued or pending work, and leave any serialized region
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		return q.ReleaseConcurrencyLocks(ctx, int64(id), "")
+	}); err != nil {
+		return err
+	}
+
+	// Stop the running handler
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: %s", fsm.ErrTaskCancelled, reason))
+	}
+	f.tasksLock.Unlock()
+	f.signalRegion(f.region(fromState))
+	f.freeSpace()
+
+	fsm.Logger(ctx).Debug("Cancelled task", "id", id, "from", fromState, "reason", reason)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, fsm.StateCancelled)
+	}
+	f.complete(ctx, id, fsm.StateCancelled)
+	return nil
+}
+
+func (f *approvalMachineFSM) lastTransition(ctx context.Context, q fsm.Q, id fsm.TaskID) (sqlc.StateTransition, error) {
+	transition, err := q.GetLastValidTransition(ctx, int64(id), "ApprovalMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := q.GetTask(ctx, int64(id), "ApprovalMachine", f.namespace); errors.Is(err, sql.ErrNoRows) {
+			return transition, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+		} else if err != nil {
+			return transition, err
+		}
+		return sqlc.StateTransition{
+			TaskID:  int64(id),
+			ToState: string(ApprovalMachineStateAwait),
+		}, nil
+	}
+	return transition, err
+}
+
+func (f *approvalMachineFSM) startTask(ctx context.Context, id fsm.TaskID) (context.Context, bool) {
+	f.tasksLock.Lock()
+	ctx2, cancel := context.WithCancelCause(ctx)
+	if f.running[id] == nil {
+		f.running[id] = make(map[context.Context]context.CancelCauseFunc)
+	}
+	f.running[id][ctx2] = cancel
+	f.tasksLock.Unlock()
+
+	// Cancel stops the handlers running when it commits, so handlers
+	// registered after that find the cancellation in the store
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		f.finishTask(ctx2, id)
+		return ctx, false
+	}
+	return ctx2, true
+}
+
+func (f *approvalMachineFSM) finishTask(ctx context.Context, id fsm.TaskID) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	if cancel, ok := f.running[id][ctx]; ok {
+		cancel(nil)
+		delete(f.running[id], ctx)
+	}
+	if len(f.running[id]) == 0 {
+		delete(f.running, id)
+	}
+}
+
+func (f *approvalMachineFSM) isCancelled(ctx context.Context, q fsm.Q, id fsm.TaskID) bool {
+	transition, err := f.lastTransition(ctx, q, id)
+	if err != nil {
+		fsm.Logger(ctx).Error("Failed to get last transition", "id", id, "error", err)
+		return false
+	}
+	return fsm.State(transition.ToState) == fsm.StateCancelled
+}
+
+// Pause and resume FSM dispatch
+
+func (f *approvalMachineFSM) Pause(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().PauseState(ctx, "ApprovalMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused state", "state", state)
+	return nil
+}
+
+func (f *approvalMachineFSM) Resume(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().ResumeState(ctx, "ApprovalMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed state", "state", state)
+	// Other processes pick the state's steps up when they next poll
+	f.signal(state)
+	return nil
+}
+
+func (f *approvalMachineFSM) PauseAll(ctx context.Context) error {
+	if err := f.store.Q().PauseState(ctx, "ApprovalMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused FSM")
+	return nil
+}
+
+func (f *approvalMachineFSM) ResumeAll(ctx context.Context) error {
+	if err := f.store.Q().ResumeState(ctx, "ApprovalMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed FSM")
+	// States paused on their own stay paused
+	for _, state := range []fsm.State{ApprovalMachineStateAwait, ApprovalMachineStateApproved, ApprovalMachineStateExpired} {
+		f.signal(state)
+	}
+	return nil
+}
+
+func (f *approvalMachineFSM) Paused(ctx context.Context, state fsm.State) (bool, error) {
+	if err := f.stateError(state); err != nil {
+		return false, err
+	}
+	paused, err := f.store.Q().GetPausedStates(ctx, "ApprovalMachine", f.namespace)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(paused, "") || slices.Contains(paused, string(state)), nil
+}
+
+func (f *approvalMachineFSM) stateError(state fsm.State) error {
+	switch state {
+	case ApprovalMachineStateAwait, ApprovalMachineStateApproved, ApprovalMachineStateExpired:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", fsm.ErrUnknownState, state)
+}
+
+// Administrative FSM task operations
+
+func (f *approvalMachineFSM) RetryNow(ctx context.Context, id fsm.TaskID, operator string) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var state fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		state = fsm.State(transition.ToState)
+		if f.isTerminal(state) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, state)
+		}
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Only failed steps that aren't running can be retried
+		if n, err := q.ExpediteQueueItem(ctx, item.ID); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrNoPendingRetry, id, state)
+		}
+		state = fsm.State(item.State)
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: item.State,
+			ToState:   string(fsm.StateRetried),
+			Operator:  &operator,
+		})
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Retrying task now", "id", id, "state", state, "operator", operator)
+	f.signal(state)
+	return nil
+}
+
+func (f *approvalMachineFSM) ForceAwait(ctx context.Context, id fsm.TaskID, operator string, P0 string, P1 int) error {
+	msg := approvalMachineFSM_AwaitParams{ID: id, P0: P0, P1: P1}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ApprovalMachineStateAwait, buf.Bytes())
+}
+
+func (f *approvalMachineFSM) ForceApproved(ctx context.Context, id fsm.TaskID, operator string, P0 string) error {
+	msg := approvalMachineFSM_ApprovedParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ApprovalMachineStateApproved, buf.Bytes())
+}
+
+func (f *approvalMachineFSM) ForceExpired(ctx context.Context, id fsm.TaskID, operator string, P0 string) error {
+	msg := approvalMachineFSM_ExpiredParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ApprovalMachineStateExpired, buf.Bytes())
+}
+
+func (f *approvalMachineFSM) Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ApprovalMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return err
+	}
+
+	// Steps are numbered as in the task's history, starting from its submission
+	toState, data := fsm.State(ApprovalMachineStateAwait), task.Data
+	if step != 0 {
+		transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+		if err != nil {
+			return err
+		}
+		if step < 0 || step > len(transitions) {
+			return fmt.Errorf("task %d has no step %d", id, step)
+		}
+		toState = fsm.State(transitions[step-1].ToState)
+		data = transitions[step-1].Data
+	}
+	switch toState {
+	case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+		return fmt.Errorf("task %d can't restart from step %d in %s", id, step, toState)
+	}
+	return f.move(ctx, id, operator, toState, data)
+}
+
+// move replaces the task's current step with a step in the given state,
+// reviving the task if it finished. A running handler loses its claim on
+// the replaced step, so it can't move the task on too.
+func (f *approvalMachineFSM) move(ctx context.Context, id fsm.TaskID, operator string, toState fsm.State, data []byte) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var fromState fsm.State
+	now := time.Now()
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if fromState == fsm.StateCancelled {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		}
+
+		// The new step keeps the priority of the step it replaces
+		priority := int64(fsm.GetPriority(ctx))
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err == nil {
+			priority = item.Priority
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+			Operator:  &operator,
+		}); err != nil {
+			return err
+		}
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		step, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  now.UnixMilli(),
+			Priority: priority,
+		})
+		if err != nil {
+			return err
+		}
+		return f.scheduleDeadline(ctx, q, int64(id), step, toState, now)
+	}); err != nil {
+		return err
+	}
+
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: id = %d, moved to %s by %s", fsm.ErrClaimLost, id, toState, operator))
+	}
+	f.tasksLock.Unlock()
+
+	fsm.Logger(ctx).Debug("Moved task", "id", id, "from", fromState, "to", toState, "operator", operator)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signal(toState)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Query FSM tasks
+
+func (f *approvalMachineFSM) Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error) {
+	history, err := f.History(ctx, id)
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	status := fsm.NewTaskStatus(id, history)
+	status.Terminal = f.isTerminal(status.State)
+	metadata, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	if status.Metadata, err = fsm.DecodeMetadata(metadata); err != nil {
+		return fsm.TaskStatus{}, err
+	}
+
+	// Queued steps carry a priority, and steps that haven't been
+	// attempted yet may be scheduled for later
+	item, err := f.store.Q().GetTaskQueueItem(ctx, int64(id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fsm.TaskStatus{}, err
+	} else if err == nil {
+		status.Priority = int(item.Priority)
+		if at := time.UnixMilli(item.ReadyAt); item.Attempt == 0 && item.LeaseOwner == nil && at.After(time.Now()) {
+			status.ScheduledAt = at
+		}
+		if deadline, err := f.store.Q().GetStepDeadline(ctx, item.ID); err == nil && deadline.FiredAt == nil {
+			status.DeadlineAt = time.UnixMilli(deadline.FireAt)
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fsm.TaskStatus{}, err
+		}
+	}
+	return status, nil
+}
+
+func (f *approvalMachineFSM) History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error) {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ApprovalMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks are submitted without a transition, so the first step comes from the task itself
+	params, err := f.decodeParams(ApprovalMachineStateAwait, task.Data)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]fsm.Step, 0, len(transitions)+1)
+	history = append(history, fsm.Step{
+		CreatedAt: time.UnixMilli(task.CreatedAt),
+		Params:    params,
+		To:        ApprovalMachineStateAwait,
+	})
+	for _, transition := range transitions {
+		step := fsm.Step{
+			Attempt:   int(transition.Attempt),
+			CreatedAt: time.UnixMilli(transition.CreatedAt),
+			Deadline:  transition.Deadline,
+			From:      fsm.State(transition.FromState),
+			To:        fsm.State(transition.ToState),
+		}
+		if transition.Operator != nil {
+			step.Operator = *transition.Operator
+		}
+		switch step.To {
+		case fsm.StateError:
+			step.Error = string(transition.Data)
+			if transition.NextAttemptAt != nil {
+				step.NextAttemptAt = time.UnixMilli(*transition.NextAttemptAt)
+			}
+		case fsm.StateCancelled:
+			step.Reason = string(transition.Data)
+		case fsm.StateRetried:
+		// Retried steps keep the failed step's inputs
+		default:
+			if step.Params, err = f.decodeParams(step.To, transition.Data); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, step)
+	}
+	return history, nil
+}
+
+func (f *approvalMachineFSM) decodeParams(state fsm.State, data []byte) (any, error) {
+	switch state {
+	case ApprovalMachineStateAwait:
+		var params ApprovalMachineAwaitParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ApprovalMachineStateApproved:
+		var params ApprovalMachineApprovedParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ApprovalMachineStateExpired:
+		var params ApprovalMachineExpiredParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("unknown state: %s", state)
+}
+
+func (f *approvalMachineFSM) isTerminal(state fsm.State) bool {
+	switch state {
+	case ApprovalMachineStateApproved, ApprovalMachineStateExpired, fsm.StateCancelled:
+		return true
+	}
+	return false
+}
+
+// Wait for FSM tasks
+
+func (f *approvalMachineFSM) Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error) {
+	waiter := make(chan fsm.State, 1)
+	f.tasksLock.Lock()
+	f.waiters[id] = append(f.waiters[id], waiter)
+	f.tasksLock.Unlock()
+	defer f.stopWaiting(id, waiter)
+
+	// The task may have finished before we started waiting, or in another
+	// process sharing the store
+	for {
+		transition, err := f.lastTransition(ctx, f.store.Q(), id)
+		if err != nil {
+			return "", err
+		}
+		if state := fsm.State(transition.ToState); f.isTerminal(state) {
+			return state, nil
+		}
+
+		select {
+		case state := <-waiter:
+			return state, nil
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (f *approvalMachineFSM) SubmitAndWait(ctx context.Context, P0 string, P1 int) (fsm.TaskID, fsm.State, error) {
+	id, err := f.Submit(ctx, P0, P1)
+	if err != nil {
+		return 0, "", err
+	}
+	state, err := f.Wait(ctx, id)
+	return id, state, err
+}
+
+func (f *approvalMachineFSM) complete(ctx context.Context, id fsm.TaskID, state fsm.State) {
+	f.tasksLock.Lock()
+	waiters := f.waiters[id]
+	delete(f.waiters, id)
+	f.tasksLock.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- state
+	}
+	if f.onCompletion != nil {
+		f.onCompletion(ctx, id, state)
+	}
+}
+
+func (f *approvalMachineFSM) stopWaiting(id fsm.TaskID, waiter chan fsm.State) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	waiters := slices.DeleteFunc(f.waiters[id], func(w chan fsm.State) bool {
+		return w == waiter
+	})
+	if len(waiters) == 0 {
+		delete(f.waiters, id)
+	} else {
+		f.waiters[id] = waiters
+	}
+}
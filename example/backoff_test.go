@@ -0,0 +1,137 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestBackoff(t *testing.T) {
+	errTransient := errors.New("transient")
+
+	tests := []struct {
+		name     string
+		backoff  fsm.Backoff
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"constant", fsm.ConstantBackoff(time.Second), 7, nil, time.Second, time.Second},
+		{"linear", fsm.LinearBackoff(time.Second, time.Minute), 3, nil, 3 * time.Second, 3 * time.Second},
+		{"linear capped", fsm.LinearBackoff(time.Second, time.Minute), 1 << 62, nil, time.Minute, time.Minute},
+		{"exponential", fsm.ExponentialBackoff(time.Second, time.Hour), 3, nil, 8 * time.Second, 8 * time.Second},
+		{"exponential overflow", fsm.ExponentialBackoff(time.Second, time.Hour), 100, nil, time.Hour, time.Hour},
+		{"full jitter", fsm.FullJitterBackoff(time.Second, time.Hour), 3, nil, 0, 8 * time.Second},
+		{"full jitter overflow", fsm.FullJitterBackoff(time.Second, time.Hour), 100, nil, 0, time.Hour},
+		{"decorrelated jitter", fsm.DecorrelatedJitterBackoff(time.Second, time.Hour), 2, nil, time.Second, 9 * time.Second},
+		{"decorrelated jitter overflow", fsm.DecorrelatedJitterBackoff(time.Second, time.Hour), 100, nil, time.Second, time.Hour},
+		{"capped", fsm.CappedBackoff(fsm.ConstantBackoff(time.Hour), time.Second), 1, nil, time.Second, time.Second},
+		{"sequence", fsm.SequenceBackoff(time.Second, time.Minute), 2, nil, time.Minute, time.Minute},
+		{"sequence repeats", fsm.SequenceBackoff(time.Second, time.Minute), 5, nil, time.Minute, time.Minute},
+		{"per error", fsm.PerErrorBackoff(fsm.ConstantBackoff(time.Minute), fsm.BackoffOn(errTransient, fsm.ConstantBackoff(time.Second))), 1, errTransient, time.Second, time.Second},
+		{"per error wrapped", fsm.PerErrorBackoff(fsm.ConstantBackoff(time.Minute), fsm.BackoffOn(errTransient, fsm.ConstantBackoff(time.Second))), 1, errors.Join(errTransient), time.Second, time.Second},
+		{"per error fallback", fsm.PerErrorBackoff(fsm.ConstantBackoff(time.Minute), fsm.BackoffOn(errTransient, fsm.ConstantBackoff(time.Second))), 1, errors.New("other"), time.Minute, time.Minute},
+		{"attempt only", fsm.AttemptBackoff(func(attempt int) time.Duration { return time.Duration(attempt) * time.Second }).Backoff(), 3, errTransient, 3 * time.Second, 3 * time.Second},
+		{"config", fsm.BackoffConfig{Type: fsm.BackoffExponential, Base: time.Second, Max: time.Minute, Jitter: fsm.JitterFull}.Backoff(), 100, nil, 0, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for range 100 {
+				if delay := test.backoff(test.attempt, test.err); delay < test.min || delay > test.max {
+					t.Fatalf("expected a delay between %s and %s, got %s", test.min, test.max, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffConfig(t *testing.T) {
+	for _, config := range []fsm.BackoffConfig{
+		{Type: "quadratic", Base: time.Second},
+		{Type: fsm.BackoffConstant},
+		{Type: fsm.BackoffConstant, Base: time.Second, Max: time.Minute},
+		{Type: fsm.BackoffLinear, Base: time.Minute, Max: time.Second},
+		{Type: fsm.BackoffLinear, Base: time.Second, Max: time.Minute, Jitter: fsm.JitterDecorrelated},
+		{Type: fsm.BackoffExponential, Base: time.Second, Max: time.Minute, Jitter: "partial"},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", config)
+		}
+	}
+}
+
+func TestStateBackoff(t *testing.T) {
+	var lock sync.Mutex
+	failures := map[fsm.State]time.Time{}
+	retries := map[fsm.State]time.Duration{}
+	attempt := func(ctx context.Context, state fsm.State) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if fsm.GetAttempt(ctx) == 0 {
+			failures[state] = time.Now()
+			return errors.New("first attempt")
+		}
+		retries[state] = time.Since(failures[state])
+		return nil
+	}
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			if err := attempt(ctx, example.TestMachineStateState1); err != nil {
+				return err
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			if err := attempt(ctx, example.TestMachineStateState2); err != nil {
+				return err
+			}
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+			fsm.WithStateBackoff(example.TestMachineStateState2, fsm.ConstantBackoff(300*time.Millisecond)),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	if _, state, err := f.SubmitAndWait(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if retry := retries[example.TestMachineStateState1]; retry >= 300*time.Millisecond {
+		t.Errorf("expected %s to retry with the FSM's backoff, got %s", example.TestMachineStateState1, retry)
+	}
+	if retry := retries[example.TestMachineStateState2]; retry < 300*time.Millisecond {
+		t.Errorf("expected %s to retry with its own backoff, got %s", example.TestMachineStateState2, retry)
+	}
+}
+
+func TestStateBackoffUnknownState(t *testing.T) {
+	for _, state := range []fsm.State{"Missing", example.TestMachineStateDone} {
+		if _, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(), fsm.WithStateBackoff(state, fsm.ConstantBackoff(time.Second))); err == nil {
+			t.Errorf("expected an error for a backoff on %s", state)
+		}
+	}
+}
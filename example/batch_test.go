@@ -0,0 +1,135 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestSubmitBatch(t *testing.T) {
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBatchSize(100),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := make([]example.TestMachineState1Params, 250)
+	for i := range inputs {
+		inputs[i] = example.TestMachineState1Params{P0: i}
+	}
+	ids, err := f.SubmitBatch(t.Context(), inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(inputs) {
+		t.Fatalf("expected %d tasks, got %d", len(inputs), len(ids))
+	}
+
+	// IDs come back in input order
+	for i, id := range ids {
+		history, err := f.History(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params, ok := history[0].Params.(example.TestMachineState1Params); !ok || params != inputs[i] {
+			t.Fatalf("expected task %d to have input %+v, got %+v", id, inputs[i], history[0].Params)
+		}
+	}
+	for _, id := range ids {
+		waitForDone(t, f, id)
+	}
+
+	// Sequences are submitted the same way
+	ids, err = f.SubmitSeq(t.Context(), slices.Values(inputs[:3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 tasks, got %d", len(ids))
+	}
+	for _, id := range ids {
+		waitForDone(t, f, id)
+	}
+}
+
+func TestSubmitBatchFullQueue(t *testing.T) {
+	release := make(chan struct{})
+	build := func(overflow fsm.Overflow) example.TestMachineFSM {
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(),
+				fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+				fsm.WithPollInterval(10*time.Millisecond),
+				fsm.WithQueue(example.TestMachineStateState1, fsm.QueueConfig{Capacity: 2, Overflow: overflow}),
+			)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	inputs := make([]example.TestMachineState1Params, 5)
+
+	// A rejecting queue stores the tasks that fit, and returns their IDs
+	// with the error
+	f := build(fsm.OverflowReject)
+	ids, err := f.SubmitBatch(t.Context(), inputs)
+	var full *fsm.QueueFullError
+	if !errors.As(err, &full) || full.State != example.TestMachineStateState1 {
+		t.Fatalf("expected a full %s queue, got %v", example.TestMachineStateState1, err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected the 2 tasks that fit, got %d", len(ids))
+	}
+
+	// A blocking queue waits for room
+	g := build(fsm.OverflowBlock)
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if ids, err = g.SubmitBatch(ctx, inputs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(inputs) {
+		t.Fatalf("expected %d tasks, got %d", len(inputs), len(ids))
+	}
+	for _, id := range ids {
+		waitForDone(t, g, id)
+	}
+}
+
+func TestSubmitBatchIdempotencyKey(t *testing.T) {
+	var state1, state2 atomic.Int64
+	f := buildCountingMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db")), &state1, &state2)
+
+	ctx := fsm.PutIdempotencyKey(t.Context(), "import")
+	if _, err := f.SubmitBatch(ctx, make([]example.TestMachineState1Params, 2)); err == nil {
+		t.Fatal("expected batches to reject an idempotency key")
+	}
+}
@@ -0,0 +1,177 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type event struct {
+		to fsm.BreakerState
+		at time.Time
+	}
+
+	var lock sync.Mutex
+	down := true
+	var calls []time.Time
+	var events []event
+	opened := make(chan struct{})
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			lock.Lock()
+			calls = append(calls, time.Now())
+			failing := down
+			lock.Unlock()
+			if failing {
+				return errors.New("dependency down")
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithBackoff(fsm.LinearBackoff(10*time.Millisecond, 10*time.Millisecond)),
+			fsm.WithBreaker(example.TestMachineStateState1, fsm.BreakerConfig{
+				Threshold: 0.5,
+				Window:    4,
+				Cooldown:  300 * time.Millisecond,
+			}),
+			fsm.WithBreakerListener(func(ctx context.Context, state fsm.State, from, to fsm.BreakerState) {
+				if state != example.TestMachineStateState1 {
+					t.Errorf("unexpected breaker change in %s", state)
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, event{to, time.Now()})
+				if to == fsm.BreakerOpen && len(events) == 1 {
+					// The dependency recovers while the breaker is open
+					down = false
+					close(opened)
+				}
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]fsm.TaskID, 3)
+	for i := range ids {
+		if ids[i], err = f.Submit(t.Context(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the breaker to open")
+	}
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+		defer cancel()
+		if state, err := f.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachineStateDone {
+			t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var states []fsm.BreakerState
+	for _, e := range events {
+		states = append(states, e.to)
+	}
+	if expected := []fsm.BreakerState{fsm.BreakerOpen, fsm.BreakerHalfOpen, fsm.BreakerClosed}; !slices.Equal(states, expected) {
+		t.Fatalf("expected breaker changes %v, got %v", expected, states)
+	}
+
+	// Nothing is dispatched during the cooldown. Listeners are told of the
+	// change after it happens, so the gap is measured between the handler
+	// calls on either side of it.
+	openedAt := events[0].at
+	probe := slices.IndexFunc(calls, func(call time.Time) bool { return call.After(openedAt) })
+	if probe <= 0 {
+		t.Fatalf("expected calls on both sides of the breaker opening, got %v", calls)
+	}
+	if cooldown := calls[probe].Sub(calls[probe-1]); cooldown < 300*time.Millisecond {
+		t.Errorf("expected a 300ms cooldown, got %s", cooldown)
+	}
+}
+
+func TestCircuitBreakerIgnoresLostClaims(t *testing.T) {
+	var lock sync.Mutex
+	var changes []fsm.BreakerState
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			switch fsm.GetAttempt(ctx) {
+			case 0:
+				return fmt.Errorf("moved on: %w", fsm.ErrClaimLost)
+			case 1:
+				return &fsm.QueueFullError{State: example.TestMachineStateState2, Capacity: 1}
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+			fsm.WithBreaker(example.TestMachineStateState1, fsm.BreakerConfig{
+				Threshold: 0.5,
+				Window:    2,
+				Cooldown:  time.Minute,
+			}),
+			fsm.WithBreakerListener(func(ctx context.Context, state fsm.State, from, to fsm.BreakerState) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes = append(changes, to)
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither error says anything about the state's health
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(changes) != 0 {
+		t.Errorf("expected the breaker to stay closed, got changes %v", changes)
+	}
+}
+
+func TestCircuitBreakerUnknownState(t *testing.T) {
+	config := fsm.BreakerConfig{Threshold: 0.5, Window: 2, Cooldown: time.Minute}
+	for _, state := range []fsm.State{"Missing", example.TestMachineStateDone} {
+		if _, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(), fsm.WithBreaker(state, config)); err == nil {
+			t.Errorf("expected an error for a breaker on %s", state)
+		}
+	}
+}
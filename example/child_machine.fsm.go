@@ -0,0 +1,1703 @@
+// Generated by fsmgen. DO NOT EDIT.
+package example
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	fsm "github.com/egoodhall/fsm"
+	sqlc "github.com/egoodhall/fsm/gen/sqlc"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ChildMachineStateWork   fsm.State = "Work"
+	ChildMachineStateDone   fsm.State = "Done"
+	ChildMachineStateFailed fsm.State = "Failed"
+)
+
+type ChildMachineFSM interface {
+	fsm.SupportsOptions
+	Submit(ctx context.Context, int int) (fsm.TaskID, error)
+	TrySubmit(ctx context.Context, int int) (fsm.TaskID, error)
+	SubmitAt(ctx context.Context, at time.Time, int int) (fsm.TaskID, error)
+	SubmitAfter(ctx context.Context, delay time.Duration, int int) (fsm.TaskID, error)
+	SubmitBatch(ctx context.Context, inputs []ChildMachineWorkParams) ([]fsm.TaskID, error)
+	SubmitSeq(ctx context.Context, inputs iter.Seq[ChildMachineWorkParams]) ([]fsm.TaskID, error)
+	SubmitAndWait(ctx context.Context, int int) (fsm.TaskID, fsm.State, error)
+	Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error)
+	Cancel(ctx context.Context, id fsm.TaskID, reason string) error
+	Pause(ctx context.Context, state fsm.State) error
+	Resume(ctx context.Context, state fsm.State) error
+	PauseAll(ctx context.Context) error
+	ResumeAll(ctx context.Context) error
+	Paused(ctx context.Context, state fsm.State) (bool, error)
+	RetryNow(ctx context.Context, id fsm.TaskID, operator string) error
+	ForceWork(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceDone(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceFailed(ctx context.Context, id fsm.TaskID, operator string, P0 string) error
+	Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error
+	Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error)
+	History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error)
+}
+
+type ChildMachineWorkParams struct {
+	P0 int
+}
+
+type ChildMachineDoneParams struct {
+	P0 int
+}
+
+type ChildMachineFailedParams struct {
+	P0 string
+}
+
+func NewChildMachineFSMBuilder() ChildMachineFSMBuilder_WorkStage {
+	return new(childMachineFSM)
+}
+
+type ChildMachineWorkTransitions interface {
+	ToDone(context.Context, int) error
+	ToDoneAt(context.Context, time.Time, int) error
+	ToDoneAfter(context.Context, time.Duration, int) error
+	ToFailed(context.Context, string) error
+	ToFailedAt(context.Context, time.Time, string) error
+	ToFailedAfter(context.Context, time.Duration, string) error
+}
+
+type ChildMachineFSMBuilder_WorkStage interface {
+	FromWork(func(context.Context, ChildMachineWorkTransitions, int) error) ChildMachineFSMBuilder__FinalStage
+}
+
+type ChildMachineFSMBuilder_DoneStage interface {
+	FromDone(func(context.Context, int) error) ChildMachineFSMBuilder__FinalStage
+}
+
+type ChildMachineFSMBuilder_FailedStage interface {
+	FromFailed(func(context.Context, string) error) ChildMachineFSMBuilder__FinalStage
+}
+
+type ChildMachineFSMBuilder__FinalStage interface {
+	BuildAndStart(context.Context, ...fsm.Option) (ChildMachineFSM, error)
+}
+
+// FSM type checks
+var _ ChildMachineFSM = new(childMachineFSM)
+var _ fsm.SupportsOptions = new(childMachineFSM)
+var _ ChildMachineFSMBuilder_WorkStage = new(childMachineFSM)
+var _ ChildMachineFSMBuilder__FinalStage = new(childMachineFSM)
+var _ ChildMachineWorkTransitions = new(childMachineFSM)
+
+// ChildMachineFSM implementation
+type childMachineFSM_WorkParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+type childMachineFSM_DoneParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+type childMachineFSM_FailedParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      string
+}
+
+type childMachineFSM struct {
+	lock sync.Mutex
+	ctx  context.Context
+
+	// Configuration options
+	store         fsm.Store
+	onTransition  fsm.TransitionListener
+	onCompletion  fsm.CompletionListener
+	onRateLimit   fsm.RateLimitListener
+	onBreaker     fsm.BreakerListener
+	middlewares   []fsm.Middleware
+	extractors    []fsm.MetadataExtractor
+	injectors     []fsm.MetadataInjector
+	backoff       fsm.Backoff
+	leaseTTL      time.Duration
+	pollInterval  time.Duration
+	aging         time.Duration
+	batchSize     int
+	namespace     string
+	adoptUnscoped func(fsm.TaskID) bool
+
+	// FSM state transitions
+	workState func(context.Context, ChildMachineWorkTransitions, int) error
+
+	// FSM state queues, rate limits, circuit breakers and backoffs
+	workQueue   fsm.QueueConfig
+	workLimiter *fsm.Limiter
+	workBreaker *fsm.Breaker
+	workBackoff fsm.Backoff
+
+	// FSM queue signals, and the owner of this instance's leases
+	workReady   chan struct{}
+	doneReady   chan struct{}
+	failedReady chan struct{}
+	owner       string
+	// Closed and replaced each time steps leave a queue, to wake blocked submissions
+	spaceLock sync.Mutex
+	space     chan struct{}
+
+	// Running tasks and their waiters
+	tasksLock sync.Mutex
+	// A task's next step can start before the handler that moved it there returns
+	running map[fsm.TaskID]map[context.Context]context.CancelCauseFunc
+	waiters map[fsm.TaskID][]chan fsm.State
+}
+
+// FSM builder methods
+
+func (f *childMachineFSM) FromWork(fn func(context.Context, ChildMachineWorkTransitions, int) error) ChildMachineFSMBuilder__FinalStage {
+	f.workState = fn
+	return f
+}
+
+func (f *childMachineFSM) BuildAndStart(ctx context.Context, opts ...fsm.Option) (ChildMachineFSM, error) {
+	// Check if FSM is already started
+	if !f.lock.TryLock() {
+		return nil, errors.New("FSM already started")
+	}
+
+	// Set context
+	f.ctx = ctx
+
+	// Initialize state queue signals
+	f.workReady = make(chan struct{}, 1)
+	f.doneReady = make(chan struct{}, 1)
+	f.failedReady = make(chan struct{}, 1)
+	f.owner = rand.Text()
+	f.space = make(chan struct{})
+
+	// Initialize task tracking
+	f.running = make(map[fsm.TaskID]map[context.Context]context.CancelCauseFunc)
+	f.waiters = make(map[fsm.TaskID][]chan fsm.State)
+
+	// Initialize state queues, rate limits, circuit breakers and backoffs
+	// from the model, which options may override
+	f.workLimiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.workBreaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(ChildMachineStateWork))
+
+	// Apply options
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.store == nil {
+		if store, err := fsm.InMemory()(); err != nil {
+			return nil, err
+		} else {
+			f.store = store
+		}
+	}
+	if f.backoff == nil {
+		f.backoff = fsm.LinearBackoff(500*time.Millisecond, 30*time.Second)
+	}
+	if f.leaseTTL == 0 {
+		f.leaseTTL = 30 * time.Second
+	}
+	if f.pollInterval == 0 {
+		f.pollInterval = time.Second
+	}
+	if f.aging == 0 {
+		f.aging = time.Minute
+	}
+	if f.batchSize == 0 {
+		f.batchSize = 1000
+	}
+
+	// Adopt tasks stored before tasks were scoped to an FSM
+	if err := f.adoptTasks(f.ctx); err != nil {
+		return nil, err
+	}
+	// Resume tasks stored before their steps were queued in the store
+	if err := f.resumeTasks(f.ctx); err != nil {
+		return nil, err
+	}
+
+	// Start FSM processors. Existing work, including steps whose lease
+	// expired in a process that died, is claimed from the store.
+	// Start 1 workProcessor
+	go f.workProcessor()
+	// Start 1 doneProcessor
+	go f.doneProcessor()
+	// Start 1 failedProcessor
+	go f.failedProcessor()
+	return f, nil
+}
+
+// adoptTasks scopes the tasks stored before tasks had an FSM, and their
+// concurrency locks, to this FSM and namespace. Only tasks that fit the FSM
+// are adopted, and only those WithUnscopedTasks accepts, since they can't
+// be told apart from other FSMs' tasks that fit too. Without the option, the
+// FSM doesn't start while tasks that fit it exist.
+func (f *childMachineFSM) adoptTasks(ctx context.Context) error {
+	return f.store.Tx(ctx, func(q fsm.Q) error {
+		tasks, err := q.ListUnscopedTasks(ctx)
+		if err != nil {
+			return err
+		}
+		var fitting []sqlc.Task
+		for _, task := range tasks {
+			if ok, err := f.fits(ctx, q, task); err != nil {
+				return err
+			} else if ok {
+				fitting = append(fitting, task)
+			}
+		}
+		if len(fitting) == 0 {
+			return nil
+		}
+		if f.adoptUnscoped == nil {
+			return fmt.Errorf("%w: count = %d", fsm.ErrUnscopedTasks, len(fitting))
+		}
+
+		var n int
+		for _, task := range fitting {
+			if !f.adoptUnscoped(fsm.TaskID(task.ID)) {
+				continue
+			}
+			if err := q.AdoptUnscopedTask(ctx, "ChildMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			if err := q.AdoptUnscopedLocks(ctx, "ChildMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			n++
+		}
+		fsm.Logger(ctx).Info("Adopted unscoped tasks", "count", n, "skipped", len(fitting)-n)
+		return nil
+	})
+}
+
+// fits reports whether an unscoped task could be one of this FSM's: its
+// input decodes as the entrypoint's, and it only went through the FSM's
+// states.
+func (f *childMachineFSM) fits(ctx context.Context, q fsm.Q, task sqlc.Task) (bool, error) {
+	if _, err := f.decodeParams(ChildMachineStateWork, task.Data); err != nil {
+		return false, nil
+	}
+	history, err := q.GetHistory(ctx, task.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, step := range history {
+		for _, state := range []fsm.State{fsm.State(step.FromState), fsm.State(step.ToState)} {
+			switch state {
+			case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+				continue
+			}
+			if f.stateError(state) != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// resumeTasks queues the current step of tasks stored before steps were
+// queued in the store. Each task is only resumed once.
+func (f *childMachineFSM) resumeTasks(ctx context.Context) error {
+	tasks, err := f.store.Q().ListUnqueuedTasks(ctx, "ChildMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		id := fsm.TaskID(task.ID)
+		var state fsm.State
+		now := time.Now()
+		if err := f.store.Tx(ctx, func(q fsm.Q) error {
+			if err := q.DeleteUnqueuedTask(ctx, task.ID); err != nil {
+				return err
+			}
+			transition, err := f.lastTransition(ctx, q, id)
+			if err != nil {
+				return err
+			}
+			state = fsm.State(transition.ToState)
+			if f.isTerminal(state) {
+				return nil
+			}
+			// Tasks that never transitioned start from their input
+			data := transition.Data
+			if transition.ID == 0 {
+				data = task.Data
+			}
+			if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+				TaskID:  task.ID,
+				State:   string(state),
+				Data:    data,
+				ReadyAt: now.UnixMilli(),
+			}); err != nil {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !f.isTerminal(state) {
+			fsm.Logger(ctx).Info("Resuming task", "id", id, "state", state)
+		}
+	}
+	return nil
+}
+
+// FSM options
+
+func (f *childMachineFSM) WithStore(store fsm.Store) {
+	f.store = store
+}
+
+func (f *childMachineFSM) WithContext(update func(context.Context) context.Context) {
+	f.ctx = update(f.ctx)
+}
+
+func (f *childMachineFSM) WithTransitionListener(listener fsm.TransitionListener) {
+	f.onTransition = listener
+}
+
+func (f *childMachineFSM) WithCompletionListener(listener fsm.CompletionListener) {
+	f.onCompletion = listener
+}
+
+func (f *childMachineFSM) WithRateLimitListener(listener fsm.RateLimitListener) {
+	f.onRateLimit = listener
+}
+
+func (f *childMachineFSM) WithBreakerListener(listener fsm.BreakerListener) {
+	f.onBreaker = listener
+}
+
+func (f *childMachineFSM) WithMiddleware(middleware fsm.Middleware) {
+	f.middlewares = append(f.middlewares, middleware)
+}
+
+func (f *childMachineFSM) WithMetadataExtractor(extractor fsm.MetadataExtractor) {
+	f.extractors = append(f.extractors, extractor)
+}
+
+func (f *childMachineFSM) WithMetadataInjector(injector fsm.MetadataInjector) {
+	f.injectors = append(f.injectors, injector)
+}
+
+func (f *childMachineFSM) WithBackoff(backoff fsm.Backoff) {
+	f.backoff = backoff
+}
+
+func (f *childMachineFSM) WithStateBackoff(state fsm.State, backoff fsm.Backoff) error {
+	switch state {
+	case ChildMachineStateWork:
+		f.workBackoff = backoff
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a backoff", state)
+	}
+	return nil
+}
+
+func (f *childMachineFSM) WithQueue(state fsm.State, config fsm.QueueConfig) error {
+	switch state {
+	case ChildMachineStateWork:
+		f.workQueue = config
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a queue", state)
+	}
+	return nil
+}
+
+func (f *childMachineFSM) WithLease(ttl time.Duration) {
+	f.leaseTTL = ttl
+}
+
+func (f *childMachineFSM) WithPollInterval(interval time.Duration) {
+	f.pollInterval = interval
+}
+
+func (f *childMachineFSM) WithPriorityAging(interval time.Duration) {
+	f.aging = interval
+}
+
+func (f *childMachineFSM) WithBatchSize(size int) {
+	f.batchSize = size
+}
+
+func (f *childMachineFSM) WithNamespace(namespace string) {
+	f.namespace = namespace
+}
+
+func (f *childMachineFSM) WithUnscopedTasks(adopt func(fsm.TaskID) bool) {
+	f.adoptUnscoped = adopt
+}
+
+func (f *childMachineFSM) WithRate(state fsm.State, rate fsm.Rate, burst int) error {
+	switch state {
+	case ChildMachineStateWork:
+		f.workLimiter.SetRate(rate, burst)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a rate limit", state)
+	}
+	return nil
+}
+
+func (f *childMachineFSM) WithBreaker(state fsm.State, config fsm.BreakerConfig) error {
+	switch state {
+	case ChildMachineStateWork:
+		f.workBreaker.SetConfig(config)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a circuit breaker", state)
+	}
+	return nil
+}
+
+func (f *childMachineFSM) WithDeadline(state fsm.State, after time.Duration) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s can't have a deadline", state)
+}
+
+// FSM transition methods
+
+func (f *childMachineFSM) ToWork(ctx context.Context, P0 int) error {
+	return f.ToWorkAt(ctx, time.Now(), P0)
+}
+
+func (f *childMachineFSM) ToWorkAfter(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToWorkAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *childMachineFSM) ToWorkAt(ctx context.Context, at time.Time, P0 int) error {
+	msg := childMachineFSM_WorkParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ChildMachineStateWork, buf.Bytes(), at)
+}
+
+func (f *childMachineFSM) ToDone(ctx context.Context, P0 int) error {
+	return f.ToDoneAt(ctx, time.Now(), P0)
+}
+
+func (f *childMachineFSM) ToDoneAfter(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToDoneAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *childMachineFSM) ToDoneAt(ctx context.Context, at time.Time, P0 int) error {
+	msg := childMachineFSM_DoneParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ChildMachineStateDone, buf.Bytes(), at)
+}
+
+func (f *childMachineFSM) ToFailed(ctx context.Context, P0 string) error {
+	return f.ToFailedAt(ctx, time.Now(), P0)
+}
+
+func (f *childMachineFSM) ToFailedAfter(ctx context.Context, delay time.Duration, P0 string) error {
+	return f.ToFailedAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *childMachineFSM) ToFailedAt(ctx context.Context, at time.Time, P0 string) error {
+	msg := childMachineFSM_FailedParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ChildMachineStateFailed, buf.Bytes(), at)
+}
+
+func (f *childMachineFSM) workProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ChildMachineStateWork))
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.workBreaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, ChildMachineStateWork, f.workReady, f.workLimiter)
+		if !ok {
+			f.workBreaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.workLimiter, item, wait)
+
+		var msg childMachineFSM_WorkParams
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", ChildMachineStateWork, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.workBreaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", ChildMachineStateWork)
+			f.ack(ctx, item)
+			f.workBreaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", ChildMachineStateWork)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, ChildMachineStateWork, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.workState(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.workBreaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
+	}
+}
+
+func (f *childMachineFSM) doneProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ChildMachineStateDone))
+	for {
+		item, _, ok := f.claim(ctx, ChildMachineStateDone, f.doneReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ChildMachineStateDone))
+	}
+}
+
+func (f *childMachineFSM) failedProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ChildMachineStateFailed))
+	for {
+		item, _, ok := f.claim(ctx, ChildMachineStateFailed, f.failedReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ChildMachineStateFailed))
+	}
+}
+
+func (f *childMachineFSM) claim(ctx context.Context, state fsm.State, ready chan struct{}, limiter *fsm.Limiter) (sqlc.QueueItem, time.Duration, bool) {
+	var waited time.Duration
+	for {
+		wait, err := f.throttle(ctx, limiter)
+		waited += wait
+		if err != nil {
+			return sqlc.QueueItem{}, waited, false
+		}
+
+		// Claims aren't interrupted, since the lease may be taken even if
+		// the claimed item is lost to a cancellation
+		uninterrupted := context.WithoutCancel(ctx)
+		var item sqlc.QueueItem
+		err = f.store.Tx(uninterrupted, func(q fsm.Q) (err error) {
+			region := f.region(state)
+			item, err = q.ClaimQueueItem(uninterrupted, sqlc.ClaimQueueItemParams{
+				Owner:     f.owner,
+				LeaseMs:   f.leaseTTL.Milliseconds(),
+				State:     string(state),
+				Fsm:       "ChildMachine",
+				Namespace: f.namespace,
+				Region:    region,
+				AgingMs:   f.aging.Milliseconds(),
+			})
+			if err != nil || region == "" {
+				return err
+			}
+			// The task holds its key's region until it leaves
+			return q.AcquireConcurrencyLock(uninterrupted, region, item.TaskID)
+		})
+		if err == nil && ctx.Err() != nil {
+			f.release(ctx, item)
+			return item, waited, false
+		} else if err == nil {
+			// There may be more, so let another processor look
+			f.signal(state)
+			return item, waited, true
+		}
+
+		// Idle processors don't hold on to tokens, so they can't start a burst
+		// of steps together once work arrives
+		if limiter != nil {
+			limiter.Refund()
+		}
+		if ctx.Err() != nil {
+			return item, waited, false
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			fsm.Logger(ctx).Error("Failed to claim queue item", "state", state, "error", err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return item, waited, false
+		}
+	}
+}
+
+func (f *childMachineFSM) heartbeat(ctx context.Context, item sqlc.QueueItem) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(f.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if n, err := f.store.Q().RenewQueueItemLease(ctx, f.leaseTTL.Milliseconds(), item.ID, f.owner); err != nil && ctx.Err() == nil {
+				fsm.Logger(ctx).Error("Failed to renew lease", "id", item.TaskID, "state", item.State, "error", err)
+			} else if err == nil && n == 0 {
+				cancel(fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, item.TaskID, item.State))
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel(nil)
+	}
+}
+
+func (f *childMachineFSM) handle(ctx context.Context, state fsm.State, id fsm.TaskID, attempt int, handler func(context.Context) error) error {
+	ctx, err := f.restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	next := handler
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := f.middlewares[i], next
+		next = func(ctx context.Context) error {
+			return middleware(ctx, "ChildMachine", state, id, attempt, inner)
+		}
+	}
+	return next(ctx)
+}
+
+func (f *childMachineFSM) metadata(ctx context.Context) ([]byte, error) {
+	metadata := make(map[string]string)
+	for _, extract := range f.extractors {
+		maps.Copy(metadata, extract(ctx))
+	}
+	maps.Copy(metadata, fsm.GetMetadata(ctx))
+	return fsm.EncodeMetadata(metadata)
+}
+
+func (f *childMachineFSM) restore(ctx context.Context, id fsm.TaskID) (context.Context, error) {
+	data, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return ctx, err
+	}
+	metadata, err := fsm.DecodeMetadata(data)
+	if err != nil || metadata == nil {
+		return ctx, err
+	}
+	ctx = fsm.PutMetadata(ctx, metadata)
+	for _, inject := range f.injectors {
+		ctx = inject(ctx, metadata)
+	}
+	return ctx, nil
+}
+
+func (f *childMachineFSM) throttle(ctx context.Context, limiter *fsm.Limiter) (time.Duration, error) {
+	if limiter == nil || !limiter.Limited() {
+		return 0, nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func (f *childMachineFSM) throttled(ctx context.Context, limiter *fsm.Limiter, item sqlc.QueueItem, wait time.Duration) {
+	if limiter.Limited() && f.onRateLimit != nil {
+		f.onRateLimit(ctx, fsm.TaskID(item.TaskID), fsm.State(item.State), wait)
+	}
+}
+
+func (f *childMachineFSM) record(ctx context.Context, breaker *fsm.Breaker, probe bool, err error) {
+	// Shutdowns, cancellations, lost claims, full queues and parked steps say
+	// nothing about the state's health
+	if err != nil && (ctx.Err() != nil || errors.Is(err, fsm.ErrTaskCancelled) || errors.Is(err, fsm.ErrClaimLost) || errors.Is(err, fsm.ErrQueueFull) || errors.Is(err, fsm.ErrChildRunning)) {
+		breaker.Abandon(probe)
+		return
+	}
+	breaker.Record(probe, err != nil)
+}
+
+func (f *childMachineFSM) breakerListener(state fsm.State) func(from, to fsm.BreakerState) {
+	return func(from, to fsm.BreakerState) {
+		fsm.Logger(f.ctx).Info("Circuit breaker changed", "state", state, "from", from, "to", to)
+		if f.onBreaker != nil {
+			f.onBreaker(f.ctx, state, from, to)
+		}
+	}
+}
+
+func (f *childMachineFSM) ack(ctx context.Context, item sqlc.QueueItem) {
+	// Finished work is acknowledged even while shutting down
+	if _, err := f.store.Q().AckQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to acknowledge queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.freeSpace()
+}
+
+func (f *childMachineFSM) fail(ctx context.Context, item sqlc.QueueItem, cause error) {
+	if f.ctx.Err() != nil {
+		// Shutting down, so hand the step over without counting an attempt
+		f.release(ctx, item)
+		return
+	}
+	attempt := int(item.Attempt) + 1
+	delay := f.stateBackoff(fsm.State(item.State))(attempt, cause)
+	retryAt := time.Now().Add(delay).UnixMilli()
+	fsm.Logger(ctx).Debug("Processing error", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", cause)
+
+	err := f.store.Tx(ctx, func(q fsm.Q) error {
+		if n, err := q.RetryQueueItem(ctx, int64(attempt), retryAt, item.ID, f.owner); err != nil {
+			return err
+		} else if n == 0 {
+			return fsm.ErrClaimLost
+		}
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:        item.TaskID,
+			Attempt:       int64(attempt),
+			FromState:     item.State,
+			ToState:       string(fsm.StateError),
+			Data:          []byte(cause.Error()),
+			NextAttemptAt: &retryAt,
+		})
+	})
+	if errors.Is(err, fsm.ErrClaimLost) {
+		// The task has moved on, or another worker took over the step
+		return
+	} else if err != nil {
+		fsm.Logger(ctx).Debug("Failed to record transition", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", err)
+		f.release(ctx, item)
+		return
+	}
+	f.signalAt(fsm.State(item.State), time.UnixMilli(retryAt))
+}
+
+func (f *childMachineFSM) release(ctx context.Context, item sqlc.QueueItem) {
+	if err := f.store.Q().ReleaseQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to release queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.signal(fsm.State(item.State))
+}
+
+func (f *childMachineFSM) signal(state fsm.State) {
+	var ready chan struct{}
+	switch state {
+	case ChildMachineStateWork:
+		ready = f.workReady
+	case ChildMachineStateDone:
+		ready = f.doneReady
+	case ChildMachineStateFailed:
+		ready = f.failedReady
+	}
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *childMachineFSM) queueConfig(state fsm.State) fsm.QueueConfig {
+	switch state {
+	case ChildMachineStateWork:
+		return f.workQueue
+	}
+	return fsm.QueueConfig{}
+}
+
+func (f *childMachineFSM) reserve(ctx context.Context, q fsm.Q, state fsm.State) error {
+	config := f.queueConfig(state)
+	if !config.Bounded() {
+		return nil
+	}
+	n, err := q.CountQueueItems(ctx, string(state), "ChildMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	if n >= int64(config.Capacity) {
+		return &fsm.QueueFullError{
+			Capacity: config.Capacity,
+			State:    state,
+		}
+	}
+	return nil
+}
+
+func (f *childMachineFSM) admit(ctx context.Context, block bool, fn func(fsm.Q) error) error {
+	for {
+		f.spaceLock.Lock()
+		space := f.space
+		f.spaceLock.Unlock()
+
+		err := f.store.Tx(ctx, fn)
+		var full *fsm.QueueFullError
+		if !block || !errors.As(err, &full) || !f.queueConfig(full.State).Blocks() {
+			return err
+		}
+
+		// Steps leaving the queue in other processes are only seen by polling
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		case <-space:
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+func (f *childMachineFSM) freeSpace() {
+	f.spaceLock.Lock()
+	defer f.spaceLock.Unlock()
+	close(f.space)
+	f.space = make(chan struct{})
+}
+
+func (f *childMachineFSM) stateBackoff(state fsm.State) fsm.Backoff {
+	var backoff fsm.Backoff
+	switch state {
+	case ChildMachineStateWork:
+		backoff = f.workBackoff
+	}
+	if backoff == nil {
+		return f.backoff
+	}
+	return backoff
+}
+
+func (f *childMachineFSM) region(state fsm.State) string {
+	return ""
+}
+
+func (f *childMachineFSM) signalRegion(region string) {}
+
+func (f *childMachineFSM) signalAt(state fsm.State, at time.Time) {
+	if delay := time.Until(at); delay > 0 {
+		time.AfterFunc(delay, func() {
+			f.signal(state)
+		})
+		return
+	}
+	f.signal(state)
+}
+
+func (f *childMachineFSM) transition(ctx context.Context, toState fsm.State, data []byte, at time.Time) error {
+	id := fsm.GetTaskID(ctx)
+	fromState := fsm.GetState(ctx)
+	itemID, ok := fsm.GetQueueItem(ctx)
+	if !ok {
+		return fmt.Errorf("transition to %s outside of a task handler", toState)
+	}
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+	}
+
+	if err := f.admit(ctx, false, func(q fsm.Q) error {
+		if n, err := q.AckQueueItem(ctx, itemID, f.owner); err != nil {
+			return err
+		} else if n == 0 && f.isCancelled(ctx, q, id) {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, id, fromState)
+		}
+		if err := f.reserve(ctx, q, toState); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   int64(fsm.GetAttempt(ctx)),
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+		}); err != nil {
+			return err
+		}
+		// Leaving a serialized region lets the next task with the same key in
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signalAt(toState, at)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Submit FSM tasks
+
+func (f *childMachineFSM) Submit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now(), P0)
+}
+
+func (f *childMachineFSM) SubmitAfter(ctx context.Context, delay time.Duration, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *childMachineFSM) SubmitAt(ctx context.Context, at time.Time, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, at, true, P0)
+}
+
+// TrySubmit never waits for room in a full queue
+
+func (f *childMachineFSM) TrySubmit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, time.Now(), false, P0)
+}
+
+func (f *childMachineFSM) submit(ctx context.Context, at time.Time, block bool, P0 int) (fsm.TaskID, error) {
+	msg := childMachineFSM_WorkParams{P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return 0, err
+	}
+
+	var key, concurrencyKey *string
+	if k, ok := fsm.GetIdempotencyKey(ctx); ok {
+		key = &k
+	}
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The task and its first step are stored together, once there is room
+	if err := f.admit(ctx, block, func(q fsm.Q) error {
+		// A repeated submission returns the task it already created
+		if key != nil {
+			task, err := q.GetTaskByIdempotencyKey(ctx, "ChildMachine", f.namespace, key)
+			if err == nil {
+				if !bytes.Equal(task.Data, buf.Bytes()) {
+					return fsm.ErrIdempotencyConflict
+				}
+				msg.ID = fsm.TaskID(task.ID)
+				return nil
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		if err := f.reserve(ctx, q, ChildMachineStateWork); err != nil {
+			return err
+		}
+		task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+			Data:           buf.Bytes(),
+			IdempotencyKey: key,
+			ConcurrencyKey: concurrencyKey,
+			Metadata:       metadata,
+			Fsm:            "ChildMachine",
+			Namespace:      f.namespace,
+		})
+		if err != nil {
+			return err
+		}
+		msg.ID = fsm.TaskID(task.ID)
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   task.ID,
+			State:    string(ChildMachineStateWork),
+			Data:     buf.Bytes(),
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	f.signalAt(ChildMachineStateWork, at)
+	return msg.ID, nil
+}
+
+// Submit FSM tasks in batches
+
+func (f *childMachineFSM) SubmitBatch(ctx context.Context, inputs []ChildMachineWorkParams) ([]fsm.TaskID, error) {
+	return f.SubmitSeq(ctx, slices.Values(inputs))
+}
+
+func (f *childMachineFSM) SubmitSeq(ctx context.Context, inputs iter.Seq[ChildMachineWorkParams]) ([]fsm.TaskID, error) {
+	if _, ok := fsm.GetIdempotencyKey(ctx); ok {
+		return nil, errors.New("batch submissions can't share an idempotency key")
+	}
+
+	var err error
+	ids := make([]fsm.TaskID, 0)
+	chunk := make([][]byte, 0, f.batchSize)
+	for input := range inputs {
+		msg := childMachineFSM_WorkParams{P0: input.P0}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return ids, err
+		}
+		chunk = append(chunk, buf.Bytes())
+		if len(chunk) == f.batchSize {
+			if ids, err = f.submitChunk(ctx, ids, chunk); err != nil {
+				return ids, err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	return f.submitChunk(ctx, ids, chunk)
+}
+
+// submitChunk stores a chunk of a batch in one transaction, and appends its
+// tasks to ids once it commits. When the entrypoint's queue fills up, the
+// tasks that fit are committed first, and the rest wait for room or are
+// rejected like single submissions.
+func (f *childMachineFSM) submitChunk(ctx context.Context, ids []fsm.TaskID, chunk [][]byte) ([]fsm.TaskID, error) {
+	if len(chunk) == 0 {
+		return ids, nil
+	}
+	var concurrencyKey *string
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return ids, err
+	}
+
+	for len(chunk) > 0 {
+		now := time.Now()
+		created := make([]fsm.TaskID, 0, len(chunk))
+		if err := f.admit(ctx, true, func(q fsm.Q) error {
+			created = created[:0]
+			for _, data := range chunk {
+				if err := f.reserve(ctx, q, ChildMachineStateWork); err != nil {
+					// Keep the tasks that fit, and stop at the first that doesn't
+					if len(created) > 0 && errors.Is(err, fsm.ErrQueueFull) {
+						return nil
+					}
+					return err
+				}
+				task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+					Data:           data,
+					ConcurrencyKey: concurrencyKey,
+					Metadata:       metadata,
+					Fsm:            "ChildMachine",
+					Namespace:      f.namespace,
+				})
+				if err != nil {
+					return err
+				}
+				_, err = q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+					TaskID:   task.ID,
+					State:    string(ChildMachineStateWork),
+					Data:     data,
+					ReadyAt:  now.UnixMilli(),
+					Priority: int64(fsm.GetPriority(ctx)),
+				})
+				if err != nil {
+					return err
+				}
+				created = append(created, fsm.TaskID(task.ID))
+			}
+			return nil
+		}); err != nil {
+			return ids, err
+		}
+		f.signal(ChildMachineStateWork)
+		ids = append(ids, created...)
+		chunk = chunk[len(created):]
+	}
+	return ids, nil
+}
+
+// Cancel FSM tasks
+
+func (f *childMachineFSM) Cancel(ctx context.Context, id fsm.TaskID, reason string) error {
+	var fromState fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if f.isTerminal(fromState) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, fromState)
+		}
+
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   transition.Attempt,
+			FromState: string(fromState),
+			ToState:   string(fsm.StateCancelled),
+			Data:      []byte(reason),
+		}); err != nil {
+			return err
+		}
+		// Drop any queued or pending work, and leave any serialized region
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		return q.ReleaseConcurrencyLocks(ctx, int64(id), "")
+	}); err != nil {
+		return err
+	}
+
+	// Stop the running handler
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: %s", fsm.ErrTaskCancelled, reason))
+	}
+	f.tasksLock.Unlock()
+	f.signalRegion(f.region(fromState))
+	f.freeSpace()
+
+	fsm.Logger(ctx).Debug("Cancelled task", "id", id, "from", fromState, "reason", reason)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, fsm.StateCancelled)
+	}
+	f.complete(ctx, id, fsm.StateCancelled)
+	return nil
+}
+
+func (f *childMachineFSM) lastTransition(ctx context.Context, q fsm.Q, id fsm.TaskID) (sqlc.StateTransition, error) {
+	transition, err := q.GetLastValidTransition(ctx, int64(id), "ChildMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := q.GetTask(ctx, int64(id), "ChildMachine", f.namespace); errors.Is(err, sql.ErrNoRows) {
+			return transition, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+		} else if err != nil {
+			return transition, err
+		}
+		return sqlc.StateTransition{
+			TaskID:  int64(id),
+			ToState: string(ChildMachineStateWork),
+		}, nil
+	}
+	return transition, err
+}
+
+func (f *childMachineFSM) startTask(ctx context.Context, id fsm.TaskID) (context.Context, bool) {
+	f.tasksLock.Lock()
+	ctx2, cancel := context.WithCancelCause(ctx)
+	if f.running[id] == nil {
+		f.running[id] = make(map[context.Context]context.CancelCauseFunc)
+	}
+	f.running[id][ctx2] = cancel
+	f.tasksLock.Unlock()
+
+	// Cancel stops the handlers running when it commits, so handlers
+	// registered after that find the cancellation in the store
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		f.finishTask(ctx2, id)
+		return ctx, false
+	}
+	return ctx2, true
+}
+
+func (f *childMachineFSM) finishTask(ctx context.Context, id fsm.TaskID) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	if cancel, ok := f.running[id][ctx]; ok {
+		cancel(nil)
+		delete(f.running[id], ctx)
+	}
+	if len(f.running[id]) == 0 {
+		delete(f.running, id)
+	}
+}
+
+func (f *childMachineFSM) isCancelled(ctx context.Context, q fsm.Q, id fsm.TaskID) bool {
+	transition, err := f.lastTransition(ctx, q, id)
+	if err != nil {
+		fsm.Logger(ctx).Error("Failed to get last transition", "id", id, "error", err)
+		return false
+	}
+	return fsm.State(transition.ToState) == fsm.StateCancelled
+}
+
+// Pause and resume FSM dispatch
+
+func (f *childMachineFSM) Pause(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().PauseState(ctx, "ChildMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused state", "state", state)
+	return nil
+}
+
+func (f *childMachineFSM) Resume(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().ResumeState(ctx, "ChildMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed state", "state", state)
+	// Other processes pick the state's steps up when they next poll
+	f.signal(state)
+	return nil
+}
+
+func (f *childMachineFSM) PauseAll(ctx context.Context) error {
+	if err := f.store.Q().PauseState(ctx, "ChildMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused FSM")
+	return nil
+}
+
+func (f *childMachineFSM) ResumeAll(ctx context.Context) error {
+	if err := f.store.Q().ResumeState(ctx, "ChildMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed FSM")
+	// States paused on their own stay paused
+	for _, state := range []fsm.State{ChildMachineStateWork, ChildMachineStateDone, ChildMachineStateFailed} {
+		f.signal(state)
+	}
+	return nil
+}
+
+func (f *childMachineFSM) Paused(ctx context.Context, state fsm.State) (bool, error) {
+	if err := f.stateError(state); err != nil {
+		return false, err
+	}
+	paused, err := f.store.Q().GetPausedStates(ctx, "ChildMachine", f.namespace)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(paused, "") || slices.Contains(paused, string(state)), nil
+}
+
+func (f *childMachineFSM) stateError(state fsm.State) error {
+	switch state {
+	case ChildMachineStateWork, ChildMachineStateDone, ChildMachineStateFailed:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", fsm.ErrUnknownState, state)
+}
+
+// Administrative FSM task operations
+
+func (f *childMachineFSM) RetryNow(ctx context.Context, id fsm.TaskID, operator string) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var state fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		state = fsm.State(transition.ToState)
+		if f.isTerminal(state) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, state)
+		}
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Only failed steps that aren't running can be retried
+		if n, err := q.ExpediteQueueItem(ctx, item.ID); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrNoPendingRetry, id, state)
+		}
+		state = fsm.State(item.State)
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: item.State,
+			ToState:   string(fsm.StateRetried),
+			Operator:  &operator,
+		})
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Retrying task now", "id", id, "state", state, "operator", operator)
+	f.signal(state)
+	return nil
+}
+
+func (f *childMachineFSM) ForceWork(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := childMachineFSM_WorkParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ChildMachineStateWork, buf.Bytes())
+}
+
+func (f *childMachineFSM) ForceDone(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := childMachineFSM_DoneParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ChildMachineStateDone, buf.Bytes())
+}
+
+func (f *childMachineFSM) ForceFailed(ctx context.Context, id fsm.TaskID, operator string, P0 string) error {
+	msg := childMachineFSM_FailedParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ChildMachineStateFailed, buf.Bytes())
+}
+
+func (f *childMachineFSM) Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ChildMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return err
+	}
+
+	// Steps are numbered as in the task's history, starting from its submission
+	toState, data := fsm.State(ChildMachineStateWork), task.Data
+	if step != 0 {
+		transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+		if err != nil {
+			return err
+		}
+		if step < 0 || step > len(transitions) {
+			return fmt.Errorf("task %d has no step %d", id, step)
+		}
+		toState = fsm.State(transitions[step-1].ToState)
+		data = transitions[step-1].Data
+	}
+	switch toState {
+	case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+		return fmt.Errorf("task %d can't restart from step %d in %s", id, step, toState)
+	}
+	return f.move(ctx, id, operator, toState, data)
+}
+
+// move replaces the task's current step with a step in the given state,
+// reviving the task if it finished. A running handler loses its claim on
+// the replaced step, so it can't move the task on too.
+func (f *childMachineFSM) move(ctx context.Context, id fsm.TaskID, operator string, toState fsm.State, data []byte) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var fromState fsm.State
+	now := time.Now()
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if fromState == fsm.StateCancelled {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		}
+
+		// The new step keeps the priority of the step it replaces
+		priority := int64(fsm.GetPriority(ctx))
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err == nil {
+			priority = item.Priority
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+			Operator:  &operator,
+		}); err != nil {
+			return err
+		}
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  now.UnixMilli(),
+			Priority: priority,
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: id = %d, moved to %s by %s", fsm.ErrClaimLost, id, toState, operator))
+	}
+	f.tasksLock.Unlock()
+
+	fsm.Logger(ctx).Debug("Moved task", "id", id, "from", fromState, "to", toState, "operator", operator)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signal(toState)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Query FSM tasks
+
+func (f *childMachineFSM) Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error) {
+	history, err := f.History(ctx, id)
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	status := fsm.NewTaskStatus(id, history)
+	status.Terminal = f.isTerminal(status.State)
+	metadata, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	if status.Metadata, err = fsm.DecodeMetadata(metadata); err != nil {
+		return fsm.TaskStatus{}, err
+	}
+
+	// Queued steps carry a priority, and steps that haven't been
+	// attempted yet may be scheduled for later
+	item, err := f.store.Q().GetTaskQueueItem(ctx, int64(id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fsm.TaskStatus{}, err
+	} else if err == nil {
+		status.Priority = int(item.Priority)
+		if at := time.UnixMilli(item.ReadyAt); item.Attempt == 0 && item.LeaseOwner == nil && at.After(time.Now()) {
+			status.ScheduledAt = at
+		}
+	}
+	return status, nil
+}
+
+func (f *childMachineFSM) History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error) {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ChildMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks are submitted without a transition, so the first step comes from the task itself
+	params, err := f.decodeParams(ChildMachineStateWork, task.Data)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]fsm.Step, 0, len(transitions)+1)
+	history = append(history, fsm.Step{
+		CreatedAt: time.UnixMilli(task.CreatedAt),
+		Params:    params,
+		To:        ChildMachineStateWork,
+	})
+	for _, transition := range transitions {
+		step := fsm.Step{
+			Attempt:   int(transition.Attempt),
+			CreatedAt: time.UnixMilli(transition.CreatedAt),
+			Deadline:  transition.Deadline,
+			From:      fsm.State(transition.FromState),
+			To:        fsm.State(transition.ToState),
+		}
+		if transition.Operator != nil {
+			step.Operator = *transition.Operator
+		}
+		switch step.To {
+		case fsm.StateError:
+			step.Error = string(transition.Data)
+			if transition.NextAttemptAt != nil {
+				step.NextAttemptAt = time.UnixMilli(*transition.NextAttemptAt)
+			}
+		case fsm.StateCancelled:
+			step.Reason = string(transition.Data)
+		case fsm.StateRetried:
+		// Retried steps keep the failed step's inputs
+		default:
+			if step.Params, err = f.decodeParams(step.To, transition.Data); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, step)
+	}
+	return history, nil
+}
+
+func (f *childMachineFSM) decodeParams(state fsm.State, data []byte) (any, error) {
+	switch state {
+	case ChildMachineStateWork:
+		var params ChildMachineWorkParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ChildMachineStateDone:
+		var params ChildMachineDoneParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ChildMachineStateFailed:
+		var params ChildMachineFailedParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("unknown state: %s", state)
+}
+
+func (f *childMachineFSM) isTerminal(state fsm.State) bool {
+	switch state {
+	case ChildMachineStateDone, ChildMachineStateFailed, fsm.StateCancelled:
+		return true
+	}
+	return false
+}
+
+// Wait for FSM tasks
+
+func (f *childMachineFSM) Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error) {
+	waiter := make(chan fsm.State, 1)
+	f.tasksLock.Lock()
+	f.waiters[id] = append(f.waiters[id], waiter)
+	f.tasksLock.Unlock()
+	defer f.stopWaiting(id, waiter)
+
+	// The task may have finished before we started waiting, or in another
+	// process sharing the store
+	for {
+		transition, err := f.lastTransition(ctx, f.store.Q(), id)
+		if err != nil {
+			return "", err
+		}
+		if state := fsm.State(transition.ToState); f.isTerminal(state) {
+			return state, nil
+		}
+
+		select {
+		case state := <-waiter:
+			return state, nil
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (f *childMachineFSM) SubmitAndWait(ctx context.Context, P0 int) (fsm.TaskID, fsm.State, error) {
+	id, err := f.Submit(ctx, P0)
+	if err != nil {
+		return 0, "", err
+	}
+	state, err := f.Wait(ctx, id)
+	return id, state, err
+}
+
+func (f *childMachineFSM) complete(ctx context.Context, id fsm.TaskID, state fsm.State) {
+	f.tasksLock.Lock()
+	waiters := f.waiters[id]
+	delete(f.waiters, id)
+	f.tasksLock.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- state
+	}
+	if f.onCompletion != nil {
+		f.onCompletion(ctx, id, state)
+	}
+}
+
+func (f *childMachineFSM) stopWaiting(id fsm.TaskID, waiter chan fsm.State) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	waiters := slices.DeleteFunc(f.waiters[id], func(w chan fsm.State) bool {
+		return w == waiter
+	})
+	if len(waiters) == 0 {
+		delete(f.waiters, id)
+	} else {
+		f.waiters[id] = waiters
+	}
+}
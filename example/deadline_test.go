@@ -0,0 +1,252 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+// buildApprovalMachine approves documents with a positive amount right away,
+// and leaves the rest waiting until their deadline moves them on.
+func buildApprovalMachine(t *testing.T, opts ...fsm.Option) example.ApprovalMachineFSM {
+	t.Helper()
+	f, err := example.NewApprovalMachineFSMBuilder().
+		FromAwait(func(ctx context.Context, transitions example.ApprovalMachineAwaitTransitions, doc string, amount int) error {
+			if amount > 0 {
+				return transitions.ToApproved(ctx, doc)
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		BuildAndStart(t.Context(), append([]fsm.Option{
+			fsm.WithLease(200 * time.Millisecond),
+			fsm.WithPollInterval(10 * time.Millisecond),
+		}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDeadline(t *testing.T) {
+	f := buildApprovalMachine(t,
+		fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+		fsm.WithDeadline(example.ApprovalMachineStateAwait, 100*time.Millisecond),
+	)
+
+	id, err := f.Submit(t.Context(), "doc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.DeadlineAt.IsZero() || status.DeadlineAt.Before(status.CreatedAt) {
+		t.Errorf("expected a deadline after %s, got %s", status.CreatedAt, status.DeadlineAt)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	state, err := f.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.ApprovalMachineStateExpired {
+		t.Fatalf("expected task to finish in %s, got %s", example.ApprovalMachineStateExpired, state)
+	}
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := history[len(history)-1]
+	if last.From != example.ApprovalMachineStateAwait || !last.Deadline {
+		t.Errorf("expected the deadline to move the task on from %s, got %+v", example.ApprovalMachineStateAwait, last)
+	}
+	if params, ok := last.Params.(example.ApprovalMachineExpiredParams); !ok || params.P0 != "doc" {
+		t.Errorf("expected the deadline to pass on the document, got %+v", last.Params)
+	}
+
+	// Tasks that move on in time never hit their deadline
+	id, state, err = f.SubmitAndWait(ctx, "doc", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.ApprovalMachineStateApproved {
+		t.Fatalf("expected task to finish in %s, got %s", example.ApprovalMachineStateApproved, state)
+	}
+	status, err = f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.DeadlineAt.IsZero() {
+		t.Errorf("expected no deadline once the task moved on, got %s", status.DeadlineAt)
+	}
+	history, err = f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range history {
+		if step.Deadline {
+			t.Errorf("expected no deadline steps, got %+v", step)
+		}
+	}
+}
+
+func TestDeadlineCancelsHandler(t *testing.T) {
+	cause := make(chan error, 1)
+	f, err := example.NewApprovalMachineFSMBuilder().
+		FromAwait(func(ctx context.Context, transitions example.ApprovalMachineAwaitTransitions, doc string, amount int) error {
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+			return ctx.Err()
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithDeadline(example.ApprovalMachineStateAwait, 100*time.Millisecond),
+			// Long enough that the handler isn't stopped by a lost lease
+			fsm.WithLease(time.Minute),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Submit(t.Context(), "doc", 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-cause:
+		if !errors.Is(err, fsm.ErrClaimLost) {
+			t.Fatalf("expected the handler to be cancelled with %v, got %v", fsm.ErrClaimLost, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the deadline to cancel the running handler")
+	}
+}
+
+func TestDeadlineSharedStore(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+
+	// Both processes poll for the same deadlines
+	var lock sync.Mutex
+	expired := make(map[fsm.TaskID]int)
+	start := func() example.ApprovalMachineFSM {
+		return buildApprovalMachine(t,
+			fsm.WithStore(store),
+			fsm.WithDeadline(example.ApprovalMachineStateAwait, 50*time.Millisecond),
+			fsm.WithTransitionListener(func(ctx context.Context, id fsm.TaskID, from, to fsm.State) {
+				if to == example.ApprovalMachineStateExpired {
+					lock.Lock()
+					defer lock.Unlock()
+					expired[id]++
+				}
+			}),
+		)
+	}
+	processes := []example.ApprovalMachineFSM{start(), start()}
+
+	ids := make([]fsm.TaskID, 0)
+	for i := range 10 {
+		id, err := processes[i%2].Submit(t.Context(), "doc", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if state, err := processes[(i+1)%2].Wait(ctx, id); err != nil {
+			t.Fatalf("wait for task %d: %s", id, err)
+		} else if state != example.ApprovalMachineStateExpired {
+			t.Fatalf("expected task %d to finish in %s, got %s", id, example.ApprovalMachineStateExpired, state)
+		}
+
+		history, err := processes[0].History(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadlines := 0
+		for _, step := range history {
+			if step.Deadline {
+				deadlines++
+			}
+		}
+		if deadlines != 1 {
+			t.Errorf("expected task %d's deadline to fire once, got %d", id, deadlines)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, id := range ids {
+		if expired[id] != 1 {
+			t.Errorf("expected one expiry of task %d, got %d", id, expired[id])
+		}
+	}
+}
+
+func TestDeadlinePaused(t *testing.T) {
+	f := buildApprovalMachine(t,
+		fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+		fsm.WithDeadline(example.ApprovalMachineStateAwait, 100*time.Millisecond),
+	)
+	if err := f.Pause(t.Context(), example.ApprovalMachineStateAwait); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), "doc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if status, err := f.Status(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if status.State != example.ApprovalMachineStateAwait {
+		t.Fatalf("expected the deadline to wait while %s is paused, got %s", example.ApprovalMachineStateAwait, status.State)
+	}
+
+	if err := f.Resume(t.Context(), example.ApprovalMachineStateAwait); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if state, err := f.Wait(ctx, id); err != nil {
+		t.Fatal(err)
+	} else if state != example.ApprovalMachineStateExpired {
+		t.Fatalf("expected task to finish in %s, got %s", example.ApprovalMachineStateExpired, state)
+	}
+}
+
+func TestDeadlineUnknownState(t *testing.T) {
+	for _, state := range []fsm.State{"Missing", example.ApprovalMachineStateApproved} {
+		if _, err := example.NewApprovalMachineFSMBuilder().
+			FromAwait(func(ctx context.Context, transitions example.ApprovalMachineAwaitTransitions, doc string, amount int) error {
+				return transitions.ToApproved(ctx, doc)
+			}).
+			BuildAndStart(t.Context(), fsm.WithDeadline(state, time.Second)); err == nil {
+			t.Errorf("expected an error for a deadline on %s", state)
+		}
+	}
+
+	// FSMs without deadlines reject them for every state
+	if _, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithDeadline(example.TestMachineStateState1, time.Second)); err == nil {
+		t.Errorf("expected an error for a deadline on %s", example.TestMachineStateState1)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -79,3 +80,299 @@ func TestMultistepFSM(t *testing.T) {
 		}
 	}
 }
+
+func TestCancel(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	started := make(chan fsm.TaskID, 1)
+	causes := make(chan error, 1)
+	completions := make(chan fsm.State, 1)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			started <- fsm.GetTaskID(ctx)
+			<-ctx.Done()
+			causes <- context.Cause(ctx)
+			return ctx.Err()
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(ctx,
+			fsm.WithStore(store),
+			fsm.WithCompletionListener(func(ctx context.Context, id fsm.TaskID, state fsm.State) {
+				completions <- state
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for handler to start")
+	}
+
+	if err := f.Cancel(t.Context(), id, "no longer needed"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cause := <-causes:
+		if !errors.Is(cause, fsm.ErrTaskCancelled) {
+			t.Fatalf("expected handler context to be cancelled with %v, got %v", fsm.ErrTaskCancelled, cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for handler to be cancelled")
+	}
+
+	select {
+	case state := <-completions:
+		if state != fsm.StateCancelled {
+			t.Fatalf("expected completion in state %s, got %s", fsm.StateCancelled, state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for completion")
+	}
+
+	if err := f.Cancel(t.Context(), id, "again"); !errors.Is(err, fsm.ErrTaskFinished) {
+		t.Fatalf("expected %v when cancelling twice, got %v", fsm.ErrTaskFinished, err)
+	}
+	if err := f.Cancel(t.Context(), id+100, "missing"); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Fatalf("expected %v for unknown task, got %v", fsm.ErrTaskNotFound, err)
+	}
+
+	// Restart against the same store, and make sure the task isn't resumed
+	cancel()
+
+	_, err = example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			started <- fsm.GetTaskID(ctx)
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-started:
+		t.Fatalf("cancelled task %d was resumed", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStatusAndHistory(t *testing.T) {
+	release := make(chan struct{})
+	completions := make(chan fsm.TaskID, 1)
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			if fsm.GetAttempt(ctx) == 0 {
+				return errors.New("first attempt")
+			}
+			return transitions.ToState2(ctx, c*2)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			<-release
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithBackoff(fsm.LinearBackoff(time.Millisecond, time.Millisecond)),
+			fsm.WithCompletionListener(func(ctx context.Context, id fsm.TaskID, state fsm.State) {
+				completions <- id
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the task to reach State2, where it blocks until released
+	deadline := time.After(time.Second)
+	for {
+		status, err := f.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == example.TestMachineStateState2 {
+			if status.Params != (example.TestMachineState2Params{P0: 42}) {
+				t.Fatalf("unexpected params: %#v", status.Params)
+			}
+			if status.Terminal {
+				t.Fatal("expected task to be in progress")
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timeout waiting for State2, status = %+v", status)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	close(release)
+	select {
+	case <-completions:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for completion")
+	}
+
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != example.TestMachineStateDone || !status.Terminal {
+		t.Fatalf("expected terminal state %s, got %+v", example.TestMachineStateDone, status)
+	}
+	if status.CreatedAt.IsZero() || status.UpdatedAt.Before(status.CreatedAt) {
+		t.Fatalf("unexpected timestamps: %+v", status)
+	}
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []fsm.Step{
+		{To: example.TestMachineStateState1, Params: example.TestMachineState1Params{P0: 21}},
+		{From: example.TestMachineStateState1, To: fsm.StateError, Attempt: 1, Error: "first attempt"},
+		{From: example.TestMachineStateState1, To: example.TestMachineStateState2, Attempt: 1, Params: example.TestMachineState2Params{P0: 42}},
+		{From: example.TestMachineStateState2, To: example.TestMachineStateDone, Params: example.TestMachineDoneParams{}},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d steps, got %+v", len(expected), history)
+	}
+	for i, step := range history {
+		if step.To == fsm.StateError && step.NextAttemptAt.IsZero() {
+			t.Errorf("step %d: expected the next attempt to be recorded, got %+v", i, step)
+		}
+		step.CreatedAt, step.NextAttemptAt = time.Time{}, time.Time{}
+		if step != expected[i] {
+			t.Errorf("step %d: expected %+v, got %+v", i, expected[i], step)
+		}
+	}
+
+	if _, err := f.Status(t.Context(), id+100); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Fatalf("expected %v for unknown task, got %v", fsm.ErrTaskNotFound, err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			if c == 0 {
+				started <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(ctx, fsm.WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for a task to complete
+	id, state, err := f.SubmitAndWait(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+
+	// Wait for a task that has already completed
+	if state, err := f.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+
+	// Give up waiting for a task that doesn't finish
+	blocked, err := f.Submit(t.Context(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	timeout, stop := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer stop()
+	if _, err := f.Wait(timeout, blocked); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Wait for the blocked task after a restart
+	cancel()
+
+	f, err = example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			<-release
+			return transitions.ToDone(ctx)
+		}).
+		// The first instance may still be handing its lease back
+		BuildAndStart(t.Context(), fsm.WithStore(store), fsm.WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan fsm.State, 1)
+	go func() {
+		state, err := f.Wait(t.Context(), blocked)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- state
+	}()
+	close(release)
+
+	select {
+	case state := <-done:
+		if state != example.TestMachineStateDone {
+			t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for resumed task")
+	}
+
+	// Waiting on a cancelled task reports the cancellation
+	cancelled, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Cancel(t.Context(), cancelled, "test"); err != nil && !errors.Is(err, fsm.ErrTaskFinished) {
+		t.Fatal(err)
+	}
+	if state, err := f.Wait(t.Context(), cancelled); err != nil {
+		t.Fatal(err)
+	} else if state != fsm.StateCancelled && state != example.TestMachineStateDone {
+		t.Fatalf("unexpected state %s", state)
+	}
+}
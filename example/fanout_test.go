@@ -0,0 +1,225 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func buildFanoutMachine(t *testing.T, ctx context.Context, store func() (fsm.Store, error), square func(ctx context.Context, c int) error) example.FanoutMachineFSM {
+	t.Helper()
+	f, err := example.NewFanoutMachineFSMBuilder().
+		FromSquare(func(ctx context.Context, transitions example.FanoutMachineSquareTransitions, c int) error {
+			if err := square(ctx, c); err != nil {
+				return err
+			}
+			return transitions.ToSum(ctx, c*c)
+		}).
+		FromSum(func(ctx context.Context, transitions example.FanoutMachineSumTransitions, squares []int) error {
+			sum := 0
+			for _, s := range squares {
+				sum += s
+			}
+			return transitions.ToDone(ctx, sum)
+		}).
+		BuildAndStart(ctx, fsm.WithStore(store), fsm.WithPollInterval(10*time.Millisecond), fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFanout(t *testing.T) {
+	f := buildFanoutMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db")), func(ctx context.Context, c int) error {
+		// Finish the branches in reverse order
+		time.Sleep(time.Duration(10-c) * 10 * time.Millisecond)
+		return nil
+	})
+
+	for _, tc := range []struct {
+		inputs  []int
+		squares []int
+		sum     int
+	}{
+		{[]int{1, 2, 3, 4}, []int{1, 4, 9, 16}, 30},
+		{nil, nil, 0},
+	} {
+		id, state, err := f.SubmitAndWait(t.Context(), tc.inputs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != example.FanoutMachineStateDone {
+			t.Fatalf("expected %s, got %s", example.FanoutMachineStateDone, state)
+		}
+		history, err := f.History(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every branch starts from the fan-out, and the join collects
+		// their outputs in branch order
+		var branches int
+		var squares []int
+		for _, step := range history {
+			switch step.To {
+			case example.FanoutMachineStateSquare:
+				branches++
+			case example.FanoutMachineStateSum:
+				squares = step.Params.(example.FanoutMachineSumParams).P0
+			}
+		}
+		if branches != len(tc.inputs) {
+			t.Fatalf("expected %d branches, got %d", len(tc.inputs), branches)
+		}
+		if !slices.Equal(squares, tc.squares) {
+			t.Fatalf("expected the join to collect %v, got %v", tc.squares, squares)
+		}
+		if result := history[len(history)-1].Params.(example.FanoutMachineDoneParams).P0; result != tc.sum {
+			t.Fatalf("expected %d, got %d", tc.sum, result)
+		}
+	}
+}
+
+func TestFanoutJoinAny(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	moved := make(chan error, 1)
+	var checked atomic.Bool
+	f, err := example.NewRaceMachineFSMBuilder().
+		FromFast(func(ctx context.Context, transitions example.RaceMachineFastTransitions, s string) error {
+			<-started
+			return transitions.ToFirst(ctx, "fast "+s)
+		}).
+		FromSlow(func(ctx context.Context, transitions example.RaceMachineSlowTransitions, s string) error {
+			close(started)
+			<-release
+			err := transitions.ToCheck(ctx, s)
+			moved <- err
+			return err
+		}).
+		FromCheck(func(ctx context.Context, transitions example.RaceMachineCheckTransitions, s string) error {
+			checked.Store(true)
+			return transitions.ToFirst(ctx, "slow "+s)
+		}).
+		FromFirst(func(ctx context.Context, transitions example.RaceMachineFirstTransitions, results []string) error {
+			return transitions.ToDone(ctx, results[0])
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))), fsm.WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, state, err := f.SubmitAndWait(t.Context(), "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.RaceMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.RaceMachineStateDone, state)
+	}
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := status.Params.(example.RaceMachineDoneParams).P0; result != "fast task" {
+		t.Fatalf("expected the fast branch to win, got %q", result)
+	}
+
+	// The slow branch was abandoned by the join, so it doesn't go on
+	close(release)
+	if err := <-moved; !errors.Is(err, fsm.ErrClaimLost) {
+		t.Fatalf("expected %v, got %v", fsm.ErrClaimLost, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if checked.Load() {
+		t.Fatal("expected the abandoned branch to stop")
+	}
+
+	// The task stays finished
+	status, err = f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != example.RaceMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.RaceMachineStateDone, status.State)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	if state, err := f.Wait(ctx, id); err != nil || state != example.RaceMachineStateDone {
+		t.Fatalf("expected %s, got %s (%v)", example.RaceMachineStateDone, state, err)
+	}
+	if err := f.Cancel(t.Context(), id, "late"); !errors.Is(err, fsm.ErrTaskFinished) {
+		t.Fatalf("expected %v, got %v", fsm.ErrTaskFinished, err)
+	}
+}
+
+func TestFanoutResume(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	blocked := make(chan struct{}, 1)
+
+	// Crash while one branch has finished and another is running
+	ctx, crash := context.WithCancel(t.Context())
+	defer crash()
+	f := buildFanoutMachine(t, ctx, store, func(ctx context.Context, c int) error {
+		if c == 2 {
+			blocked <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	id, err := f.Submit(t.Context(), []int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-blocked
+	time.Sleep(50 * time.Millisecond)
+	crash()
+
+	// The restarted instance runs the remaining branch, and joins both
+	f = buildFanoutMachine(t, t.Context(), store, func(ctx context.Context, c int) error {
+		return nil
+	})
+	if state, err := f.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != example.FanoutMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.FanoutMachineStateDone, state)
+	}
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := status.Params.(example.FanoutMachineDoneParams).P0; result != 5 {
+		t.Fatalf("expected 5, got %d", result)
+	}
+}
+
+func TestJoinConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config   fsm.JoinConfig
+		branches int
+		needed   int
+	}{
+		{fsm.JoinConfig{}, 3, 3},
+		{fsm.JoinConfig{Mode: fsm.JoinAll}, 3, 3},
+		{fsm.JoinConfig{Mode: fsm.JoinAny}, 3, 1},
+		{fsm.JoinConfig{Mode: fsm.JoinAny}, 0, 0},
+		{fsm.JoinConfig{Mode: fsm.JoinQuorum, Quorum: 2}, 3, 2},
+		{fsm.JoinConfig{Mode: fsm.JoinQuorum, Quorum: 5}, 3, 3},
+	} {
+		if err := tc.config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if needed := tc.config.Needed(tc.branches); needed != tc.needed {
+			t.Fatalf("expected %+v to need %d of %d branches, got %d", tc.config, tc.needed, tc.branches, needed)
+		}
+	}
+	if err := (fsm.JoinConfig{Mode: fsm.JoinQuorum}).Validate(); err == nil {
+		t.Fatal("expected a quorum join without a quorum to be invalid")
+	}
+}
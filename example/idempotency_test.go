@@ -0,0 +1,83 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestIdempotentSubmit(t *testing.T) {
+	var runs atomic.Int32
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			runs.Add(1)
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent retries of the same submission all get the same task
+	ctx := fsm.PutIdempotencyKey(t.Context(), "order-1")
+	ids := make([]fsm.TaskID, 10)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := f.Submit(ctx, 1)
+			if err != nil {
+				t.Error(err)
+			}
+			ids[i] = id
+		}()
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("expected every submission to return task %d, got %v", ids[0], ids)
+		}
+	}
+
+	if _, err := f.Submit(ctx, 2); !errors.Is(err, fsm.ErrIdempotencyConflict) {
+		t.Fatalf("expected %v, got %v", fsm.ErrIdempotencyConflict, err)
+	}
+
+	// Submissions without a key, or with another key, create new tasks
+	other, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyed, err := f.Submit(fsm.PutIdempotencyKey(t.Context(), "order-2"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == ids[0] || keyed == ids[0] || other == keyed {
+		t.Fatalf("expected distinct tasks, got %d, %d and %d", ids[0], other, keyed)
+	}
+
+	for _, id := range []fsm.TaskID{ids[0], other, keyed} {
+		if _, err := f.Wait(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runs.Load(); n != 3 {
+		t.Fatalf("expected 3 tasks to run, got %d", n)
+	}
+
+	// The key still resolves once the task has finished
+	if id, err := f.Submit(ctx, 1); err != nil {
+		t.Fatal(err)
+	} else if id != ids[0] {
+		t.Fatalf("expected task %d, got %d", ids[0], id)
+	}
+}
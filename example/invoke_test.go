@@ -0,0 +1,216 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func buildChildMachine(t *testing.T, ctx context.Context, work func(ctx context.Context, transitions example.ChildMachineWorkTransitions, c int) error) example.ChildMachineFSM {
+	t.Helper()
+	child, err := example.NewChildMachineFSMBuilder().
+		FromWork(work).
+		BuildAndStart(ctx, fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "child.db"))), fsm.WithPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return child
+}
+
+func buildParentMachine(t *testing.T, ctx context.Context, store func() (fsm.Store, error), child example.ChildMachineFSM) example.ParentMachineFSM {
+	t.Helper()
+	parent, err := example.NewParentMachineFSMBuilder().
+		FromStart(child).
+		FromNext(func(ctx context.Context, transitions example.ParentMachineNextTransitions, c int) error {
+			return transitions.ToDone(ctx, c+1)
+		}).
+		BuildAndStart(ctx, fsm.WithStore(store), fsm.WithPollInterval(10*time.Millisecond), fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parent
+}
+
+func TestInvoke(t *testing.T) {
+	child := buildChildMachine(t, t.Context(), func(ctx context.Context, transitions example.ChildMachineWorkTransitions, c int) error {
+		if c < 0 {
+			return transitions.ToFailed(ctx, "negative")
+		}
+		return transitions.ToDone(ctx, c*2)
+	})
+	parent := buildParentMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "parent.db")), child)
+
+	for _, tc := range []struct {
+		input  int
+		state  fsm.State
+		params any
+	}{
+		{3, example.ParentMachineStateDone, example.ParentMachineDoneParams{P0: 7}},
+		{-1, example.ParentMachineStateFailed, example.ParentMachineFailedParams{P0: "negative"}},
+	} {
+		id, state, err := parent.SubmitAndWait(t.Context(), tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != tc.state {
+			t.Fatalf("expected %d to finish in %s, got %s", tc.input, tc.state, state)
+		}
+		status, err := parent.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Params != tc.params {
+			t.Fatalf("expected %d to finish with %+v, got %+v", tc.input, tc.params, status.Params)
+		}
+	}
+}
+
+func TestInvokeCancel(t *testing.T) {
+	started := make(chan fsm.TaskID, 1)
+	child := buildChildMachine(t, t.Context(), func(ctx context.Context, transitions example.ChildMachineWorkTransitions, c int) error {
+		started <- fsm.GetTaskID(ctx)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	parent := buildParentMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "parent.db")), child)
+
+	id, err := parent.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childID := <-started
+	if err := parent.Cancel(t.Context(), id, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := child.Wait(t.Context(), childID); err != nil {
+		t.Fatal(err)
+	} else if state != fsm.StateCancelled {
+		t.Fatalf("expected child to be cancelled, got %s", state)
+	}
+
+	// Cancelling a child cancels the parent too
+	id, err = parent.Submit(t.Context(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Cancel(t.Context(), <-started, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := parent.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != fsm.StateCancelled {
+		t.Fatalf("expected parent to be cancelled, got %s", state)
+	}
+}
+
+func TestInvokeResume(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	child := buildChildMachine(t, t.Context(), func(ctx context.Context, transitions example.ChildMachineWorkTransitions, c int) error {
+		calls.Add(1)
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return transitions.ToDone(ctx, c*2)
+	})
+
+	// Crash the parent while its child is running
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "parent.db"))
+	ctx, crash := context.WithCancel(t.Context())
+	defer crash()
+	parent := buildParentMachine(t, ctx, store, child)
+	id, err := parent.Submit(t.Context(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	crash()
+
+	// The restarted parent waits on the same child instead of starting another
+	parent = buildParentMachine(t, t.Context(), store, child)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if state, err := parent.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != example.ParentMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.ParentMachineStateDone, state)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected the child to run once, got %d", n)
+	}
+	if _, err := child.Status(t.Context(), 2); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Fatalf("expected a single child task, got %v", err)
+	}
+}
+
+func TestInvokeParked(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	child := buildChildMachine(t, t.Context(), func(ctx context.Context, transitions example.ChildMachineWorkTransitions, c int) error {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return transitions.ToDone(ctx, c*2)
+	})
+
+	path := filepath.Join(t.TempDir(), "parent.db")
+	ctx, crash := context.WithCancel(t.Context())
+	defer crash()
+	parent := buildParentMachine(t, ctx, fsm.OnDisk(path), child)
+	id, err := parent.Submit(t.Context(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	// The parent's step doesn't hold a lease while its child runs
+	store, err := fsm.OnDisk(path)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		var leased bool
+		if err := store.DB().QueryRowContext(t.Context(), "SELECT lease_owner IS NOT NULL FROM queue_items WHERE task_id = ?", id).Scan(&leased); err != nil {
+			t.Fatal(err)
+		}
+		if !leased {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the parent's step to be parked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, err := parent.Status(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if !status.ScheduledAt.IsZero() {
+		t.Fatalf("expected a parked step not to be scheduled, got %s", status.ScheduledAt)
+	}
+
+	// A restarted parent is woken by the child instead of waiting out its
+	// lease TTL
+	crash()
+	parent = buildParentMachine(t, t.Context(), fsm.OnDisk(path), child)
+	close(release)
+	wait, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if state, err := parent.Wait(wait, id); err != nil {
+		t.Fatal(err)
+	} else if state != example.ParentMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.ParentMachineStateDone, state)
+	}
+}
@@ -0,0 +1,111 @@
+package example_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestSharedStore(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	opts := []fsm.Option{
+		fsm.WithStore(store),
+		fsm.WithLease(time.Second),
+		fsm.WithPollInterval(50 * time.Millisecond),
+	}
+
+	// A process that hangs while running a step, so its lease expires
+	hung := make(chan struct{})
+	defer close(hung)
+	ctx, kill := context.WithCancel(t.Context())
+	defer kill()
+
+	dead, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			hung <- struct{}{}
+			<-hung
+			return nil
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranded, err := dead.Submit(t.Context(), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-hung
+	kill()
+
+	// Two healthy processes sharing the store, recording who ran what
+	var lock sync.Mutex
+	calls := make(map[fsm.TaskID][]string)
+	record := func(ctx context.Context, process string) {
+		lock.Lock()
+		defer lock.Unlock()
+		id := fsm.GetTaskID(ctx)
+		calls[id] = append(calls[id], process)
+	}
+	start := func(process string) example.TestMachineFSM {
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				record(ctx, process)
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				record(ctx, process)
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	processes := []example.TestMachineFSM{start("a"), start("b")}
+
+	ids := []fsm.TaskID{stranded}
+	for i := range 20 {
+		id, err := processes[i%2].Submit(t.Context(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for i, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		// Wait from the other process than the one that submitted
+		if state, err := processes[(i+1)%2].Wait(ctx, id); err != nil {
+			t.Fatalf("wait for task %d: %s", id, err)
+		} else if state != example.TestMachineStateDone {
+			t.Fatalf("expected task %d to finish in %s, got %s", id, example.TestMachineStateDone, state)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	ran := make(map[string]int)
+	// Including the stranded task, whose State1 lease expired in the hung process
+	for _, id := range ids {
+		if len(calls[id]) != 2 {
+			t.Errorf("expected task %d to run each step once, got %v", id, calls[id])
+		}
+		for _, process := range calls[id] {
+			ran[process]++
+		}
+	}
+	if ran["a"] == 0 || ran["b"] == 0 {
+		t.Errorf("expected both processes to run steps, got %v", ran)
+	}
+}
@@ -0,0 +1,137 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+// buildMetadataMachine records the metadata and request ID each of its
+// handlers sees, carrying request IDs through task metadata.
+func buildMetadataMachine(t *testing.T, ctx context.Context, store func() (fsm.Store, error), seen func(state fsm.State, metadata map[string]string, request any)) example.TestMachineFSM {
+	t.Helper()
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			seen(example.TestMachineStateState1, fsm.GetMetadata(ctx), ctx.Value(requestKey{}))
+			if fsm.GetAttempt(ctx) == 0 {
+				return errors.New("first attempt")
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			seen(example.TestMachineStateState2, fsm.GetMetadata(ctx), ctx.Value(requestKey{}))
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(ctx,
+			fsm.WithStore(store),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+			fsm.WithMetadataExtractor(func(ctx context.Context) map[string]string {
+				if request, ok := ctx.Value(requestKey{}).(string); ok {
+					return map[string]string{"request": request}
+				}
+				return nil
+			}),
+			fsm.WithMetadataInjector(func(ctx context.Context, metadata map[string]string) context.Context {
+				if request, ok := metadata["request"]; ok {
+					return context.WithValue(ctx, requestKey{}, request)
+				}
+				return ctx
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestMetadata(t *testing.T) {
+	var lock sync.Mutex
+	var steps int
+	f := buildMetadataMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db")), func(state fsm.State, metadata map[string]string, request any) {
+		lock.Lock()
+		defer lock.Unlock()
+		steps++
+		if metadata["tenant"] != "acme" || metadata["request"] != "req-1" || request != "req-1" {
+			t.Errorf("expected the submission's metadata in %s, got %v and request %v", state, metadata, request)
+		}
+	})
+
+	ctx := context.WithValue(t.Context(), requestKey{}, "req-1")
+	ctx = fsm.PutMetadata(ctx, map[string]string{"tenant": "acme"})
+	id, err := f.Submit(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	// Both attempts of State1 and State2 see it
+	lock.Lock()
+	if steps != 3 {
+		t.Errorf("expected 3 steps, got %d", steps)
+	}
+	lock.Unlock()
+
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"tenant": "acme", "request": "req-1"}; !maps.Equal(status.Metadata, expected) {
+		t.Errorf("expected metadata %v, got %v", expected, status.Metadata)
+	}
+
+	// Tasks submitted without any have none
+	if err := f.Pause(t.Context(), example.TestMachineStateState1); err != nil {
+		t.Fatal(err)
+	}
+	id, err = f.Submit(t.Context(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Metadata != nil {
+		t.Errorf("expected no metadata, got %v", status.Metadata)
+	}
+}
+
+func TestMetadataAfterRestart(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	requests := make(chan any, 3)
+	seen := func(state fsm.State, metadata map[string]string, request any) {
+		requests <- request
+	}
+
+	ctx, stop := context.WithCancel(t.Context())
+	defer stop()
+	f := buildMetadataMachine(t, ctx, store, seen)
+	if err := f.PauseAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	id, err := f.Submit(context.WithValue(t.Context(), requestKey{}, "req-2"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new process restores the metadata from the store
+	stop()
+	f = buildMetadataMachine(t, t.Context(), store, seen)
+	if err := f.ResumeAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+	for range 3 {
+		if request := <-requests; request != "req-2" {
+			t.Fatalf("expected the request ID after a restart, got %v", request)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package example_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+type requestKey struct{}
+
+func TestMiddleware(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	trace := func(name string) fsm.Middleware {
+		return func(ctx context.Context, machine string, state fsm.State, id fsm.TaskID, attempt int, next func(ctx context.Context) error) error {
+			lock.Lock()
+			calls = append(calls, fmt.Sprintf("%s %s.%s %d/%d", name, machine, state, id, attempt))
+			lock.Unlock()
+			return next(context.WithValue(ctx, requestKey{}, name))
+		}
+	}
+
+	var requests []any
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			lock.Lock()
+			requests = append(requests, ctx.Value(requestKey{}))
+			lock.Unlock()
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			lock.Lock()
+			requests = append(requests, ctx.Value(requestKey{}))
+			lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithMiddleware(trace("outer")),
+			fsm.WithMiddleware(trace("inner"), example.TestMachineStateState2),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := []string{
+		fmt.Sprintf("outer TestMachine.State1 %d/0", id),
+		fmt.Sprintf("outer TestMachine.State2 %d/0", id),
+		fmt.Sprintf("inner TestMachine.State2 %d/0", id),
+	}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("expected calls %q, got %q", expected, calls)
+	}
+
+	// Handlers see the context of the innermost middleware wrapping them
+	if !slices.Equal(requests, []any{"outer", "inner"}) {
+		t.Errorf("expected handler contexts from the middlewares, got %v", requests)
+	}
+}
+
+func TestMiddlewareRecover(t *testing.T) {
+	recovered := func(ctx context.Context, machine string, state fsm.State, id fsm.TaskID, attempt int, next func(ctx context.Context) error) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return next(ctx)
+	}
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			if fsm.GetAttempt(ctx) == 0 {
+				panic("first attempt")
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+			fsm.WithMiddleware(recovered),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The panic fails the step like an error, and the retry goes through
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, f, id)
+
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.IndexFunc(history, func(step fsm.Step) bool { return step.To == fsm.StateError }); i < 0 || history[i].Error != "panic: first attempt" {
+		t.Errorf("expected the recovered panic in the history, got %+v", history)
+	}
+}
@@ -0,0 +1,2006 @@
+// Generated by fsmgen. DO NOT EDIT.
+package example
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	fsm "github.com/egoodhall/fsm"
+	sqlc "github.com/egoodhall/fsm/gen/sqlc"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ParentMachineStateStart  fsm.State = "Start"
+	ParentMachineStateNext   fsm.State = "Next"
+	ParentMachineStateDone   fsm.State = "Done"
+	ParentMachineStateFailed fsm.State = "Failed"
+)
+
+type ParentMachineFSM interface {
+	fsm.SupportsOptions
+	Submit(ctx context.Context, int int) (fsm.TaskID, error)
+	TrySubmit(ctx context.Context, int int) (fsm.TaskID, error)
+	SubmitAt(ctx context.Context, at time.Time, int int) (fsm.TaskID, error)
+	SubmitAfter(ctx context.Context, delay time.Duration, int int) (fsm.TaskID, error)
+	SubmitBatch(ctx context.Context, inputs []ParentMachineStartParams) ([]fsm.TaskID, error)
+	SubmitSeq(ctx context.Context, inputs iter.Seq[ParentMachineStartParams]) ([]fsm.TaskID, error)
+	SubmitAndWait(ctx context.Context, int int) (fsm.TaskID, fsm.State, error)
+	Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error)
+	Cancel(ctx context.Context, id fsm.TaskID, reason string) error
+	Pause(ctx context.Context, state fsm.State) error
+	Resume(ctx context.Context, state fsm.State) error
+	PauseAll(ctx context.Context) error
+	ResumeAll(ctx context.Context) error
+	Paused(ctx context.Context, state fsm.State) (bool, error)
+	RetryNow(ctx context.Context, id fsm.TaskID, operator string) error
+	ForceStart(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceNext(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceDone(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceFailed(ctx context.Context, id fsm.TaskID, operator string, P0 string) error
+	Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error
+	Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error)
+	History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error)
+}
+
+type ParentMachineStartParams struct {
+	P0 int
+}
+
+type ParentMachineNextParams struct {
+	P0 int
+}
+
+type ParentMachineDoneParams struct {
+	P0 int
+}
+
+type ParentMachineFailedParams struct {
+	P0 string
+}
+
+func NewParentMachineFSMBuilder() ParentMachineFSMBuilder_StartStage {
+	return new(parentMachineFSM)
+}
+
+type ParentMachineStartTransitions interface {
+	ToNext(context.Context, int) error
+	ToNextAt(context.Context, time.Time, int) error
+	ToNextAfter(context.Context, time.Duration, int) error
+	ToFailed(context.Context, string) error
+	ToFailedAt(context.Context, time.Time, string) error
+	ToFailedAfter(context.Context, time.Duration, string) error
+}
+
+type ParentMachineNextTransitions interface {
+	ToDone(context.Context, int) error
+	ToDoneAt(context.Context, time.Time, int) error
+	ToDoneAfter(context.Context, time.Duration, int) error
+}
+
+type ParentMachineFSMBuilder_StartStage interface {
+	FromStart(ChildMachineFSM) ParentMachineFSMBuilder_NextStage
+}
+
+type ParentMachineFSMBuilder_NextStage interface {
+	FromNext(func(context.Context, ParentMachineNextTransitions, int) error) ParentMachineFSMBuilder__FinalStage
+}
+
+type ParentMachineFSMBuilder_DoneStage interface {
+	FromDone(func(context.Context, int) error) ParentMachineFSMBuilder__FinalStage
+}
+
+type ParentMachineFSMBuilder_FailedStage interface {
+	FromFailed(func(context.Context, string) error) ParentMachineFSMBuilder__FinalStage
+}
+
+type ParentMachineFSMBuilder__FinalStage interface {
+	BuildAndStart(context.Context, ...fsm.Option) (ParentMachineFSM, error)
+}
+
+// FSM type checks
+var _ ParentMachineFSM = new(parentMachineFSM)
+var _ fsm.SupportsOptions = new(parentMachineFSM)
+var _ ParentMachineFSMBuilder_StartStage = new(parentMachineFSM)
+var _ ParentMachineFSMBuilder_NextStage = new(parentMachineFSM)
+var _ ParentMachineFSMBuilder__FinalStage = new(parentMachineFSM)
+var _ ParentMachineStartTransitions = new(parentMachineFSM)
+var _ ParentMachineNextTransitions = new(parentMachineFSM)
+
+// ParentMachineFSM implementation
+type parentMachineFSM_StartParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+type parentMachineFSM_NextParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+type parentMachineFSM_DoneParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+type parentMachineFSM_FailedParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      string
+}
+
+type parentMachineFSM struct {
+	lock sync.Mutex
+	ctx  context.Context
+
+	// Configuration options
+	store         fsm.Store
+	onTransition  fsm.TransitionListener
+	onCompletion  fsm.CompletionListener
+	onRateLimit   fsm.RateLimitListener
+	onBreaker     fsm.BreakerListener
+	middlewares   []fsm.Middleware
+	extractors    []fsm.MetadataExtractor
+	injectors     []fsm.MetadataInjector
+	backoff       fsm.Backoff
+	leaseTTL      time.Duration
+	pollInterval  time.Duration
+	aging         time.Duration
+	batchSize     int
+	namespace     string
+	adoptUnscoped func(fsm.TaskID) bool
+
+	// FSM state transitions
+	startState func(context.Context, ParentMachineStartTransitions, int) error
+	nextState  func(context.Context, ParentMachineNextTransitions, int) error
+
+	// FSMs invoked by states
+	startChild ChildMachineFSM
+
+	// FSM state queues, rate limits, circuit breakers and backoffs
+	startQueue   fsm.QueueConfig
+	startLimiter *fsm.Limiter
+	startBreaker *fsm.Breaker
+	startBackoff fsm.Backoff
+	nextQueue    fsm.QueueConfig
+	nextLimiter  *fsm.Limiter
+	nextBreaker  *fsm.Breaker
+	nextBackoff  fsm.Backoff
+
+	// FSM queue signals, and the owner of this instance's leases
+	startReady  chan struct{}
+	nextReady   chan struct{}
+	doneReady   chan struct{}
+	failedReady chan struct{}
+	owner       string
+	// Closed and replaced each time steps leave a queue, to wake blocked submissions
+	spaceLock sync.Mutex
+	space     chan struct{}
+
+	// Running tasks and their waiters
+	tasksLock sync.Mutex
+	// A task's next step can start before the handler that moved it there returns
+	running map[fsm.TaskID]map[context.Context]context.CancelCauseFunc
+	waiters map[fsm.TaskID][]chan fsm.State
+	// Parked steps watched until the task they invoked finishes
+	watching map[int64]struct{}
+}
+
+// FSM builder methods
+
+func (f *parentMachineFSM) FromStart(fn ChildMachineFSM) ParentMachineFSMBuilder_NextStage {
+	f.startChild = fn
+	f.startState = f.invokeStart
+	return f
+}
+
+func (f *parentMachineFSM) FromNext(fn func(context.Context, ParentMachineNextTransitions, int) error) ParentMachineFSMBuilder__FinalStage {
+	f.nextState = fn
+	return f
+}
+
+func (f *parentMachineFSM) BuildAndStart(ctx context.Context, opts ...fsm.Option) (ParentMachineFSM, error) {
+	// Check if FSM is already started
+	if !f.lock.TryLock() {
+		return nil, errors.New("FSM already started")
+	}
+
+	// Set context
+	f.ctx = ctx
+
+	// Initialize state queue signals
+	f.startReady = make(chan struct{}, 1)
+	f.nextReady = make(chan struct{}, 1)
+	f.doneReady = make(chan struct{}, 1)
+	f.failedReady = make(chan struct{}, 1)
+	f.owner = rand.Text()
+	f.space = make(chan struct{})
+
+	// Initialize task tracking
+	f.running = make(map[fsm.TaskID]map[context.Context]context.CancelCauseFunc)
+	f.waiters = make(map[fsm.TaskID][]chan fsm.State)
+	f.watching = make(map[int64]struct{})
+
+	// Initialize state queues, rate limits, circuit breakers and backoffs
+	// from the model, which options may override
+	f.startLimiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.startBreaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(ParentMachineStateStart))
+	f.nextLimiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.nextBreaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(ParentMachineStateNext))
+
+	// Apply options
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return nil, err
+		}
+	}
+	if f.store == nil {
+		if store, err := fsm.InMemory()(); err != nil {
+			return nil, err
+		} else {
+			f.store = store
+		}
+	}
+	if f.backoff == nil {
+		f.backoff = fsm.LinearBackoff(500*time.Millisecond, 30*time.Second)
+	}
+	if f.leaseTTL == 0 {
+		f.leaseTTL = 30 * time.Second
+	}
+	if f.pollInterval == 0 {
+		f.pollInterval = time.Second
+	}
+	if f.aging == 0 {
+		f.aging = time.Minute
+	}
+	if f.batchSize == 0 {
+		f.batchSize = 1000
+	}
+
+	// Adopt tasks stored before tasks were scoped to an FSM
+	if err := f.adoptTasks(f.ctx); err != nil {
+		return nil, err
+	}
+	// Resume tasks stored before their steps were queued in the store
+	if err := f.resumeTasks(f.ctx); err != nil {
+		return nil, err
+	}
+	// Watch the children of steps parked before a restart again
+	if err := f.watchParked(f.ctx); err != nil {
+		return nil, err
+	}
+
+	// Start FSM processors. Existing work, including steps whose lease
+	// expired in a process that died, is claimed from the store.
+	// Start 1 startProcessor
+	go f.startProcessor()
+	// Start 1 nextProcessor
+	go f.nextProcessor()
+	// Start 1 doneProcessor
+	go f.doneProcessor()
+	// Start 1 failedProcessor
+	go f.failedProcessor()
+	return f, nil
+}
+
+// adoptTasks scopes the tasks stored before tasks had an FSM, and their
+// concurrency locks, to this FSM and namespace. Only tasks that fit the FSM
+// are adopted, and only those WithUnscopedTasks accepts, since they can't
+// be told apart from other FSMs' tasks that fit too. Without the option, the
+// FSM doesn't start while tasks that fit it exist.
+func (f *parentMachineFSM) adoptTasks(ctx context.Context) error {
+	return f.store.Tx(ctx, func(q fsm.Q) error {
+		tasks, err := q.ListUnscopedTasks(ctx)
+		if err != nil {
+			return err
+		}
+		var fitting []sqlc.Task
+		for _, task := range tasks {
+			if ok, err := f.fits(ctx, q, task); err != nil {
+				return err
+			} else if ok {
+				fitting = append(fitting, task)
+			}
+		}
+		if len(fitting) == 0 {
+			return nil
+		}
+		if f.adoptUnscoped == nil {
+			return fmt.Errorf("%w: count = %d", fsm.ErrUnscopedTasks, len(fitting))
+		}
+
+		var n int
+		for _, task := range fitting {
+			if !f.adoptUnscoped(fsm.TaskID(task.ID)) {
+				continue
+			}
+			if err := q.AdoptUnscopedTask(ctx, "ParentMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			if err := q.AdoptUnscopedLocks(ctx, "ParentMachine", f.namespace, task.ID); err != nil {
+				return err
+			}
+			n++
+		}
+		fsm.Logger(ctx).Info("Adopted unscoped tasks", "count", n, "skipped", len(fitting)-n)
+		return nil
+	})
+}
+
+// fits reports whether an unscoped task could be one of this FSM's: its
+// input decodes as the entrypoint's, and it only went through the FSM's
+// states.
+func (f *parentMachineFSM) fits(ctx context.Context, q fsm.Q, task sqlc.Task) (bool, error) {
+	if _, err := f.decodeParams(ParentMachineStateStart, task.Data); err != nil {
+		return false, nil
+	}
+	history, err := q.GetHistory(ctx, task.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, step := range history {
+		for _, state := range []fsm.State{fsm.State(step.FromState), fsm.State(step.ToState)} {
+			switch state {
+			case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+				continue
+			}
+			if f.stateError(state) != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// resumeTasks queues the current step of tasks stored before steps were
+// queued in the store. Each task is only resumed once.
+func (f *parentMachineFSM) resumeTasks(ctx context.Context) error {
+	tasks, err := f.store.Q().ListUnqueuedTasks(ctx, "ParentMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		id := fsm.TaskID(task.ID)
+		var state fsm.State
+		now := time.Now()
+		if err := f.store.Tx(ctx, func(q fsm.Q) error {
+			if err := q.DeleteUnqueuedTask(ctx, task.ID); err != nil {
+				return err
+			}
+			transition, err := f.lastTransition(ctx, q, id)
+			if err != nil {
+				return err
+			}
+			state = fsm.State(transition.ToState)
+			if f.isTerminal(state) {
+				return nil
+			}
+			// Tasks that never transitioned start from their input
+			data := transition.Data
+			if transition.ID == 0 {
+				data = task.Data
+			}
+			if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+				TaskID:  task.ID,
+				State:   string(state),
+				Data:    data,
+				ReadyAt: now.UnixMilli(),
+			}); err != nil {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !f.isTerminal(state) {
+			fsm.Logger(ctx).Info("Resuming task", "id", id, "state", state)
+		}
+	}
+	return nil
+}
+
+// FSM options
+
+func (f *parentMachineFSM) WithStore(store fsm.Store) {
+	f.store = store
+}
+
+func (f *parentMachineFSM) WithContext(update func(context.Context) context.Context) {
+	f.ctx = update(f.ctx)
+}
+
+func (f *parentMachineFSM) WithTransitionListener(listener fsm.TransitionListener) {
+	f.onTransition = listener
+}
+
+func (f *parentMachineFSM) WithCompletionListener(listener fsm.CompletionListener) {
+	f.onCompletion = listener
+}
+
+func (f *parentMachineFSM) WithRateLimitListener(listener fsm.RateLimitListener) {
+	f.onRateLimit = listener
+}
+
+func (f *parentMachineFSM) WithBreakerListener(listener fsm.BreakerListener) {
+	f.onBreaker = listener
+}
+
+func (f *parentMachineFSM) WithMiddleware(middleware fsm.Middleware) {
+	f.middlewares = append(f.middlewares, middleware)
+}
+
+func (f *parentMachineFSM) WithMetadataExtractor(extractor fsm.MetadataExtractor) {
+	f.extractors = append(f.extractors, extractor)
+}
+
+func (f *parentMachineFSM) WithMetadataInjector(injector fsm.MetadataInjector) {
+	f.injectors = append(f.injectors, injector)
+}
+
+func (f *parentMachineFSM) WithBackoff(backoff fsm.Backoff) {
+	f.backoff = backoff
+}
+
+func (f *parentMachineFSM) WithStateBackoff(state fsm.State, backoff fsm.Backoff) error {
+	switch state {
+	case ParentMachineStateStart:
+		f.startBackoff = backoff
+	case ParentMachineStateNext:
+		f.nextBackoff = backoff
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a backoff", state)
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) WithQueue(state fsm.State, config fsm.QueueConfig) error {
+	switch state {
+	case ParentMachineStateStart:
+		f.startQueue = config
+	case ParentMachineStateNext:
+		f.nextQueue = config
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a queue", state)
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) WithLease(ttl time.Duration) {
+	f.leaseTTL = ttl
+}
+
+func (f *parentMachineFSM) WithPollInterval(interval time.Duration) {
+	f.pollInterval = interval
+}
+
+func (f *parentMachineFSM) WithPriorityAging(interval time.Duration) {
+	f.aging = interval
+}
+
+func (f *parentMachineFSM) WithBatchSize(size int) {
+	f.batchSize = size
+}
+
+func (f *parentMachineFSM) WithNamespace(namespace string) {
+	f.namespace = namespace
+}
+
+func (f *parentMachineFSM) WithUnscopedTasks(adopt func(fsm.TaskID) bool) {
+	f.adoptUnscoped = adopt
+}
+
+func (f *parentMachineFSM) WithRate(state fsm.State, rate fsm.Rate, burst int) error {
+	switch state {
+	case ParentMachineStateStart:
+		f.startLimiter.SetRate(rate, burst)
+	case ParentMachineStateNext:
+		f.nextLimiter.SetRate(rate, burst)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a rate limit", state)
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) WithBreaker(state fsm.State, config fsm.BreakerConfig) error {
+	switch state {
+	case ParentMachineStateStart:
+		f.startBreaker.SetConfig(config)
+	case ParentMachineStateNext:
+		f.nextBreaker.SetConfig(config)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a circuit breaker", state)
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) WithDeadline(state fsm.State, after time.Duration) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s can't have a deadline", state)
+}
+
+// FSM transition methods
+
+func (f *parentMachineFSM) ToStart(ctx context.Context, P0 int) error {
+	return f.ToStartAt(ctx, time.Now(), P0)
+}
+
+func (f *parentMachineFSM) ToStartAfter(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToStartAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *parentMachineFSM) ToStartAt(ctx context.Context, at time.Time, P0 int) error {
+	msg := parentMachineFSM_StartParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ParentMachineStateStart, buf.Bytes(), at)
+}
+
+func (f *parentMachineFSM) ToNext(ctx context.Context, P0 int) error {
+	return f.ToNextAt(ctx, time.Now(), P0)
+}
+
+func (f *parentMachineFSM) ToNextAfter(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToNextAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *parentMachineFSM) ToNextAt(ctx context.Context, at time.Time, P0 int) error {
+	msg := parentMachineFSM_NextParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ParentMachineStateNext, buf.Bytes(), at)
+}
+
+func (f *parentMachineFSM) ToDone(ctx context.Context, P0 int) error {
+	return f.ToDoneAt(ctx, time.Now(), P0)
+}
+
+func (f *parentMachineFSM) ToDoneAfter(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToDoneAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *parentMachineFSM) ToDoneAt(ctx context.Context, at time.Time, P0 int) error {
+	msg := parentMachineFSM_DoneParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ParentMachineStateDone, buf.Bytes(), at)
+}
+
+func (f *parentMachineFSM) ToFailed(ctx context.Context, P0 string) error {
+	return f.ToFailedAt(ctx, time.Now(), P0)
+}
+
+func (f *parentMachineFSM) ToFailedAfter(ctx context.Context, delay time.Duration, P0 string) error {
+	return f.ToFailedAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *parentMachineFSM) ToFailedAt(ctx context.Context, at time.Time, P0 string) error {
+	msg := parentMachineFSM_FailedParams{ID: fsm.GetTaskID(ctx), P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.transition(ctx, ParentMachineStateFailed, buf.Bytes(), at)
+}
+
+func (f *parentMachineFSM) startProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ParentMachineStateStart))
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.startBreaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, ParentMachineStateStart, f.startReady, f.startLimiter)
+		if !ok {
+			f.startBreaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.startLimiter, item, wait)
+
+		var msg parentMachineFSM_StartParams
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", ParentMachineStateStart, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.startBreaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", ParentMachineStateStart)
+			f.ack(ctx, item)
+			f.startBreaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", ParentMachineStateStart)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, ParentMachineStateStart, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.startState(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.startBreaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if errors.Is(err, fsm.ErrChildRunning) {
+			f.park(ctx, item)
+			continue
+		}
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
+	}
+}
+
+func (f *parentMachineFSM) nextProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ParentMachineStateNext))
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.nextBreaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, ParentMachineStateNext, f.nextReady, f.nextLimiter)
+		if !ok {
+			f.nextBreaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.nextLimiter, item, wait)
+
+		var msg parentMachineFSM_NextParams
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", ParentMachineStateNext, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.nextBreaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", ParentMachineStateNext)
+			f.ack(ctx, item)
+			f.nextBreaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", ParentMachineStateNext)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, ParentMachineStateNext, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.nextState(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.nextBreaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
+	}
+}
+
+func (f *parentMachineFSM) doneProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ParentMachineStateDone))
+	for {
+		item, _, ok := f.claim(ctx, ParentMachineStateDone, f.doneReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ParentMachineStateDone))
+	}
+}
+
+func (f *parentMachineFSM) failedProcessor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(ParentMachineStateFailed))
+	for {
+		item, _, ok := f.claim(ctx, ParentMachineStateFailed, f.failedReady, nil)
+		if !ok {
+			return
+		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(ParentMachineStateFailed))
+	}
+}
+
+func (f *parentMachineFSM) invokeStart(ctx context.Context, transitions ParentMachineStartTransitions, P0 int) error {
+	id := fsm.GetTaskID(ctx)
+	item, _ := fsm.GetQueueItem(ctx)
+
+	// The child is keyed by this step, so retries and rechecks of the step
+	// find the child they already started instead of starting another
+	key := fmt.Sprintf("ParentMachine/%s/Start/%d", f.namespace, item)
+	child, err := f.startChild.Submit(fsm.PutIdempotencyKey(ctx, key), P0)
+	if err != nil {
+		return err
+	}
+
+	// Links are recorded even if the task is being cancelled, so cancelling
+	// it can find the child
+	uninterrupted := context.WithoutCancel(ctx)
+	if err := f.store.Q().LinkChildTask(uninterrupted, int64(id), string(ParentMachineStateStart), int64(child)); err != nil {
+		return err
+	}
+	if f.isCancelled(uninterrupted, f.store.Q(), id) {
+		// The task was cancelled before the child was linked
+		return f.startChild.Cancel(uninterrupted, child, fmt.Sprintf("invoking ParentMachine task %d was cancelled", id))
+	}
+
+	status, err := f.startChild.Status(ctx, child)
+	if err != nil {
+		return err
+	}
+	if !status.Terminal {
+		// The step is parked instead of holding a worker while the child runs
+		f.watchTask(ParentMachineStateStart, item, func(ctx context.Context) error {
+			_, err := f.startChild.Wait(ctx, child)
+			return err
+		})
+		return fsm.ErrChildRunning
+	}
+	switch status.State {
+	case ChildMachineStateDone:
+		result := status.Params.(ChildMachineDoneParams)
+		return transitions.ToNext(ctx, result.P0)
+	case ChildMachineStateFailed:
+		result := status.Params.(ChildMachineFailedParams)
+		return transitions.ToFailed(ctx, result.P0)
+	}
+
+	// The child was cancelled, so there's nothing to transition on. Cancelling
+	// the task interrupts this handler, so it mustn't interrupt cancelling
+	return f.Cancel(uninterrupted, id, fmt.Sprintf("invoked ChildMachine task %d was cancelled", child))
+}
+
+func (f *parentMachineFSM) park(ctx context.Context, item sqlc.QueueItem) {
+	recheckAt := time.Now().Add(f.leaseTTL).UnixMilli()
+	if _, err := f.store.Q().RetryQueueItem(context.WithoutCancel(ctx), item.Attempt, recheckAt, item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to park queue item", "id", item.TaskID, "state", item.State, "error", err)
+		f.release(ctx, item)
+		return
+	}
+	f.signalAt(fsm.State(item.State), time.UnixMilli(recheckAt))
+}
+
+func (f *parentMachineFSM) watchTask(state fsm.State, item int64, wait func(context.Context) error) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+	if _, ok := f.watching[item]; ok {
+		return
+	}
+	f.watching[item] = struct{}{}
+
+	go func() {
+		defer func() {
+			f.tasksLock.Lock()
+			delete(f.watching, item)
+			f.tasksLock.Unlock()
+		}()
+		if err := wait(f.ctx); err != nil {
+			return
+		}
+		if n, err := f.store.Q().WakeQueueItem(f.ctx, item); err != nil {
+			fsm.Logger(f.ctx).Error("Failed to wake queue item", "state", state, "error", err)
+		} else if n > 0 {
+			f.signal(state)
+		}
+	}()
+}
+
+func (f *parentMachineFSM) watchParked(ctx context.Context) error {
+	steps, err := f.store.Q().ListParkedSteps(ctx, "ParentMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		child := fsm.TaskID(step.ChildID)
+		switch fsm.State(step.State) {
+		case ParentMachineStateStart:
+			f.watchTask(ParentMachineStateStart, step.ID, func(ctx context.Context) error {
+				_, err := f.startChild.Wait(ctx, child)
+				return err
+			})
+		}
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) claim(ctx context.Context, state fsm.State, ready chan struct{}, limiter *fsm.Limiter) (sqlc.QueueItem, time.Duration, bool) {
+	var waited time.Duration
+	for {
+		wait, err := f.throttle(ctx, limiter)
+		waited += wait
+		if err != nil {
+			return sqlc.QueueItem{}, waited, false
+		}
+
+		// Claims aren't interrupted, since the lease may be taken even if
+		// the claimed item is lost to a cancellation
+		uninterrupted := context.WithoutCancel(ctx)
+		var item sqlc.QueueItem
+		err = f.store.Tx(uninterrupted, func(q fsm.Q) (err error) {
+			region := f.region(state)
+			item, err = q.ClaimQueueItem(uninterrupted, sqlc.ClaimQueueItemParams{
+				Owner:     f.owner,
+				LeaseMs:   f.leaseTTL.Milliseconds(),
+				State:     string(state),
+				Fsm:       "ParentMachine",
+				Namespace: f.namespace,
+				Region:    region,
+				AgingMs:   f.aging.Milliseconds(),
+			})
+			if err != nil || region == "" {
+				return err
+			}
+			// The task holds its key's region until it leaves
+			return q.AcquireConcurrencyLock(uninterrupted, region, item.TaskID)
+		})
+		if err == nil && ctx.Err() != nil {
+			f.release(ctx, item)
+			return item, waited, false
+		} else if err == nil {
+			// There may be more, so let another processor look
+			f.signal(state)
+			return item, waited, true
+		}
+
+		// Idle processors don't hold on to tokens, so they can't start a burst
+		// of steps together once work arrives
+		if limiter != nil {
+			limiter.Refund()
+		}
+		if ctx.Err() != nil {
+			return item, waited, false
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			fsm.Logger(ctx).Error("Failed to claim queue item", "state", state, "error", err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return item, waited, false
+		}
+	}
+}
+
+func (f *parentMachineFSM) heartbeat(ctx context.Context, item sqlc.QueueItem) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(f.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if n, err := f.store.Q().RenewQueueItemLease(ctx, f.leaseTTL.Milliseconds(), item.ID, f.owner); err != nil && ctx.Err() == nil {
+				fsm.Logger(ctx).Error("Failed to renew lease", "id", item.TaskID, "state", item.State, "error", err)
+			} else if err == nil && n == 0 {
+				cancel(fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, item.TaskID, item.State))
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel(nil)
+	}
+}
+
+func (f *parentMachineFSM) handle(ctx context.Context, state fsm.State, id fsm.TaskID, attempt int, handler func(context.Context) error) error {
+	ctx, err := f.restore(ctx, id)
+	if err != nil {
+		return err
+	}
+	next := handler
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := f.middlewares[i], next
+		next = func(ctx context.Context) error {
+			return middleware(ctx, "ParentMachine", state, id, attempt, inner)
+		}
+	}
+	return next(ctx)
+}
+
+func (f *parentMachineFSM) metadata(ctx context.Context) ([]byte, error) {
+	metadata := make(map[string]string)
+	for _, extract := range f.extractors {
+		maps.Copy(metadata, extract(ctx))
+	}
+	maps.Copy(metadata, fsm.GetMetadata(ctx))
+	return fsm.EncodeMetadata(metadata)
+}
+
+func (f *parentMachineFSM) restore(ctx context.Context, id fsm.TaskID) (context.Context, error) {
+	data, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return ctx, err
+	}
+	metadata, err := fsm.DecodeMetadata(data)
+	if err != nil || metadata == nil {
+		return ctx, err
+	}
+	ctx = fsm.PutMetadata(ctx, metadata)
+	for _, inject := range f.injectors {
+		ctx = inject(ctx, metadata)
+	}
+	return ctx, nil
+}
+
+func (f *parentMachineFSM) throttle(ctx context.Context, limiter *fsm.Limiter) (time.Duration, error) {
+	if limiter == nil || !limiter.Limited() {
+		return 0, nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func (f *parentMachineFSM) throttled(ctx context.Context, limiter *fsm.Limiter, item sqlc.QueueItem, wait time.Duration) {
+	if limiter.Limited() && f.onRateLimit != nil {
+		f.onRateLimit(ctx, fsm.TaskID(item.TaskID), fsm.State(item.State), wait)
+	}
+}
+
+func (f *parentMachineFSM) record(ctx context.Context, breaker *fsm.Breaker, probe bool, err error) {
+	// Shutdowns, cancellations, lost claims, full queues and parked steps say
+	// nothing about the state's health
+	if err != nil && (ctx.Err() != nil || errors.Is(err, fsm.ErrTaskCancelled) || errors.Is(err, fsm.ErrClaimLost) || errors.Is(err, fsm.ErrQueueFull) || errors.Is(err, fsm.ErrChildRunning)) {
+		breaker.Abandon(probe)
+		return
+	}
+	breaker.Record(probe, err != nil)
+}
+
+func (f *parentMachineFSM) breakerListener(state fsm.State) func(from, to fsm.BreakerState) {
+	return func(from, to fsm.BreakerState) {
+		fsm.Logger(f.ctx).Info("Circuit breaker changed", "state", state, "from", from, "to", to)
+		if f.onBreaker != nil {
+			f.onBreaker(f.ctx, state, from, to)
+		}
+	}
+}
+
+func (f *parentMachineFSM) ack(ctx context.Context, item sqlc.QueueItem) {
+	// Finished work is acknowledged even while shutting down
+	if _, err := f.store.Q().AckQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to acknowledge queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.freeSpace()
+}
+
+func (f *parentMachineFSM) fail(ctx context.Context, item sqlc.QueueItem, cause error) {
+	if f.ctx.Err() != nil {
+		// Shutting down, so hand the step over without counting an attempt
+		f.release(ctx, item)
+		return
+	}
+	attempt := int(item.Attempt) + 1
+	delay := f.stateBackoff(fsm.State(item.State))(attempt, cause)
+	retryAt := time.Now().Add(delay).UnixMilli()
+	fsm.Logger(ctx).Debug("Processing error", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", cause)
+
+	err := f.store.Tx(ctx, func(q fsm.Q) error {
+		if n, err := q.RetryQueueItem(ctx, int64(attempt), retryAt, item.ID, f.owner); err != nil {
+			return err
+		} else if n == 0 {
+			return fsm.ErrClaimLost
+		}
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:        item.TaskID,
+			Attempt:       int64(attempt),
+			FromState:     item.State,
+			ToState:       string(fsm.StateError),
+			Data:          []byte(cause.Error()),
+			NextAttemptAt: &retryAt,
+		})
+	})
+	if errors.Is(err, fsm.ErrClaimLost) {
+		// The task has moved on, or another worker took over the step
+		return
+	} else if err != nil {
+		fsm.Logger(ctx).Debug("Failed to record transition", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", err)
+		f.release(ctx, item)
+		return
+	}
+	f.signalAt(fsm.State(item.State), time.UnixMilli(retryAt))
+}
+
+func (f *parentMachineFSM) release(ctx context.Context, item sqlc.QueueItem) {
+	if err := f.store.Q().ReleaseQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to release queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.signal(fsm.State(item.State))
+}
+
+func (f *parentMachineFSM) signal(state fsm.State) {
+	var ready chan struct{}
+	switch state {
+	case ParentMachineStateStart:
+		ready = f.startReady
+	case ParentMachineStateNext:
+		ready = f.nextReady
+	case ParentMachineStateDone:
+		ready = f.doneReady
+	case ParentMachineStateFailed:
+		ready = f.failedReady
+	}
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *parentMachineFSM) queueConfig(state fsm.State) fsm.QueueConfig {
+	switch state {
+	case ParentMachineStateStart:
+		return f.startQueue
+	case ParentMachineStateNext:
+		return f.nextQueue
+	}
+	return fsm.QueueConfig{}
+}
+
+func (f *parentMachineFSM) reserve(ctx context.Context, q fsm.Q, state fsm.State) error {
+	config := f.queueConfig(state)
+	if !config.Bounded() {
+		return nil
+	}
+	n, err := q.CountQueueItems(ctx, string(state), "ParentMachine", f.namespace)
+	if err != nil {
+		return err
+	}
+	if n >= int64(config.Capacity) {
+		return &fsm.QueueFullError{
+			Capacity: config.Capacity,
+			State:    state,
+		}
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) admit(ctx context.Context, block bool, fn func(fsm.Q) error) error {
+	for {
+		f.spaceLock.Lock()
+		space := f.space
+		f.spaceLock.Unlock()
+
+		err := f.store.Tx(ctx, fn)
+		var full *fsm.QueueFullError
+		if !block || !errors.As(err, &full) || !f.queueConfig(full.State).Blocks() {
+			return err
+		}
+
+		// Steps leaving the queue in other processes are only seen by polling
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		case <-space:
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+func (f *parentMachineFSM) freeSpace() {
+	f.spaceLock.Lock()
+	defer f.spaceLock.Unlock()
+	close(f.space)
+	f.space = make(chan struct{})
+}
+
+func (f *parentMachineFSM) stateBackoff(state fsm.State) fsm.Backoff {
+	var backoff fsm.Backoff
+	switch state {
+	case ParentMachineStateStart:
+		backoff = f.startBackoff
+	case ParentMachineStateNext:
+		backoff = f.nextBackoff
+	}
+	if backoff == nil {
+		return f.backoff
+	}
+	return backoff
+}
+
+func (f *parentMachineFSM) region(state fsm.State) string {
+	return ""
+}
+
+func (f *parentMachineFSM) signalRegion(region string) {}
+
+func (f *parentMachineFSM) signalAt(state fsm.State, at time.Time) {
+	if delay := time.Until(at); delay > 0 {
+		time.AfterFunc(delay, func() {
+			f.signal(state)
+		})
+		return
+	}
+	f.signal(state)
+}
+
+func (f *parentMachineFSM) transition(ctx context.Context, toState fsm.State, data []byte, at time.Time) error {
+	id := fsm.GetTaskID(ctx)
+	fromState := fsm.GetState(ctx)
+	itemID, ok := fsm.GetQueueItem(ctx)
+	if !ok {
+		return fmt.Errorf("transition to %s outside of a task handler", toState)
+	}
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+	}
+
+	if err := f.admit(ctx, false, func(q fsm.Q) error {
+		if n, err := q.AckQueueItem(ctx, itemID, f.owner); err != nil {
+			return err
+		} else if n == 0 && f.isCancelled(ctx, q, id) {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, id, fromState)
+		}
+		if err := f.reserve(ctx, q, toState); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   int64(fsm.GetAttempt(ctx)),
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+		}); err != nil {
+			return err
+		}
+		// Leaving a serialized region lets the next task with the same key in
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signalAt(toState, at)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Submit FSM tasks
+
+func (f *parentMachineFSM) Submit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now(), P0)
+}
+
+func (f *parentMachineFSM) SubmitAfter(ctx context.Context, delay time.Duration, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *parentMachineFSM) SubmitAt(ctx context.Context, at time.Time, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, at, true, P0)
+}
+
+// TrySubmit never waits for room in a full queue
+
+func (f *parentMachineFSM) TrySubmit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, time.Now(), false, P0)
+}
+
+func (f *parentMachineFSM) submit(ctx context.Context, at time.Time, block bool, P0 int) (fsm.TaskID, error) {
+	msg := parentMachineFSM_StartParams{P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return 0, err
+	}
+
+	var key, concurrencyKey *string
+	if k, ok := fsm.GetIdempotencyKey(ctx); ok {
+		key = &k
+	}
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The task and its first step are stored together, once there is room
+	if err := f.admit(ctx, block, func(q fsm.Q) error {
+		// A repeated submission returns the task it already created
+		if key != nil {
+			task, err := q.GetTaskByIdempotencyKey(ctx, "ParentMachine", f.namespace, key)
+			if err == nil {
+				if !bytes.Equal(task.Data, buf.Bytes()) {
+					return fsm.ErrIdempotencyConflict
+				}
+				msg.ID = fsm.TaskID(task.ID)
+				return nil
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		if err := f.reserve(ctx, q, ParentMachineStateStart); err != nil {
+			return err
+		}
+		task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+			Data:           buf.Bytes(),
+			IdempotencyKey: key,
+			ConcurrencyKey: concurrencyKey,
+			Metadata:       metadata,
+			Fsm:            "ParentMachine",
+			Namespace:      f.namespace,
+		})
+		if err != nil {
+			return err
+		}
+		msg.ID = fsm.TaskID(task.ID)
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   task.ID,
+			State:    string(ParentMachineStateStart),
+			Data:     buf.Bytes(),
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	f.signalAt(ParentMachineStateStart, at)
+	return msg.ID, nil
+}
+
+// Submit FSM tasks in batches
+
+func (f *parentMachineFSM) SubmitBatch(ctx context.Context, inputs []ParentMachineStartParams) ([]fsm.TaskID, error) {
+	return f.SubmitSeq(ctx, slices.Values(inputs))
+}
+
+func (f *parentMachineFSM) SubmitSeq(ctx context.Context, inputs iter.Seq[ParentMachineStartParams]) ([]fsm.TaskID, error) {
+	if _, ok := fsm.GetIdempotencyKey(ctx); ok {
+		return nil, errors.New("batch submissions can't share an idempotency key")
+	}
+
+	var err error
+	ids := make([]fsm.TaskID, 0)
+	chunk := make([][]byte, 0, f.batchSize)
+	for input := range inputs {
+		msg := parentMachineFSM_StartParams{P0: input.P0}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return ids, err
+		}
+		chunk = append(chunk, buf.Bytes())
+		if len(chunk) == f.batchSize {
+			if ids, err = f.submitChunk(ctx, ids, chunk); err != nil {
+				return ids, err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	return f.submitChunk(ctx, ids, chunk)
+}
+
+// submitChunk stores a chunk of a batch in one transaction, and appends its
+// tasks to ids once it commits. When the entrypoint's queue fills up, the
+// tasks that fit are committed first, and the rest wait for room or are
+// rejected like single submissions.
+func (f *parentMachineFSM) submitChunk(ctx context.Context, ids []fsm.TaskID, chunk [][]byte) ([]fsm.TaskID, error) {
+	if len(chunk) == 0 {
+		return ids, nil
+	}
+	var concurrencyKey *string
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return ids, err
+	}
+
+	for len(chunk) > 0 {
+		now := time.Now()
+		created := make([]fsm.TaskID, 0, len(chunk))
+		if err := f.admit(ctx, true, func(q fsm.Q) error {
+			created = created[:0]
+			for _, data := range chunk {
+				if err := f.reserve(ctx, q, ParentMachineStateStart); err != nil {
+					// Keep the tasks that fit, and stop at the first that doesn't
+					if len(created) > 0 && errors.Is(err, fsm.ErrQueueFull) {
+						return nil
+					}
+					return err
+				}
+				task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+					Data:           data,
+					ConcurrencyKey: concurrencyKey,
+					Metadata:       metadata,
+					Fsm:            "ParentMachine",
+					Namespace:      f.namespace,
+				})
+				if err != nil {
+					return err
+				}
+				_, err = q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+					TaskID:   task.ID,
+					State:    string(ParentMachineStateStart),
+					Data:     data,
+					ReadyAt:  now.UnixMilli(),
+					Priority: int64(fsm.GetPriority(ctx)),
+				})
+				if err != nil {
+					return err
+				}
+				created = append(created, fsm.TaskID(task.ID))
+			}
+			return nil
+		}); err != nil {
+			return ids, err
+		}
+		f.signal(ParentMachineStateStart)
+		ids = append(ids, created...)
+		chunk = chunk[len(created):]
+	}
+	return ids, nil
+}
+
+// Cancel FSM tasks
+
+func (f *parentMachineFSM) Cancel(ctx context.Context, id fsm.TaskID, reason string) error {
+	var fromState fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if f.isTerminal(fromState) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, fromState)
+		}
+
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   transition.Attempt,
+			FromState: string(fromState),
+			ToState:   string(fsm.StateCancelled),
+			Data:      []byte(reason),
+		}); err != nil {
+			return err
+		}
+		// Drop any queued or pending work, and leave any serialized region
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		return q.ReleaseConcurrencyLocks(ctx, int64(id), "")
+	}); err != nil {
+		return err
+	}
+
+	// Stop the running handler
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: %s", fsm.ErrTaskCancelled, reason))
+	}
+	f.tasksLock.Unlock()
+	f.signalRegion(f.region(fromState))
+	f.freeSpace()
+
+	fsm.Logger(ctx).Debug("Cancelled task", "id", id, "from", fromState, "reason", reason)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, fsm.StateCancelled)
+	}
+	f.complete(ctx, id, fsm.StateCancelled)
+	return f.cancelChildren(ctx, id, reason)
+}
+
+func (f *parentMachineFSM) cancelChildren(ctx context.Context, id fsm.TaskID, reason string) error {
+	children, err := f.store.Q().GetChildTasks(ctx, int64(id))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, child := range children {
+		var err error
+		switch fsm.State(child.State) {
+		case ParentMachineStateStart:
+			err = f.startChild.Cancel(ctx, fsm.TaskID(child.ChildID), reason)
+		}
+		// Children that already finished have nothing left to cancel
+		if err != nil && !errors.Is(err, fsm.ErrTaskFinished) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *parentMachineFSM) parked(ctx context.Context, id fsm.TaskID, state fsm.State) bool {
+	children, err := f.store.Q().GetChildTasks(ctx, int64(id))
+	if err != nil {
+		fsm.Logger(ctx).Error("Failed to get child tasks", "id", id, "error", err)
+		return false
+	}
+	for _, child := range children {
+		if fsm.State(child.State) != state {
+			continue
+		}
+		var status fsm.TaskStatus
+		switch state {
+		case ParentMachineStateStart:
+			status, err = f.startChild.Status(ctx, fsm.TaskID(child.ChildID))
+		}
+		if err != nil {
+			fsm.Logger(ctx).Error("Failed to get child task status", "id", child.ChildID, "error", err)
+		} else if !status.Terminal {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *parentMachineFSM) lastTransition(ctx context.Context, q fsm.Q, id fsm.TaskID) (sqlc.StateTransition, error) {
+	transition, err := q.GetLastValidTransition(ctx, int64(id), "ParentMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := q.GetTask(ctx, int64(id), "ParentMachine", f.namespace); errors.Is(err, sql.ErrNoRows) {
+			return transition, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+		} else if err != nil {
+			return transition, err
+		}
+		return sqlc.StateTransition{
+			TaskID:  int64(id),
+			ToState: string(ParentMachineStateStart),
+		}, nil
+	}
+	return transition, err
+}
+
+func (f *parentMachineFSM) startTask(ctx context.Context, id fsm.TaskID) (context.Context, bool) {
+	f.tasksLock.Lock()
+	ctx2, cancel := context.WithCancelCause(ctx)
+	if f.running[id] == nil {
+		f.running[id] = make(map[context.Context]context.CancelCauseFunc)
+	}
+	f.running[id][ctx2] = cancel
+	f.tasksLock.Unlock()
+
+	// Cancel stops the handlers running when it commits, so handlers
+	// registered after that find the cancellation in the store
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		f.finishTask(ctx2, id)
+		return ctx, false
+	}
+	return ctx2, true
+}
+
+func (f *parentMachineFSM) finishTask(ctx context.Context, id fsm.TaskID) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	if cancel, ok := f.running[id][ctx]; ok {
+		cancel(nil)
+		delete(f.running[id], ctx)
+	}
+	if len(f.running[id]) == 0 {
+		delete(f.running, id)
+	}
+}
+
+func (f *parentMachineFSM) isCancelled(ctx context.Context, q fsm.Q, id fsm.TaskID) bool {
+	transition, err := f.lastTransition(ctx, q, id)
+	if err != nil {
+		fsm.Logger(ctx).Error("Failed to get last transition", "id", id, "error", err)
+		return false
+	}
+	return fsm.State(transition.ToState) == fsm.StateCancelled
+}
+
+// Pause and resume FSM dispatch
+
+func (f *parentMachineFSM) Pause(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().PauseState(ctx, "ParentMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused state", "state", state)
+	return nil
+}
+
+func (f *parentMachineFSM) Resume(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().ResumeState(ctx, "ParentMachine", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed state", "state", state)
+	// Other processes pick the state's steps up when they next poll
+	f.signal(state)
+	return nil
+}
+
+func (f *parentMachineFSM) PauseAll(ctx context.Context) error {
+	if err := f.store.Q().PauseState(ctx, "ParentMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused FSM")
+	return nil
+}
+
+func (f *parentMachineFSM) ResumeAll(ctx context.Context) error {
+	if err := f.store.Q().ResumeState(ctx, "ParentMachine", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed FSM")
+	// States paused on their own stay paused
+	for _, state := range []fsm.State{ParentMachineStateStart, ParentMachineStateNext, ParentMachineStateDone, ParentMachineStateFailed} {
+		f.signal(state)
+	}
+	return nil
+}
+
+func (f *parentMachineFSM) Paused(ctx context.Context, state fsm.State) (bool, error) {
+	if err := f.stateError(state); err != nil {
+		return false, err
+	}
+	paused, err := f.store.Q().GetPausedStates(ctx, "ParentMachine", f.namespace)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(paused, "") || slices.Contains(paused, string(state)), nil
+}
+
+func (f *parentMachineFSM) stateError(state fsm.State) error {
+	switch state {
+	case ParentMachineStateStart, ParentMachineStateNext, ParentMachineStateDone, ParentMachineStateFailed:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", fsm.ErrUnknownState, state)
+}
+
+// Administrative FSM task operations
+
+func (f *parentMachineFSM) RetryNow(ctx context.Context, id fsm.TaskID, operator string) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var state fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		state = fsm.State(transition.ToState)
+		if f.isTerminal(state) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, state)
+		}
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Only failed steps that aren't running can be retried
+		if n, err := q.ExpediteQueueItem(ctx, item.ID); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrNoPendingRetry, id, state)
+		}
+		state = fsm.State(item.State)
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: item.State,
+			ToState:   string(fsm.StateRetried),
+			Operator:  &operator,
+		})
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Retrying task now", "id", id, "state", state, "operator", operator)
+	f.signal(state)
+	return nil
+}
+
+func (f *parentMachineFSM) ForceStart(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := parentMachineFSM_StartParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ParentMachineStateStart, buf.Bytes())
+}
+
+func (f *parentMachineFSM) ForceNext(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := parentMachineFSM_NextParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ParentMachineStateNext, buf.Bytes())
+}
+
+func (f *parentMachineFSM) ForceDone(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := parentMachineFSM_DoneParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ParentMachineStateDone, buf.Bytes())
+}
+
+func (f *parentMachineFSM) ForceFailed(ctx context.Context, id fsm.TaskID, operator string, P0 string) error {
+	msg := parentMachineFSM_FailedParams{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, ParentMachineStateFailed, buf.Bytes())
+}
+
+func (f *parentMachineFSM) Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ParentMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return err
+	}
+
+	// Steps are numbered as in the task's history, starting from its submission
+	toState, data := fsm.State(ParentMachineStateStart), task.Data
+	if step != 0 {
+		transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+		if err != nil {
+			return err
+		}
+		if step < 0 || step > len(transitions) {
+			return fmt.Errorf("task %d has no step %d", id, step)
+		}
+		toState = fsm.State(transitions[step-1].ToState)
+		data = transitions[step-1].Data
+	}
+	switch toState {
+	case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+		return fmt.Errorf("task %d can't restart from step %d in %s", id, step, toState)
+	}
+	return f.move(ctx, id, operator, toState, data)
+}
+
+// move replaces the task's current step with a step in the given state,
+// reviving the task if it finished. A running handler loses its claim on
+// the replaced step, so it can't move the task on too.
+func (f *parentMachineFSM) move(ctx context.Context, id fsm.TaskID, operator string, toState fsm.State, data []byte) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var fromState fsm.State
+	now := time.Now()
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if fromState == fsm.StateCancelled {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		}
+
+		// The new step keeps the priority of the step it replaces
+		priority := int64(fsm.GetPriority(ctx))
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err == nil {
+			priority = item.Priority
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+			Operator:  &operator,
+		}); err != nil {
+			return err
+		}
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  now.UnixMilli(),
+			Priority: priority,
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: id = %d, moved to %s by %s", fsm.ErrClaimLost, id, toState, operator))
+	}
+	f.tasksLock.Unlock()
+
+	fsm.Logger(ctx).Debug("Moved task", "id", id, "from", fromState, "to", toState, "operator", operator)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signal(toState)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Query FSM tasks
+
+func (f *parentMachineFSM) Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error) {
+	history, err := f.History(ctx, id)
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	status := fsm.NewTaskStatus(id, history)
+	status.Terminal = f.isTerminal(status.State)
+	metadata, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	if status.Metadata, err = fsm.DecodeMetadata(metadata); err != nil {
+		return fsm.TaskStatus{}, err
+	}
+
+	// Queued steps carry a priority, and steps that haven't been
+	// attempted yet may be scheduled for later
+	item, err := f.store.Q().GetTaskQueueItem(ctx, int64(id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fsm.TaskStatus{}, err
+	} else if err == nil {
+		status.Priority = int(item.Priority)
+		if at := time.UnixMilli(item.ReadyAt); item.Attempt == 0 && item.LeaseOwner == nil && at.After(time.Now()) && !f.parked(ctx, id, status.State) {
+			status.ScheduledAt = at
+		}
+	}
+	return status, nil
+}
+
+func (f *parentMachineFSM) History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error) {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "ParentMachine", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks are submitted without a transition, so the first step comes from the task itself
+	params, err := f.decodeParams(ParentMachineStateStart, task.Data)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]fsm.Step, 0, len(transitions)+1)
+	history = append(history, fsm.Step{
+		CreatedAt: time.UnixMilli(task.CreatedAt),
+		Params:    params,
+		To:        ParentMachineStateStart,
+	})
+	for _, transition := range transitions {
+		step := fsm.Step{
+			Attempt:   int(transition.Attempt),
+			CreatedAt: time.UnixMilli(transition.CreatedAt),
+			Deadline:  transition.Deadline,
+			From:      fsm.State(transition.FromState),
+			To:        fsm.State(transition.ToState),
+		}
+		if transition.Operator != nil {
+			step.Operator = *transition.Operator
+		}
+		switch step.To {
+		case fsm.StateError:
+			step.Error = string(transition.Data)
+			if transition.NextAttemptAt != nil {
+				step.NextAttemptAt = time.UnixMilli(*transition.NextAttemptAt)
+			}
+		case fsm.StateCancelled:
+			step.Reason = string(transition.Data)
+		case fsm.StateRetried:
+		// Retried steps keep the failed step's inputs
+		default:
+			if step.Params, err = f.decodeParams(step.To, transition.Data); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, step)
+	}
+	return history, nil
+}
+
+func (f *parentMachineFSM) decodeParams(state fsm.State, data []byte) (any, error) {
+	switch state {
+	case ParentMachineStateStart:
+		var params ParentMachineStartParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ParentMachineStateNext:
+		var params ParentMachineNextParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ParentMachineStateDone:
+		var params ParentMachineDoneParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case ParentMachineStateFailed:
+		var params ParentMachineFailedParams
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("unknown state: %s", state)
+}
+
+func (f *parentMachineFSM) isTerminal(state fsm.State) bool {
+	switch state {
+	case ParentMachineStateDone, ParentMachineStateFailed, fsm.StateCancelled:
+		return true
+	}
+	return false
+}
+
+// Wait for FSM tasks
+
+func (f *parentMachineFSM) Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error) {
+	waiter := make(chan fsm.State, 1)
+	f.tasksLock.Lock()
+	f.waiters[id] = append(f.waiters[id], waiter)
+	f.tasksLock.Unlock()
+	defer f.stopWaiting(id, waiter)
+
+	// The task may have finished before we started waiting, or in another
+	// process sharing the store
+	for {
+		transition, err := f.lastTransition(ctx, f.store.Q(), id)
+		if err != nil {
+			return "", err
+		}
+		if state := fsm.State(transition.ToState); f.isTerminal(state) {
+			return state, nil
+		}
+
+		select {
+		case state := <-waiter:
+			return state, nil
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (f *parentMachineFSM) SubmitAndWait(ctx context.Context, P0 int) (fsm.TaskID, fsm.State, error) {
+	id, err := f.Submit(ctx, P0)
+	if err != nil {
+		return 0, "", err
+	}
+	state, err := f.Wait(ctx, id)
+	return id, state, err
+}
+
+func (f *parentMachineFSM) complete(ctx context.Context, id fsm.TaskID, state fsm.State) {
+	f.tasksLock.Lock()
+	waiters := f.waiters[id]
+	delete(f.waiters, id)
+	f.tasksLock.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- state
+	}
+	if f.onCompletion != nil {
+		f.onCompletion(ctx, id, state)
+	}
+}
+
+func (f *parentMachineFSM) stopWaiting(id fsm.TaskID, waiter chan fsm.State) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	waiters := slices.DeleteFunc(f.waiters[id], func(w chan fsm.State) bool {
+		return w == waiter
+	})
+	if len(waiters) == 0 {
+		delete(f.waiters, id)
+	} else {
+		f.waiters[id] = waiters
+	}
+}
@@ -0,0 +1,160 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+// buildCountingMachine counts the steps each state of a TestMachine runs.
+func buildCountingMachine(t *testing.T, ctx context.Context, store func() (fsm.Store, error), state1, state2 *atomic.Int64) example.TestMachineFSM {
+	t.Helper()
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			state1.Add(1)
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			state2.Add(1)
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(ctx,
+			fsm.WithStore(store),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestPauseState(t *testing.T) {
+	var state1, state2 atomic.Int64
+	f := buildCountingMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db")), &state1, &state2)
+
+	if err := f.Pause(t.Context(), example.TestMachineStateState2); err != nil {
+		t.Fatal(err)
+	}
+	if paused, err := f.Paused(t.Context(), example.TestMachineStateState2); err != nil || !paused {
+		t.Fatalf("expected %s to be paused, got %t, %v", example.TestMachineStateState2, paused, err)
+	}
+	if paused, err := f.Paused(t.Context(), example.TestMachineStateState1); err != nil || paused {
+		t.Fatalf("expected %s not to be paused, got %t, %v", example.TestMachineStateState1, paused, err)
+	}
+
+	ids := make([]fsm.TaskID, 0)
+	for i := range 5 {
+		id, err := f.Submit(t.Context(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Steps keep moving into the paused state, but wait there
+	time.Sleep(100 * time.Millisecond)
+	for _, id := range ids {
+		status, err := f.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != example.TestMachineStateState2 {
+			t.Errorf("expected task %d to wait in %s, got %s", id, example.TestMachineStateState2, status.State)
+		}
+	}
+	if n := state2.Load(); n != 0 {
+		t.Fatalf("expected no %s steps while paused, got %d", example.TestMachineStateState2, n)
+	}
+
+	if err := f.Resume(t.Context(), example.TestMachineStateState2); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if state, err := f.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachineStateDone {
+			t.Fatalf("expected task %d to finish in %s, got %s", id, example.TestMachineStateDone, state)
+		}
+	}
+	if n := state2.Load(); n != int64(len(ids)) {
+		t.Fatalf("expected %d %s steps, got %d", len(ids), example.TestMachineStateState2, n)
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	var state1, state2 atomic.Int64
+
+	ctx, stop := context.WithCancel(t.Context())
+	defer stop()
+	f := buildCountingMachine(t, ctx, store, &state1, &state2)
+	if err := f.PauseAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Pause(t.Context(), example.TestMachineStateState2); err != nil {
+		t.Fatal(err)
+	}
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pause outlives the process
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	f = buildCountingMachine(t, t.Context(), store, &state1, &state2)
+	time.Sleep(100 * time.Millisecond)
+	if n := state1.Load(); n != 0 {
+		t.Fatalf("expected no steps while paused, got %d", n)
+	}
+	if paused, err := f.Paused(t.Context(), example.TestMachineStateState1); err != nil || !paused {
+		t.Fatalf("expected %s to be paused, got %t, %v", example.TestMachineStateState1, paused, err)
+	}
+
+	// Resuming the FSM leaves states paused on their own paused
+	if err := f.ResumeAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for state1.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != example.TestMachineStateState2 || state2.Load() != 0 {
+		t.Fatalf("expected task to wait in paused %s, got %s", example.TestMachineStateState2, status.State)
+	}
+
+	if err := f.Resume(t.Context(), example.TestMachineStateState2); err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	if state, err := f.Wait(waitCtx, id); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected task to finish in %s, got %s", example.TestMachineStateDone, state)
+	}
+}
+
+func TestPauseUnknownState(t *testing.T) {
+	var state1, state2 atomic.Int64
+	f := buildCountingMachine(t, t.Context(), fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db")), &state1, &state2)
+	if err := f.Pause(t.Context(), "Missing"); !errors.Is(err, fsm.ErrUnknownState) {
+		t.Fatalf("expected %v, got %v", fsm.ErrUnknownState, err)
+	}
+	if err := f.Resume(t.Context(), "Missing"); !errors.Is(err, fsm.ErrUnknownState) {
+		t.Fatalf("expected %v, got %v", fsm.ErrUnknownState, err)
+	}
+}
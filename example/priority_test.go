@@ -0,0 +1,129 @@
+package example_test
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+type priorityRecorder struct {
+	lock       sync.Mutex
+	order      []int
+	priorities map[int]int
+	blocked    chan struct{}
+}
+
+func (r *priorityRecorder) start(t *testing.T, opts ...fsm.Option) example.TestMachineFSM {
+	r.priorities = make(map[int]int)
+	r.blocked = make(chan struct{})
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			// Hold the only State1 worker until everything else is queued
+			if c < 0 {
+				r.blocked <- struct{}{}
+				<-r.blocked
+				return transitions.ToState2(ctx, c)
+			}
+			r.lock.Lock()
+			r.order = append(r.order, c)
+			r.lock.Unlock()
+			if c == 11 {
+				ctx = fsm.PutPriority(ctx, 9)
+			}
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			r.lock.Lock()
+			r.priorities[c] = fsm.GetPriority(ctx)
+			r.lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (r *priorityRecorder) submit(t *testing.T, f example.TestMachineFSM, priority int, cs ...int) []fsm.TaskID {
+	ids := make([]fsm.TaskID, 0, len(cs))
+	for _, c := range cs {
+		id, err := f.Submit(fsm.PutPriority(t.Context(), priority), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (r *priorityRecorder) wait(t *testing.T, f example.TestMachineFSM, ids []fsm.TaskID) {
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if _, err := f.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	r := new(priorityRecorder)
+	f := r.start(t)
+
+	ids := r.submit(t, f, 0, -1)
+	<-r.blocked
+	ids = append(ids, r.submit(t, f, 0, 0, 1, 2)...)
+	ids = append(ids, r.submit(t, f, 5, 10, 11, 12)...)
+
+	status, err := f.Status(t.Context(), ids[len(ids)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Priority != 5 {
+		t.Fatalf("expected queued priority 5, got %d", status.Priority)
+	}
+
+	r.blocked <- struct{}{}
+	r.wait(t, f, ids)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if expected := []int{10, 11, 12, 0, 1, 2}; !slices.Equal(r.order, expected) {
+		t.Fatalf("expected steps to run in order %v, got %v", expected, r.order)
+	}
+	// Transitions inherit the task's priority, unless overridden
+	for c, expected := range map[int]int{0: 0, 1: 0, 2: 0, 10: 5, 11: 9, 12: 5} {
+		if actual := r.priorities[c]; actual != expected {
+			t.Errorf("expected task %d to reach %s with priority %d, got %d", c, example.TestMachineStateState2, expected, actual)
+		}
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	r := new(priorityRecorder)
+	f := r.start(t, fsm.WithPriorityAging(50*time.Millisecond))
+
+	ids := r.submit(t, f, 0, -1)
+	<-r.blocked
+	ids = append(ids, r.submit(t, f, 0, 0)...)
+
+	// After waiting for several aging intervals, the low priority task
+	// outranks newer high priority ones
+	time.Sleep(400 * time.Millisecond)
+	ids = append(ids, r.submit(t, f, 3, 10, 12)...)
+
+	r.blocked <- struct{}{}
+	r.wait(t, f, ids)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if expected := []int{0, 10, 12}; !slices.Equal(r.order, expected) {
+		t.Fatalf("expected steps to run in order %v, got %v", expected, r.order)
+	}
+}
@@ -0,0 +1,300 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestQueueAcknowledgement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsm.db")
+	var state1Calls, state2Calls atomic.Int32
+	duplicate := make(chan error, 1)
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			state1Calls.Add(1)
+			if err := transitions.ToState2(ctx, c); err != nil {
+				return err
+			}
+			// The first transition acknowledged this step, so it can't be taken twice
+			err := transitions.ToState2(ctx, c)
+			duplicate <- err
+			return err
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			state2Calls.Add(1)
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(fsm.OnDisk(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, state, err := f.SubmitAndWait(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+	if err := <-duplicate; !errors.Is(err, fsm.ErrClaimLost) {
+		t.Fatalf("expected %v for a second transition, got %v", fsm.ErrClaimLost, err)
+	}
+	if state1Calls.Load() != 1 || state2Calls.Load() != 1 {
+		t.Fatalf("expected each state to run once, got %d and %d", state1Calls.Load(), state2Calls.Load())
+	}
+
+	// The failed handler must not have been recorded or retried
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected 3 steps, got %+v", history)
+	}
+
+	store, err := fsm.OnDisk(path)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queued int
+	if err := store.DB().QueryRowContext(t.Context(), "SELECT COUNT(*) FROM queue_items").Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Fatalf("expected an empty queue, got %d items", queued)
+	}
+}
+
+func TestQueueCapacity(t *testing.T) {
+	build := func(t *testing.T, config fsm.QueueConfig) (example.TestMachineFSM, chan struct{}) {
+		release := make(chan struct{})
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(),
+				fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+				fsm.WithQueue(example.TestMachineStateState1, config),
+			)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Fill the queue: one step running, and one waiting
+		for c := range 2 {
+			if _, err := f.Submit(t.Context(), c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f, release
+	}
+
+	t.Run("try", func(t *testing.T) {
+		f, _ := build(t, fsm.QueueConfig{Capacity: 2})
+
+		_, err := f.TrySubmit(t.Context(), 2)
+		var full *fsm.QueueFullError
+		if !errors.As(err, &full) || full.State != example.TestMachineStateState1 || full.Capacity != 2 {
+			t.Fatalf("expected a full %s queue, got %v", example.TestMachineStateState1, err)
+		}
+		if !errors.Is(err, fsm.ErrQueueFull) {
+			t.Fatalf("expected %v, got %v", fsm.ErrQueueFull, err)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		f, release := build(t, fsm.QueueConfig{Capacity: 2, Overflow: fsm.OverflowBlock})
+
+		submitted := make(chan error, 1)
+		go func() {
+			_, err := f.Submit(t.Context(), 2)
+			submitted <- err
+		}()
+		select {
+		case err := <-submitted:
+			t.Fatalf("expected submission to wait for room, got %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		release <- struct{}{}
+		select {
+		case err := <-submitted:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for submission")
+		}
+
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := f.Submit(ctx, 3); !errors.Is(err, fsm.ErrQueueFull) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %v and %v, got %v", fsm.ErrQueueFull, context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		f, _ := build(t, fsm.QueueConfig{Capacity: 2, Overflow: fsm.OverflowReject})
+
+		if _, err := f.Submit(t.Context(), 2); !errors.Is(err, fsm.ErrQueueFull) {
+			t.Fatalf("expected %v, got %v", fsm.ErrQueueFull, err)
+		}
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		f, release := build(t, fsm.QueueConfig{Capacity: 2, Overflow: fsm.OverflowSpill})
+		close(release)
+
+		id, err := f.TrySubmit(t.Context(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := f.Wait(t.Context(), id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachineStateDone {
+			t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+		}
+	})
+}
+
+func TestQueueCapacityTransition(t *testing.T) {
+	var running, overlapped, full atomic.Int32
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			err := transitions.ToState2(ctx, c)
+			if errors.Is(err, fsm.ErrQueueFull) {
+				full.Add(1)
+			}
+			return err
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			if running.Add(1) > 1 {
+				overlapped.Add(1)
+			}
+			defer running.Add(-1)
+			time.Sleep(50 * time.Millisecond)
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithQueue(example.TestMachineStateState2, fsm.QueueConfig{Capacity: 1}),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]fsm.TaskID, 3)
+	for c := range ids {
+		if ids[c], err = f.Submit(t.Context(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+		defer cancel()
+		if state, err := f.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachineStateDone {
+			t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+		}
+	}
+	// State2 has several workers, but its queue only holds one step
+	if n := overlapped.Load(); n != 0 {
+		t.Fatalf("expected one step in %s at a time, got %d overlaps", example.TestMachineStateState2, n)
+	}
+	// Handlers don't wait for room in a blocking queue, they're retried
+	if full.Load() == 0 {
+		t.Fatalf("expected transitions into the full %s queue to fail and be retried", example.TestMachineStateState2)
+	}
+}
+
+func TestQueueUnknownState(t *testing.T) {
+	for _, state := range []fsm.State{"Missing", example.TestMachineStateDone} {
+		if _, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(), fsm.WithQueue(state, fsm.QueueConfig{Capacity: 1})); err == nil {
+			t.Errorf("expected an error for a queue on %s", state)
+		}
+	}
+}
+
+func TestQueueUndecodableStep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsm.db")
+	var state1 atomic.Int32
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			state1.Add(1)
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(fsm.OnDisk(path)),
+			fsm.WithPollInterval(10*time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(10*time.Millisecond)),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Pause(t.Context(), example.TestMachineStateState1); err != nil {
+		t.Fatal(err)
+	}
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := fsm.OnDisk(path)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DB().ExecContext(t.Context(), "UPDATE queue_items SET data = X'00' WHERE task_id = ?", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Resume(t.Context(), example.TestMachineStateState1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The step fails and backs off instead of being claimed over and over
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, err := f.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Attempt > 0 && strings.HasPrefix(status.Error, "decode message") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the step to fail, got %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := state1.Load(); n != 0 {
+		t.Fatalf("expected the handler not to run, got %d calls", n)
+	}
+}
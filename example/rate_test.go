@@ -0,0 +1,179 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, expected := range map[string]fsm.Rate{
+		"10/s":    {Count: 10, Per: time.Second},
+		"600/m":   {Count: 600, Per: time.Minute},
+		"5/100ms": {Count: 5, Per: 100 * time.Millisecond},
+		"1/2h":    {Count: 1, Per: 2 * time.Hour},
+	} {
+		if actual, err := fsm.ParseRate(s); err != nil {
+			t.Errorf("parse %q: %s", s, err)
+		} else if actual != expected {
+			t.Errorf("expected %q to parse as %s, got %s", s, expected, actual)
+		}
+	}
+	for _, s := range []string{"", "10", "0/s", "-1/s", "10/", "10/0s", "ten/s", "10/x"} {
+		if _, err := fsm.ParseRate(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var lock sync.Mutex
+	var starts []time.Time
+	waits := make(map[fsm.State][]time.Duration)
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			lock.Lock()
+			starts = append(starts, time.Now())
+			lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithRate(example.TestMachineStateState2, fsm.Rate{Count: 20, Per: time.Second}, 2),
+			fsm.WithRateLimitListener(func(ctx context.Context, id fsm.TaskID, state fsm.State, wait time.Duration) {
+				lock.Lock()
+				defer lock.Unlock()
+				waits[state] = append(waits[state], wait)
+			}),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(n int) time.Duration {
+		lock.Lock()
+		starts = nil
+		lock.Unlock()
+
+		ids := make([]fsm.TaskID, n)
+		for i := range ids {
+			if ids[i], err = f.Submit(t.Context(), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range ids {
+			if _, err := f.Wait(t.Context(), id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		first, last := starts[0], starts[0]
+		for _, start := range starts {
+			if start.Before(first) {
+				first = start
+			}
+			if start.After(last) {
+				last = start
+			}
+		}
+		return last.Sub(first)
+	}
+
+	// The burst runs right away, and the rest are spaced out at the rate
+	if elapsed := run(8); elapsed < 250*time.Millisecond {
+		t.Fatalf("expected 8 steps at 20/s with a burst of 2 to take about 300ms, took %s", elapsed)
+	}
+
+	lock.Lock()
+	var waited time.Duration
+	for _, wait := range waits[example.TestMachineStateState2] {
+		waited += wait
+	}
+	if n := len(waits[example.TestMachineStateState2]); n != 8 || waited == 0 {
+		t.Errorf("expected 8 reported waits in %s, with some time spent waiting, got %d totalling %s", example.TestMachineStateState2, n, waited)
+	}
+	if n := len(waits[example.TestMachineStateState1]); n != 0 {
+		t.Errorf("expected no reported waits in unlimited %s, got %d", example.TestMachineStateState1, n)
+	}
+	lock.Unlock()
+
+	// Lifting the limit at runtime
+	if err := f.WithRate(example.TestMachineStateState2, fsm.Rate{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := run(8); elapsed > 200*time.Millisecond {
+		t.Fatalf("expected unlimited steps to run without waiting, took %s", elapsed)
+	}
+
+	// States that can't be limited are rejected
+	if err := f.WithRate("Missing", fsm.Rate{Count: 1, Per: time.Second}, 1); !errors.Is(err, fsm.ErrUnknownState) {
+		t.Errorf("expected %v for a state the FSM doesn't have, got %v", fsm.ErrUnknownState, err)
+	}
+	if err := f.WithRate(example.TestMachineStateDone, fsm.Rate{Count: 1, Per: time.Second}, 1); err == nil {
+		t.Errorf("expected an error limiting terminal %s", example.TestMachineStateDone)
+	}
+}
+
+func TestRateLimitAfterIdle(t *testing.T) {
+	var lock sync.Mutex
+	var starts []time.Time
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			lock.Lock()
+			starts = append(starts, time.Now())
+			lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithRate(example.TestMachineStateState2, fsm.Rate{Count: 10, Per: time.Second}, 1),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Idle workers keep looking for steps, but don't save up tokens while
+	// they do
+	time.Sleep(time.Second)
+
+	ids := make([]fsm.TaskID, 5)
+	for i := range ids {
+		if ids[i], err = f.Submit(t.Context(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range ids {
+		if _, err := f.Wait(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	first, last := starts[0], starts[0]
+	for _, start := range starts {
+		if start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+	}
+	if elapsed := last.Sub(first); elapsed < 300*time.Millisecond {
+		t.Fatalf("expected 5 steps at 10/s with a burst of 1 to take about 400ms after idling, took %s", elapsed)
+	}
+}
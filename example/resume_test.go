@@ -0,0 +1,330 @@
+package example_test
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+	"github.com/egoodhall/fsm/migrations"
+	"github.com/pressly/goose/v3"
+)
+
+type resumedCall struct {
+	State   fsm.State
+	Param   int
+	Attempt int
+	At      time.Time
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	backoff := fsm.LinearBackoff(300*time.Millisecond, 300*time.Millisecond)
+	blocked := make(chan int, 3)
+
+	// Run a first instance until each task is in a different situation, then
+	// crash it by cancelling its context.
+	ctx, crash := context.WithCancel(t.Context())
+	defer crash()
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			switch c {
+			case 0:
+				blocked <- c
+				<-ctx.Done()
+				return ctx.Err()
+			case 4:
+				return errors.New("boom")
+			}
+			return transitions.ToState2(ctx, c*10)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			if c == 10 {
+				return transitions.ToDone(ctx)
+			}
+			blocked <- c
+			<-ctx.Done()
+			return ctx.Err()
+		}).
+		BuildAndStart(ctx, fsm.WithStore(store), fsm.WithBackoff(backoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[int]fsm.TaskID)
+	submit := func(c int) {
+		id, err := f.Submit(t.Context(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[c] = id
+	}
+
+	// Finished before the crash
+	submit(1)
+	if _, err := f.Wait(t.Context(), ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// In State2 when the crash happens, and cancelled in State2
+	submit(3)
+	submit(5)
+	for range 2 {
+		<-blocked
+	}
+	if err := f.Cancel(t.Context(), ids[5], "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting for a retry when the crash happens
+	submit(4)
+	deadline := time.After(time.Second)
+	for {
+		status, err := f.Status(t.Context(), ids[4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Attempt == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for failed attempt")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Submitted, but without any transitions when the crash happens
+	submit(0)
+	<-blocked
+	submit(7)
+
+	crash()
+
+	// Restart, and record every handler invocation
+	var lock sync.Mutex
+	calls := make(map[fsm.TaskID][]resumedCall)
+	record := func(ctx context.Context, state fsm.State, c int) {
+		lock.Lock()
+		defer lock.Unlock()
+		id := fsm.GetTaskID(ctx)
+		calls[id] = append(calls[id], resumedCall{state, c, fsm.GetAttempt(ctx), time.Now()})
+	}
+
+	f, err = example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			record(ctx, example.TestMachineStateState1, c)
+			return transitions.ToState2(ctx, c*10)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			record(ctx, example.TestMachineStateState2, c)
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(store), fsm.WithBackoff(backoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[int]fsm.State{
+		0: example.TestMachineStateDone,
+		1: example.TestMachineStateDone,
+		3: example.TestMachineStateDone,
+		4: example.TestMachineStateDone,
+		5: fsm.StateCancelled,
+		7: example.TestMachineStateDone,
+	}
+	for c, state := range expected {
+		ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+		defer cancel()
+		if actual, err := f.Wait(ctx, ids[c]); err != nil {
+			t.Fatalf("wait for task %d: %s", c, err)
+		} else if actual != state {
+			t.Fatalf("expected task %d to finish in %s, got %s", c, state, actual)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, c := range []int{1, 5} {
+		if len(calls[ids[c]]) > 0 {
+			t.Errorf("finished task %d was resumed: %+v", c, calls[ids[c]])
+		}
+	}
+
+	if actual := calls[ids[3]]; len(actual) != 1 || actual[0].State != example.TestMachineStateState2 || actual[0].Param != 30 || actual[0].Attempt != 0 {
+		t.Errorf("expected task 3 to resume once in State2 with its payload, got %+v", actual)
+	}
+
+	for _, c := range []int{0, 7} {
+		actual := calls[ids[c]]
+		if len(actual) != 2 || actual[0].State != example.TestMachineStateState1 || actual[0].Param != c || actual[1].Param != c*10 {
+			t.Errorf("expected task %d to resume once from State1, got %+v", c, actual)
+		}
+	}
+
+	actual := calls[ids[4]]
+	if len(actual) != 2 || actual[0].State != example.TestMachineStateState1 || actual[0].Param != 4 || actual[0].Attempt != 1 {
+		t.Fatalf("expected task 4 to resume its retry once, got %+v", actual)
+	}
+	history, err := f.History(t.Context(), ids[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryAt := history[1].CreatedAt.Add(backoff(1, nil)); actual[0].At.Before(retryAt.Add(-5 * time.Millisecond)) {
+		t.Errorf("expected retry no earlier than %s, got %s", retryAt, actual[0].At)
+	}
+}
+
+// legacyParams is encoded like the generated messages, which gob matches by
+// field name.
+type legacyParams struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
+func TestResumeLegacyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsm.db")
+	encode := func(msg legacyParams) []byte {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// Store tasks the way they were stored before queue items and scopes:
+	// one never transitioned, one waiting in State2 and one done. TestMachine2
+	// shared the store, with one task waiting in State3 and one that never
+	// transitioned.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := goose.NewProvider(goose.DialectSQLite3, db, migrations.FS, goose.WithLogger(goose.NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.UpTo(t.Context(), 20250426130949); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO tasks (id, data) VALUES (?, ?)", []any{1, encode(legacyParams{ID: 1, P0: 1})}},
+		{"INSERT INTO tasks (id, data) VALUES (?, ?)", []any{2, encode(legacyParams{ID: 2, P0: 2})}},
+		{"INSERT INTO state_transitions (attempt, task_id, from_state, to_state, data) VALUES (?, ?, ?, ?, ?)", []any{0, 2, "State1", "State2", encode(legacyParams{ID: 2, P0: 20})}},
+		{"INSERT INTO tasks (id, data) VALUES (?, ?)", []any{3, encode(legacyParams{ID: 3, P0: 3})}},
+		{"INSERT INTO state_transitions (attempt, task_id, from_state, to_state, data) VALUES (?, ?, ?, ?, ?)", []any{0, 3, "State1", "State2", encode(legacyParams{ID: 3, P0: 30})}},
+		{"INSERT INTO state_transitions (attempt, task_id, from_state, to_state, data) VALUES (?, ?, ?, ?, ?)", []any{0, 3, "State2", "Done", encode(legacyParams{ID: 3})}},
+		{"INSERT INTO tasks (id, data) VALUES (?, ?)", []any{4, encode(legacyParams{ID: 4, P0: 4})}},
+		{"INSERT INTO state_transitions (attempt, task_id, from_state, to_state, data) VALUES (?, ?, ?, ?, ?)", []any{0, 4, "State1", "State2", encode(legacyParams{ID: 4, P0: 40})}},
+		{"INSERT INTO state_transitions (attempt, task_id, from_state, to_state, data) VALUES (?, ?, ?, ?, ?)", []any{0, 4, "State2", "State3", encode(legacyParams{ID: 4, P0: 40})}},
+		{"INSERT INTO tasks (id, data) VALUES (?, ?)", []any{5, encode(legacyParams{ID: 5, P0: 5})}},
+	} {
+		if _, err := db.ExecContext(t.Context(), stmt.query, stmt.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var calls []resumedCall
+	build := func(opts ...fsm.Option) (example.TestMachineFSM, error) {
+		return example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				lock.Lock()
+				calls = append(calls, resumedCall{State: example.TestMachineStateState1, Param: c})
+				lock.Unlock()
+				return transitions.ToState2(ctx, c*10)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				lock.Lock()
+				calls = append(calls, resumedCall{State: example.TestMachineStateState2, Param: c})
+				lock.Unlock()
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(), append([]fsm.Option{fsm.WithStore(fsm.OnDisk(path))}, opts...)...)
+	}
+
+	// Unscoped tasks can't be told apart from other FSMs' tasks
+	if _, err := build(); !errors.Is(err, fsm.ErrUnscopedTasks) {
+		t.Fatalf("expected %v, got %v", fsm.ErrUnscopedTasks, err)
+	}
+
+	// Task 4 went through a state TestMachine doesn't have, so it's never
+	// adopted. Task 5 fits both FSMs, so it's left out explicitly.
+	f, err := build(fsm.WithUnscopedTasks(func(id fsm.TaskID) bool { return id != 5 }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []fsm.TaskID{1, 2, 3} {
+		waitForDone(t, f, id)
+	}
+	for _, id := range []fsm.TaskID{4, 5} {
+		if _, err := f.Status(t.Context(), id); !errors.Is(err, fsm.ErrTaskNotFound) {
+			t.Errorf("expected %v for task %d, got %v", fsm.ErrTaskNotFound, id, err)
+		}
+	}
+
+	// TestMachine2 adopts the rest
+	var other []fsm.TaskID
+	f2, err := example.NewTestMachine2FSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachine2State1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachine2State2Transitions, c int) error {
+			return transitions.ToState3(ctx, c)
+		}).
+		FromState3(func(ctx context.Context, transitions example.TestMachine2State3Transitions, c int) error {
+			lock.Lock()
+			other = append(other, fsm.GetTaskID(ctx))
+			lock.Unlock()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(fsm.OnDisk(path)), fsm.WithUnscopedTasks(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []fsm.TaskID{4, 5} {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		state, err := f2.Wait(ctx, id)
+		cancel()
+		if err != nil || state != example.TestMachine2StateDone {
+			t.Fatalf("expected task %d to finish in %s, got %s (%v)", id, example.TestMachine2StateDone, state, err)
+		}
+	}
+
+	// Each unfinished task resumes from its last step, once
+	lock.Lock()
+	defer lock.Unlock()
+	slices.Sort(other)
+	if !slices.Equal(other, []fsm.TaskID{4, 5}) {
+		t.Errorf("expected TestMachine2 to finish tasks 4 and 5, got %v", other)
+	}
+	expected := []resumedCall{
+		{State: example.TestMachineStateState1, Param: 1},
+		{State: example.TestMachineStateState2, Param: 10},
+		{State: example.TestMachineStateState2, Param: 20},
+	}
+	slices.SortFunc(calls, func(a, b resumedCall) int {
+		return cmp.Or(cmp.Compare(a.State, b.State), cmp.Compare(a.Param, b.Param))
+	})
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, calls)
+	}
+}
@@ -0,0 +1,87 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestPendingRetryAfterRestart(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	attempts := make(chan int, 2)
+
+	build := func(ctx context.Context) example.TestMachineFSM {
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				attempts <- fsm.GetAttempt(ctx)
+				return errors.New("unavailable")
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(ctx,
+				fsm.WithStore(store),
+				fsm.WithPollInterval(10*time.Millisecond),
+				fsm.WithBackoff(fsm.ConstantBackoff(30*time.Minute)),
+			)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	ctx, stop := context.WithCancel(t.Context())
+	defer stop()
+	f := build(ctx)
+
+	id, err := f.Submit(t.Context(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failedAt := time.Now()
+	<-attempts
+
+	// The next attempt is recorded with the failure
+	var status fsm.TaskStatus
+	deadline := time.After(time.Second)
+	for status.Attempt == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for the failure to be recorded")
+		case <-time.After(time.Millisecond):
+		}
+		if status, err = f.Status(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if at := failedAt.Add(30 * time.Minute); status.NextAttemptAt.Before(at.Add(-time.Second)) || status.NextAttemptAt.After(at.Add(time.Second)) {
+		t.Fatalf("expected the next attempt around %s, got %+v", at, status)
+	}
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step := history[len(history)-1]; step.To != fsm.StateError || !step.NextAttemptAt.Equal(status.NextAttemptAt) {
+		t.Fatalf("expected an error step retried at %s, got %+v", status.NextAttemptAt, step)
+	}
+
+	// A restarted instance keeps waiting for the backoff
+	stop()
+	f = build(t.Context())
+
+	select {
+	case attempt := <-attempts:
+		t.Fatalf("expected no retry before %s, got attempt %d", status.NextAttemptAt, attempt)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if resumed, err := f.Status(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if !resumed.NextAttemptAt.Equal(status.NextAttemptAt) {
+		t.Fatalf("expected the next attempt at %s after restarting, got %+v", status.NextAttemptAt, resumed)
+	}
+}
@@ -0,0 +1,195 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+// sagaLog records the steps and compensations a saga runs, in order.
+type sagaLog struct {
+	lock  sync.Mutex
+	steps []string
+}
+
+func (l *sagaLog) add(step string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.steps = append(l.steps, step)
+}
+
+func (l *sagaLog) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return slices.Clone(l.steps)
+}
+
+func buildSagaMachine(t *testing.T, log *sagaLog, charge, ship, undoCharge func(string) error, opts ...fsm.Option) example.SagaMachineFSM {
+	t.Helper()
+	f, err := example.NewSagaMachineFSMBuilder().
+		FromReserve(func(ctx context.Context, transitions example.SagaMachineReserveTransitions, order string) error {
+			log.add("reserve")
+			return transitions.ToCharge(ctx, order)
+		}).
+		CompensateReserve(func(ctx context.Context, order string) error {
+			log.add("unreserve " + order)
+			return nil
+		}).
+		FromCharge(func(ctx context.Context, transitions example.SagaMachineChargeTransitions, order string) error {
+			log.add("charge")
+			if err := charge(order); err != nil {
+				return transitions.ToRollback(ctx, err.Error())
+			}
+			return transitions.ToShip(ctx, order)
+		}).
+		CompensateCharge(func(ctx context.Context, order string) error {
+			log.add("refund " + order)
+			return undoCharge(order)
+		}).
+		FromShip(func(ctx context.Context, transitions example.SagaMachineShipTransitions, order string) error {
+			log.add("ship")
+			if err := ship(order); err != nil {
+				return transitions.ToRollback(ctx, err.Error())
+			}
+			return transitions.ToDone(ctx, order)
+		}).
+		FromRollback(func(ctx context.Context, transitions example.SagaMachineRollbackTransitions, reason string) error {
+			log.add("rollback")
+			return transitions.ToFailed(ctx, reason)
+		}).
+		BuildAndStart(t.Context(), append([]fsm.Option{
+			fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))),
+			fsm.WithPollInterval(10 * time.Millisecond),
+			fsm.WithBackoff(fsm.ConstantBackoff(10 * time.Millisecond)),
+		}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSagaCompensation(t *testing.T) {
+	ok := func(string) error { return nil }
+	failed := func(string) error { return errors.New("failed") }
+
+	for _, tc := range []struct {
+		name   string
+		charge func(string) error
+		ship   func(string) error
+		state  fsm.State
+		steps  []string
+	}{
+		{
+			name:   "completed",
+			charge: ok,
+			ship:   ok,
+			state:  example.SagaMachineStateDone,
+			steps:  []string{"reserve", "charge", "ship"},
+		},
+		{
+			// Every completed step is undone, most recent first
+			name:   "failed shipping",
+			charge: ok,
+			ship:   failed,
+			state:  example.SagaMachineStateFailed,
+			steps:  []string{"reserve", "charge", "ship", "refund order", "unreserve order", "rollback"},
+		},
+		{
+			// A step that moves onto the failure path didn't complete
+			name:   "failed charge",
+			charge: failed,
+			ship:   ok,
+			state:  example.SagaMachineStateFailed,
+			steps:  []string{"reserve", "charge", "unreserve order", "rollback"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := new(sagaLog)
+			f := buildSagaMachine(t, log, tc.charge, tc.ship, ok)
+			_, state, err := f.SubmitAndWait(t.Context(), "order")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state != tc.state {
+				t.Fatalf("expected %s, got %s", tc.state, state)
+			}
+			if steps := log.get(); !slices.Equal(steps, tc.steps) {
+				t.Fatalf("expected %v, got %v", tc.steps, steps)
+			}
+		})
+	}
+}
+
+func TestSagaCompensationRetry(t *testing.T) {
+	log := new(sagaLog)
+	var refunds int
+	f := buildSagaMachine(t, log,
+		func(string) error { return nil },
+		func(string) error { return errors.New("failed") },
+		func(string) error {
+			// Only called from the rollback processor, one step at a time
+			if refunds++; refunds < 3 {
+				return errors.New("refund unavailable")
+			}
+			return nil
+		},
+	)
+	id, state, err := f.SubmitAndWait(t.Context(), "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != example.SagaMachineStateFailed {
+		t.Fatalf("expected %s, got %s", example.SagaMachineStateFailed, state)
+	}
+
+	// The failed compensation is retried without repeating the others
+	expected := []string{"reserve", "charge", "ship", "refund order", "refund order", "refund order", "unreserve order", "rollback"}
+	if steps := log.get(); !slices.Equal(steps, expected) {
+		t.Fatalf("expected %v, got %v", expected, steps)
+	}
+	history, err := f.History(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var retries int
+	for _, step := range history {
+		if step.From == example.SagaMachineStateRollback && step.To == fsm.StateError {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Fatalf("expected 2 retries of the rollback, got %d", retries)
+	}
+}
+
+func TestSagaCompensationMiddleware(t *testing.T) {
+	log := new(sagaLog)
+	f := buildSagaMachine(t, log,
+		func(string) error { return nil },
+		func(string) error { return errors.New("failed") },
+		func(string) error { return nil },
+		fsm.WithMiddleware(func(ctx context.Context, name string, state fsm.State, id fsm.TaskID, attempt int, next func(ctx context.Context) error) error {
+			log.add("wrap " + string(state))
+			return next(ctx)
+		}),
+	)
+	if _, _, err := f.SubmitAndWait(t.Context(), "order"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compensations are wrapped as the state they undo
+	expected := []string{
+		"wrap Reserve", "reserve", "wrap Charge", "charge", "wrap Ship", "ship",
+		"wrap Charge", "refund order", "wrap Reserve", "unreserve order", "wrap Rollback", "rollback",
+	}
+	if steps := log.get(); !slices.Equal(steps, expected) {
+		t.Fatalf("expected %v, got %v", expected, steps)
+	}
+}
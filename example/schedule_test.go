@@ -0,0 +1,128 @@
+package example_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestScheduledSubmission(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	started := make(chan time.Time, 1)
+
+	build := func(ctx context.Context) example.TestMachineFSM {
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				started <- time.Now()
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(ctx, fsm.WithStore(store), fsm.WithPollInterval(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// Schedule a task, then restart before it is due
+	ctx, stop := context.WithCancel(t.Context())
+	defer stop()
+	f := build(ctx)
+
+	at := time.Now().Add(300 * time.Millisecond)
+	id, err := f.SubmitAt(t.Context(), at, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := f.Status(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Scheduled() || status.State != example.TestMachineStateState1 || status.ScheduledAt.UnixMilli() != at.UnixMilli() {
+		t.Fatalf("expected task to be scheduled in %s at %s, got %+v", example.TestMachineStateState1, at, status)
+	}
+
+	stop()
+	f = build(t.Context())
+
+	select {
+	case actual := <-started:
+		if actual.Before(at) {
+			t.Fatalf("expected task to start no earlier than %s, got %s", at, actual)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for scheduled task")
+	}
+
+	if state, err := f.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+	if status, err := f.Status(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if status.Scheduled() {
+		t.Fatalf("expected finished task not to be scheduled, got %+v", status)
+	}
+}
+
+func TestScheduledTransition(t *testing.T) {
+	transitioned := make(chan time.Time, 1)
+	started := make(chan time.Time, 1)
+
+	f, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+			transitioned <- time.Now()
+			return transitions.ToState2After(ctx, 200*time.Millisecond, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+			started <- time.Now()
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(), fsm.WithStore(fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := f.SubmitAfter(t.Context(), 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := <-transitioned
+
+	// The transition is recorded right away, and the step waits for its time
+	deadline := time.After(time.Second)
+	for {
+		status, err := f.Status(t.Context(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == example.TestMachineStateState2 {
+			if !status.Scheduled() {
+				t.Fatalf("expected %s to be scheduled, got %+v", example.TestMachineStateState2, status)
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for scheduled transition")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if after := <-started; after.Sub(before) < 200*time.Millisecond {
+		t.Fatalf("expected %s to start 200ms after the transition, got %s", example.TestMachineStateState2, after.Sub(before))
+	}
+	if state, err := f.Wait(t.Context(), id); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachineStateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachineStateDone, state)
+	}
+}
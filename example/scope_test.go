@@ -0,0 +1,148 @@
+package example_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestMachinesSharingStore(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+
+	// Both machines have a State1, which only sees its own machine's tasks
+	var state1, state2 atomic.Int64
+	f := buildCountingMachine(t, t.Context(), store, &state1, &state2)
+	var other atomic.Int64
+	f2, err := example.NewTestMachine2FSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachine2State1Transitions, c int) error {
+			other.Add(1)
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachine2State2Transitions, c int) error {
+			return transitions.ToState3(ctx, c)
+		}).
+		FromState3(func(ctx context.Context, transitions example.TestMachine2State3Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context(),
+			fsm.WithStore(store),
+			fsm.WithPollInterval(10*time.Millisecond),
+		)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]fsm.TaskID, 0)
+	ids2 := make([]fsm.TaskID, 0)
+	for i := range 5 {
+		id, err := f.Submit(t.Context(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		if id, err = f2.Submit(t.Context(), i); err != nil {
+			t.Fatal(err)
+		}
+		ids2 = append(ids2, id)
+	}
+	for _, id := range ids {
+		waitForDone(t, f, id)
+	}
+	for _, id := range ids2 {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if state, err := f2.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachine2StateDone {
+			t.Fatalf("expected task %d to finish in %s, got %s", id, example.TestMachine2StateDone, state)
+		}
+	}
+	if n, n2 := state1.Load(), other.Load(); n != 5 || n2 != 5 {
+		t.Errorf("expected 5 State1 steps in each machine, got %d and %d", n, n2)
+	}
+
+	// Tasks of other machines aren't found
+	if _, err := f2.Status(t.Context(), ids[0]); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Errorf("expected %v, got %v", fsm.ErrTaskNotFound, err)
+	}
+	if err := f2.Cancel(t.Context(), ids[0], "test"); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Errorf("expected %v, got %v", fsm.ErrTaskNotFound, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	store := fsm.OnDisk(filepath.Join(t.TempDir(), "fsm.db"))
+	build := func(namespace string, steps *atomic.Int64) example.TestMachineFSM {
+		f, err := example.NewTestMachineFSMBuilder().
+			FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error {
+				steps.Add(1)
+				return transitions.ToState2(ctx, c)
+			}).
+			FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error {
+				return transitions.ToDone(ctx)
+			}).
+			BuildAndStart(t.Context(),
+				fsm.WithStore(store),
+				fsm.WithPollInterval(10*time.Millisecond),
+				fsm.WithNamespace(namespace),
+			)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	var acmeSteps, globexSteps atomic.Int64
+	acme, globex := build("acme", &acmeSteps), build("globex", &globexSteps)
+
+	// Pauses only hold in their own namespace
+	if err := acme.PauseAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if paused, err := globex.Paused(t.Context(), example.TestMachineStateState1); err != nil || paused {
+		t.Fatalf("expected globex not to be paused, got %t, %v", paused, err)
+	}
+
+	// Idempotency keys are only unique within a namespace
+	ctx := fsm.PutIdempotencyKey(t.Context(), "import-1")
+	id, err := acme.Submit(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := globex.Submit(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == id2 {
+		t.Fatalf("expected a task in each namespace, got %d twice", id)
+	}
+	waitForDone(t, globex, id2)
+
+	time.Sleep(50 * time.Millisecond)
+	if n := acmeSteps.Load(); n != 0 {
+		t.Fatalf("expected no steps in paused acme, got %d", n)
+	}
+	if _, err := globex.Status(t.Context(), id); !errors.Is(err, fsm.ErrTaskNotFound) {
+		t.Errorf("expected %v, got %v", fsm.ErrTaskNotFound, err)
+	}
+
+	if err := acme.ResumeAll(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	waitForDone(t, acme, id)
+	if n, n2 := acmeSteps.Load(), globexSteps.Load(); n != 1 || n2 != 1 {
+		t.Errorf("expected one step in each namespace, got %d and %d", n, n2)
+	}
+
+	if _, err := example.NewTestMachineFSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachineState1Transitions, c int) error { return nil }).
+		FromState2(func(ctx context.Context, transitions example.TestMachineState2Transitions, c int) error { return nil }).
+		BuildAndStart(t.Context(), fsm.WithStore(store), fsm.WithNamespace("")); err == nil {
+		t.Error("expected an empty namespace to be rejected")
+	}
+}
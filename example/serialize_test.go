@@ -0,0 +1,155 @@
+package example_test
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/egoodhall/fsm"
+	"github.com/egoodhall/fsm/example"
+)
+
+func TestSerializedRegion(t *testing.T) {
+	var lock sync.Mutex
+	inside := make(map[string]int)
+	var running, maxRunning int
+	entered := make(map[string][]int)
+	keys := make(map[int]string)
+
+	// Track tasks from entering State2 until they are about to leave State3
+	enter := func(c int) {
+		lock.Lock()
+		defer lock.Unlock()
+		key := keys[c]
+		inside[key]++
+		if inside[key] > 1 {
+			t.Errorf("expected one task at a time for key %s, got %d", key, inside[key])
+		}
+		entered[key] = append(entered[key], c)
+		running++
+		maxRunning = max(maxRunning, running)
+	}
+	leave := func(c int) {
+		lock.Lock()
+		defer lock.Unlock()
+		inside[keys[c]]--
+		running--
+	}
+
+	f, err := example.NewTestMachine2FSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachine2State1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachine2State2Transitions, c int) error {
+			enter(c)
+			time.Sleep(20 * time.Millisecond)
+			return transitions.ToState3(ctx, c)
+		}).
+		FromState3(func(ctx context.Context, transitions example.TestMachine2State3Transitions, c int) error {
+			time.Sleep(20 * time.Millisecond)
+			leave(c)
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []fsm.TaskID
+	submitted := make(map[string][]int)
+	for c := range 12 {
+		key := []string{"a", "b", "c"}[c%3]
+		lock.Lock()
+		keys[c] = key
+		lock.Unlock()
+		submitted[key] = append(submitted[key], c)
+
+		id, err := f.Submit(fsm.PutConcurrencyKey(t.Context(), key), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		if state, err := f.Wait(ctx, id); err != nil {
+			t.Fatal(err)
+		} else if state != example.TestMachine2StateDone {
+			t.Fatalf("expected %s, got %s", example.TestMachine2StateDone, state)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for key, expected := range submitted {
+		if !slices.Equal(entered[key], expected) {
+			t.Errorf("expected key %s to enter in order %v, got %v", key, expected, entered[key])
+		}
+	}
+	if maxRunning < 2 {
+		t.Errorf("expected tasks with different keys to run in parallel, got at most %d", maxRunning)
+	}
+}
+
+func TestSerializedRegionCancel(t *testing.T) {
+	started := make(chan int, 2)
+
+	f, err := example.NewTestMachine2FSMBuilder().
+		FromState1(func(ctx context.Context, transitions example.TestMachine2State1Transitions, c int) error {
+			return transitions.ToState2(ctx, c)
+		}).
+		FromState2(func(ctx context.Context, transitions example.TestMachine2State2Transitions, c int) error {
+			started <- c
+			if c == 0 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return transitions.ToState3(ctx, c)
+		}).
+		FromState3(func(ctx context.Context, transitions example.TestMachine2State3Transitions, c int) error {
+			return transitions.ToDone(ctx)
+		}).
+		BuildAndStart(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := fsm.PutConcurrencyKey(t.Context(), "repo")
+	blocking, err := f.Submit(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	waiting, err := f.Submit(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second task is held back while the first is in the region
+	select {
+	case c := <-started:
+		t.Fatalf("expected task %d to wait for the region", c)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if status, err := f.Status(t.Context(), waiting); err != nil {
+		t.Fatal(err)
+	} else if status.State != example.TestMachine2StateState2 {
+		t.Fatalf("expected task to wait in %s, got %s", example.TestMachine2StateState2, status.State)
+	}
+
+	// Cancelling the first task lets it in
+	if err := f.Cancel(t.Context(), blocking, "test"); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	if state, err := f.Wait(timeout, waiting); err != nil {
+		t.Fatal(err)
+	} else if state != example.TestMachine2StateDone {
+		t.Fatalf("expected %s, got %s", example.TestMachine2StateDone, state)
+	}
+}
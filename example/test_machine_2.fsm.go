@@ -4,11 +4,16 @@ package example
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	fsm "github.com/egoodhall/fsm"
 	sqlc "github.com/egoodhall/fsm/gen/sqlc"
+	"iter"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 )
@@ -16,24 +21,70 @@ import (
 const (
 	TestMachine2StateState1 fsm.State = "State1"
 	TestMachine2StateState2 fsm.State = "State2"
+	TestMachine2StateState3 fsm.State = "State3"
 	TestMachine2StateDone   fsm.State = "Done"
 )
 
 type TestMachine2FSM interface {
 	fsm.SupportsOptions
 	Submit(ctx context.Context, int int) (fsm.TaskID, error)
+	TrySubmit(ctx context.Context, int int) (fsm.TaskID, error)
+	SubmitAt(ctx context.Context, at time.Time, int int) (fsm.TaskID, error)
+	SubmitAfter(ctx context.Context, delay time.Duration, int int) (fsm.TaskID, error)
+	SubmitBatch(ctx context.Context, inputs []TestMachine2State1Params) ([]fsm.TaskID, error)
+	SubmitSeq(ctx context.Context, inputs iter.Seq[TestMachine2State1Params]) ([]fsm.TaskID, error)
+	SubmitAndWait(ctx context.Context, int int) (fsm.TaskID, fsm.State, error)
+	Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error)
+	Cancel(ctx context.Context, id fsm.TaskID, reason string) error
+	Pause(ctx context.Context, state fsm.State) error
+	Resume(ctx context.Context, state fsm.State) error
+	PauseAll(ctx context.Context) error
+	ResumeAll(ctx context.Context) error
+	Paused(ctx context.Context, state fsm.State) (bool, error)
+	RetryNow(ctx context.Context, id fsm.TaskID, operator string) error
+	ForceState1(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceState2(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceState3(ctx context.Context, id fsm.TaskID, operator string, P0 int) error
+	ForceDone(ctx context.Context, id fsm.TaskID, operator string) error
+	Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error
+	Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error)
+	History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error)
 }
 
+type TestMachine2State1Params struct {
+	P0 int
+}
+
+type TestMachine2State2Params struct {
+	P0 int
+}
+
+type TestMachine2State3Params struct {
+	P0 int
+}
+
+type TestMachine2DoneParams struct{}
+
 func NewTestMachine2FSMBuilder() TestMachine2FSMBuilder_State1Stage {
 	return new(testMachine2FSM)
 }
 
 type TestMachine2State1Transitions interface {
 	ToState2(context.Context, int) error
+	ToState2At(context.Context, time.Time, int) error
+	ToState2After(context.Context, time.Duration, int) error
 }
 
 type TestMachine2State2Transitions interface {
+	ToState3(context.Context, int) error
+	ToState3At(context.Context, time.Time, int) error
+	ToState3After(context.Context, time.Duration, int) error
+}
+
+type TestMachine2State3Transitions interface {
 	ToDone(context.Context) error
+	ToDoneAt(context.Context, time.Time) error
+	ToDoneAfter(context.Context, time.Duration) error
 }
 
 type TestMachine2FSMBuilder_State1Stage interface {
@@ -41,7 +92,11 @@ type TestMachine2FSMBuilder_State1Stage interface {
 }
 
 type TestMachine2FSMBuilder_State2Stage interface {
-	FromState2(func(context.Context, TestMachine2State2Transitions, int) error) TestMachine2FSMBuilder__FinalStage
+	FromState2(func(context.Context, TestMachine2State2Transitions, int) error) TestMachine2FSMBuilder_State3Stage
+}
+
+type TestMachine2FSMBuilder_State3Stage interface {
+	FromState3(func(context.Context, TestMachine2State3Transitions, int) error) TestMachine2FSMBuilder__FinalStage
 }
 
 type TestMachine2FSMBuilder_DoneStage interface {
@@ -57,9 +112,11 @@ var _ TestMachine2FSM = new(testMachine2FSM)
 var _ fsm.SupportsOptions = new(testMachine2FSM)
 var _ TestMachine2FSMBuilder_State1Stage = new(testMachine2FSM)
 var _ TestMachine2FSMBuilder_State2Stage = new(testMachine2FSM)
+var _ TestMachine2FSMBuilder_State3Stage = new(testMachine2FSM)
 var _ TestMachine2FSMBuilder__FinalStage = new(testMachine2FSM)
 var _ TestMachine2State1Transitions = new(testMachine2FSM)
 var _ TestMachine2State2Transitions = new(testMachine2FSM)
+var _ TestMachine2State3Transitions = new(testMachine2FSM)
 
 // TestMachine2FSM implementation
 type testMachine2FSM_State1Params struct {
@@ -74,6 +131,12 @@ type testMachine2FSM_State2Params struct {
 	P0      int
 }
 
+type testMachine2FSM_State3Params struct {
+	ID      fsm.TaskID
+	Attempt int
+	P0      int
+}
+
 type testMachine2FSM_DoneParams struct {
 	ID      fsm.TaskID
 	Attempt int
@@ -84,19 +147,56 @@ type testMachine2FSM struct {
 	ctx  context.Context
 
 	// Configuration options
-	store        fsm.Store
-	onTransition fsm.TransitionListener
-	onCompletion fsm.CompletionListener
-	backoff      fsm.Backoff
+	store         fsm.Store
+	onTransition  fsm.TransitionListener
+	onCompletion  fsm.CompletionListener
+	onRateLimit   fsm.RateLimitListener
+	onBreaker     fsm.BreakerListener
+	middlewares   []fsm.Middleware
+	extractors    []fsm.MetadataExtractor
+	injectors     []fsm.MetadataInjector
+	backoff       fsm.Backoff
+	leaseTTL      time.Duration
+	pollInterval  time.Duration
+	aging         time.Duration
+	batchSize     int
+	namespace     string
+	adoptUnscoped func(fsm.TaskID) bool
 
 	// FSM state transitions
 	state1State func(context.Context, TestMachine2State1Transitions, int) error
 	state2State func(context.Context, TestMachine2State2Transitions, int) error
+	state3State func(context.Context, TestMachine2State3Transitions, int) error
 
-	// FSM queues
-	state1Queue chan testMachine2FSM_State1Params
-	state2Queue chan testMachine2FSM_State2Params
-	doneQueue   chan testMachine2FSM_DoneParams
+	// FSM state queues, rate limits, circuit breakers and backoffs
+	state1Queue   fsm.QueueConfig
+	state1Limiter *fsm.Limiter
+	state1Breaker *fsm.Breaker
+	state1Backoff fsm.Backoff
+	state2Queue   fsm.QueueConfig
+	state2Limiter *fsm.Limiter
+	state2Breaker *fsm.Breaker
+	state2Backoff fsm.Backoff
+	state3Queue   fsm.QueueConfig
+	state3Limiter *fsm.Limiter
+	state3Breaker *fsm.Breaker
+	state3Backoff fsm.Backoff
+
+	// FSM queue signals, and the owner of this instance's leases
+	state1Ready chan struct{}
+	state2Ready chan struct{}
+	state3Ready chan struct{}
+	doneReady   chan struct{}
+	owner       string
+	// Closed and replaced each time steps leave a queue, to wake blocked submissions
+	spaceLock sync.Mutex
+	space     chan struct{}
+
+	// Running tasks and their waiters
+	tasksLock sync.Mutex
+	// A task's next step can start before the handler that moved it there returns
+	running map[fsm.TaskID]map[context.Context]context.CancelCauseFunc
+	waiters map[fsm.TaskID][]chan fsm.State
 }
 
 // FSM builder methods
@@ -106,11 +206,16 @@ func (f *testMachine2FSM) FromState1(fn func(context.Context, TestMachine2State1
 	return f
 }
 
-func (f *testMachine2FSM) FromState2(fn func(context.Context, TestMachine2State2Transitions, int) error) TestMachine2FSMBuilder__FinalStage {
+func (f *testMachine2FSM) FromState2(fn func(context.Context, TestMachine2State2Transitions, int) error) TestMachine2FSMBuilder_State3Stage {
 	f.state2State = fn
 	return f
 }
 
+func (f *testMachine2FSM) FromState3(fn func(context.Context, TestMachine2State3Transitions, int) error) TestMachine2FSMBuilder__FinalStage {
+	f.state3State = fn
+	return f
+}
+
 func (f *testMachine2FSM) BuildAndStart(ctx context.Context, opts ...fsm.Option) (TestMachine2FSM, error) {
 	// Check if FSM is already started
 	if !f.lock.TryLock() {
@@ -120,10 +225,40 @@ func (f *testMachine2FSM) BuildAndStart(ctx context.Context, opts ...fsm.Option)
 	// Set context
 	f.ctx = ctx
 
-	// Initialize state queues
-	f.state1Queue = make(chan testMachine2FSM_State1Params, 5)
-	f.state2Queue = make(chan testMachine2FSM_State2Params, 5)
-	f.doneQueue = make(chan testMachine2FSM_DoneParams, 5)
+	// Initialize state queue signals
+	f.state1Ready = make(chan struct{}, 1)
+	f.state2Ready = make(chan struct{}, 1)
+	f.state3Ready = make(chan struct{}, 1)
+	f.doneReady = make(chan struct{}, 1)
+	f.owner = rand.Text()
+	f.space = make(chan struct{})
+
+	// Initialize task tracking
+	f.running = make(map[fsm.TaskID]map[context.Context]context.CancelCauseFunc)
+	f.waiters = make(map[fsm.TaskID][]chan fsm.State)
+
+	// Initialize state queues, rate limits, circuit breakers and backoffs
+	// from the model, which options may override
+	f.state1Queue = fsm.QueueConfig{
+		Capacity: 1000,
+		Overflow: fsm.OverflowReject,
+	}
+	f.state1Limiter = fsm.NewLimiter(fsm.MustParseRate("100/s"), 10)
+	f.state1Breaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(TestMachine2StateState1))
+	f.state2Limiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.state2Breaker = fsm.NewBreaker(fsm.BreakerConfig{}, f.breakerListener(TestMachine2StateState2))
+	f.state3Limiter = fsm.NewLimiter(fsm.Rate{}, 0)
+	f.state3Breaker = fsm.NewBreaker(fsm.BreakerConfig{
+		Cooldown:  30 * time.Second,
+		Threshold: 0.5,
+		Window:    10,
+	}, f.breakerListener(TestMachine2StateState3))
+	f.state3Backoff = fsm.BackoffConfig{
+		Base:   100 * time.Millisecond,
+		Jitter: fsm.JitterFull,
+		Max:    1 * time.Minute,
+		Type:   fsm.BackoffExponential,
+	}.Backoff()
 
 	// Apply options
 	for _, opt := range opts {
@@ -141,60 +276,156 @@ func (f *testMachine2FSM) BuildAndStart(ctx context.Context, opts ...fsm.Option)
 	if f.backoff == nil {
 		f.backoff = fsm.LinearBackoff(500*time.Millisecond, 30*time.Second)
 	}
+	if f.leaseTTL == 0 {
+		f.leaseTTL = 30 * time.Second
+	}
+	if f.pollInterval == 0 {
+		f.pollInterval = time.Second
+	}
+	if f.aging == 0 {
+		f.aging = time.Minute
+	}
+	if f.batchSize == 0 {
+		f.batchSize = 1000
+	}
+
+	// Adopt tasks stored before tasks were scoped to an FSM
+	if err := f.adoptTasks(f.ctx); err != nil {
+		return nil, err
+	}
+	// Resume tasks stored before their steps were queued in the store
+	if err := f.resumeTasks(f.ctx); err != nil {
+		return nil, err
+	}
 
-	// Start FSM processors
+	// Start FSM processors. Existing work, including steps whose lease
+	// expired in a process that died, is claimed from the store.
 	// Start 1 state1Processor
 	go f.state1Processor()
 	// Start 5 state2Processors
 	for _ = range 5 {
 		go f.state2Processor()
 	}
+	// Start 5 state3Processors
+	for _ = range 5 {
+		go f.state3Processor()
+	}
 	// Start 1 doneProcessor
 	go f.doneProcessor()
-
-	// Resume existingtasks
-	if err := f.resumeTasks(); err != nil {
-		return nil, err
-	}
 	return f, nil
 }
 
-func (f *testMachine2FSM) resumeTasks() error {
-	tasks, err := f.store.Q().ListTasks(f.ctx)
-	if err != nil {
-		return err
-	}
-	for _, task := range tasks {
-		transition, err := f.store.Q().GetLastValidTransition(f.ctx, task.ID)
+// adoptTasks scopes the tasks stored before tasks had an FSM, and their
+// concurrency locks, to this FSM and namespace. Only tasks that fit the FSM
+// are adopted, and only those WithUnscopedTasks accepts, since they can't
+// be told apart from other FSMs' tasks that fit too. Without the option, the
+// FSM doesn't start while tasks that fit it exist.
+func (f *testMachine2FSM) adoptTasks(ctx context.Context) error {
+	return f.store.Tx(ctx, func(q fsm.Q) error {
+		tasks, err := q.ListUnscopedTasks(ctx)
 		if err != nil {
 			return err
 		}
+		var fitting []sqlc.Task
+		for _, task := range tasks {
+			if ok, err := f.fits(ctx, q, task); err != nil {
+				return err
+			} else if ok {
+				fitting = append(fitting, task)
+			}
+		}
+		if len(fitting) == 0 {
+			return nil
+		}
+		if f.adoptUnscoped == nil {
+			return fmt.Errorf("%w: count = %d", fsm.ErrUnscopedTasks, len(fitting))
+		}
 
-		switch fsm.State(transition.ToState) {
-		case TestMachine2StateState1:
-			var msg testMachine2FSM_State1Params
-			if err := gob.NewDecoder(bytes.NewReader(task.Data)).Decode(&msg); err != nil {
+		var n int
+		for _, task := range fitting {
+			if !f.adoptUnscoped(fsm.TaskID(task.ID)) {
+				continue
+			}
+			if err := q.AdoptUnscopedTask(ctx, "TestMachine2", f.namespace, task.ID); err != nil {
 				return err
 			}
-			fsm.Logger(f.ctx).Info("Resuming task", "id", task.ID)
-			select {
-			case f.state1Queue <- msg:
-				return nil
-			case <-f.ctx.Done():
-				return errors.New("task submission cancelled")
+			if err := q.AdoptUnscopedLocks(ctx, "TestMachine2", f.namespace, task.ID); err != nil {
+				return err
+			}
+			n++
+		}
+		fsm.Logger(ctx).Info("Adopted unscoped tasks", "count", n, "skipped", len(fitting)-n)
+		return nil
+	})
+}
+
+// fits reports whether an unscoped task could be one of this FSM's: its
+// input decodes as the entrypoint's, and it only went through the FSM's
+// states.
+func (f *testMachine2FSM) fits(ctx context.Context, q fsm.Q, task sqlc.Task) (bool, error) {
+	if _, err := f.decodeParams(TestMachine2StateState1, task.Data); err != nil {
+		return false, nil
+	}
+	history, err := q.GetHistory(ctx, task.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, step := range history {
+		for _, state := range []fsm.State{fsm.State(step.FromState), fsm.State(step.ToState)} {
+			switch state {
+			case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+				continue
+			}
+			if f.stateError(state) != nil {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// resumeTasks queues the current step of tasks stored before steps were
+// queued in the store. Each task is only resumed once.
+func (f *testMachine2FSM) resumeTasks(ctx context.Context) error {
+	tasks, err := f.store.Q().ListUnqueuedTasks(ctx, "TestMachine2", f.namespace)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		id := fsm.TaskID(task.ID)
+		var state fsm.State
+		now := time.Now()
+		if err := f.store.Tx(ctx, func(q fsm.Q) error {
+			if err := q.DeleteUnqueuedTask(ctx, task.ID); err != nil {
+				return err
 			}
-		case TestMachine2StateState2:
-			var msg testMachine2FSM_State2Params
-			if err := gob.NewDecoder(bytes.NewReader(task.Data)).Decode(&msg); err != nil {
+			transition, err := f.lastTransition(ctx, q, id)
+			if err != nil {
 				return err
 			}
-			fsm.Logger(f.ctx).Info("Resuming task", "id", task.ID)
-			select {
-			case f.state2Queue <- msg:
+			state = fsm.State(transition.ToState)
+			if f.isTerminal(state) {
 				return nil
-			case <-f.ctx.Done():
-				return errors.New("task submission cancelled")
 			}
+			// Tasks that never transitioned start from their input
+			data := transition.Data
+			if transition.ID == 0 {
+				data = task.Data
+			}
+			if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+				TaskID:  task.ID,
+				State:   string(state),
+				Data:    data,
+				ReadyAt: now.UnixMilli(),
+			}); err != nil {
+				return err
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !f.isTerminal(state) {
+			fsm.Logger(ctx).Info("Resuming task", "id", id, "state", state)
 		}
 	}
 	return nil
@@ -218,200 +449,1487 @@ func (f *testMachine2FSM) WithCompletionListener(listener fsm.CompletionListener
 	f.onCompletion = listener
 }
 
+func (f *testMachine2FSM) WithRateLimitListener(listener fsm.RateLimitListener) {
+	f.onRateLimit = listener
+}
+
+func (f *testMachine2FSM) WithBreakerListener(listener fsm.BreakerListener) {
+	f.onBreaker = listener
+}
+
+func (f *testMachine2FSM) WithMiddleware(middleware fsm.Middleware) {
+	f.middlewares = append(f.middlewares, middleware)
+}
+
+func (f *testMachine2FSM) WithMetadataExtractor(extractor fsm.MetadataExtractor) {
+	f.extractors = append(f.extractors, extractor)
+}
+
+func (f *testMachine2FSM) WithMetadataInjector(injector fsm.MetadataInjector) {
+	f.injectors = append(f.injectors, injector)
+}
+
 func (f *testMachine2FSM) WithBackoff(backoff fsm.Backoff) {
 	f.backoff = backoff
 }
 
+func (f *testMachine2FSM) WithStateBackoff(state fsm.State, backoff fsm.Backoff) error {
+	switch state {
+	case TestMachine2StateState1:
+		f.state1Backoff = backoff
+	case TestMachine2StateState2:
+		f.state2Backoff = backoff
+	case TestMachine2StateState3:
+		f.state3Backoff = backoff
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a backoff", state)
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) WithQueue(state fsm.State, config fsm.QueueConfig) error {
+	switch state {
+	case TestMachine2StateState1:
+		f.state1Queue = config
+	case TestMachine2StateState2:
+		f.state2Queue = config
+	case TestMachine2StateState3:
+		f.state3Queue = config
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a queue", state)
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) WithLease(ttl time.Duration) {
+	f.leaseTTL = ttl
+}
+
+func (f *testMachine2FSM) WithPollInterval(interval time.Duration) {
+	f.pollInterval = interval
+}
+
+func (f *testMachine2FSM) WithPriorityAging(interval time.Duration) {
+	f.aging = interval
+}
+
+func (f *testMachine2FSM) WithBatchSize(size int) {
+	f.batchSize = size
+}
+
+func (f *testMachine2FSM) WithNamespace(namespace string) {
+	f.namespace = namespace
+}
+
+func (f *testMachine2FSM) WithUnscopedTasks(adopt func(fsm.TaskID) bool) {
+	f.adoptUnscoped = adopt
+}
+
+func (f *testMachine2FSM) WithRate(state fsm.State, rate fsm.Rate, burst int) error {
+	switch state {
+	case TestMachine2StateState1:
+		f.state1Limiter.SetRate(rate, burst)
+	case TestMachine2StateState2:
+		f.state2Limiter.SetRate(rate, burst)
+	case TestMachine2StateState3:
+		f.state3Limiter.SetRate(rate, burst)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a rate limit", state)
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) WithBreaker(state fsm.State, config fsm.BreakerConfig) error {
+	switch state {
+	case TestMachine2StateState1:
+		f.state1Breaker.SetConfig(config)
+	case TestMachine2StateState2:
+		f.state2Breaker.SetConfig(config)
+	case TestMachine2StateState3:
+		f.state3Breaker.SetConfig(config)
+	default:
+		if err := f.stateError(state); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s can't have a circuit breaker", state)
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) WithDeadline(state fsm.State, after time.Duration) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s can't have a deadline", state)
+}
+
 // FSM transition methods
 
 func (f *testMachine2FSM) ToState1(ctx context.Context, P0 int) error {
-	id := fsm.GetTaskID(ctx)
-	fromState := fsm.GetState(ctx)
-	toState := fsm.State(TestMachine2StateState1)
-	msg := testMachine2FSM_State1Params{ID: id, P0: P0}
+	return f.ToState1At(ctx, time.Now(), P0)
+}
+
+func (f *testMachine2FSM) ToState1After(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToState1At(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *testMachine2FSM) ToState1At(ctx context.Context, at time.Time, P0 int) error {
+	msg := testMachine2FSM_State1Params{ID: fsm.GetTaskID(ctx), P0: P0}
 
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	if err := f.store.Q().RecordTransition(ctx, sqlc.RecordTransitionParams{
-		TaskID:    int64(id),
-		Attempt:   int64(fsm.GetAttempt(ctx)),
-		FromState: string(fromState),
-		ToState:   string(toState),
-		Data:      buf.Bytes(),
-	}); err != nil {
-		return err
-	}
-	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
-	if f.onTransition != nil {
-		f.onTransition(ctx, msg.ID, fromState, toState)
-	}
-
-	select {
-	case f.state1Queue <- msg:
-		return nil
-	case <-ctx.Done():
-		return fmt.Errorf("task submission cancelled: id = %d", id)
-	}
+	return f.transition(ctx, TestMachine2StateState1, buf.Bytes(), at)
 }
 
 func (f *testMachine2FSM) ToState2(ctx context.Context, P0 int) error {
-	id := fsm.GetTaskID(ctx)
-	fromState := fsm.GetState(ctx)
-	toState := fsm.State(TestMachine2StateState2)
-	msg := testMachine2FSM_State2Params{ID: id, P0: P0}
+	return f.ToState2At(ctx, time.Now(), P0)
+}
+
+func (f *testMachine2FSM) ToState2After(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToState2At(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *testMachine2FSM) ToState2At(ctx context.Context, at time.Time, P0 int) error {
+	msg := testMachine2FSM_State2Params{ID: fsm.GetTaskID(ctx), P0: P0}
 
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	if err := f.store.Q().RecordTransition(ctx, sqlc.RecordTransitionParams{
-		TaskID:    int64(id),
-		Attempt:   int64(fsm.GetAttempt(ctx)),
-		FromState: string(fromState),
-		ToState:   string(toState),
-		Data:      buf.Bytes(),
-	}); err != nil {
-		return err
-	}
-	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
-	if f.onTransition != nil {
-		f.onTransition(ctx, msg.ID, fromState, toState)
-	}
+	return f.transition(ctx, TestMachine2StateState2, buf.Bytes(), at)
+}
 
-	select {
-	case f.state2Queue <- msg:
-		return nil
-	case <-ctx.Done():
-		return fmt.Errorf("task submission cancelled: id = %d", id)
-	}
+func (f *testMachine2FSM) ToState3(ctx context.Context, P0 int) error {
+	return f.ToState3At(ctx, time.Now(), P0)
 }
 
-func (f *testMachine2FSM) ToDone(ctx context.Context) error {
-	id := fsm.GetTaskID(ctx)
-	fromState := fsm.GetState(ctx)
-	toState := fsm.State(TestMachine2StateDone)
-	msg := testMachine2FSM_DoneParams{ID: id}
+func (f *testMachine2FSM) ToState3After(ctx context.Context, delay time.Duration, P0 int) error {
+	return f.ToState3At(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *testMachine2FSM) ToState3At(ctx context.Context, at time.Time, P0 int) error {
+	msg := testMachine2FSM_State3Params{ID: fsm.GetTaskID(ctx), P0: P0}
 
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	if err := f.store.Q().RecordTransition(ctx, sqlc.RecordTransitionParams{
-		TaskID:    int64(id),
-		Attempt:   int64(fsm.GetAttempt(ctx)),
-		FromState: string(fromState),
-		ToState:   string(toState),
-		Data:      buf.Bytes(),
-	}); err != nil {
+	return f.transition(ctx, TestMachine2StateState3, buf.Bytes(), at)
+}
+
+func (f *testMachine2FSM) ToDone(ctx context.Context) error {
+	return f.ToDoneAt(ctx, time.Now())
+}
+
+func (f *testMachine2FSM) ToDoneAfter(ctx context.Context, delay time.Duration) error {
+	return f.ToDoneAt(ctx, time.Now().Add(delay))
+}
+
+func (f *testMachine2FSM) ToDoneAt(ctx context.Context, at time.Time) error {
+	msg := testMachine2FSM_DoneParams{ID: fsm.GetTaskID(ctx)}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
-	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
-	if f.onTransition != nil {
-		f.onTransition(ctx, msg.ID, fromState, toState)
-	}
 
-	select {
-	case f.doneQueue <- msg:
-		return nil
-	case <-ctx.Done():
-		return fmt.Errorf("task submission cancelled: id = %d", id)
-	}
+	return f.transition(ctx, TestMachine2StateDone, buf.Bytes(), at)
 }
 
 func (f *testMachine2FSM) state1Processor() {
 	ctx := fsm.PutState(f.ctx, fsm.State(TestMachine2StateState1))
-	for msg := range f.state1Queue {
-		ctx2 := fsm.PutAttempt(ctx, msg.Attempt)
-		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", TestMachine2StateState1)
-		if err := f.state1State(fsm.PutTaskID(ctx2, msg.ID), f, msg.P0); err != nil {
-			msg.Attempt++
-			delay := f.backoff(msg.Attempt)
-			fsm.Logger(ctx).Debug("Processing error", "id", msg.ID, "attempt", msg.Attempt, "delay", delay, "state", TestMachine2StateState1, "error", err)
-			if err := f.store.Q().RecordTransition(ctx2, sqlc.RecordTransitionParams{
-				TaskID:    int64(msg.ID),
-				Attempt:   int64(msg.Attempt),
-				FromState: string(TestMachine2StateState1),
-				ToState:   string(fsm.StateError),
-				Data:      []byte(err.Error()),
-			}); err != nil {
-				fsm.Logger(ctx).Debug("Failed to record transition", "id", msg.ID, "attempt", msg.Attempt, "delay", delay, "state", TestMachine2StateState1, "error", err)
-			}
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.state1Breaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, TestMachine2StateState1, f.state1Ready, f.state1Limiter)
+		if !ok {
+			f.state1Breaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.state1Limiter, item, wait)
 
-			go func() {
-				<-time.After(delay)
-				select {
-				case f.state1Queue <- msg:
-				case <-ctx.Done():
-				}
-			}()
+		var msg testMachine2FSM_State1Params
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", TestMachine2StateState1, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.state1Breaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", TestMachine2StateState1)
+			f.ack(ctx, item)
+			f.state1Breaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", TestMachine2StateState1)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, TestMachine2StateState1, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.state1State(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.state1Breaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
 		}
+		f.fail(ctx2, item, err)
 	}
 }
 
 func (f *testMachine2FSM) state2Processor() {
 	ctx := fsm.PutState(f.ctx, fsm.State(TestMachine2StateState2))
-	for msg := range f.state2Queue {
-		ctx2 := fsm.PutAttempt(ctx, msg.Attempt)
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.state2Breaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, TestMachine2StateState2, f.state2Ready, f.state2Limiter)
+		if !ok {
+			f.state2Breaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.state2Limiter, item, wait)
+
+		var msg testMachine2FSM_State2Params
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", TestMachine2StateState2, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.state2Breaker.Abandon(probe)
+			continue
+		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", TestMachine2StateState2)
+			f.ack(ctx, item)
+			f.state2Breaker.Abandon(probe)
+			continue
+		}
 		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", TestMachine2StateState2)
-		if err := f.state2State(fsm.PutTaskID(ctx2, msg.ID), f, msg.P0); err != nil {
-			msg.Attempt++
-			delay := f.backoff(msg.Attempt)
-			fsm.Logger(ctx).Debug("Processing error", "id", msg.ID, "attempt", msg.Attempt, "delay", delay, "state", TestMachine2StateState2, "error", err)
-			if err := f.store.Q().RecordTransition(ctx2, sqlc.RecordTransitionParams{
-				TaskID:    int64(msg.ID),
-				Attempt:   int64(msg.Attempt),
-				FromState: string(TestMachine2StateState2),
-				ToState:   string(fsm.StateError),
-				Data:      []byte(err.Error()),
-			}); err != nil {
-				fsm.Logger(ctx).Debug("Failed to record transition", "id", msg.ID, "attempt", msg.Attempt, "delay", delay, "state", TestMachine2StateState2, "error", err)
-			}
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, TestMachine2StateState2, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.state2State(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.state2Breaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
+	}
+}
 
-			go func() {
-				<-time.After(delay)
-				select {
-				case f.state2Queue <- msg:
-				case <-ctx.Done():
-				}
-			}()
+func (f *testMachine2FSM) state3Processor() {
+	ctx := fsm.PutState(f.ctx, fsm.State(TestMachine2StateState3))
+	for {
+		// The breaker and rate limit hold steps back before they're claimed, so
+		// held back steps aren't leased
+		probe, err := f.state3Breaker.Allow(ctx)
+		if err != nil {
+			return
+		}
+		item, wait, ok := f.claim(ctx, TestMachine2StateState3, f.state3Ready, f.state3Limiter)
+		if !ok {
+			f.state3Breaker.Abandon(probe)
+			return
+		}
+		f.throttled(ctx, f.state3Limiter, item, wait)
+
+		var msg testMachine2FSM_State3Params
+		if err := gob.NewDecoder(bytes.NewReader(item.Data)).Decode(&msg); err != nil {
+			fsm.Logger(ctx).Error("Failed to decode message", "id", item.TaskID, "state", TestMachine2StateState3, "error", err)
+			// The attempt fails like a handler error, so the step backs off and
+			// the failure shows in the task's history
+			f.fail(ctx, item, fmt.Errorf("decode message: %w", err))
+			f.state3Breaker.Abandon(probe)
+			continue
 		}
+		msg.ID, msg.Attempt = fsm.TaskID(item.TaskID), int(item.Attempt)
+
+		// Transitions inherit the step's priority unless the handler overrides it
+		ctx2 := fsm.PutPriority(fsm.PutAttempt(ctx, msg.Attempt), int(item.Priority))
+		ctx3, ok := f.startTask(ctx2, msg.ID)
+		if !ok {
+			fsm.Logger(ctx2).Debug("Skipping cancelled task", "id", msg.ID, "state", TestMachine2StateState3)
+			f.ack(ctx, item)
+			f.state3Breaker.Abandon(probe)
+			continue
+		}
+		fsm.Logger(ctx2).Debug("Processing message", "id", msg.ID, "attempt", msg.Attempt, "state", TestMachine2StateState3)
+		ctx4, stop := f.heartbeat(fsm.PutQueueItem(fsm.PutTaskID(ctx3, msg.ID), item.ID), item)
+		err = f.handle(ctx4, TestMachine2StateState3, msg.ID, msg.Attempt, func(ctx context.Context) error {
+			return f.state3State(ctx, f, msg.P0)
+		})
+		f.record(ctx4, f.state3Breaker, probe, err)
+		stop()
+		f.finishTask(ctx3, msg.ID)
+		if err == nil || f.isCancelled(ctx, f.store.Q(), msg.ID) {
+			f.ack(ctx, item)
+			continue
+		}
+		f.fail(ctx2, item, err)
 	}
 }
 
 func (f *testMachine2FSM) doneProcessor() {
 	ctx := fsm.PutState(f.ctx, fsm.State(TestMachine2StateDone))
-	for msg := range f.doneQueue {
-		if f.onCompletion != nil {
-			f.onCompletion(ctx, msg.ID, fsm.State(TestMachine2StateDone))
+	for {
+		item, _, ok := f.claim(ctx, TestMachine2StateDone, f.doneReady, nil)
+		if !ok {
+			return
 		}
+		f.ack(ctx, item)
+		f.complete(ctx, fsm.TaskID(item.TaskID), fsm.State(TestMachine2StateDone))
 	}
 }
 
-// Submit FSM tasks
+func (f *testMachine2FSM) claim(ctx context.Context, state fsm.State, ready chan struct{}, limiter *fsm.Limiter) (sqlc.QueueItem, time.Duration, bool) {
+	var waited time.Duration
+	for {
+		wait, err := f.throttle(ctx, limiter)
+		waited += wait
+		if err != nil {
+			return sqlc.QueueItem{}, waited, false
+		}
 
-func (f *testMachine2FSM) Submit(ctx context.Context, P0 int) (fsm.TaskID, error) {
-	msg := testMachine2FSM_State1Params{P0: P0}
+		// Claims aren't interrupted, since the lease may be taken even if
+		// the claimed item is lost to a cancellation
+		uninterrupted := context.WithoutCancel(ctx)
+		var item sqlc.QueueItem
+		err = f.store.Tx(uninterrupted, func(q fsm.Q) (err error) {
+			region := f.region(state)
+			item, err = q.ClaimQueueItem(uninterrupted, sqlc.ClaimQueueItemParams{
+				Owner:     f.owner,
+				LeaseMs:   f.leaseTTL.Milliseconds(),
+				State:     string(state),
+				Fsm:       "TestMachine2",
+				Namespace: f.namespace,
+				Region:    region,
+				AgingMs:   f.aging.Milliseconds(),
+			})
+			if err != nil || region == "" {
+				return err
+			}
+			// The task holds its key's region until it leaves
+			return q.AcquireConcurrencyLock(uninterrupted, region, item.TaskID)
+		})
+		if err == nil && ctx.Err() != nil {
+			f.release(ctx, item)
+			return item, waited, false
+		} else if err == nil {
+			// There may be more, so let another processor look
+			f.signal(state)
+			return item, waited, true
+		}
 
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return 0, err
+		// Idle processors don't hold on to tokens, so they can't start a burst
+		// of steps together once work arrives
+		if limiter != nil {
+			limiter.Refund()
+		}
+		if ctx.Err() != nil {
+			return item, waited, false
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			fsm.Logger(ctx).Error("Failed to claim queue item", "state", state, "error", err)
+		}
+		select {
+		case <-ready:
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return item, waited, false
+		}
+	}
+}
+
+func (f *testMachine2FSM) heartbeat(ctx context.Context, item sqlc.QueueItem) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(f.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if n, err := f.store.Q().RenewQueueItemLease(ctx, f.leaseTTL.Milliseconds(), item.ID, f.owner); err != nil && ctx.Err() == nil {
+				fsm.Logger(ctx).Error("Failed to renew lease", "id", item.TaskID, "state", item.State, "error", err)
+			} else if err == nil && n == 0 {
+				cancel(fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, item.TaskID, item.State))
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		cancel(nil)
 	}
+}
 
-	task, err := f.store.Q().CreateTask(ctx, buf.Bytes())
+func (f *testMachine2FSM) handle(ctx context.Context, state fsm.State, id fsm.TaskID, attempt int, handler func(context.Context) error) error {
+	ctx, err := f.restore(ctx, id)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	next := handler
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		middleware, inner := f.middlewares[i], next
+		next = func(ctx context.Context) error {
+			return middleware(ctx, "TestMachine2", state, id, attempt, inner)
+		}
 	}
-	msg.ID = fsm.TaskID(task.ID)
+	return next(ctx)
+}
 
-	select {
-	case f.state1Queue <- msg:
-		return msg.ID, nil
-	case <-ctx.Done():
-		return 0, errors.New("task submission cancelled")
+func (f *testMachine2FSM) metadata(ctx context.Context) ([]byte, error) {
+	metadata := make(map[string]string)
+	for _, extract := range f.extractors {
+		maps.Copy(metadata, extract(ctx))
+	}
+	maps.Copy(metadata, fsm.GetMetadata(ctx))
+	return fsm.EncodeMetadata(metadata)
+}
+
+func (f *testMachine2FSM) restore(ctx context.Context, id fsm.TaskID) (context.Context, error) {
+	data, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return ctx, err
+	}
+	metadata, err := fsm.DecodeMetadata(data)
+	if err != nil || metadata == nil {
+		return ctx, err
+	}
+	ctx = fsm.PutMetadata(ctx, metadata)
+	for _, inject := range f.injectors {
+		ctx = inject(ctx, metadata)
+	}
+	return ctx, nil
+}
+
+func (f *testMachine2FSM) throttle(ctx context.Context, limiter *fsm.Limiter) (time.Duration, error) {
+	if limiter == nil || !limiter.Limited() {
+		return 0, nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func (f *testMachine2FSM) throttled(ctx context.Context, limiter *fsm.Limiter, item sqlc.QueueItem, wait time.Duration) {
+	if limiter.Limited() && f.onRateLimit != nil {
+		f.onRateLimit(ctx, fsm.TaskID(item.TaskID), fsm.State(item.State), wait)
+	}
+}
+
+func (f *testMachine2FSM) record(ctx context.Context, breaker *fsm.Breaker, probe bool, err error) {
+	// Shutdowns, cancellations, lost claims, full queues and parked steps say
+	// nothing about the state's health
+	if err != nil && (ctx.Err() != nil || errors.Is(err, fsm.ErrTaskCancelled) || errors.Is(err, fsm.ErrClaimLost) || errors.Is(err, fsm.ErrQueueFull) || errors.Is(err, fsm.ErrChildRunning)) {
+		breaker.Abandon(probe)
+		return
+	}
+	breaker.Record(probe, err != nil)
+}
+
+func (f *testMachine2FSM) breakerListener(state fsm.State) func(from, to fsm.BreakerState) {
+	return func(from, to fsm.BreakerState) {
+		fsm.Logger(f.ctx).Info("Circuit breaker changed", "state", state, "from", from, "to", to)
+		if f.onBreaker != nil {
+			f.onBreaker(f.ctx, state, from, to)
+		}
+	}
+}
+
+func (f *testMachine2FSM) ack(ctx context.Context, item sqlc.QueueItem) {
+	// Finished work is acknowledged even while shutting down
+	if _, err := f.store.Q().AckQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to acknowledge queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.freeSpace()
+}
+
+func (f *testMachine2FSM) fail(ctx context.Context, item sqlc.QueueItem, cause error) {
+	if f.ctx.Err() != nil {
+		// Shutting down, so hand the step over without counting an attempt
+		f.release(ctx, item)
+		return
+	}
+	attempt := int(item.Attempt) + 1
+	delay := f.stateBackoff(fsm.State(item.State))(attempt, cause)
+	retryAt := time.Now().Add(delay).UnixMilli()
+	fsm.Logger(ctx).Debug("Processing error", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", cause)
+
+	err := f.store.Tx(ctx, func(q fsm.Q) error {
+		if n, err := q.RetryQueueItem(ctx, int64(attempt), retryAt, item.ID, f.owner); err != nil {
+			return err
+		} else if n == 0 {
+			return fsm.ErrClaimLost
+		}
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:        item.TaskID,
+			Attempt:       int64(attempt),
+			FromState:     item.State,
+			ToState:       string(fsm.StateError),
+			Data:          []byte(cause.Error()),
+			NextAttemptAt: &retryAt,
+		})
+	})
+	if errors.Is(err, fsm.ErrClaimLost) {
+		// The task has moved on, or another worker took over the step
+		return
+	} else if err != nil {
+		fsm.Logger(ctx).Debug("Failed to record transition", "id", item.TaskID, "attempt", attempt, "delay", delay, "state", item.State, "error", err)
+		f.release(ctx, item)
+		return
+	}
+	f.signalAt(fsm.State(item.State), time.UnixMilli(retryAt))
+}
+
+func (f *testMachine2FSM) release(ctx context.Context, item sqlc.QueueItem) {
+	if err := f.store.Q().ReleaseQueueItem(context.WithoutCancel(ctx), item.ID, f.owner); err != nil {
+		fsm.Logger(ctx).Error("Failed to release queue item", "id", item.TaskID, "state", item.State, "error", err)
+		return
+	}
+	f.signal(fsm.State(item.State))
+}
+
+func (f *testMachine2FSM) signal(state fsm.State) {
+	var ready chan struct{}
+	switch state {
+	case TestMachine2StateState1:
+		ready = f.state1Ready
+	case TestMachine2StateState2:
+		ready = f.state2Ready
+	case TestMachine2StateState3:
+		ready = f.state3Ready
+	case TestMachine2StateDone:
+		ready = f.doneReady
+	}
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+func (f *testMachine2FSM) queueConfig(state fsm.State) fsm.QueueConfig {
+	switch state {
+	case TestMachine2StateState1:
+		return f.state1Queue
+	case TestMachine2StateState2:
+		return f.state2Queue
+	case TestMachine2StateState3:
+		return f.state3Queue
+	}
+	return fsm.QueueConfig{}
+}
+
+func (f *testMachine2FSM) reserve(ctx context.Context, q fsm.Q, state fsm.State) error {
+	config := f.queueConfig(state)
+	if !config.Bounded() {
+		return nil
+	}
+	n, err := q.CountQueueItems(ctx, string(state), "TestMachine2", f.namespace)
+	if err != nil {
+		return err
+	}
+	if n >= int64(config.Capacity) {
+		return &fsm.QueueFullError{
+			Capacity: config.Capacity,
+			State:    state,
+		}
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) admit(ctx context.Context, block bool, fn func(fsm.Q) error) error {
+	for {
+		f.spaceLock.Lock()
+		space := f.space
+		f.spaceLock.Unlock()
+
+		err := f.store.Tx(ctx, fn)
+		var full *fsm.QueueFullError
+		if !block || !errors.As(err, &full) || !f.queueConfig(full.State).Blocks() {
+			return err
+		}
+
+		// Steps leaving the queue in other processes are only seen by polling
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		case <-space:
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+func (f *testMachine2FSM) freeSpace() {
+	f.spaceLock.Lock()
+	defer f.spaceLock.Unlock()
+	close(f.space)
+	f.space = make(chan struct{})
+}
+
+func (f *testMachine2FSM) stateBackoff(state fsm.State) fsm.Backoff {
+	var backoff fsm.Backoff
+	switch state {
+	case TestMachine2StateState1:
+		backoff = f.state1Backoff
+	case TestMachine2StateState2:
+		backoff = f.state2Backoff
+	case TestMachine2StateState3:
+		backoff = f.state3Backoff
+	}
+	if backoff == nil {
+		return f.backoff
+	}
+	return backoff
+}
+
+func (f *testMachine2FSM) region(state fsm.State) string {
+	switch state {
+	case TestMachine2StateState2, TestMachine2StateState3:
+		return "critical"
+	}
+	return ""
+}
+
+func (f *testMachine2FSM) signalRegion(region string) {
+	switch region {
+	case "critical":
+		f.signal(TestMachine2StateState2)
+		f.signal(TestMachine2StateState3)
+	}
+}
+
+func (f *testMachine2FSM) signalAt(state fsm.State, at time.Time) {
+	if delay := time.Until(at); delay > 0 {
+		time.AfterFunc(delay, func() {
+			f.signal(state)
+		})
+		return
+	}
+	f.signal(state)
+}
+
+func (f *testMachine2FSM) transition(ctx context.Context, toState fsm.State, data []byte, at time.Time) error {
+	id := fsm.GetTaskID(ctx)
+	fromState := fsm.GetState(ctx)
+	itemID, ok := fsm.GetQueueItem(ctx)
+	if !ok {
+		return fmt.Errorf("transition to %s outside of a task handler", toState)
+	}
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+	}
+
+	if err := f.admit(ctx, false, func(q fsm.Q) error {
+		if n, err := q.AckQueueItem(ctx, itemID, f.owner); err != nil {
+			return err
+		} else if n == 0 && f.isCancelled(ctx, q, id) {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrClaimLost, id, fromState)
+		}
+		if err := f.reserve(ctx, q, toState); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   int64(fsm.GetAttempt(ctx)),
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+		}); err != nil {
+			return err
+		}
+		// Leaving a serialized region lets the next task with the same key in
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Transitioned state", "id", id, "from", fromState, "to", toState)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signalAt(toState, at)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Submit FSM tasks
+
+func (f *testMachine2FSM) Submit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now(), P0)
+}
+
+func (f *testMachine2FSM) SubmitAfter(ctx context.Context, delay time.Duration, P0 int) (fsm.TaskID, error) {
+	return f.SubmitAt(ctx, time.Now().Add(delay), P0)
+}
+
+func (f *testMachine2FSM) SubmitAt(ctx context.Context, at time.Time, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, at, true, P0)
+}
+
+// TrySubmit never waits for room in a full queue
+
+func (f *testMachine2FSM) TrySubmit(ctx context.Context, P0 int) (fsm.TaskID, error) {
+	return f.submit(ctx, time.Now(), false, P0)
+}
+
+func (f *testMachine2FSM) submit(ctx context.Context, at time.Time, block bool, P0 int) (fsm.TaskID, error) {
+	msg := testMachine2FSM_State1Params{P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return 0, err
+	}
+
+	var key, concurrencyKey *string
+	if k, ok := fsm.GetIdempotencyKey(ctx); ok {
+		key = &k
+	}
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The task and its first step are stored together, once there is room
+	if err := f.admit(ctx, block, func(q fsm.Q) error {
+		// A repeated submission returns the task it already created
+		if key != nil {
+			task, err := q.GetTaskByIdempotencyKey(ctx, "TestMachine2", f.namespace, key)
+			if err == nil {
+				if !bytes.Equal(task.Data, buf.Bytes()) {
+					return fsm.ErrIdempotencyConflict
+				}
+				msg.ID = fsm.TaskID(task.ID)
+				return nil
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		if err := f.reserve(ctx, q, TestMachine2StateState1); err != nil {
+			return err
+		}
+		task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+			Data:           buf.Bytes(),
+			IdempotencyKey: key,
+			ConcurrencyKey: concurrencyKey,
+			Metadata:       metadata,
+			Fsm:            "TestMachine2",
+			Namespace:      f.namespace,
+		})
+		if err != nil {
+			return err
+		}
+		msg.ID = fsm.TaskID(task.ID)
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   task.ID,
+			State:    string(TestMachine2StateState1),
+			Data:     buf.Bytes(),
+			ReadyAt:  at.UnixMilli(),
+			Priority: int64(fsm.GetPriority(ctx)),
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	f.signalAt(TestMachine2StateState1, at)
+	return msg.ID, nil
+}
+
+// Submit FSM tasks in batches
+
+func (f *testMachine2FSM) SubmitBatch(ctx context.Context, inputs []TestMachine2State1Params) ([]fsm.TaskID, error) {
+	return f.SubmitSeq(ctx, slices.Values(inputs))
+}
+
+func (f *testMachine2FSM) SubmitSeq(ctx context.Context, inputs iter.Seq[TestMachine2State1Params]) ([]fsm.TaskID, error) {
+	if _, ok := fsm.GetIdempotencyKey(ctx); ok {
+		return nil, errors.New("batch submissions can't share an idempotency key")
+	}
+
+	var err error
+	ids := make([]fsm.TaskID, 0)
+	chunk := make([][]byte, 0, f.batchSize)
+	for input := range inputs {
+		msg := testMachine2FSM_State1Params{P0: input.P0}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+			return ids, err
+		}
+		chunk = append(chunk, buf.Bytes())
+		if len(chunk) == f.batchSize {
+			if ids, err = f.submitChunk(ctx, ids, chunk); err != nil {
+				return ids, err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	return f.submitChunk(ctx, ids, chunk)
+}
+
+// submitChunk stores a chunk of a batch in one transaction, and appends its
+// tasks to ids once it commits. When the entrypoint's queue fills up, the
+// tasks that fit are committed first, and the rest wait for room or are
+// rejected like single submissions.
+func (f *testMachine2FSM) submitChunk(ctx context.Context, ids []fsm.TaskID, chunk [][]byte) ([]fsm.TaskID, error) {
+	if len(chunk) == 0 {
+		return ids, nil
+	}
+	var concurrencyKey *string
+	if k, ok := fsm.GetConcurrencyKey(ctx); ok {
+		concurrencyKey = &k
+	}
+	metadata, err := f.metadata(ctx)
+	if err != nil {
+		return ids, err
+	}
+
+	for len(chunk) > 0 {
+		now := time.Now()
+		created := make([]fsm.TaskID, 0, len(chunk))
+		if err := f.admit(ctx, true, func(q fsm.Q) error {
+			created = created[:0]
+			for _, data := range chunk {
+				if err := f.reserve(ctx, q, TestMachine2StateState1); err != nil {
+					// Keep the tasks that fit, and stop at the first that doesn't
+					if len(created) > 0 && errors.Is(err, fsm.ErrQueueFull) {
+						return nil
+					}
+					return err
+				}
+				task, err := q.CreateTask(ctx, sqlc.CreateTaskParams{
+					Data:           data,
+					ConcurrencyKey: concurrencyKey,
+					Metadata:       metadata,
+					Fsm:            "TestMachine2",
+					Namespace:      f.namespace,
+				})
+				if err != nil {
+					return err
+				}
+				_, err = q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+					TaskID:   task.ID,
+					State:    string(TestMachine2StateState1),
+					Data:     data,
+					ReadyAt:  now.UnixMilli(),
+					Priority: int64(fsm.GetPriority(ctx)),
+				})
+				if err != nil {
+					return err
+				}
+				created = append(created, fsm.TaskID(task.ID))
+			}
+			return nil
+		}); err != nil {
+			return ids, err
+		}
+		f.signal(TestMachine2StateState1)
+		ids = append(ids, created...)
+		chunk = chunk[len(created):]
+	}
+	return ids, nil
+}
+
+// Cancel FSM tasks
+
+func (f *testMachine2FSM) Cancel(ctx context.Context, id fsm.TaskID, reason string) error {
+	var fromState fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if f.isTerminal(fromState) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, fromState)
+		}
+
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   transition.Attempt,
+			FromState: string(fromState),
+			ToState:   string(fsm.StateCancelled),
+			Data:      []byte(reason),
+		}); err != nil {
+			return err
+		}
+		// Drop any queued or pending work, and leave any serialized region
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		return q.ReleaseConcurrencyLocks(ctx, int64(id), "")
+	}); err != nil {
+		return err
+	}
+
+	// Stop the running handler
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: %s", fsm.ErrTaskCancelled, reason))
+	}
+	f.tasksLock.Unlock()
+	f.signalRegion(f.region(fromState))
+	f.freeSpace()
+
+	fsm.Logger(ctx).Debug("Cancelled task", "id", id, "from", fromState, "reason", reason)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, fsm.StateCancelled)
+	}
+	f.complete(ctx, id, fsm.StateCancelled)
+	return nil
+}
+
+func (f *testMachine2FSM) lastTransition(ctx context.Context, q fsm.Q, id fsm.TaskID) (sqlc.StateTransition, error) {
+	transition, err := q.GetLastValidTransition(ctx, int64(id), "TestMachine2", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := q.GetTask(ctx, int64(id), "TestMachine2", f.namespace); errors.Is(err, sql.ErrNoRows) {
+			return transition, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+		} else if err != nil {
+			return transition, err
+		}
+		return sqlc.StateTransition{
+			TaskID:  int64(id),
+			ToState: string(TestMachine2StateState1),
+		}, nil
+	}
+	return transition, err
+}
+
+func (f *testMachine2FSM) startTask(ctx context.Context, id fsm.TaskID) (context.Context, bool) {
+	f.tasksLock.Lock()
+	ctx2, cancel := context.WithCancelCause(ctx)
+	if f.running[id] == nil {
+		f.running[id] = make(map[context.Context]context.CancelCauseFunc)
+	}
+	f.running[id][ctx2] = cancel
+	f.tasksLock.Unlock()
+
+	// Cancel stops the handlers running when it commits, so handlers
+	// registered after that find the cancellation in the store
+	if f.isCancelled(ctx, f.store.Q(), id) {
+		f.finishTask(ctx2, id)
+		return ctx, false
+	}
+	return ctx2, true
+}
+
+func (f *testMachine2FSM) finishTask(ctx context.Context, id fsm.TaskID) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	if cancel, ok := f.running[id][ctx]; ok {
+		cancel(nil)
+		delete(f.running[id], ctx)
+	}
+	if len(f.running[id]) == 0 {
+		delete(f.running, id)
+	}
+}
+
+func (f *testMachine2FSM) isCancelled(ctx context.Context, q fsm.Q, id fsm.TaskID) bool {
+	transition, err := f.lastTransition(ctx, q, id)
+	if err != nil {
+		fsm.Logger(ctx).Error("Failed to get last transition", "id", id, "error", err)
+		return false
+	}
+	return fsm.State(transition.ToState) == fsm.StateCancelled
+}
+
+// Pause and resume FSM dispatch
+
+func (f *testMachine2FSM) Pause(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().PauseState(ctx, "TestMachine2", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused state", "state", state)
+	return nil
+}
+
+func (f *testMachine2FSM) Resume(ctx context.Context, state fsm.State) error {
+	if err := f.stateError(state); err != nil {
+		return err
+	}
+	if err := f.store.Q().ResumeState(ctx, "TestMachine2", f.namespace, string(state)); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed state", "state", state)
+	// Other processes pick the state's steps up when they next poll
+	f.signal(state)
+	return nil
+}
+
+func (f *testMachine2FSM) PauseAll(ctx context.Context) error {
+	if err := f.store.Q().PauseState(ctx, "TestMachine2", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Paused FSM")
+	return nil
+}
+
+func (f *testMachine2FSM) ResumeAll(ctx context.Context) error {
+	if err := f.store.Q().ResumeState(ctx, "TestMachine2", f.namespace, ""); err != nil {
+		return err
+	}
+	fsm.Logger(ctx).Debug("Resumed FSM")
+	// States paused on their own stay paused
+	for _, state := range []fsm.State{TestMachine2StateState1, TestMachine2StateState2, TestMachine2StateState3, TestMachine2StateDone} {
+		f.signal(state)
+	}
+	return nil
+}
+
+func (f *testMachine2FSM) Paused(ctx context.Context, state fsm.State) (bool, error) {
+	if err := f.stateError(state); err != nil {
+		return false, err
+	}
+	paused, err := f.store.Q().GetPausedStates(ctx, "TestMachine2", f.namespace)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(paused, "") || slices.Contains(paused, string(state)), nil
+}
+
+func (f *testMachine2FSM) stateError(state fsm.State) error {
+	switch state {
+	case TestMachine2StateState1, TestMachine2StateState2, TestMachine2StateState3, TestMachine2StateDone:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", fsm.ErrUnknownState, state)
+}
+
+// Administrative FSM task operations
+
+func (f *testMachine2FSM) RetryNow(ctx context.Context, id fsm.TaskID, operator string) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var state fsm.State
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		state = fsm.State(transition.ToState)
+		if f.isTerminal(state) {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrTaskFinished, id, state)
+		}
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Only failed steps that aren't running can be retried
+		if n, err := q.ExpediteQueueItem(ctx, item.ID); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("%w: id = %d, state = %s", fsm.ErrNoPendingRetry, id, state)
+		}
+		state = fsm.State(item.State)
+		return q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: item.State,
+			ToState:   string(fsm.StateRetried),
+			Operator:  &operator,
+		})
+	}); err != nil {
+		return err
+	}
+
+	fsm.Logger(ctx).Debug("Retrying task now", "id", id, "state", state, "operator", operator)
+	f.signal(state)
+	return nil
+}
+
+func (f *testMachine2FSM) ForceState1(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := testMachine2FSM_State1Params{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, TestMachine2StateState1, buf.Bytes())
+}
+
+func (f *testMachine2FSM) ForceState2(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := testMachine2FSM_State2Params{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, TestMachine2StateState2, buf.Bytes())
+}
+
+func (f *testMachine2FSM) ForceState3(ctx context.Context, id fsm.TaskID, operator string, P0 int) error {
+	msg := testMachine2FSM_State3Params{ID: id, P0: P0}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, TestMachine2StateState3, buf.Bytes())
+}
+
+func (f *testMachine2FSM) ForceDone(ctx context.Context, id fsm.TaskID, operator string) error {
+	msg := testMachine2FSM_DoneParams{ID: id}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return f.move(ctx, id, operator, TestMachine2StateDone, buf.Bytes())
+}
+
+func (f *testMachine2FSM) Restart(ctx context.Context, id fsm.TaskID, step int, operator string) error {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "TestMachine2", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return err
+	}
+
+	// Steps are numbered as in the task's history, starting from its submission
+	toState, data := fsm.State(TestMachine2StateState1), task.Data
+	if step != 0 {
+		transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+		if err != nil {
+			return err
+		}
+		if step < 0 || step > len(transitions) {
+			return fmt.Errorf("task %d has no step %d", id, step)
+		}
+		toState = fsm.State(transitions[step-1].ToState)
+		data = transitions[step-1].Data
+	}
+	switch toState {
+	case fsm.StateError, fsm.StateCancelled, fsm.StateRetried:
+		return fmt.Errorf("task %d can't restart from step %d in %s", id, step, toState)
+	}
+	return f.move(ctx, id, operator, toState, data)
+}
+
+// move replaces the task's current step with a step in the given state,
+// reviving the task if it finished. A running handler loses its claim on
+// the replaced step, so it can't move the task on too.
+func (f *testMachine2FSM) move(ctx context.Context, id fsm.TaskID, operator string, toState fsm.State, data []byte) error {
+	if operator == "" {
+		return errors.New("operator is required")
+	}
+	var fromState fsm.State
+	now := time.Now()
+	if err := f.store.Tx(ctx, func(q fsm.Q) error {
+		transition, err := f.lastTransition(ctx, q, id)
+		if err != nil {
+			return err
+		}
+		fromState = fsm.State(transition.ToState)
+		if fromState == fsm.StateCancelled {
+			return fmt.Errorf("%w: id = %d", fsm.ErrTaskCancelled, id)
+		}
+
+		// The new step keeps the priority of the step it replaces
+		priority := int64(fsm.GetPriority(ctx))
+		item, err := q.GetTaskQueueItem(ctx, int64(id))
+		if err == nil {
+			priority = item.Priority
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err := q.DeleteTaskQueueItems(ctx, int64(id)); err != nil {
+			return err
+		}
+		if err := q.RecordTransition(ctx, sqlc.RecordTransitionParams{
+			TaskID:    int64(id),
+			Attempt:   item.Attempt,
+			FromState: string(fromState),
+			ToState:   string(toState),
+			Data:      data,
+			Operator:  &operator,
+		}); err != nil {
+			return err
+		}
+		if err := q.ReleaseConcurrencyLocks(ctx, int64(id), f.region(toState)); err != nil {
+			return err
+		}
+		if _, err := q.EnqueueItem(ctx, sqlc.EnqueueItemParams{
+			TaskID:   int64(id),
+			State:    string(toState),
+			Data:     data,
+			ReadyAt:  now.UnixMilli(),
+			Priority: priority,
+		}); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	f.tasksLock.Lock()
+	for _, cancel := range f.running[id] {
+		cancel(fmt.Errorf("%w: id = %d, moved to %s by %s", fsm.ErrClaimLost, id, toState, operator))
+	}
+	f.tasksLock.Unlock()
+
+	fsm.Logger(ctx).Debug("Moved task", "id", id, "from", fromState, "to", toState, "operator", operator)
+	if f.onTransition != nil {
+		f.onTransition(ctx, id, fromState, toState)
+	}
+	f.signal(toState)
+	f.freeSpace()
+	if region := f.region(fromState); region != "" && region != f.region(toState) {
+		f.signalRegion(region)
+	}
+	return nil
+}
+
+// Query FSM tasks
+
+func (f *testMachine2FSM) Status(ctx context.Context, id fsm.TaskID) (fsm.TaskStatus, error) {
+	history, err := f.History(ctx, id)
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	status := fsm.NewTaskStatus(id, history)
+	status.Terminal = f.isTerminal(status.State)
+	metadata, err := f.store.Q().GetTaskMetadata(ctx, int64(id))
+	if err != nil {
+		return fsm.TaskStatus{}, err
+	}
+	if status.Metadata, err = fsm.DecodeMetadata(metadata); err != nil {
+		return fsm.TaskStatus{}, err
+	}
+
+	// Queued steps carry a priority, and steps that haven't been
+	// attempted yet may be scheduled for later
+	item, err := f.store.Q().GetTaskQueueItem(ctx, int64(id))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fsm.TaskStatus{}, err
+	} else if err == nil {
+		status.Priority = int(item.Priority)
+		if at := time.UnixMilli(item.ReadyAt); item.Attempt == 0 && item.LeaseOwner == nil && at.After(time.Now()) {
+			status.ScheduledAt = at
+		}
+	}
+	return status, nil
+}
+
+func (f *testMachine2FSM) History(ctx context.Context, id fsm.TaskID) ([]fsm.Step, error) {
+	task, err := f.store.Q().GetTask(ctx, int64(id), "TestMachine2", f.namespace)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: id = %d", fsm.ErrTaskNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	transitions, err := f.store.Q().GetHistory(ctx, int64(id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Tasks are submitted without a transition, so the first step comes from the task itself
+	params, err := f.decodeParams(TestMachine2StateState1, task.Data)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]fsm.Step, 0, len(transitions)+1)
+	history = append(history, fsm.Step{
+		CreatedAt: time.UnixMilli(task.CreatedAt),
+		Params:    params,
+		To:        TestMachine2StateState1,
+	})
+	for _, transition := range transitions {
+		step := fsm.Step{
+			Attempt:   int(transition.Attempt),
+			CreatedAt: time.UnixMilli(transition.CreatedAt),
+			Deadline:  transition.Deadline,
+			From:      fsm.State(transition.FromState),
+			To:        fsm.State(transition.ToState),
+		}
+		if transition.Operator != nil {
+			step.Operator = *transition.Operator
+		}
+		switch step.To {
+		case fsm.StateError:
+			step.Error = string(transition.Data)
+			if transition.NextAttemptAt != nil {
+				step.NextAttemptAt = time.UnixMilli(*transition.NextAttemptAt)
+			}
+		case fsm.StateCancelled:
+			step.Reason = string(transition.Data)
+		case fsm.StateRetried:
+		// Retried steps keep the failed step's inputs
+		default:
+			if step.Params, err = f.decodeParams(step.To, transition.Data); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, step)
+	}
+	return history, nil
+}
+
+func (f *testMachine2FSM) decodeParams(state fsm.State, data []byte) (any, error) {
+	switch state {
+	case TestMachine2StateState1:
+		var params TestMachine2State1Params
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case TestMachine2StateState2:
+		var params TestMachine2State2Params
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case TestMachine2StateState3:
+		var params TestMachine2State3Params
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params); err != nil {
+			return nil, err
+		}
+		return params, nil
+	case TestMachine2StateDone:
+		return TestMachine2DoneParams{}, nil
+	}
+	return nil, fmt.Errorf("unknown state: %s", state)
+}
+
+func (f *testMachine2FSM) isTerminal(state fsm.State) bool {
+	switch state {
+	case TestMachine2StateDone, fsm.StateCancelled:
+		return true
+	}
+	return false
+}
+
+// Wait for FSM tasks
+
+func (f *testMachine2FSM) Wait(ctx context.Context, id fsm.TaskID) (fsm.State, error) {
+	waiter := make(chan fsm.State, 1)
+	f.tasksLock.Lock()
+	f.waiters[id] = append(f.waiters[id], waiter)
+	f.tasksLock.Unlock()
+	defer f.stopWaiting(id, waiter)
+
+	// The task may have finished before we started waiting, or in another
+	// process sharing the store
+	for {
+		transition, err := f.lastTransition(ctx, f.store.Q(), id)
+		if err != nil {
+			return "", err
+		}
+		if state := fsm.State(transition.ToState); f.isTerminal(state) {
+			return state, nil
+		}
+
+		select {
+		case state := <-waiter:
+			return state, nil
+		case <-time.After(f.pollInterval):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (f *testMachine2FSM) SubmitAndWait(ctx context.Context, P0 int) (fsm.TaskID, fsm.State, error) {
+	id, err := f.Submit(ctx, P0)
+	if err != nil {
+		return 0, "", err
+	}
+	state, err := f.Wait(ctx, id)
+	return id, state, err
+}
+
+func (f *testMachine2FSM) complete(ctx context.Context, id fsm.TaskID, state fsm.State) {
+	f.tasksLock.Lock()
+	waiters := f.waiters[id]
+	delete(f.waiters, id)
+	f.tasksLock.Unlock()
+
+	for _, waiter := range waiters {
+		waiter <- state
+	}
+	if f.onCompletion != nil {
+		f.onCompletion(ctx, id, state)
+	}
+}
+
+func (f *testMachine2FSM) stopWaiting(id fsm.TaskID, waiter chan fsm.State) {
+	f.tasksLock.Lock()
+	defer f.tasksLock.Unlock()
+
+	waiters := slices.DeleteFunc(f.waiters[id], func(w chan fsm.State) bool {
+		return w == waiter
+	})
+	if len(waiters) == 0 {
+		delete(f.waiters, id)
+	} else {
+		f.waiters[id] = waiters
 	}
 }
@@ -4,18 +4,102 @@
 
 package sqlc
 
+type ConcurrencyLock struct {
+	Fsm            string
+	Namespace      string
+	ConcurrencyKey string
+	Region         string
+	TaskID         int64
+	CreatedAt      int64
+}
+
+type PausedState struct {
+	Fsm       string
+	Namespace string
+	State     string
+	CreatedAt int64
+}
+
+type QueueItem struct {
+	ID             int64
+	TaskID         int64
+	State          string
+	Attempt        int64
+	Data           []byte
+	CreatedAt      int64
+	LeaseOwner     *string
+	LeaseExpiresAt *int64
+	ReadyAt        int64
+	Priority       int64
+}
+
 type StateTransition struct {
+	ID            int64
+	Attempt       int64
+	TaskID        int64
+	FromState     string
+	ToState       string
+	Data          []byte
+	CreatedAt     int64
+	NextAttemptAt *int64
+	Deadline      bool
+	Operator      *string
+}
+
+type Task struct {
+	ID             int64
+	Data           []byte
+	CreatedAt      int64
+	IdempotencyKey *string
+	ConcurrencyKey *string
+	Metadata       []byte
+	Fsm            string
+	Namespace      string
+}
+
+type TaskBranch struct {
+	TaskID     int64
+	FanoutID   int64
+	Branch     int64
+	Output     []byte
+	FinishedAt int64
+}
+
+type TaskChild struct {
+	ParentID  int64
+	State     string
+	ChildID   int64
+	CreatedAt int64
+}
+
+type TaskCompensation struct {
+	ID            int64
+	TaskID        int64
+	StepID        int64
+	State         string
+	Data          []byte
+	CompensatedAt *int64
+	CreatedAt     int64
+}
+
+type TaskDeadline struct {
 	ID        int64
-	Attempt   int64
 	TaskID    int64
-	FromState string
-	ToState   string
-	Data      []byte
+	StepID    int64
+	State     string
+	FireAt    int64
+	FiredAt   *int64
 	CreatedAt int64
 }
 
-type Task struct {
-	ID        int64
-	Data      []byte
+type TaskFanout struct {
+	TaskID    int64
+	FanoutID  int64
+	Branches  int64
+	JoinedAt  *int64
 	CreatedAt int64
 }
+
+type UnqueuedTask struct {
+	TaskID int64
+}
@@ -9,13 +9,52 @@ import (
 )
 
 type Querier interface {
-	CreateTask(ctx context.Context, data []byte) (Task, error)
-	CreateTaskWithID(ctx context.Context, iD int64, data []byte) (Task, error)
+	AckQueueItem(ctx context.Context, iD int64, owner string) (int64, error)
+	AcquireConcurrencyLock(ctx context.Context, region string, taskID int64) error
+	AddCompensation(ctx context.Context, iD int64, owner string) error
+	AdoptUnscopedLocks(ctx context.Context, fsm string, namespace string, taskID int64) error
+	AdoptUnscopedTask(ctx context.Context, fsm string, namespace string, id int64) error
+	ClaimQueueItem(ctx context.Context, arg ClaimQueueItemParams) (QueueItem, error)
+	CountQueueItems(ctx context.Context, state string, fsm string, namespace string) (int64, error)
+	CreateFanout(ctx context.Context, taskID int64, fanoutID int64, branches int64) error
+	CreateTask(ctx context.Context, arg CreateTaskParams) (Task, error)
+	DeleteDeadline(ctx context.Context, id int64) error
+	DeleteQueueItem(ctx context.Context, id int64) (int64, error)
+	DeleteTaskQueueItems(ctx context.Context, taskID int64) error
+	DeleteUnqueuedTask(ctx context.Context, taskID int64) error
+	EnqueueItem(ctx context.Context, arg EnqueueItemParams) (int64, error)
+	ExpediteQueueItem(ctx context.Context, id int64) (int64, error)
+	FinishBranch(ctx context.Context, taskID int64, fanoutID int64, branch int64, output []byte) error
+	FinishCompensation(ctx context.Context, id int64) error
+	FireDeadline(ctx context.Context, id int64) (int64, error)
+	GetChildTasks(ctx context.Context, parentID int64) ([]TaskChild, error)
+	GetDueDeadline(ctx context.Context, state string, fsm string, namespace string, fireAt int64) (TaskDeadline, error)
+	GetFanout(ctx context.Context, taskID int64, fanoutID int64) (TaskFanout, error)
+	GetFinishedBranches(ctx context.Context, taskID int64, fanoutID int64) ([]TaskBranch, error)
 	GetHistory(ctx context.Context, taskID int64) ([]StateTransition, error)
-	GetLastValidTransition(ctx context.Context, taskID int64) (StateTransition, error)
-	GetTaskState(ctx context.Context, taskID int64) (string, error)
-	ListTasks(ctx context.Context) ([]Task, error)
+	GetLastValidTransition(ctx context.Context, taskID int64, fsm string, namespace string) (StateTransition, error)
+	GetPausedStates(ctx context.Context, fsm string, namespace string) ([]string, error)
+	GetPendingCompensations(ctx context.Context, taskID int64) ([]TaskCompensation, error)
+	GetQueueItem(ctx context.Context, id int64) (QueueItem, error)
+	GetStepDeadline(ctx context.Context, stepID int64) (TaskDeadline, error)
+	GetTask(ctx context.Context, id int64, fsm string, namespace string) (Task, error)
+	GetTaskByIdempotencyKey(ctx context.Context, fsm string, namespace string, idempotencyKey *string) (Task, error)
+	GetTaskMetadata(ctx context.Context, id int64) ([]byte, error)
+	GetTaskQueueItem(ctx context.Context, taskID int64) (QueueItem, error)
+	JoinFanout(ctx context.Context, taskID int64, fanoutID int64) error
+	LinkChildTask(ctx context.Context, parentID int64, state string, childID int64) error
+	ListParkedSteps(ctx context.Context, fsm string, namespace string) ([]ListParkedStepsRow, error)
+	ListUnqueuedTasks(ctx context.Context, fsm string, namespace string) ([]Task, error)
+	ListUnscopedTasks(ctx context.Context) ([]Task, error)
+	PauseState(ctx context.Context, fsm string, namespace string, state string) error
 	RecordTransition(ctx context.Context, arg RecordTransitionParams) error
+	ReleaseConcurrencyLocks(ctx context.Context, taskID int64, region string) error
+	ReleaseQueueItem(ctx context.Context, iD int64, owner string) error
+	RenewQueueItemLease(ctx context.Context, leaseMs int64, iD int64, owner string) (int64, error)
+	ResumeState(ctx context.Context, fsm string, namespace string, state string) error
+	RetryQueueItem(ctx context.Context, attempt int64, readyAt int64, iD int64, owner string) (int64, error)
+	ScheduleDeadline(ctx context.Context, taskID int64, stepID int64, state string, fireAt int64) error
+	WakeQueueItem(ctx context.Context, id int64) (int64, error)
 }
 
 var _ Querier = (*Queries)(nil)
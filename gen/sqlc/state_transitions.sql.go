@@ -10,9 +10,9 @@ import (
 )
 
 const getHistory = `-- name: GetHistory :many
-SELECT id, attempt, task_id, from_state, to_state, data, created_at FROM state_transitions
+SELECT id, attempt, task_id, from_state, to_state, data, created_at, next_attempt_at, deadline, operator FROM state_transitions
 WHERE task_id = ?
-ORDER BY created_at ASC
+ORDER BY created_at ASC, id ASC
 `
 
 func (q *Queries) GetHistory(ctx context.Context, taskID int64) ([]StateTransition, error) {
@@ -32,6 +32,9 @@ func (q *Queries) GetHistory(ctx context.Context, taskID int64) ([]StateTransiti
 			&i.ToState,
 			&i.Data,
 			&i.CreatedAt,
+			&i.NextAttemptAt,
+			&i.Deadline,
+			&i.Operator,
 		); err != nil {
 			return nil, err
 		}
@@ -47,15 +50,22 @@ func (q *Queries) GetHistory(ctx context.Context, taskID int64) ([]StateTransiti
 }
 
 const getLastValidTransition = `-- name: GetLastValidTransition :one
-SELECT id, attempt, task_id, from_state, to_state, data, created_at FROM state_transitions
-WHERE task_id = ?
-  AND to_state != '__error__'
-ORDER BY created_at DESC
+SELECT id, attempt, task_id, from_state, to_state, data, created_at, next_attempt_at, deadline, operator FROM state_transitions
+WHERE task_id = ?1
+  AND to_state NOT IN ('__error__', '__retried__')
+  -- Tasks of other FSMs and namespaces aren't visible
+  AND EXISTS (
+      SELECT 1 FROM tasks
+      WHERE tasks.id = state_transitions.task_id
+        AND tasks.fsm = CAST(?2 AS TEXT)
+        AND tasks.namespace = CAST(?3 AS TEXT)
+  )
+ORDER BY created_at DESC, id DESC
 LIMIT 1
 `
 
-func (q *Queries) GetLastValidTransition(ctx context.Context, taskID int64) (StateTransition, error) {
-	row := q.db.QueryRowContext(ctx, getLastValidTransition, taskID)
+func (q *Queries) GetLastValidTransition(ctx context.Context, taskID int64, fsm string, namespace string) (StateTransition, error) {
+	row := q.db.QueryRowContext(ctx, getLastValidTransition, taskID, fsm, namespace)
 	var i StateTransition
 	err := row.Scan(
 		&i.ID,
@@ -65,36 +75,27 @@ func (q *Queries) GetLastValidTransition(ctx context.Context, taskID int64) (Sta
 		&i.ToState,
 		&i.Data,
 		&i.CreatedAt,
+		&i.NextAttemptAt,
+		&i.Deadline,
+		&i.Operator,
 	)
 	return i, err
 }
 
-const getTaskState = `-- name: GetTaskState :one
-SELECT to_state FROM state_transitions
-WHERE task_id = ?
-  AND to_state != '__error__'
-ORDER BY created_at DESC
-LIMIT 1
-`
-
-func (q *Queries) GetTaskState(ctx context.Context, taskID int64) (string, error) {
-	row := q.db.QueryRowContext(ctx, getTaskState, taskID)
-	var to_state string
-	err := row.Scan(&to_state)
-	return to_state, err
-}
-
 const recordTransition = `-- name: RecordTransition :exec
-INSERT INTO state_transitions (task_id, attempt, from_state, to_state, data)
-VALUES (?, ?, ?, ?, ?)
+INSERT INTO state_transitions (task_id, attempt, from_state, to_state, data, next_attempt_at, deadline, operator)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 `
 
 type RecordTransitionParams struct {
-	TaskID    int64
-	Attempt   int64
-	FromState string
-	ToState   string
-	Data      []byte
+	TaskID        int64
+	Attempt       int64
+	FromState     string
+	ToState       string
+	Data          []byte
+	NextAttemptAt *int64
+	Deadline      bool
+	Operator      *string
 }
 
 func (q *Queries) RecordTransition(ctx context.Context, arg RecordTransitionParams) error {
@@ -104,6 +105,9 @@ func (q *Queries) RecordTransition(ctx context.Context, arg RecordTransitionPara
 		arg.FromState,
 		arg.ToState,
 		arg.Data,
+		arg.NextAttemptAt,
+		arg.Deadline,
+		arg.Operator,
 	)
 	return err
 }
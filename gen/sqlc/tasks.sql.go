@@ -9,39 +9,124 @@ import (
 	"context"
 )
 
+const adoptUnscopedTask = `-- name: AdoptUnscopedTask :exec
+UPDATE tasks
+SET fsm = ?,
+    namespace = ?
+WHERE id = ?
+  AND fsm = ''
+`
+
+func (q *Queries) AdoptUnscopedTask(ctx context.Context, fsm string, namespace string, id int64) error {
+	_, err := q.db.ExecContext(ctx, adoptUnscopedTask, fsm, namespace, id)
+	return err
+}
+
 const createTask = `-- name: CreateTask :one
-INSERT INTO tasks (data)
-VALUES (?)
-RETURNING id, data, created_at
+INSERT INTO tasks (data, idempotency_key, concurrency_key, metadata, fsm, namespace)
+VALUES (?, ?, ?, ?, ?, ?)
+RETURNING id, data, created_at, idempotency_key, concurrency_key, metadata, fsm, namespace
+`
+
+type CreateTaskParams struct {
+	Data           []byte
+	IdempotencyKey *string
+	ConcurrencyKey *string
+	Metadata       []byte
+	Fsm            string
+	Namespace      string
+}
+
+func (q *Queries) CreateTask(ctx context.Context, arg CreateTaskParams) (Task, error) {
+	row := q.db.QueryRowContext(ctx, createTask,
+		arg.Data,
+		arg.IdempotencyKey,
+		arg.ConcurrencyKey,
+		arg.Metadata,
+		arg.Fsm,
+		arg.Namespace,
+	)
+	var i Task
+	err := row.Scan(
+		&i.ID,
+		&i.Data,
+		&i.CreatedAt,
+		&i.IdempotencyKey,
+		&i.ConcurrencyKey,
+		&i.Metadata,
+		&i.Fsm,
+		&i.Namespace,
+	)
+	return i, err
+}
+
+const getTask = `-- name: GetTask :one
+SELECT id, data, created_at, idempotency_key, concurrency_key, metadata, fsm, namespace FROM tasks
+WHERE id = ?
+  AND fsm = ?
+  AND namespace = ?
 `
 
-func (q *Queries) CreateTask(ctx context.Context, data []byte) (Task, error) {
-	row := q.db.QueryRowContext(ctx, createTask, data)
+func (q *Queries) GetTask(ctx context.Context, id int64, fsm string, namespace string) (Task, error) {
+	row := q.db.QueryRowContext(ctx, getTask, id, fsm, namespace)
 	var i Task
-	err := row.Scan(&i.ID, &i.Data, &i.CreatedAt)
+	err := row.Scan(
+		&i.ID,
+		&i.Data,
+		&i.CreatedAt,
+		&i.IdempotencyKey,
+		&i.ConcurrencyKey,
+		&i.Metadata,
+		&i.Fsm,
+		&i.Namespace,
+	)
 	return i, err
 }
 
-const createTaskWithID = `-- name: CreateTaskWithID :one
-INSERT INTO tasks (id, data)
-VALUES (?, ?)
-RETURNING id, data, created_at
+const getTaskByIdempotencyKey = `-- name: GetTaskByIdempotencyKey :one
+SELECT id, data, created_at, idempotency_key, concurrency_key, metadata, fsm, namespace FROM tasks
+WHERE fsm = ?
+  AND namespace = ?
+  AND idempotency_key = ?
 `
 
-func (q *Queries) CreateTaskWithID(ctx context.Context, iD int64, data []byte) (Task, error) {
-	row := q.db.QueryRowContext(ctx, createTaskWithID, iD, data)
+func (q *Queries) GetTaskByIdempotencyKey(ctx context.Context, fsm string, namespace string, idempotencyKey *string) (Task, error) {
+	row := q.db.QueryRowContext(ctx, getTaskByIdempotencyKey, fsm, namespace, idempotencyKey)
 	var i Task
-	err := row.Scan(&i.ID, &i.Data, &i.CreatedAt)
+	err := row.Scan(
+		&i.ID,
+		&i.Data,
+		&i.CreatedAt,
+		&i.IdempotencyKey,
+		&i.ConcurrencyKey,
+		&i.Metadata,
+		&i.Fsm,
+		&i.Namespace,
+	)
 	return i, err
 }
 
-const listTasks = `-- name: ListTasks :many
-SELECT id, data, created_at FROM tasks
+const getTaskMetadata = `-- name: GetTaskMetadata :one
+SELECT metadata FROM tasks
+WHERE id = ?
+`
+
+func (q *Queries) GetTaskMetadata(ctx context.Context, id int64) ([]byte, error) {
+	row := q.db.QueryRowContext(ctx, getTaskMetadata, id)
+	var metadata []byte
+	err := row.Scan(&metadata)
+	return metadata, err
+}
+
+const listUnscopedTasks = `-- name: ListUnscopedTasks :many
+SELECT id, data, created_at, idempotency_key, concurrency_key, metadata, fsm, namespace FROM tasks
+WHERE fsm = ''
 ORDER BY id ASC
 `
 
-func (q *Queries) ListTasks(ctx context.Context) ([]Task, error) {
-	rows, err := q.db.QueryContext(ctx, listTasks)
+// Tasks stored before tasks were scoped belong to no FSM
+func (q *Queries) ListUnscopedTasks(ctx context.Context) ([]Task, error) {
+	rows, err := q.db.QueryContext(ctx, listUnscopedTasks)
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +134,16 @@ func (q *Queries) ListTasks(ctx context.Context) ([]Task, error) {
 	var items []Task
 	for rows.Next() {
 		var i Task
-		if err := rows.Scan(&i.ID, &i.Data, &i.CreatedAt); err != nil {
+		if err := rows.Scan(
+			&i.ID,
+			&i.Data,
+			&i.CreatedAt,
+			&i.IdempotencyKey,
+			&i.ConcurrencyKey,
+			&i.Metadata,
+			&i.Fsm,
+			&i.Namespace,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
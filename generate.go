@@ -2,6 +2,9 @@ package fsm
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"time"
 
 	"github.com/dave/jennifer/jen"
 )
@@ -19,9 +22,12 @@ func Generate(pkg string, model *FsmModel) *jen.File {
 	file.Var().Id("_").Id(model.FsmName()).Op("=").New(jen.Id(model.FsmInternalName()))
 	file.Var().Id("_").Qual("github.com/egoodhall/fsm", "SupportsOptions").Op("=").New(jen.Id(model.FsmInternalName()))
 	for _, state := range model.States {
-		if !state.Terminal {
+		if state.Handled() {
 			file.Var().Id("_").Id(model.FsmBuilderStageName(state)).Op("=").New(jen.Id(model.FsmInternalName()))
 		}
+		if state.Compensate {
+			file.Var().Id("_").Id(model.FsmBuilderCompensationStageName(state)).Op("=").New(jen.Id(model.FsmInternalName()))
+		}
 	}
 	file.Var().Id("_").Id(model.FsmBuilderFinalStageName()).Op("=").New(jen.Id(model.FsmInternalName()))
 	for _, state := range model.States {
@@ -56,15 +62,117 @@ func generatePublicInterfaces(model *FsmModel) []jen.Code {
 			ParamsFunc(func(g *jen.Group) {
 				g.Id("ctx").Qual("context", "Context")
 				for _, param := range model.InitialState().Inputs {
-					g.Id(param).Add(model.RenderType(param))
+					g.Id(param).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("TrySubmit").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				for _, param := range model.InitialState().Inputs {
+					g.Id(param).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("SubmitAt").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				g.Id("at").Qual("time", "Time")
+				for _, param := range model.InitialState().Inputs {
+					g.Id(param).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("SubmitAfter").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				g.Id("delay").Qual("time", "Duration")
+				for _, param := range model.InitialState().Inputs {
+					g.Id(param).Add(model.RenderInput(model.InitialState(), param))
 				}
 			}).
 			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("SubmitBatch").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("inputs").Index().Id(model.ParamsTypeName(model.InitialState()))).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("SubmitSeq").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("inputs").Qual("iter", "Seq").Types(jen.Id(model.ParamsTypeName(model.InitialState())))).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()),
+		jen.Id("SubmitAndWait").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				for _, param := range model.InitialState().Inputs {
+					g.Id(param).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Qual("github.com/egoodhall/fsm", "State"), jen.Error()),
+		jen.Id("Wait").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("github.com/egoodhall/fsm", "State"), jen.Error()),
+		jen.Id("Cancel").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("reason").String()).
+			Error(),
+		jen.Id("Pause").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error(),
+		jen.Id("Resume").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error(),
+		jen.Id("PauseAll").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error(),
+		jen.Id("ResumeAll").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error(),
+		jen.Id("Paused").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Params(jen.Bool(), jen.Error()),
+		jen.Id("RetryNow").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("operator").String()).
+			Error(),
+		jen.Do(func(s *jen.Statement) {
+			for i, state := range model.ForcibleStates() {
+				if i > 0 {
+					s.Line()
+				}
+				s.Id(model.ForceName(state.Name)).ParamsFunc(func(g *jen.Group) {
+					g.Id("ctx").Qual("context", "Context")
+					g.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")
+					g.Id("operator").String()
+					for i, param := range state.Inputs {
+						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, param))
+					}
+				}).Error()
+			}
+		}),
+		jen.Id("Restart").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("step").Int(), jen.Id("operator").String()).
+			Error(),
+		jen.Id("Status").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskStatus"), jen.Error()),
+		jen.Id("History").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "Step"), jen.Error()),
 	))
 
-	// FSM builder constructor
+	// FSM state params, as reported by Status and History
+	for _, state := range model.States {
+		code = append(code, jen.Type().Id(model.ParamsTypeName(state)).StructFunc(func(g *jen.Group) {
+			for i, input := range state.Inputs {
+				g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, input))
+			}
+		}))
+	}
+
+	// FSM builder constructor, starting at the first state with a handler
+	first := model.InitialState()
+	if !first.Handled() {
+		i := slices.IndexFunc(model.States, func(s StateModel) bool { return s.Name == first.Name })
+		first, _ = nextHandledState(model.States[i+1:])
+	}
 	code = append(code, jen.Func().Id(model.FsmBuilderConstructorName()).Params().
-		Id(model.FsmBuilderStageName(model.InitialState())).Block(
+		Id(model.FsmBuilderStageName(first)).Block(
 		jen.Return(jen.New(jen.Id(model.FsmInternalName()))),
 	))
 
@@ -76,25 +184,37 @@ func generatePublicInterfaces(model *FsmModel) []jen.Code {
 
 		code = append(code, jen.Type().Id(model.TransitionsParamTypeName(state)).InterfaceFunc(func(g *jen.Group) {
 			for _, transition := range state.Transitions {
-				params := []jen.Code{jen.Qual("context", "Context")}
+				params := make([]jen.Code, 0)
 				for _, param := range model.GetState(transition).Inputs {
-					params = append(params, model.RenderType(param))
+					params = append(params, model.RenderTransitionInput(model.GetState(transition), param))
 				}
-				g.Id(model.TransitionToName(transition)).Params(params...).Error()
+				g.Id(model.TransitionToName(transition)).Params(append([]jen.Code{jen.Qual("context", "Context")}, params...)...).Error()
+				g.Id(model.TransitionToName(transition) + "At").Params(append([]jen.Code{jen.Qual("context", "Context"), jen.Qual("time", "Time")}, params...)...).Error()
+				g.Id(model.TransitionToName(transition) + "After").Params(append([]jen.Code{jen.Qual("context", "Context"), jen.Qual("time", "Duration")}, params...)...).Error()
 			}
 		}))
 	}
 
 	// FSM builder stage interfaces
 	for i, state := range model.States {
-		method := jen.Id(model.FsmBuilderStageMethodName(state)).Params(
-			generateFSMStateMethodSignature(model, state),
-		)
-		if next, ok := nextNonTerminalState(model.States[i+1:]); ok {
-			method = method.Id(model.FsmBuilderStageName(next))
-		} else {
-			method = method.Id(model.FsmBuilderFinalStageName())
+		if state.Fanout != nil {
+			// Fan-outs have no handler to build
+			continue
+		}
+		next := nextStageName(model, i)
+		if state.Compensate {
+			// Compensated states take their compensation handler next
+			code = append(code, jen.Type().Id(model.FsmBuilderStageName(state)).Interface(
+				jen.Id(model.FsmBuilderStageMethodName(state)).Params(generateFSMStageParam(model, state)).Id(model.FsmBuilderCompensationStageName(state)),
+			).Line())
+			code = append(code, jen.Type().Id(model.FsmBuilderCompensationStageName(state)).Interface(
+				jen.Id(model.FsmBuilderCompensationMethodName(state)).Params(generateCompensationSignature(model, state)).Id(next),
+			).Line())
+			continue
 		}
+		method := jen.Id(model.FsmBuilderStageMethodName(state)).Params(
+			generateFSMStageParam(model, state),
+		).Id(next)
 
 		code = append(code, jen.Type().Id(model.FsmBuilderStageName(state)).Interface(method).Line())
 	}
@@ -107,9 +227,9 @@ func generatePublicInterfaces(model *FsmModel) []jen.Code {
 	return code
 }
 
-func nextNonTerminalState(states []StateModel) (StateModel, bool) {
+func nextHandledState(states []StateModel) (StateModel, bool) {
 	for _, state := range states {
-		if state.Terminal {
+		if !state.Handled() {
 			continue
 		}
 		return state, true
@@ -117,6 +237,15 @@ func nextNonTerminalState(states []StateModel) (StateModel, bool) {
 	return StateModel{}, false
 }
 
+// nextStageName returns the builder stage following the handler of the
+// model's i-th state.
+func nextStageName(model *FsmModel, i int) string {
+	if next, ok := nextHandledState(model.States[i+1:]); ok {
+		return model.FsmBuilderStageName(next)
+	}
+	return model.FsmBuilderFinalStageName()
+}
+
 func generateFSMImplementation(model *FsmModel) []jen.Code {
 	code := make([]jen.Code, 0)
 
@@ -125,8 +254,11 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 		code = append(code, jen.Type().Id(model.FsmStateMessageName(state)).StructFunc(func(g *jen.Group) {
 			g.Id("ID").Qual("github.com/egoodhall/fsm", "TaskID")
 			g.Id("Attempt").Int()
+			if model.InBranch(state) {
+				g.Id("Branch").Qual("github.com/egoodhall/fsm", "Branch")
+			}
 			for i, input := range state.Inputs {
-				g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderType(input))
+				g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, input))
 			}
 		}))
 	}
@@ -141,7 +273,18 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 			g.Id("store").Qual("github.com/egoodhall/fsm", "Store")
 			g.Id("onTransition").Qual("github.com/egoodhall/fsm", "TransitionListener")
 			g.Id("onCompletion").Qual("github.com/egoodhall/fsm", "CompletionListener")
+			g.Id("onRateLimit").Qual("github.com/egoodhall/fsm", "RateLimitListener")
+			g.Id("onBreaker").Qual("github.com/egoodhall/fsm", "BreakerListener")
+			g.Id("middlewares").Index().Qual("github.com/egoodhall/fsm", "Middleware")
+			g.Id("extractors").Index().Qual("github.com/egoodhall/fsm", "MetadataExtractor")
+			g.Id("injectors").Index().Qual("github.com/egoodhall/fsm", "MetadataInjector")
 			g.Id("backoff").Qual("github.com/egoodhall/fsm", "Backoff")
+			g.Id("leaseTTL").Qual("time", "Duration")
+			g.Id("pollInterval").Qual("time", "Duration")
+			g.Id("aging").Qual("time", "Duration")
+			g.Id("batchSize").Int()
+			g.Id("namespace").String()
+			g.Id("adoptUnscoped").Func().Params(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Bool()
 			g.Line()
 			g.Comment("FSM state transitions")
 			for _, state := range model.States {
@@ -150,10 +293,55 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 				}
 				g.Id(model.FsmStateInternalName(state)).Add(generateFSMStateMethodSignature(model, state))
 			}
+			if len(model.CompensatedStates()) > 0 {
+				g.Line()
+				g.Comment("FSM state compensations, undoing completed steps on failure paths")
+				for _, state := range model.CompensatedStates() {
+					g.Id(model.FsmStateCompensationInternalName(state)).Add(generateCompensationSignature(model, state))
+				}
+			}
+			if len(model.DeadlineStates()) > 0 {
+				g.Line()
+				g.Comment("FSM state deadlines, after which steps still in the state move on")
+				for _, state := range model.DeadlineStates() {
+					g.Id(model.FsmStateDeadlineInternalName(state)).Qual("time", "Duration")
+				}
+			}
+			if len(model.InvokingStates()) > 0 {
+				g.Line()
+				g.Comment("FSMs invoked by states")
+				for _, state := range model.InvokingStates() {
+					g.Id(model.FsmStateChildInternalName(state)).Id(state.Invoke.Child.FsmName())
+				}
+			}
+			g.Line()
+			g.Comment("FSM state queues, rate limits, circuit breakers and backoffs")
+			for _, state := range model.States {
+				if !state.Terminal {
+					g.Id(model.FsmStateQueueInternalName(state)).Qual("github.com/egoodhall/fsm", "QueueConfig")
+					g.Id(model.FsmStateLimiterInternalName(state)).Op("*").Qual("github.com/egoodhall/fsm", "Limiter")
+					g.Id(model.FsmStateBreakerInternalName(state)).Op("*").Qual("github.com/egoodhall/fsm", "Breaker")
+					g.Id(model.FsmStateBackoffInternalName(state)).Qual("github.com/egoodhall/fsm", "Backoff")
+				}
+			}
 			g.Line()
-			g.Comment("FSM queues")
+			g.Comment("FSM queue signals, and the owner of this instance's leases")
 			for _, state := range model.States {
-				g.Id(model.FsmStateQueueInternalName(state)).Chan().Id(model.FsmStateMessageName(state))
+				g.Id(model.FsmStateReadyInternalName(state)).Chan().Struct()
+			}
+			g.Id("owner").String()
+			g.Comment("Closed and replaced each time steps leave a queue, to wake blocked submissions")
+			g.Id("spaceLock").Qual("sync", "Mutex")
+			g.Id("space").Chan().Struct()
+			g.Line()
+			g.Comment("Running tasks and their waiters")
+			g.Id("tasksLock").Qual("sync", "Mutex")
+			g.Comment("A task's next step can start before the handler that moved it there returns")
+			g.Id("running").Map(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Map(jen.Qual("context", "Context")).Qual("context", "CancelCauseFunc")
+			g.Id("waiters").Map(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Index().Chan().Qual("github.com/egoodhall/fsm", "State")
+			if len(model.InvokingStates()) > 0 {
+				g.Comment("Parked steps watched until the task they invoked finishes")
+				g.Id("watching").Map(jen.Int64()).Struct()
 			}
 		}),
 		jen.Comment("FSM builder methods"),
@@ -161,29 +349,54 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 
 	// FSM builder stage methods
 	for i, state := range model.States {
-		if state.Terminal {
-			// No transitions from terminal states
+		if !state.Handled() {
+			// No transitions from terminal states, and fan-outs have no handler
 			continue
 		}
 
 		method := jen.Func().
 			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
 			Id(model.FsmBuilderStageMethodName(state)).Params(
-			jen.Id("fn").Add(generateFSMStateMethodSignature(model, state)),
+			jen.Id("fn").Add(generateFSMStageParam(model, state)),
 		)
 
-		if next, ok := nextNonTerminalState(model.States[i+1:]); ok {
-			method = method.Id(model.FsmBuilderStageName(next))
+		if state.Compensate {
+			method = method.Id(model.FsmBuilderCompensationStageName(state))
 		} else {
-			method = method.Id(model.FsmBuilderFinalStageName())
+			method = method.Id(nextStageName(model, i))
 		}
 
-		code = append(code,
-			method.Block(
-				jen.Id("f").Dot(model.FsmStateInternalName(state)).Op("=").Id("fn"),
-				jen.Return(jen.Id("f")),
-			),
-		)
+		if state.Invoke != nil {
+			// The invoked FSM's tasks are run and waited on by a generated handler
+			code = append(code,
+				method.Block(
+					jen.Id("f").Dot(model.FsmStateChildInternalName(state)).Op("=").Id("fn"),
+					jen.Id("f").Dot(model.FsmStateInternalName(state)).Op("=").Id("f").Dot(model.FsmStateInvokeName(state)),
+					jen.Return(jen.Id("f")),
+				),
+			)
+		} else {
+			code = append(code,
+				method.Block(
+					jen.Id("f").Dot(model.FsmStateInternalName(state)).Op("=").Id("fn"),
+					jen.Return(jen.Id("f")),
+				),
+			)
+		}
+
+		if state.Compensate {
+			code = append(code,
+				jen.Func().
+					Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+					Id(model.FsmBuilderCompensationMethodName(state)).
+					Params(jen.Id("fn").Add(generateCompensationSignature(model, state))).
+					Id(nextStageName(model, i)).
+					Block(
+						jen.Id("f").Dot(model.FsmStateCompensationInternalName(state)).Op("=").Id("fn"),
+						jen.Return(jen.Id("f")),
+					),
+			)
+		}
 	}
 
 	// FSM builder final stage
@@ -202,10 +415,77 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 				g.Line()
 				g.Comment("Set context")
 				g.Id("f").Dot("ctx").Op("=").Id("ctx")
+				if fanouts := model.Fanouts(); len(fanouts) > 0 {
+					g.Line()
+					g.Comment("Fan-out states start their branches instead of running a handler")
+					for _, state := range fanouts {
+						g.Id("f").Dot(model.FsmStateInternalName(state)).Op("=").Id("f").Dot(model.FsmStateFanoutName(state))
+					}
+				}
+				g.Line()
+				g.Comment("Initialize state queue signals")
+				for _, state := range model.States {
+					g.Id("f").Dot(model.FsmStateReadyInternalName(state)).Op("=").Make(jen.Chan().Struct(), jen.Lit(1))
+				}
+				g.Id("f").Dot("owner").Op("=").Qual("crypto/rand", "Text").Call()
+				g.Id("f").Dot("space").Op("=").Make(jen.Chan().Struct())
+				g.Line()
+				g.Comment("Initialize task tracking")
+				g.Id("f").Dot("running").Op("=").Make(jen.Map(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Map(jen.Qual("context", "Context")).Qual("context", "CancelCauseFunc"))
+				g.Id("f").Dot("waiters").Op("=").Make(jen.Map(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Index().Chan().Qual("github.com/egoodhall/fsm", "State"))
+				if len(model.InvokingStates()) > 0 {
+					g.Id("f").Dot("watching").Op("=").Make(jen.Map(jen.Int64()).Struct())
+				}
 				g.Line()
-				g.Comment("Initialize state queues")
+				g.Comment("Initialize state queues, rate limits, circuit breakers and backoffs")
+				g.Comment("from the model, which options may override")
 				for _, state := range model.States {
-					g.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("=").Make(jen.Chan().Id(model.FsmStateMessageName(state)), jen.Lit(max(state.Queue, 5)))
+					if state.Terminal {
+						continue
+					}
+					if state.Queue > 0 {
+						g.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("=").Qual("github.com/egoodhall/fsm", "QueueConfig").Values(jen.DictFunc(func(d jen.Dict) {
+							d[jen.Id("Capacity")] = jen.Lit(state.Queue)
+							if state.Overflow != "" {
+								d[jen.Id("Overflow")] = jen.Qual("github.com/egoodhall/fsm", overflowNames[state.Overflow])
+							}
+						}))
+					}
+					rate := jen.Qual("github.com/egoodhall/fsm", "Rate").Values()
+					if state.Rate != "" {
+						rate = jen.Qual("github.com/egoodhall/fsm", "MustParseRate").Call(jen.Lit(state.Rate))
+					}
+					g.Id("f").Dot(model.FsmStateLimiterInternalName(state)).Op("=").Qual("github.com/egoodhall/fsm", "NewLimiter").Call(rate, jen.Lit(state.Burst))
+					breaker := jen.Qual("github.com/egoodhall/fsm", "BreakerConfig").Values()
+					if state.Breaker != nil {
+						config, _ := state.Breaker.Config()
+						breaker = jen.Qual("github.com/egoodhall/fsm", "BreakerConfig").Values(jen.DictFunc(func(d jen.Dict) {
+							d[jen.Id("Threshold")] = jen.Lit(config.Threshold)
+							d[jen.Id("Window")] = jen.Lit(config.Window)
+							d[jen.Id("Cooldown")] = generateDuration(config.Cooldown)
+							if config.Probes > 0 {
+								d[jen.Id("Probes")] = jen.Lit(config.Probes)
+							}
+						}))
+					}
+					g.Id("f").Dot(model.FsmStateBreakerInternalName(state)).Op("=").Qual("github.com/egoodhall/fsm", "NewBreaker").Call(breaker, jen.Id("f").Dot("breakerListener").Call(jen.Id(model.StateName(state))))
+					if state.Backoff != nil {
+						config, _ := state.Backoff.Config()
+						g.Id("f").Dot(model.FsmStateBackoffInternalName(state)).Op("=").Qual("github.com/egoodhall/fsm", "BackoffConfig").Values(jen.DictFunc(func(d jen.Dict) {
+							d[jen.Id("Type")] = jen.Qual("github.com/egoodhall/fsm", backoffTypeNames[config.Type])
+							d[jen.Id("Base")] = generateDuration(config.Base)
+							if config.Max > 0 {
+								d[jen.Id("Max")] = generateDuration(config.Max)
+							}
+							if config.Jitter != JitterNone {
+								d[jen.Id("Jitter")] = jen.Qual("github.com/egoodhall/fsm", jitterNames[config.Jitter])
+							}
+						})).Dot("Backoff").Call()
+					}
+					if state.Deadline != nil {
+						after, _ := state.Deadline.Duration()
+						g.Id("f").Dot(model.FsmStateDeadlineInternalName(state)).Op("=").Add(generateDuration(after))
+					}
 				}
 				g.Line()
 				// Apply options
@@ -225,9 +505,37 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 				g.If(jen.Id("f").Dot("backoff").Op("==").Nil()).Block(
 					jen.Id("f").Dot("backoff").Op("=").Qual("github.com/egoodhall/fsm", "LinearBackoff").Call(jen.Lit(500).Op("*").Qual("time", "Millisecond"), jen.Lit(30).Op("*").Qual("time", "Second")),
 				)
+				g.If(jen.Id("f").Dot("leaseTTL").Op("==").Lit(0)).Block(
+					jen.Id("f").Dot("leaseTTL").Op("=").Lit(30).Op("*").Qual("time", "Second"),
+				)
+				g.If(jen.Id("f").Dot("pollInterval").Op("==").Lit(0)).Block(
+					jen.Id("f").Dot("pollInterval").Op("=").Qual("time", "Second"),
+				)
+				g.If(jen.Id("f").Dot("aging").Op("==").Lit(0)).Block(
+					jen.Id("f").Dot("aging").Op("=").Qual("time", "Minute"),
+				)
+				g.If(jen.Id("f").Dot("batchSize").Op("==").Lit(0)).Block(
+					jen.Id("f").Dot("batchSize").Op("=").Lit(1000),
+				)
+				g.Line()
+				g.Comment("Adopt tasks stored before tasks were scoped to an FSM")
+				g.If(jen.Err().Op(":=").Id("f").Dot("adoptTasks").Call(jen.Id("f").Dot("ctx")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				)
+				g.Comment("Resume tasks stored before their steps were queued in the store")
+				g.If(jen.Err().Op(":=").Id("f").Dot("resumeTasks").Call(jen.Id("f").Dot("ctx")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				)
+				if len(model.InvokingStates()) > 0 {
+					g.Comment("Watch the children of steps parked before a restart again")
+					g.If(jen.Err().Op(":=").Id("f").Dot("watchParked").Call(jen.Id("f").Dot("ctx")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Nil(), jen.Err()),
+					)
+				}
 				g.Line()
 				// Start FSM processors
-				g.Comment("Start FSM processors")
+				g.Comment("Start FSM processors. Existing work, including steps whose lease")
+				g.Comment("expired in a process that died, is claimed from the store.")
 				for _, state := range model.States {
 					if state.Workers <= 1 {
 						g.Commentf("Start 1 %s", model.FsmStateProcessorName(state))
@@ -239,55 +547,142 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 						)
 					}
 				}
-				g.Line()
-				// Resume tasks
-				g.Comment("Resume existingtasks")
-				g.If(jen.Err().Op(":=").Id("f").Dot("resumeTasks").Call(), jen.Err().Op("!=").Nil()).Block(
-					jen.Return(jen.Nil(), jen.Err()),
-				)
+				if len(model.DeadlineStates()) > 0 {
+					g.Comment("Start the deadline poller")
+					g.Go().Id("f").Dot("deadlines").Call()
+				}
 				// Return FSM
 				g.Return(jen.Id("f"), jen.Nil())
 			}),
 	)
 
-	// Resume tasks
+	// Resume tasks without queued steps
 	code = append(code,
-		jen.Func().Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
-			Id("resumeTasks").Params().Error().
+		jen.Comment("adoptTasks scopes the tasks stored before tasks had an FSM, and their").Line().
+			Comment("concurrency locks, to this FSM and namespace. Only tasks that fit the FSM").Line().
+			Comment("are adopted, and only those WithUnscopedTasks accepts, since they can't").Line().
+			Comment("be told apart from other FSMs' tasks that fit too. Without the option, the").Line().
+			Comment("FSM doesn't start while tasks that fit it exist.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("adoptTasks").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error().
+			Block(
+				jen.Return(jen.Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.List(jen.Id("tasks"), jen.Err()).Op(":=").Id("q").Dot("ListUnscopedTasks").Call(jen.Id("ctx")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Var().Id("fitting").Index().Qual("github.com/egoodhall/fsm/gen/sqlc", "Task"),
+					jen.For(jen.List(jen.Id("_"), jen.Id("task")).Op(":=").Range().Id("tasks")).Block(
+						jen.If(jen.List(jen.Id("ok"), jen.Err()).Op(":=").Id("f").Dot("fits").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("task")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						).Else().If(jen.Id("ok")).Block(
+							jen.Id("fitting").Op("=").Append(jen.Id("fitting"), jen.Id("task")),
+						),
+					),
+					jen.If(jen.Len(jen.Id("fitting")).Op("==").Lit(0)).Block(
+						jen.Return(jen.Nil()),
+					),
+					jen.If(jen.Id("f").Dot("adoptUnscoped").Op("==").Nil()).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: count = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrUnscopedTasks"), jen.Len(jen.Id("fitting")))),
+					),
+					jen.Line(),
+					jen.Var().Id("n").Int(),
+					jen.For(jen.List(jen.Id("_"), jen.Id("task")).Op(":=").Range().Id("fitting")).Block(
+						jen.If(jen.Op("!").Id("f").Dot("adoptUnscoped").Call(jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")))).Block(
+							jen.Continue(),
+						),
+						jen.If(jen.Err().Op(":=").Id("q").Dot("AdoptUnscopedTask").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Id("task").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.If(jen.Err().Op(":=").Id("q").Dot("AdoptUnscopedLocks").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Id("task").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.Id("n").Op("++"),
+					),
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Info").Call(jen.Lit("Adopted unscoped tasks"), jen.Lit("count"), jen.Id("n"), jen.Lit("skipped"), jen.Len(jen.Id("fitting")).Op("-").Id("n")),
+					jen.Return(jen.Nil()),
+				))),
+			),
+		jen.Comment("fits reports whether an unscoped task could be one of this FSM's: its").Line().
+			Comment("input decodes as the entrypoint's, and it only went through the FSM's").Line().
+			Comment("states.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("fits").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("task").Qual("github.com/egoodhall/fsm/gen/sqlc", "Task")).
+			Params(jen.Bool(), jen.Error()).
+			Block(
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("f").Dot("decodeParams").Call(jen.Id(model.StateName(model.InitialState())), jen.Id("task").Dot("Data")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.False(), jen.Nil()),
+				),
+				jen.List(jen.Id("history"), jen.Err()).Op(":=").Id("q").Dot("GetHistory").Call(jen.Id("ctx"), jen.Id("task").Dot("ID")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.False(), jen.Err()),
+				),
+				jen.For(jen.List(jen.Id("_"), jen.Id("step")).Op(":=").Range().Id("history")).Block(
+					jen.For(jen.List(jen.Id("_"), jen.Id("state")).Op(":=").Range().Index().Qual("github.com/egoodhall/fsm", "State").Values(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("step").Dot("FromState")), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("step").Dot("ToState")))).Block(
+						jen.Switch(jen.Id("state")).Block(
+							jen.Case(jen.Qual("github.com/egoodhall/fsm", "StateError"), jen.Qual("github.com/egoodhall/fsm", "StateCancelled"), jen.Qual("github.com/egoodhall/fsm", "StateRetried")).Block(
+								jen.Continue(),
+							),
+						),
+						jen.If(jen.Id("f").Dot("stateError").Call(jen.Id("state")).Op("!=").Nil()).Block(
+							jen.Return(jen.False(), jen.Nil()),
+						),
+					),
+				),
+				jen.Return(jen.True(), jen.Nil()),
+			),
+		jen.Comment("resumeTasks queues the current step of tasks stored before steps were").Line().
+			Comment("queued in the store. Each task is only resumed once.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("resumeTasks").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error().
 			Block(
-				jen.List(jen.Id("tasks"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ListTasks").Call(jen.Id("f").Dot("ctx")),
+				jen.List(jen.Id("tasks"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ListUnqueuedTasks").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
 				jen.If(jen.Err().Op("!=").Nil()).Block(
 					jen.Return(jen.Err()),
 				),
-				jen.For(jen.List(jen.Id("_"), jen.Id("task")).Op(":=").Range().Id("tasks")).BlockFunc(func(g *jen.Group) {
-					g.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetLastValidTransition").Call(jen.Id("f").Dot("ctx"), jen.Id("task").Dot("ID"))
-					g.If(jen.Err().Op("!=").Nil()).Block(
+				jen.For(jen.List(jen.Id("_"), jen.Id("task")).Op(":=").Range().Id("tasks")).Block(
+					jen.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")),
+					jen.Var().Id("state").Qual("github.com/egoodhall/fsm", "State"),
+					jen.Id("now").Op(":=").Qual("time", "Now").Call(),
+					jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+						jen.If(jen.Err().Op(":=").Id("q").Dot("DeleteUnqueuedTask").Call(jen.Id("ctx"), jen.Id("task").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id")),
+						jen.If(jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.Id("state").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")),
+						jen.If(jen.Id("f").Dot("isTerminal").Call(jen.Id("state"))).Block(
+							jen.Return(jen.Nil()),
+						),
+						jen.Comment("Tasks that never transitioned start from their input"),
+						jen.Id("data").Op(":=").Id("transition").Dot("Data"),
+						jen.If(jen.Id("transition").Dot("ID").Op("==").Lit(0)).Block(
+							jen.Id("data").Op("=").Id("task").Dot("Data"),
+						),
+						generateEnqueue(model, jen.Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Id("task").Dot("ID")
+							g.Line().Id("State").Op(":").String().Call(jen.Id("state"))
+							g.Line().Id("Data").Op(":").Id("data")
+							g.Line().Id("ReadyAt").Op(":").Id("now").Dot("UnixMilli").Call()
+							g.Line()
+						})), jen.Id("task").Dot("ID"), jen.Id("state"), jen.Id("now")),
+					)), jen.Err().Op("!=").Nil()).Block(
 						jen.Return(jen.Err()),
-					)
-					g.Line()
-					g.Switch(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState"))).BlockFunc(func(g *jen.Group) {
-						for _, state := range model.States {
-							if state.Terminal {
-								continue
-							}
-							g.Case(jen.Id(model.StateName(state))).Block(
-								jen.Var().Id("msg").Id(model.FsmStateMessageName(state)),
-								jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("task").Dot("Data"))).Dot("Decode").Call(jen.Op("&").Id("msg")), jen.Err().Op("!=").Nil()).Block(
-									jen.Return(jen.Err()),
-								),
-								jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("f").Dot("ctx")).Dot("Info").Call(jen.Lit("Resuming task"), jen.Lit("id"), jen.Id("task").Dot("ID")),
-								jen.Select().Block(
-									jen.Case(jen.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("<-").Id("msg")).Block(
-										jen.Return(jen.Nil()),
-									),
-									jen.Case(jen.Op("<-").Id("f").Dot("ctx").Dot("Done").Call()).Block(
-										jen.Return(jen.Qual("errors", "New").Call(jen.Lit("task submission cancelled"))),
-									),
-								),
-							)
-						}
-					})
-				}),
+					),
+					jen.If(jen.Op("!").Id("f").Dot("isTerminal").Call(jen.Id("state"))).Block(
+						jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Info").Call(jen.Lit("Resuming task"), jen.Lit("id"), jen.Id("id"), jen.Lit("state"), jen.Id("state")),
+					),
+				),
 				jen.Return(jen.Nil()),
 			),
 	)
@@ -323,6 +718,41 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 			Block(
 				jen.Id("f").Dot("onCompletion").Op("=").Id("listener"),
 			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithRateLimitListener").
+			Params(jen.Id("listener").Qual("github.com/egoodhall/fsm", "RateLimitListener")).
+			Block(
+				jen.Id("f").Dot("onRateLimit").Op("=").Id("listener"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithBreakerListener").
+			Params(jen.Id("listener").Qual("github.com/egoodhall/fsm", "BreakerListener")).
+			Block(
+				jen.Id("f").Dot("onBreaker").Op("=").Id("listener"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithMiddleware").
+			Params(jen.Id("middleware").Qual("github.com/egoodhall/fsm", "Middleware")).
+			Block(
+				jen.Id("f").Dot("middlewares").Op("=").Append(jen.Id("f").Dot("middlewares"), jen.Id("middleware")),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithMetadataExtractor").
+			Params(jen.Id("extractor").Qual("github.com/egoodhall/fsm", "MetadataExtractor")).
+			Block(
+				jen.Id("f").Dot("extractors").Op("=").Append(jen.Id("f").Dot("extractors"), jen.Id("extractor")),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithMetadataInjector").
+			Params(jen.Id("injector").Qual("github.com/egoodhall/fsm", "MetadataInjector")).
+			Block(
+				jen.Id("f").Dot("injectors").Op("=").Append(jen.Id("f").Dot("injectors"), jen.Id("injector")),
+			),
 		jen.Func().
 			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
 			Id("WithBackoff").
@@ -330,9 +760,145 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 			Block(
 				jen.Id("f").Dot("backoff").Op("=").Id("backoff"),
 			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithStateBackoff").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("backoff").Qual("github.com/egoodhall/fsm", "Backoff")).
+			Error().
+			Block(
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("f").Dot(model.FsmStateBackoffInternalName(state)).Op("=").Id("backoff"),
+							)
+						}
+					}
+					g.Default().Block(generateOptionError("backoff")...)
+				}),
+				jen.Return(jen.Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithQueue").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("config").Qual("github.com/egoodhall/fsm", "QueueConfig")).
+			Error().
+			Block(
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("=").Id("config"),
+							)
+						}
+					}
+					g.Default().Block(generateOptionError("queue")...)
+				}),
+				jen.Return(jen.Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithLease").
+			Params(jen.Id("ttl").Qual("time", "Duration")).
+			Block(
+				jen.Id("f").Dot("leaseTTL").Op("=").Id("ttl"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithPollInterval").
+			Params(jen.Id("interval").Qual("time", "Duration")).
+			Block(
+				jen.Id("f").Dot("pollInterval").Op("=").Id("interval"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithPriorityAging").
+			Params(jen.Id("interval").Qual("time", "Duration")).
+			Block(
+				jen.Id("f").Dot("aging").Op("=").Id("interval"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithBatchSize").
+			Params(jen.Id("size").Int()).
+			Block(
+				jen.Id("f").Dot("batchSize").Op("=").Id("size"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithNamespace").
+			Params(jen.Id("namespace").String()).
+			Block(
+				jen.Id("f").Dot("namespace").Op("=").Id("namespace"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithUnscopedTasks").
+			Params(jen.Id("adopt").Func().Params(jen.Qual("github.com/egoodhall/fsm", "TaskID")).Bool()).
+			Block(
+				jen.Id("f").Dot("adoptUnscoped").Op("=").Id("adopt"),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithRate").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("rate").Qual("github.com/egoodhall/fsm", "Rate"), jen.Id("burst").Int()).
+			Error().
+			Block(
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("f").Dot(model.FsmStateLimiterInternalName(state)).Dot("SetRate").Call(jen.Id("rate"), jen.Id("burst")),
+							)
+						}
+					}
+					g.Default().Block(generateOptionError("rate limit")...)
+				}),
+				jen.Return(jen.Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithBreaker").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("config").Qual("github.com/egoodhall/fsm", "BreakerConfig")).
+			Error().
+			Block(
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("f").Dot(model.FsmStateBreakerInternalName(state)).Dot("SetConfig").Call(jen.Id("config")),
+							)
+						}
+					}
+					g.Default().Block(generateOptionError("circuit breaker")...)
+				}),
+				jen.Return(jen.Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("WithDeadline").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("after").Qual("time", "Duration")).
+			Error().
+			BlockFunc(func(g *jen.Group) {
+				if len(model.DeadlineStates()) == 0 {
+					for _, code := range generateOptionError("deadline") {
+						g.Add(code)
+					}
+					return
+				}
+				g.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.DeadlineStates() {
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Id("f").Dot(model.FsmStateDeadlineInternalName(state)).Op("=").Id("after"),
+						)
+					}
+					g.Default().Block(generateOptionError("deadline")...)
+				})
+				g.Return(jen.Nil())
+			}),
 	)
 
-	// FSM transition methods
+	// FSM transition methods, immediate or scheduled for later
 	code = append(code, jen.Comment("FSM transition methods"))
 	for _, state := range model.States {
 		code = append(code,
@@ -342,54 +908,84 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 				ParamsFunc(func(g *jen.Group) {
 					g.Id("ctx").Qual("context", "Context")
 					for i, param := range state.Inputs {
-						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderType(param))
+						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderTransitionInput(state, param))
 					}
 				}).
 				Error().
 				Block(
-					jen.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx")),
-					jen.Id("fromState").Op(":=").Qual("github.com/egoodhall/fsm", "GetState").Call(jen.Id("ctx")),
-					jen.Id("toState").Op(":=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id(model.StateName(state))),
-					jen.Id("msg").Op(":=").Id(model.FsmStateMessageName(state)).ValuesFunc(func(g *jen.Group) {
-						g.Id("ID").Op(":").Id("id")
+					jen.Return(jen.Id("f").Dot(model.TransitionToName(state.Name)+"At").CallFunc(func(g *jen.Group) {
+						g.Id("ctx")
+						g.Qual("time", "Now").Call()
 						for i := range state.Inputs {
-							g.Id(fmt.Sprintf("P%d", i)).Op(":").Id(fmt.Sprintf("P%d", i))
+							g.Id(fmt.Sprintf("P%d", i))
 						}
-					}),
-					jen.Line(),
+					})),
+				),
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id(model.TransitionToName(state.Name)+"After").
+				ParamsFunc(func(g *jen.Group) {
+					g.Id("ctx").Qual("context", "Context")
+					g.Id("delay").Qual("time", "Duration")
+					for i, param := range state.Inputs {
+						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderTransitionInput(state, param))
+					}
+				}).
+				Error().
+				Block(
+					jen.Return(jen.Id("f").Dot(model.TransitionToName(state.Name)+"At").CallFunc(func(g *jen.Group) {
+						g.Id("ctx")
+						g.Qual("time", "Now").Call().Dot("Add").Call(jen.Id("delay"))
+						for i := range state.Inputs {
+							g.Id(fmt.Sprintf("P%d", i))
+						}
+					})),
+				),
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id(model.TransitionToName(state.Name)+"At").
+				ParamsFunc(func(g *jen.Group) {
+					g.Id("ctx").Qual("context", "Context")
+					g.Id("at").Qual("time", "Time")
+					for i, param := range state.Inputs {
+						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderTransitionInput(state, param))
+					}
+				}).
+				Error().
+				BlockFunc(func(g *jen.Group) {
+					if model.InBranch(state) {
+						g.Comment("Branches stay in the branch they started in")
+						g.List(jen.Id("branch"), jen.Id("_")).Op(":=").Qual("github.com/egoodhall/fsm", "GetBranch").Call(jen.Id("ctx"))
+					}
+					if state.Join != nil {
+						g.Comment("Each branch contributes one element of the join's inputs")
+					}
+					g.Id("msg").Op(":=").Id(model.FsmStateMessageName(state)).ValuesFunc(func(g *jen.Group) {
+						g.Id("ID").Op(":").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx"))
+						if model.InBranch(state) {
+							g.Id("Branch").Op(":").Id("branch")
+						}
+						for i, param := range state.Inputs {
+							if state.Join != nil {
+								g.Id(fmt.Sprintf("P%d", i)).Op(":").Index().Add(model.RenderType(param)).Values(jen.Id(fmt.Sprintf("P%d", i)))
+								continue
+							}
+							g.Id(fmt.Sprintf("P%d", i)).Op(":").Id(fmt.Sprintf("P%d", i))
+						}
+					})
+					g.Line()
 					// Encode and save transition
-					jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
-					jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+					g.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer"))
+					g.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
 						jen.Return(jen.Err()),
-					),
-					jen.Line(),
-					jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("RecordTransition").Call(
-						jen.Id("ctx"),
-						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
-							g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
-							g.Line().Id("Attempt").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetAttempt").Call(jen.Id("ctx")))
-							g.Line().Id("FromState").Op(":").String().Call(jen.Id("fromState"))
-							g.Line().Id("ToState").Op(":").String().Call(jen.Id("toState"))
-							g.Line().Id("Data").Op(":").Id("buf").Dot("Bytes").Call()
-							g.Line()
-						}),
-					), jen.Err().Op("!=").Nil()).Block(
-						jen.Return(jen.Err()),
-					),
-					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Transitioned state"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("toState")),
-					jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
-						jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("msg").Dot("ID"), jen.Id("fromState"), jen.Id("toState")),
-					),
-					jen.Line(),
-					jen.Select().Block(
-						jen.Case(jen.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("<-").Id("msg")).Block(
-							jen.Return(jen.Nil()),
-						),
-						jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
-							jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("task submission cancelled: id = %d"), jen.Id("id"))),
-						),
-					),
-				),
+					)
+					g.Line()
+					if state.Join != nil {
+						g.Return(jen.Id("f").Dot("join").Call(jen.Id("ctx"), jen.Id(model.StateName(state)), jen.Id("buf").Dot("Bytes").Call(), jen.Id("at")))
+						return
+					}
+					g.Return(jen.Id("f").Dot("transition").Call(jen.Id("ctx"), jen.Id(model.StateName(state)), jen.Id("buf").Dot("Bytes").Call(), jen.Id("at")))
+				}),
 		)
 	}
 
@@ -402,55 +998,127 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 				Params().
 				Block(
 					jen.Id("ctx").Op(":=").Qual("github.com/egoodhall/fsm", "PutState").Call(jen.Id("f").Dot("ctx"), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id(model.StateName(state)))),
-					jen.For(jen.Id("msg").Op(":=").Range().Id("f").Dot(model.FsmStateQueueInternalName(state))).BlockFunc(func(g *jen.Group) {
+					jen.For().BlockFunc(func(g *jen.Group) {
 						if state.Terminal {
-							g.If(jen.Id("f").Dot("onCompletion").Op("!=").Nil()).Block(
-								jen.Id("f").Dot("onCompletion").Call(jen.Id("ctx"), jen.Id("msg").Dot("ID"), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id(model.StateName(state)))),
+							g.List(jen.Id("item"), jen.Id("_"), jen.Id("ok")).Op(":=").Id("f").Dot("claim").Call(jen.Id("ctx"), jen.Id(model.StateName(state)), jen.Id("f").Dot(model.FsmStateReadyInternalName(state)), jen.Nil())
+							g.If(jen.Op("!").Id("ok")).Block(
+								jen.Return(),
 							)
-						} else {
-							g.Id("ctx2").Op(":=").Qual("github.com/egoodhall/fsm", "PutAttempt").Call(jen.Id("ctx"), jen.Id("msg").Dot("Attempt"))
-							g.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx2")).Dot("Debug").Call(jen.Lit("Processing message"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("attempt"), jen.Id("msg").Dot("Attempt"), jen.Lit("state"), jen.Id(model.StateName(state)))
-							g.If(jen.Err().Op(":=").Id("f").Dot(model.FsmStateInternalName(state)).CallFunc(func(g *jen.Group) {
-								g.Qual("github.com/egoodhall/fsm", "PutTaskID").Call(jen.Id("ctx2"), jen.Id("msg").Dot("ID"))
-								if !state.Terminal {
-									g.Id("f")
-								}
+							g.Id("f").Dot("ack").Call(jen.Id("ctx"), jen.Id("item"))
+							g.Id("f").Dot("complete").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("item").Dot("TaskID")), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id(model.StateName(state))))
+							return
+						}
+						breaker := jen.Id("f").Dot(model.FsmStateBreakerInternalName(state))
+						g.Comment("The breaker and rate limit hold steps back before they're claimed, so")
+						g.Comment("held back steps aren't leased")
+						g.List(jen.Id("probe"), jen.Err()).Op(":=").Add(breaker).Dot("Allow").Call(jen.Id("ctx"))
+						g.If(jen.Err().Op("!=").Nil()).Block(
+							jen.Return(),
+						)
+						g.List(jen.Id("item"), jen.Id("wait"), jen.Id("ok")).Op(":=").Id("f").Dot("claim").Call(jen.Id("ctx"), jen.Id(model.StateName(state)), jen.Id("f").Dot(model.FsmStateReadyInternalName(state)), jen.Id("f").Dot(model.FsmStateLimiterInternalName(state)))
+						g.If(jen.Op("!").Id("ok")).Block(
+							jen.Add(breaker).Dot("Abandon").Call(jen.Id("probe")),
+							jen.Return(),
+						)
+						g.Id("f").Dot("throttled").Call(jen.Id("ctx"), jen.Id("f").Dot(model.FsmStateLimiterInternalName(state)), jen.Id("item"), jen.Id("wait"))
+						g.Line()
+						g.Var().Id("msg").Id(model.FsmStateMessageName(state))
+						if len(state.Inputs) > 0 || model.InBranch(state) {
+							g.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("item").Dot("Data"))).Dot("Decode").Call(jen.Op("&").Id("msg")), jen.Err().Op("!=").Nil()).Block(
+								jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to decode message"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("state"), jen.Id(model.StateName(state)), jen.Lit("error"), jen.Err()),
+								jen.Comment("The attempt fails like a handler error, so the step backs off and"),
+								jen.Comment("the failure shows in the task's history"),
+								jen.Id("f").Dot("fail").Call(jen.Id("ctx"), jen.Id("item"), jen.Qual("fmt", "Errorf").Call(jen.Lit("decode message: %w"), jen.Err())),
+								jen.Id("f").Dot(model.FsmStateBreakerInternalName(state)).Dot("Abandon").Call(jen.Id("probe")),
+								jen.Continue(),
+							)
+						}
+						g.List(jen.Id("msg").Dot("ID"), jen.Id("msg").Dot("Attempt")).Op("=").List(jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("item").Dot("TaskID")), jen.Int().Call(jen.Id("item").Dot("Attempt")))
+						if model.InBranch(state) {
+							g.If(jen.Id("f").Dot("abandoned").Call(jen.Id("ctx"), jen.Id("msg").Dot("ID"), jen.Id("msg").Dot("Branch"))).Block(
+								jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Skipping abandoned branch"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("branch"), jen.Id("msg").Dot("Branch").Dot("Index"), jen.Lit("state"), jen.Id(model.StateName(state))),
+								jen.Id("f").Dot("ack").Call(jen.Id("ctx"), jen.Id("item")),
+								jen.Id("f").Dot(model.FsmStateBreakerInternalName(state)).Dot("Abandon").Call(jen.Id("probe")),
+								jen.Continue(),
+							)
+						}
+						g.Line()
+						g.Comment("Transitions inherit the step's priority unless the handler overrides it")
+						g.Id("ctx2").Op(":=").Qual("github.com/egoodhall/fsm", "PutPriority").Call(jen.Qual("github.com/egoodhall/fsm", "PutAttempt").Call(jen.Id("ctx"), jen.Id("msg").Dot("Attempt")), jen.Int().Call(jen.Id("item").Dot("Priority")))
+						g.List(jen.Id("ctx3"), jen.Id("ok")).Op(":=").Id("f").Dot("startTask").Call(jen.Id("ctx2"), jen.Id("msg").Dot("ID"))
+						g.If(jen.Op("!").Id("ok")).Block(
+							jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx2")).Dot("Debug").Call(jen.Lit("Skipping cancelled task"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("state"), jen.Id(model.StateName(state))),
+							jen.Id("f").Dot("ack").Call(jen.Id("ctx"), jen.Id("item")),
+							jen.Id("f").Dot(model.FsmStateBreakerInternalName(state)).Dot("Abandon").Call(jen.Id("probe")),
+							jen.Continue(),
+						)
+						g.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx2")).Dot("Debug").Call(jen.Lit("Processing message"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("attempt"), jen.Id("msg").Dot("Attempt"), jen.Lit("state"), jen.Id(model.StateName(state)))
+						handlerCtx := jen.Qual("github.com/egoodhall/fsm", "PutQueueItem").Call(jen.Qual("github.com/egoodhall/fsm", "PutTaskID").Call(jen.Id("ctx3"), jen.Id("msg").Dot("ID")), jen.Id("item").Dot("ID"))
+						if model.InBranch(state) {
+							handlerCtx = jen.Qual("github.com/egoodhall/fsm", "PutBranch").Call(handlerCtx, jen.Id("msg").Dot("Branch"))
+						}
+						g.List(jen.Id("ctx4"), jen.Id("stop")).Op(":=").Id("f").Dot("heartbeat").Call(handlerCtx, jen.Id("item"))
+						handle := jen.Err().Op("=").Id("f").Dot("handle").Call(jen.Id("ctx4"), jen.Id(model.StateName(state)), jen.Id("msg").Dot("ID"), jen.Id("msg").Dot("Attempt"), jen.Func().Params(jen.Id("ctx").Qual("context", "Context")).Error().Block(
+							jen.Return(jen.Id("f").Dot(model.FsmStateInternalName(state)).CallFunc(func(g *jen.Group) {
+								g.Id("ctx")
+								g.Id("f")
 								for i := range state.Inputs {
 									g.Id("msg").Dot(fmt.Sprintf("P%d", i))
 								}
-							}), jen.Err().Op("!=").Nil()).Block(
-								jen.Id("msg").Dot("Attempt").Op("++"),
-								jen.Id("delay").Op(":=").Id("f").Dot("backoff").Call(jen.Id("msg").Dot("Attempt")),
-								jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Processing error"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("attempt"), jen.Id("msg").Dot("Attempt"), jen.Lit("delay"), jen.Id("delay"), jen.Lit("state"), jen.Id(model.StateName(state)), jen.Lit("error"), jen.Err()),
-								jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("RecordTransition").Call(
-									jen.Id("ctx2"),
-									jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
-										g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("msg").Dot("ID"))
-										g.Line().Id("Attempt").Op(":").Int64().Call(jen.Id("msg").Dot("Attempt"))
-										g.Line().Id("FromState").Op(":").String().Call(jen.Id(model.StateName(state)))
-										g.Line().Id("ToState").Op(":").String().Call(jen.Qual("github.com/egoodhall/fsm", "StateError"))
-										g.Line().Id("Data").Op(":").Id("[]byte").Call(jen.Id("err").Dot("Error").Call())
-										g.Line()
-									}),
-								), jen.Err().Op("!=").Nil()).Block(
-									jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Failed to record transition"), jen.Lit("id"), jen.Id("msg").Dot("ID"), jen.Lit("attempt"), jen.Id("msg").Dot("Attempt"), jen.Lit("delay"), jen.Id("delay"), jen.Lit("state"), jen.Id(model.StateName(state)), jen.Lit("error"), jen.Err()),
-								),
-								jen.Line(),
-								jen.Go().Func().Params().Block(
-									jen.Op("<-").Qual("time", "After").Call(jen.Id("delay")),
-									jen.Select().Block(
-										jen.Case(jen.Id("f").Dot(model.FsmStateQueueInternalName(state)).Op("<-").Id("msg")).Block(),
-										jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(),
-									),
-								).Call(),
+							})),
+						))
+						if state.Failure && len(model.CompensatedStates()) > 0 {
+							g.Comment("Failure paths undo the task's completed steps first")
+							g.Err().Op("=").Id("f").Dot("compensate").Call(jen.Id("ctx4"), jen.Id("msg").Dot("ID"), jen.Id("msg").Dot("Attempt"))
+							g.If(jen.Err().Op("==").Nil()).Block(handle)
+						} else {
+							g.Add(handle)
+						}
+						g.Id("f").Dot("record").Call(jen.Id("ctx4"), jen.Id("f").Dot(model.FsmStateBreakerInternalName(state)), jen.Id("probe"), jen.Err())
+						g.Id("stop").Call()
+						g.Id("f").Dot("finishTask").Call(jen.Id("ctx3"), jen.Id("msg").Dot("ID"))
+						if state.Invoke != nil {
+							g.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrChildRunning"))).Block(
+								jen.Id("f").Dot("park").Call(jen.Id("ctx"), jen.Id("item")),
+								jen.Continue(),
 							)
 						}
+						done := jen.Err().Op("==").Nil().Op("||").Id("f").Dot("isCancelled").Call(jen.Id("ctx"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("msg").Dot("ID"))
+						if model.InBranch(state) {
+							// Branches abandoned by their join while running are dropped
+							done = done.Op("||").Id("f").Dot("abandoned").Call(jen.Id("ctx"), jen.Id("msg").Dot("ID"), jen.Id("msg").Dot("Branch"))
+						}
+						g.If(done).Block(
+							jen.Id("f").Dot("ack").Call(jen.Id("ctx"), jen.Id("item")),
+							jen.Continue(),
+						)
+						g.Id("f").Dot("fail").Call(jen.Id("ctx2"), jen.Id("item"), jen.Err())
 					}),
 				),
 		)
 	}
 
-	// FSM submit method
+	// FSM invocation handlers
+	code = append(code, generateInvokeMethods(model)...)
+
+	// FSM fan-out and join methods
+	code = append(code, generateFanoutMethods(model)...)
+
+	// FSM compensation methods
+	code = append(code, generateCompensationMethods(model)...)
+
+	// FSM deadline methods
+	code = append(code, generateDeadlineMethods(model)...)
+
+	// FSM queue methods
+	code = append(code, generateQueueMethods(model)...)
+
+	// FSM submit methods, immediate or scheduled for later
+	initialArgs := func(g *jen.Group) {
+		for i := range model.InitialState().Inputs {
+			g.Id(fmt.Sprintf("P%d", i))
+		}
+	}
 	code = append(code,
 		jen.Comment("Submit FSM tasks"),
 		jen.Func().
@@ -459,7 +1127,82 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 			ParamsFunc(func(g *jen.Group) {
 				g.Id("ctx").Qual("context", "Context")
 				for i, param := range model.InitialState().Inputs {
-					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderType(param))
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.Return(jen.Id("f").Dot("SubmitAt").CallFunc(func(g *jen.Group) {
+					g.Id("ctx")
+					g.Qual("time", "Now").Call()
+					initialArgs(g)
+				})),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("SubmitAfter").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				g.Id("delay").Qual("time", "Duration")
+				for i, param := range model.InitialState().Inputs {
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.Return(jen.Id("f").Dot("SubmitAt").CallFunc(func(g *jen.Group) {
+					g.Id("ctx")
+					g.Qual("time", "Now").Call().Dot("Add").Call(jen.Id("delay"))
+					initialArgs(g)
+				})),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("SubmitAt").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				g.Id("at").Qual("time", "Time")
+				for i, param := range model.InitialState().Inputs {
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.Return(jen.Id("f").Dot("submit").CallFunc(func(g *jen.Group) {
+					g.Id("ctx")
+					g.Id("at")
+					g.True()
+					initialArgs(g)
+				})),
+			),
+		jen.Comment("TrySubmit never waits for room in a full queue"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("TrySubmit").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				for i, param := range model.InitialState().Inputs {
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.Return(jen.Id("f").Dot("submit").CallFunc(func(g *jen.Group) {
+					g.Id("ctx")
+					g.Qual("time", "Now").Call()
+					g.False()
+					initialArgs(g)
+				})),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("submit").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				g.Id("at").Qual("time", "Time")
+				g.Id("block").Bool()
+				for i, param := range model.InitialState().Inputs {
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
 				}
 			}).
 			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
@@ -477,35 +1220,2618 @@ func generateFSMImplementation(model *FsmModel) []jen.Code {
 					jen.Return(jen.Lit(0), jen.Err()),
 				),
 				jen.Line(),
-				jen.List(jen.Id("task"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("CreateTask").Call(jen.Id("ctx"), jen.Id("buf").Dot("Bytes").Call()),
+				jen.Var().List(jen.Id("key"), jen.Id("concurrencyKey")).Op("*").String(),
+				jen.If(jen.List(jen.Id("k"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetIdempotencyKey").Call(jen.Id("ctx")), jen.Id("ok")).Block(
+					jen.Id("key").Op("=").Op("&").Id("k"),
+				),
+				jen.If(jen.List(jen.Id("k"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetConcurrencyKey").Call(jen.Id("ctx")), jen.Id("ok")).Block(
+					jen.Id("concurrencyKey").Op("=").Op("&").Id("k"),
+				),
+				jen.List(jen.Id("metadata"), jen.Err()).Op(":=").Id("f").Dot("metadata").Call(jen.Id("ctx")),
 				jen.If(jen.Err().Op("!=").Nil()).Block(
 					jen.Return(jen.Lit(0), jen.Err()),
 				),
-				jen.Id("msg").Dot("ID").Op("=").Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")),
 				jen.Line(),
-				jen.Select().Block(
-					jen.Case(jen.Id("f").Dot(model.FsmStateQueueInternalName(model.InitialState())).Op("<-").Id("msg")).Block(
-						jen.Return(jen.Id("msg").Dot("ID"), jen.Nil()),
+				jen.Comment("The task and its first step are stored together, once there is room"),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("admit").Call(jen.Id("ctx"), jen.Id("block"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.Comment("A repeated submission returns the task it already created"),
+					jen.If(jen.Id("key").Op("!=").Nil()).Block(
+						jen.List(jen.Id("task"), jen.Err()).Op(":=").Id("q").Dot("GetTaskByIdempotencyKey").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Id("key")),
+						jen.If(jen.Err().Op("==").Nil()).Block(
+							jen.If(jen.Op("!").Qual("bytes", "Equal").Call(jen.Id("task").Dot("Data"), jen.Id("buf").Dot("Bytes").Call())).Block(
+								jen.Return(jen.Qual("github.com/egoodhall/fsm", "ErrIdempotencyConflict")),
+							),
+							jen.Id("msg").Dot("ID").Op("=").Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")),
+							jen.Return(jen.Nil()),
+						).Else().If(jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+							jen.Return(jen.Err()),
+						),
+					),
+					jen.Line(),
+					jen.If(jen.Err().Op(":=").Id("f").Dot("reserve").Call(jen.Id("ctx"), jen.Id("q"), jen.Id(model.StateName(model.InitialState()))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
 					),
-					jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
-						jen.Return(jen.Lit(0), jen.Qual("errors", "New").Call(jen.Lit("task submission cancelled"))),
+					jen.List(jen.Id("task"), jen.Err()).Op(":=").Id("q").Dot("CreateTask").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "CreateTaskParams").ValuesFunc(func(g *jen.Group) {
+						g.Line().Id("Data").Op(":").Id("buf").Dot("Bytes").Call()
+						g.Line().Id("IdempotencyKey").Op(":").Id("key")
+						g.Line().Id("ConcurrencyKey").Op(":").Id("concurrencyKey")
+						g.Line().Id("Metadata").Op(":").Id("metadata")
+						g.Line().Id("Fsm").Op(":").Lit(model.Name)
+						g.Line().Id("Namespace").Op(":").Id("f").Dot("namespace")
+						g.Line()
+					})),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
 					),
+					jen.Id("msg").Dot("ID").Op("=").Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")),
+					generateEnqueue(model, jen.Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+						g.Line().Id("TaskID").Op(":").Id("task").Dot("ID")
+						g.Line().Id("State").Op(":").String().Call(jen.Id(model.StateName(model.InitialState())))
+						g.Line().Id("Data").Op(":").Id("buf").Dot("Bytes").Call()
+						g.Line().Id("ReadyAt").Op(":").Id("at").Dot("UnixMilli").Call()
+						g.Line().Id("Priority").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetPriority").Call(jen.Id("ctx")))
+						g.Line()
+					})), jen.Id("task").Dot("ID"), jen.Id(model.StateName(model.InitialState())), jen.Id("at")),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Lit(0), jen.Err()),
 				),
+				jen.Id("f").Dot("signalAt").Call(jen.Id(model.StateName(model.InitialState())), jen.Id("at")),
+				jen.Return(jen.Id("msg").Dot("ID"), jen.Nil()),
 			),
 	)
 
+	// FSM batch submit methods
+	code = append(code, generateBatchMethods(model)...)
+
+	// FSM cancellation and task tracking methods
+	code = append(code, generateCancelMethods(model)...)
+
+	// FSM pause and resume methods
+	code = append(code, generatePauseMethods(model)...)
+
+	// FSM administrative methods
+	code = append(code, generateAdminMethods(model)...)
+
+	// FSM status and history methods
+	code = append(code, generateStatusMethods(model)...)
+
+	// FSM completion methods
+	code = append(code, generateWaitMethods(model)...)
+
 	return code
 }
 
-func generateFSMStateMethodSignature(model *FsmModel, state StateModel) jen.Code {
-	params := []jen.Code{
-		jen.Qual("context", "Context"),
-	}
-	if !state.Terminal {
-		params = append(params, jen.Id(model.TransitionsParamTypeName(state)))
+func generateInvokeMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	for _, state := range model.InvokingStates() {
+		child := state.Invoke.Child
+		params := []jen.Code{
+			jen.Id("ctx").Qual("context", "Context"),
+			jen.Id("transitions").Id(model.TransitionsParamTypeName(state)),
+		}
+		for i, input := range state.Inputs {
+			params = append(params, jen.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, input)))
+		}
+
+		code = append(code,
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id(model.FsmStateInvokeName(state)).
+				Params(params...).
+				Error().
+				BlockFunc(func(g *jen.Group) {
+					g.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx"))
+					g.List(jen.Id("item"), jen.Id("_")).Op(":=").Qual("github.com/egoodhall/fsm", "GetQueueItem").Call(jen.Id("ctx"))
+					g.Line()
+					g.Comment("The child is keyed by this step, so retries and rechecks of the step")
+					g.Comment("find the child they already started instead of starting another")
+					g.Id("key").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit(fmt.Sprintf("%s/%%s/%s/%%d", model.Name, state.Name)), jen.Id("f").Dot("namespace"), jen.Id("item"))
+					g.List(jen.Id("child"), jen.Err()).Op(":=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Submit").CallFunc(func(g *jen.Group) {
+						g.Qual("github.com/egoodhall/fsm", "PutIdempotencyKey").Call(jen.Id("ctx"), jen.Id("key"))
+						for i := range state.Inputs {
+							g.Id(fmt.Sprintf("P%d", i))
+						}
+					})
+					g.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					)
+					g.Line()
+					g.Comment("Links are recorded even if the task is being cancelled, so cancelling")
+					g.Comment("it can find the child")
+					g.Id("uninterrupted").Op(":=").Qual("context", "WithoutCancel").Call(jen.Id("ctx"))
+					g.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("LinkChildTask").Call(jen.Id("uninterrupted"), jen.Int64().Call(jen.Id("id")), jen.String().Call(jen.Id(model.StateName(state))), jen.Int64().Call(jen.Id("child"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					)
+					g.If(jen.Id("f").Dot("isCancelled").Call(jen.Id("uninterrupted"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("id"))).Block(
+						jen.Comment("The task was cancelled before the child was linked"),
+						jen.Return(jen.Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Cancel").Call(jen.Id("uninterrupted"), jen.Id("child"), jen.Qual("fmt", "Sprintf").Call(jen.Lit(fmt.Sprintf("invoking %s task %%d was cancelled", model.Name)), jen.Id("id")))),
+					)
+					g.Line()
+					g.List(jen.Id("status"), jen.Err()).Op(":=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Status").Call(jen.Id("ctx"), jen.Id("child"))
+					g.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					)
+					g.If(jen.Op("!").Id("status").Dot("Terminal")).Block(
+						jen.Comment("The step is parked instead of holding a worker while the child runs"),
+						jen.Id("f").Dot("watchTask").Call(jen.Id(model.StateName(state)), jen.Id("item"), jen.Func().Params(jen.Id("ctx").Qual("context", "Context")).Error().Block(
+							jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Wait").Call(jen.Id("ctx"), jen.Id("child")),
+							jen.Return(jen.Err()),
+						)),
+						jen.Return(jen.Qual("github.com/egoodhall/fsm", "ErrChildRunning")),
+					)
+					g.Switch(jen.Id("status").Dot("State")).BlockFunc(func(g *jen.Group) {
+						for _, terminal := range child.States {
+							if !terminal.Terminal {
+								continue
+							}
+							to := state.Invoke.On[terminal.Name]
+							g.Case(jen.Id(child.StateName(terminal))).BlockFunc(func(g *jen.Group) {
+								if len(terminal.Inputs) == 0 {
+									g.Return(jen.Id("transitions").Dot(model.TransitionToName(to)).Call(jen.Id("ctx")))
+									return
+								}
+								g.Id("result").Op(":=").Id("status").Dot("Params").Assert(jen.Id(child.ParamsTypeName(terminal)))
+								g.Return(jen.Id("transitions").Dot(model.TransitionToName(to)).CallFunc(func(g *jen.Group) {
+									g.Id("ctx")
+									for i := range terminal.Inputs {
+										g.Id("result").Dot(fmt.Sprintf("P%d", i))
+									}
+								}))
+							})
+						}
+					})
+					g.Line()
+					g.Comment("The child was cancelled, so there's nothing to transition on. Cancelling")
+					g.Comment("the task interrupts this handler, so it mustn't interrupt cancelling")
+					g.Return(jen.Id("f").Dot("Cancel").Call(jen.Id("uninterrupted"), jen.Id("id"), jen.Qual("fmt", "Sprintf").Call(jen.Lit(fmt.Sprintf("invoked %s task %%d was cancelled", child.Name)), jen.Id("child"))))
+				}),
+		)
 	}
-	for _, param := range state.Inputs {
-		params = append(params, model.RenderType(param))
+	if len(model.InvokingStates()) == 0 {
+		return code
 	}
-	return jen.Func().Params(params...).Error()
+
+	// Parked steps, released without counting an attempt while their child
+	// runs. They're woken when it finishes, and rechecked every lease TTL in
+	// case the process watching the child died.
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("park").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem")).
+			Block(
+				jen.Id("recheckAt").Op(":=").Qual("time", "Now").Call().Dot("Add").Call(jen.Id("f").Dot("leaseTTL")).Dot("UnixMilli").Call(),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("RetryQueueItem").Call(jen.Qual("context", "WithoutCancel").Call(jen.Id("ctx")), jen.Id("item").Dot("Attempt"), jen.Id("recheckAt"), jen.Id("item").Dot("ID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to park queue item"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Err()),
+					jen.Id("f").Dot("release").Call(jen.Id("ctx"), jen.Id("item")),
+					jen.Return(),
+				),
+				jen.Id("f").Dot("signalAt").Call(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State")), jen.Qual("time", "UnixMilli").Call(jen.Id("recheckAt"))),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("watchTask").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("item").Int64(), jen.Id("wait").Func().Params(jen.Qual("context", "Context")).Error()).
+			Block(
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.Defer().Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id("f").Dot("watching").Index(jen.Id("item")), jen.Id("ok")).Block(
+					jen.Return(),
+				),
+				jen.Id("f").Dot("watching").Index(jen.Id("item")).Op("=").Struct().Values(),
+				jen.Line(),
+				jen.Go().Func().Params().Block(
+					jen.Defer().Func().Params().Block(
+						jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+						jen.Delete(jen.Id("f").Dot("watching"), jen.Id("item")),
+						jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+					).Call(),
+					jen.If(jen.Err().Op(":=").Id("wait").Call(jen.Id("f").Dot("ctx")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(),
+					),
+					jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("WakeQueueItem").Call(jen.Id("f").Dot("ctx"), jen.Id("item")), jen.Err().Op("!=").Nil()).Block(
+						jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("f").Dot("ctx")).Dot("Error").Call(jen.Lit("Failed to wake queue item"), jen.Lit("state"), jen.Id("state"), jen.Lit("error"), jen.Err()),
+					).Else().If(jen.Id("n").Op(">").Lit(0)).Block(
+						jen.Id("f").Dot("signal").Call(jen.Id("state")),
+					),
+				).Call(),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("watchParked").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error().
+			Block(
+				jen.List(jen.Id("steps"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ListParkedSteps").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.For(jen.List(jen.Id("_"), jen.Id("step")).Op(":=").Range().Id("steps")).Block(
+					jen.Id("child").Op(":=").Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("step").Dot("ChildID")),
+					jen.Switch(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("step").Dot("State"))).BlockFunc(func(g *jen.Group) {
+						for _, state := range model.InvokingStates() {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("f").Dot("watchTask").Call(jen.Id(model.StateName(state)), jen.Id("step").Dot("ID"), jen.Func().Params(jen.Id("ctx").Qual("context", "Context")).Error().Block(
+									jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Wait").Call(jen.Id("ctx"), jen.Id("child")),
+									jen.Return(jen.Err()),
+								)),
+							)
+						}
+					}),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateQueueMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Queue claims, taking a lease on the oldest claimable item and waiting
+	// for a signal or the next poll when there is nothing to claim. Each
+	// attempt takes a rate limit token, handed back if nothing is claimed
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("claim").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("ready").Chan().Struct(), jen.Id("limiter").Op("*").Qual("github.com/egoodhall/fsm", "Limiter")).
+			Params(jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem"), jen.Qual("time", "Duration"), jen.Bool()).
+			Block(
+				jen.Var().Id("waited").Qual("time", "Duration"),
+				jen.For().Block(
+					jen.List(jen.Id("wait"), jen.Err()).Op(":=").Id("f").Dot("throttle").Call(jen.Id("ctx"), jen.Id("limiter")),
+					jen.Id("waited").Op("+=").Id("wait"),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem").Values(), jen.Id("waited"), jen.False()),
+					),
+					jen.Line(),
+					jen.Comment("Claims aren't interrupted, since the lease may be taken even if"),
+					jen.Comment("the claimed item is lost to a cancellation"),
+					jen.Id("uninterrupted").Op(":=").Qual("context", "WithoutCancel").Call(jen.Id("ctx")),
+					jen.Var().Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem"),
+					jen.Err().Op("=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("uninterrupted"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Params(jen.Err().Error()).Block(
+						jen.Id("region").Op(":=").Id("f").Dot("region").Call(jen.Id("state")),
+						jen.List(jen.Id("item"), jen.Err()).Op("=").Id("q").Dot("ClaimQueueItem").Call(jen.Id("uninterrupted"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "ClaimQueueItemParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("Owner").Op(":").Id("f").Dot("owner")
+							g.Line().Id("LeaseMs").Op(":").Id("f").Dot("leaseTTL").Dot("Milliseconds").Call()
+							g.Line().Id("State").Op(":").String().Call(jen.Id("state"))
+							g.Line().Id("Fsm").Op(":").Lit(model.Name)
+							g.Line().Id("Namespace").Op(":").Id("f").Dot("namespace")
+							g.Line().Id("Region").Op(":").Id("region")
+							g.Line().Id("AgingMs").Op(":").Id("f").Dot("aging").Dot("Milliseconds").Call()
+							g.Line()
+						})),
+						jen.If(jen.Err().Op("!=").Nil().Op("||").Id("region").Op("==").Lit("")).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.Comment("The task holds its key's region until it leaves"),
+						jen.Return(jen.Id("q").Dot("AcquireConcurrencyLock").Call(jen.Id("uninterrupted"), jen.Id("region"), jen.Id("item").Dot("TaskID"))),
+					)),
+					jen.If(jen.Err().Op("==").Nil().Op("&&").Id("ctx").Dot("Err").Call().Op("!=").Nil()).Block(
+						jen.Id("f").Dot("release").Call(jen.Id("ctx"), jen.Id("item")),
+						jen.Return(jen.Id("item"), jen.Id("waited"), jen.False()),
+					).Else().If(jen.Err().Op("==").Nil()).Block(
+						jen.Comment("There may be more, so let another processor look"),
+						jen.Id("f").Dot("signal").Call(jen.Id("state")),
+						jen.Return(jen.Id("item"), jen.Id("waited"), jen.True()),
+					),
+					jen.Line(),
+					jen.Comment("Idle processors don't hold on to tokens, so they can't start a burst"),
+					jen.Comment("of steps together once work arrives"),
+					jen.If(jen.Id("limiter").Op("!=").Nil()).Block(
+						jen.Id("limiter").Dot("Refund").Call(),
+					),
+					jen.If(jen.Id("ctx").Dot("Err").Call().Op("!=").Nil()).Block(
+						jen.Return(jen.Id("item"), jen.Id("waited"), jen.False()),
+					).Else().If(jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+						jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to claim queue item"), jen.Lit("state"), jen.Id("state"), jen.Lit("error"), jen.Err()),
+					),
+					jen.Select().Block(
+						jen.Case(jen.Op("<-").Id("ready")).Block(),
+						jen.Case(jen.Op("<-").Qual("time", "After").Call(jen.Id("f").Dot("pollInterval"))).Block(),
+						jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
+							jen.Return(jen.Id("item"), jen.Id("waited"), jen.False()),
+						),
+					),
+				),
+			),
+	)
+
+	// Lease heartbeats, cancelling the handler if the lease is lost
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("heartbeat").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem")).
+			Params(jen.Qual("context", "Context"), jen.Func().Params()).
+			Block(
+				jen.List(jen.Id("ctx"), jen.Id("cancel")).Op(":=").Qual("context", "WithCancelCause").Call(jen.Id("ctx")),
+				jen.Go().Func().Params().Block(
+					jen.Id("ticker").Op(":=").Qual("time", "NewTicker").Call(jen.Id("f").Dot("leaseTTL").Op("/").Lit(3)),
+					jen.Defer().Id("ticker").Dot("Stop").Call(),
+					jen.For().Block(
+						jen.Select().Block(
+							jen.Case(jen.Op("<-").Id("ticker").Dot("C")).Block(),
+							jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
+								jen.Return(),
+							),
+						),
+						jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("RenewQueueItemLease").Call(jen.Id("ctx"), jen.Id("f").Dot("leaseTTL").Dot("Milliseconds").Call(), jen.Id("item").Dot("ID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil().Op("&&").Id("ctx").Dot("Err").Call().Op("==").Nil()).Block(
+							jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to renew lease"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Err()),
+						).Else().If(jen.Err().Op("==").Nil().Op("&&").Id("n").Op("==").Lit(0)).Block(
+							jen.Id("cancel").Call(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"), jen.Id("item").Dot("TaskID"), jen.Id("item").Dot("State"))),
+							jen.Return(),
+						),
+					),
+				).Call(),
+				jen.Return(jen.Id("ctx"), jen.Func().Params().Block(
+					jen.Id("cancel").Call(jen.Nil()),
+				)),
+			),
+	)
+
+	// Middlewares, wrapping a step's handler with the first added outermost
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("handle").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("attempt").Int(), jen.Id("handler").Func().Params(jen.Qual("context", "Context")).Error()).
+			Error().
+			Block(
+				jen.List(jen.Id("ctx"), jen.Err()).Op(":=").Id("f").Dot("restore").Call(jen.Id("ctx"), jen.Id("id")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Id("next").Op(":=").Id("handler"),
+				jen.For(jen.Id("i").Op(":=").Len(jen.Id("f").Dot("middlewares")).Op("-").Lit(1), jen.Id("i").Op(">=").Lit(0), jen.Id("i").Op("--")).Block(
+					jen.List(jen.Id("middleware"), jen.Id("inner")).Op(":=").List(jen.Id("f").Dot("middlewares").Index(jen.Id("i")), jen.Id("next")),
+					jen.Id("next").Op("=").Func().Params(jen.Id("ctx").Qual("context", "Context")).Error().Block(
+						jen.Return(jen.Id("middleware").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("state"), jen.Id("id"), jen.Id("attempt"), jen.Id("inner"))),
+					),
+				),
+				jen.Return(jen.Id("next").Call(jen.Id("ctx"))),
+			),
+	)
+
+	// Task metadata, captured at submission and restored for each step
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("metadata").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Params(jen.Index().Byte(), jen.Error()).
+			Block(
+				jen.Id("metadata").Op(":=").Make(jen.Map(jen.String()).String()),
+				jen.For(jen.List(jen.Id("_"), jen.Id("extract")).Op(":=").Range().Id("f").Dot("extractors")).Block(
+					jen.Qual("maps", "Copy").Call(jen.Id("metadata"), jen.Id("extract").Call(jen.Id("ctx"))),
+				),
+				jen.Qual("maps", "Copy").Call(jen.Id("metadata"), jen.Qual("github.com/egoodhall/fsm", "GetMetadata").Call(jen.Id("ctx"))),
+				jen.Return(jen.Qual("github.com/egoodhall/fsm", "EncodeMetadata").Call(jen.Id("metadata"))),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("restore").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("context", "Context"), jen.Error()).
+			Block(
+				jen.List(jen.Id("data"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetTaskMetadata").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Id("ctx"), jen.Err()),
+				),
+				jen.List(jen.Id("metadata"), jen.Err()).Op(":=").Qual("github.com/egoodhall/fsm", "DecodeMetadata").Call(jen.Id("data")),
+				jen.If(jen.Err().Op("!=").Nil().Op("||").Id("metadata").Op("==").Nil()).Block(
+					jen.Return(jen.Id("ctx"), jen.Err()),
+				),
+				jen.Id("ctx").Op("=").Qual("github.com/egoodhall/fsm", "PutMetadata").Call(jen.Id("ctx"), jen.Id("metadata")),
+				jen.For(jen.List(jen.Id("_"), jen.Id("inject")).Op(":=").Range().Id("f").Dot("injectors")).Block(
+					jen.Id("ctx").Op("=").Id("inject").Call(jen.Id("ctx"), jen.Id("metadata")),
+				),
+				jen.Return(jen.Id("ctx"), jen.Nil()),
+			),
+	)
+
+	// Rate limits, waiting for a token before claiming a step, and reporting
+	// the wait once the step is known
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("throttle").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("limiter").Op("*").Qual("github.com/egoodhall/fsm", "Limiter")).
+			Params(jen.Qual("time", "Duration"), jen.Error()).
+			Block(
+				jen.If(jen.Id("limiter").Op("==").Nil().Op("||").Op("!").Id("limiter").Dot("Limited").Call()).Block(
+					jen.Return(jen.Lit(0), jen.Nil()),
+				),
+				jen.Return(jen.Id("limiter").Dot("Wait").Call(jen.Id("ctx"))),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("throttled").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("limiter").Op("*").Qual("github.com/egoodhall/fsm", "Limiter"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem"), jen.Id("wait").Qual("time", "Duration")).
+			Block(
+				jen.If(jen.Id("limiter").Dot("Limited").Call().Op("&&").Id("f").Dot("onRateLimit").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onRateLimit").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("item").Dot("TaskID")), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State")), jen.Id("wait")),
+				),
+			),
+	)
+
+	// Circuit breakers, recording step outcomes and reporting state changes
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("record").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("breaker").Op("*").Qual("github.com/egoodhall/fsm", "Breaker"), jen.Id("probe").Bool(), jen.Err().Error()).
+			Block(
+				jen.Comment("Shutdowns, cancellations, lost claims, full queues and parked steps say"),
+				jen.Comment("nothing about the state's health"),
+				jen.If(jen.Err().Op("!=").Nil().Op("&&").Parens(
+					jen.Id("ctx").Dot("Err").Call().Op("!=").Nil().Op("||").
+						Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled")).Op("||").
+						Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost")).Op("||").
+						Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrQueueFull")).Op("||").
+						Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrChildRunning")),
+				)).Block(
+					jen.Id("breaker").Dot("Abandon").Call(jen.Id("probe")),
+					jen.Return(),
+				),
+				jen.Id("breaker").Dot("Record").Call(jen.Id("probe"), jen.Err().Op("!=").Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("breakerListener").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Func().Params(jen.Id("from"), jen.Id("to").Qual("github.com/egoodhall/fsm", "BreakerState")).
+			Block(
+				jen.Return(jen.Func().Params(jen.Id("from"), jen.Id("to").Qual("github.com/egoodhall/fsm", "BreakerState")).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("f").Dot("ctx")).Dot("Info").Call(jen.Lit("Circuit breaker changed"), jen.Lit("state"), jen.Id("state"), jen.Lit("from"), jen.Id("from"), jen.Lit("to"), jen.Id("to")),
+					jen.If(jen.Id("f").Dot("onBreaker").Op("!=").Nil()).Block(
+						jen.Id("f").Dot("onBreaker").Call(jen.Id("f").Dot("ctx"), jen.Id("state"), jen.Id("from"), jen.Id("to")),
+					),
+				)),
+			),
+	)
+
+	// Queue acknowledgement
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("ack").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem")).
+			Block(
+				jen.Comment("Finished work is acknowledged even while shutting down"),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("AckQueueItem").Call(jen.Qual("context", "WithoutCancel").Call(jen.Id("ctx")), jen.Id("item").Dot("ID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to acknowledge queue item"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Err()),
+					jen.Return(),
+				),
+				jen.Id("f").Dot("freeSpace").Call(),
+			),
+	)
+
+	// Failed attempts, recorded together with the item's next attempt. The
+	// lease is given up, and the item becomes claimable once the backoff ends,
+	// which is persisted so it outlasts restarts.
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("fail").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem"), jen.Id("cause").Error()).
+			Block(
+				jen.If(jen.Id("f").Dot("ctx").Dot("Err").Call().Op("!=").Nil()).Block(
+					jen.Comment("Shutting down, so hand the step over without counting an attempt"),
+					jen.Id("f").Dot("release").Call(jen.Id("ctx"), jen.Id("item")),
+					jen.Return(),
+				),
+				jen.Id("attempt").Op(":=").Int().Call(jen.Id("item").Dot("Attempt")).Op("+").Lit(1),
+				jen.Id("delay").Op(":=").Id("f").Dot("stateBackoff").Call(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State"))).Call(jen.Id("attempt"), jen.Id("cause")),
+				jen.Id("retryAt").Op(":=").Qual("time", "Now").Call().Dot("Add").Call(jen.Id("delay")).Dot("UnixMilli").Call(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Processing error"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("attempt"), jen.Id("attempt"), jen.Lit("delay"), jen.Id("delay"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Id("cause")),
+				jen.Line(),
+				jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("q").Dot("RetryQueueItem").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("attempt")), jen.Id("retryAt"), jen.Id("item").Dot("ID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					).Else().If(jen.Id("n").Op("==").Lit(0)).Block(
+						jen.Return(jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost")),
+					),
+					jen.Return(jen.Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Id("item").Dot("TaskID")
+							g.Line().Id("Attempt").Op(":").Int64().Call(jen.Id("attempt"))
+							g.Line().Id("FromState").Op(":").Id("item").Dot("State")
+							g.Line().Id("ToState").Op(":").String().Call(jen.Qual("github.com/egoodhall/fsm", "StateError"))
+							g.Line().Id("Data").Op(":").Id("[]byte").Call(jen.Id("cause").Dot("Error").Call())
+							g.Line().Id("NextAttemptAt").Op(":").Op("&").Id("retryAt")
+							g.Line()
+						}),
+					)),
+				)),
+				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"))).Block(
+					jen.Comment("The task has moved on, or another worker took over the step"),
+					jen.Return(),
+				).Else().If(jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Failed to record transition"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("attempt"), jen.Id("attempt"), jen.Lit("delay"), jen.Id("delay"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Err()),
+					jen.Id("f").Dot("release").Call(jen.Id("ctx"), jen.Id("item")),
+					jen.Return(),
+				),
+				jen.Id("f").Dot("signalAt").Call(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State")), jen.Qual("time", "UnixMilli").Call(jen.Id("retryAt"))),
+			),
+	)
+
+	// Queue releases, giving up a lease so the item can be claimed right away
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("release").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem")).
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ReleaseQueueItem").Call(jen.Qual("context", "WithoutCancel").Call(jen.Id("ctx")), jen.Id("item").Dot("ID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to release queue item"), jen.Lit("id"), jen.Id("item").Dot("TaskID"), jen.Lit("state"), jen.Id("item").Dot("State"), jen.Lit("error"), jen.Err()),
+					jen.Return(),
+				),
+				jen.Id("f").Dot("signal").Call(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State"))),
+			),
+	)
+
+	// Queue signals, waking a processor without blocking
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("signal").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Block(
+				jen.Var().Id("ready").Chan().Struct(),
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Id("ready").Op("=").Id("f").Dot(model.FsmStateReadyInternalName(state)),
+						)
+					}
+				}),
+				jen.Select().Block(
+					jen.Case(jen.Id("ready").Op("<-").Struct().Values()).Block(),
+					jen.Default().Block(),
+				),
+			),
+	)
+
+	// Queue capacities. Steps queued or running in a state count towards
+	// its capacity, and are counted in the transaction that adds a step.
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("queueConfig").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Qual("github.com/egoodhall/fsm", "QueueConfig").
+			BlockFunc(func(g *jen.Group) {
+				g.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Return(jen.Id("f").Dot(model.FsmStateQueueInternalName(state))),
+							)
+						}
+					}
+				})
+				g.Return(jen.Qual("github.com/egoodhall/fsm", "QueueConfig").Values())
+			}),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("reserve").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			Block(
+				jen.Id("config").Op(":=").Id("f").Dot("queueConfig").Call(jen.Id("state")),
+				jen.If(jen.Op("!").Id("config").Dot("Bounded").Call()).Block(
+					jen.Return(jen.Nil()),
+				),
+				jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("q").Dot("CountQueueItems").Call(jen.Id("ctx"), jen.String().Call(jen.Id("state")), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Id("n").Op(">=").Int64().Call(jen.Id("config").Dot("Capacity"))).Block(
+					jen.Return(jen.Op("&").Qual("github.com/egoodhall/fsm", "QueueFullError").Values(jen.Dict{
+						jen.Id("State"):    jen.Id("state"),
+						jen.Id("Capacity"): jen.Id("config").Dot("Capacity"),
+					})),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Queue admission, retrying the transaction that adds a step while the
+	// state's queue is full and blocks. Handlers don't wait for room, since
+	// they'd hold their lease and worker while the queue may be waiting on
+	// them; their step is retried with backoff instead.
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("admit").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("block").Bool(), jen.Id("fn").Func().Params(jen.Qual("github.com/egoodhall/fsm", "Q")).Error()).
+			Error().
+			Block(
+				jen.For().Block(
+					jen.Id("f").Dot("spaceLock").Dot("Lock").Call(),
+					jen.Id("space").Op(":=").Id("f").Dot("space"),
+					jen.Id("f").Dot("spaceLock").Dot("Unlock").Call(),
+					jen.Line(),
+					jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Id("fn")),
+					jen.Var().Id("full").Op("*").Qual("github.com/egoodhall/fsm", "QueueFullError"),
+					jen.If(jen.Op("!").Id("block").Op("||").Op("!").Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("full")).Op("||").Op("!").Id("f").Dot("queueConfig").Call(jen.Id("full").Dot("State")).Dot("Blocks").Call()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Line(),
+					jen.Comment("Steps leaving the queue in other processes are only seen by polling"),
+					jen.Select().Block(
+						jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
+							jen.Return(jen.Qual("errors", "Join").Call(jen.Err(), jen.Qual("context", "Cause").Call(jen.Id("ctx")))),
+						),
+						jen.Case(jen.Op("<-").Id("space")).Block(),
+						jen.Case(jen.Op("<-").Qual("time", "After").Call(jen.Id("f").Dot("pollInterval"))).Block(),
+					),
+				),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("freeSpace").
+			Params().
+			Block(
+				jen.Id("f").Dot("spaceLock").Dot("Lock").Call(),
+				jen.Defer().Id("f").Dot("spaceLock").Dot("Unlock").Call(),
+				jen.Close(jen.Id("f").Dot("space")),
+				jen.Id("f").Dot("space").Op("=").Make(jen.Chan().Struct()),
+			),
+	)
+
+	// Backoffs for retries, from the state if it has one
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("stateBackoff").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Qual("github.com/egoodhall/fsm", "Backoff").
+			Block(
+				jen.Var().Id("backoff").Qual("github.com/egoodhall/fsm", "Backoff"),
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if !state.Terminal {
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Id("backoff").Op("=").Id("f").Dot(model.FsmStateBackoffInternalName(state)),
+							)
+						}
+					}
+				}),
+				jen.If(jen.Id("backoff").Op("==").Nil()).Block(
+					jen.Return(jen.Id("f").Dot("backoff")),
+				),
+				jen.Return(jen.Id("backoff")),
+			),
+	)
+
+	// Serialized regions, which tasks sharing a concurrency key pass through
+	// one at a time
+	regions := model.Regions()
+	names := slices.Sorted(maps.Keys(regions))
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("region").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			String().
+			BlockFunc(func(g *jen.Group) {
+				if len(names) > 0 {
+					g.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+						for _, name := range names {
+							g.CaseFunc(func(g *jen.Group) {
+								for _, state := range regions[name] {
+									g.Id(model.StateName(state))
+								}
+							}).Block(
+								jen.Return(jen.Lit(name)),
+							)
+						}
+					})
+				}
+				g.Return(jen.Lit(""))
+			}),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("signalRegion").
+			Params(jen.Id("region").String()).
+			BlockFunc(func(g *jen.Group) {
+				if len(names) > 0 {
+					g.Switch(jen.Id("region")).BlockFunc(func(g *jen.Group) {
+						for _, name := range names {
+							g.Case(jen.Lit(name)).BlockFunc(func(g *jen.Group) {
+								for _, state := range regions[name] {
+									g.Id("f").Dot("signal").Call(jen.Id(model.StateName(state)))
+								}
+							})
+						}
+					})
+				}
+			}),
+	)
+
+	// Delayed queue signals, for work that becomes claimable later. Other
+	// processes sharing the store find it when they poll.
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("signalAt").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("at").Qual("time", "Time")).
+			Block(
+				jen.If(jen.Id("delay").Op(":=").Qual("time", "Until").Call(jen.Id("at")), jen.Id("delay").Op(">").Lit(0)).Block(
+					jen.Qual("time", "AfterFunc").Call(jen.Id("delay"), jen.Func().Params().Block(
+						jen.Id("f").Dot("signal").Call(jen.Id("state")),
+					)),
+					jen.Return(),
+				),
+				jen.Id("f").Dot("signal").Call(jen.Id("state")),
+			),
+	)
+
+	// Transitions, acknowledging the current item and enqueueing the next
+	// one atomically
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("transition").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("toState").Qual("github.com/egoodhall/fsm", "State"), jen.Id("data").Index().Byte(), jen.Id("at").Qual("time", "Time")).
+			Error().
+			Block(
+				jen.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx")),
+				jen.Id("fromState").Op(":=").Qual("github.com/egoodhall/fsm", "GetState").Call(jen.Id("ctx")),
+				jen.List(jen.Id("itemID"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetQueueItem").Call(jen.Id("ctx")),
+				jen.If(jen.Op("!").Id("ok")).Block(
+					jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("transition to %s outside of a task handler"), jen.Id("toState"))),
+				),
+				jen.If(jen.Id("f").Dot("isCancelled").Call(jen.Id("ctx"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("id"))).Block(
+					jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled"), jen.Id("id"))),
+				),
+				jen.Line(),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("admit").Call(jen.Id("ctx"), jen.False(), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					generateCompleteStep(model, jen.Id("toState")),
+					generateAckStep(),
+					generateBranchStep(model),
+					jen.If(jen.Err().Op(":=").Id("f").Dot("reserve").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("toState")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+							g.Line().Id("Attempt").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetAttempt").Call(jen.Id("ctx")))
+							g.Line().Id("FromState").Op(":").String().Call(jen.Id("fromState"))
+							g.Line().Id("ToState").Op(":").String().Call(jen.Id("toState"))
+							g.Line().Id("Data").Op(":").Id("data")
+							g.Line()
+						}),
+					), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Comment("Leaving a serialized region lets the next task with the same key in"),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("ReleaseConcurrencyLocks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("f").Dot("region").Call(jen.Id("toState"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					generateEnqueue(model, jen.Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+						g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+						g.Line().Id("State").Op(":").String().Call(jen.Id("toState"))
+						g.Line().Id("Data").Op(":").Id("data")
+						g.Line().Id("ReadyAt").Op(":").Id("at").Dot("UnixMilli").Call()
+						g.Line().Id("Priority").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetPriority").Call(jen.Id("ctx")))
+						g.Line()
+					})), jen.Int64().Call(jen.Id("id")), jen.Id("toState"), jen.Id("at")),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Transitioned state"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("toState")),
+				jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Id("toState")),
+				),
+				jen.Id("f").Dot("signalAt").Call(jen.Id("toState"), jen.Id("at")),
+				jen.Id("f").Dot("freeSpace").Call(),
+				jen.If(jen.Id("region").Op(":=").Id("f").Dot("region").Call(jen.Id("fromState")), jen.Id("region").Op("!=").Lit("").Op("&&").Id("region").Op("!=").Id("f").Dot("region").Call(jen.Id("toState"))).Block(
+					jen.Id("f").Dot("signalRegion").Call(jen.Id("region")),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateBatchMethods(model *FsmModel) []jen.Code {
+	initial := model.InitialState()
+	code := make([]jen.Code, 0)
+
+	code = append(code,
+		jen.Comment("Submit FSM tasks in batches"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("SubmitBatch").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("inputs").Index().Id(model.ParamsTypeName(initial))).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.Return(jen.Id("f").Dot("SubmitSeq").Call(jen.Id("ctx"), jen.Qual("slices", "Values").Call(jen.Id("inputs")))),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("SubmitSeq").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("inputs").Qual("iter", "Seq").Types(jen.Id(model.ParamsTypeName(initial)))).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetIdempotencyKey").Call(jen.Id("ctx")), jen.Id("ok")).Block(
+					jen.Return(jen.Nil(), jen.Qual("errors", "New").Call(jen.Lit("batch submissions can't share an idempotency key"))),
+				),
+				jen.Line(),
+				jen.Var().Err().Error(),
+				jen.Id("ids").Op(":=").Make(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Lit(0)),
+				jen.Id("chunk").Op(":=").Make(jen.Index().Index().Byte(), jen.Lit(0), jen.Id("f").Dot("batchSize")),
+				jen.For(jen.Id("input").Op(":=").Range().Id("inputs")).Block(
+					jen.Id("msg").Op(":=").Id(model.FsmStateMessageName(initial)).ValuesFunc(func(g *jen.Group) {
+						for i := range initial.Inputs {
+							g.Id(fmt.Sprintf("P%d", i)).Op(":").Id("input").Dot(fmt.Sprintf("P%d", i))
+						}
+					}),
+					jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
+					jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Id("ids"), jen.Err()),
+					),
+					jen.Id("chunk").Op("=").Append(jen.Id("chunk"), jen.Id("buf").Dot("Bytes").Call()),
+					jen.If(jen.Len(jen.Id("chunk")).Op("==").Id("f").Dot("batchSize")).Block(
+						jen.If(jen.List(jen.Id("ids"), jen.Err()).Op("=").Id("f").Dot("submitChunk").Call(jen.Id("ctx"), jen.Id("ids"), jen.Id("chunk")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Id("ids"), jen.Err()),
+						),
+						jen.Id("chunk").Op("=").Id("chunk").Index(jen.Empty(), jen.Lit(0)),
+					),
+				),
+				jen.Return(jen.Id("f").Dot("submitChunk").Call(jen.Id("ctx"), jen.Id("ids"), jen.Id("chunk"))),
+			),
+	)
+
+	code = append(code,
+		jen.Comment("submitChunk stores a chunk of a batch in one transaction, and appends its").Line().
+			Comment("tasks to ids once it commits. When the entrypoint's queue fills up, the").Line().
+			Comment("tasks that fit are committed first, and the rest wait for room or are").Line().
+			Comment("rejected like single submissions.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("submitChunk").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("ids").Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("chunk").Index().Index().Byte()).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Error()).
+			Block(
+				jen.If(jen.Len(jen.Id("chunk")).Op("==").Lit(0)).Block(
+					jen.Return(jen.Id("ids"), jen.Nil()),
+				),
+				jen.Var().Id("concurrencyKey").Op("*").String(),
+				jen.If(jen.List(jen.Id("k"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetConcurrencyKey").Call(jen.Id("ctx")), jen.Id("ok")).Block(
+					jen.Id("concurrencyKey").Op("=").Op("&").Id("k"),
+				),
+				jen.List(jen.Id("metadata"), jen.Err()).Op(":=").Id("f").Dot("metadata").Call(jen.Id("ctx")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Id("ids"), jen.Err()),
+				),
+				jen.Line(),
+				jen.For(jen.Len(jen.Id("chunk")).Op(">").Lit(0)).Block(
+					jen.Id("now").Op(":=").Qual("time", "Now").Call(),
+					jen.Id("created").Op(":=").Make(jen.Index().Qual("github.com/egoodhall/fsm", "TaskID"), jen.Lit(0), jen.Len(jen.Id("chunk"))),
+					jen.If(jen.Err().Op(":=").Id("f").Dot("admit").Call(jen.Id("ctx"), jen.True(), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+						jen.Id("created").Op("=").Id("created").Index(jen.Empty(), jen.Lit(0)),
+						jen.For(jen.List(jen.Id("_"), jen.Id("data")).Op(":=").Range().Id("chunk")).BlockFunc(func(g *jen.Group) {
+							g.If(jen.Err().Op(":=").Id("f").Dot("reserve").Call(jen.Id("ctx"), jen.Id("q"), jen.Id(model.StateName(initial))), jen.Err().Op("!=").Nil()).Block(
+								jen.Comment("Keep the tasks that fit, and stop at the first that doesn't"),
+								jen.If(jen.Len(jen.Id("created")).Op(">").Lit(0).Op("&&").Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrQueueFull"))).Block(
+									jen.Return(jen.Nil()),
+								),
+								jen.Return(jen.Err()),
+							)
+							g.List(jen.Id("task"), jen.Err()).Op(":=").Id("q").Dot("CreateTask").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "CreateTaskParams").ValuesFunc(func(g *jen.Group) {
+								g.Line().Id("Data").Op(":").Id("data")
+								g.Line().Id("ConcurrencyKey").Op(":").Id("concurrencyKey")
+								g.Line().Id("Metadata").Op(":").Id("metadata")
+								g.Line().Id("Fsm").Op(":").Lit(model.Name)
+								g.Line().Id("Namespace").Op(":").Id("f").Dot("namespace")
+								g.Line()
+							}))
+							g.If(jen.Err().Op("!=").Nil()).Block(
+								jen.Return(jen.Err()),
+							)
+							enqueue := jen.List(jen.Id("_"), jen.Err()).Op("=")
+							if len(model.DeadlineStates()) > 0 {
+								enqueue = jen.List(jen.Id("step"), jen.Err()).Op(":=")
+							}
+							g.Add(enqueue).Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+								g.Line().Id("TaskID").Op(":").Id("task").Dot("ID")
+								g.Line().Id("State").Op(":").String().Call(jen.Id(model.StateName(initial)))
+								g.Line().Id("Data").Op(":").Id("data")
+								g.Line().Id("ReadyAt").Op(":").Id("now").Dot("UnixMilli").Call()
+								g.Line().Id("Priority").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetPriority").Call(jen.Id("ctx")))
+								g.Line()
+							}))
+							g.If(jen.Err().Op("!=").Nil()).Block(
+								jen.Return(jen.Err()),
+							)
+							if len(model.DeadlineStates()) > 0 {
+								g.If(jen.Err().Op(":=").Id("f").Dot("scheduleDeadline").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("task").Dot("ID"), jen.Id("step"), jen.Id(model.StateName(initial)), jen.Id("now")), jen.Err().Op("!=").Nil()).Block(
+									jen.Return(jen.Err()),
+								)
+							}
+							g.Id("created").Op("=").Append(jen.Id("created"), jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("task").Dot("ID")))
+						}),
+						jen.Return(jen.Nil()),
+					)), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Id("ids"), jen.Err()),
+					),
+					jen.Id("f").Dot("signal").Call(jen.Id(model.StateName(initial))),
+					jen.Id("ids").Op("=").Append(jen.Id("ids"), jen.Id("created").Op("...")),
+					jen.Id("chunk").Op("=").Id("chunk").Index(jen.Len(jen.Id("created")), jen.Empty()),
+				),
+				jen.Return(jen.Id("ids"), jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateCancelMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Cancel method
+	code = append(code,
+		jen.Comment("Cancel FSM tasks"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Cancel").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("reason").String()).
+			Error().
+			Block(
+				jen.Var().Id("fromState").Qual("github.com/egoodhall/fsm", "State"),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Id("fromState").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")),
+					jen.If(jen.Id("f").Dot("isTerminal").Call(jen.Id("fromState"))).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskFinished"), jen.Id("id"), jen.Id("fromState"))),
+					),
+					jen.Line(),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+							g.Line().Id("Attempt").Op(":").Id("transition").Dot("Attempt")
+							g.Line().Id("FromState").Op(":").String().Call(jen.Id("fromState"))
+							g.Line().Id("ToState").Op(":").String().Call(jen.Qual("github.com/egoodhall/fsm", "StateCancelled"))
+							g.Line().Id("Data").Op(":").Id("[]byte").Call(jen.Id("reason"))
+							g.Line()
+						}),
+					), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Comment("Drop any queued or pending work, and leave any serialized region"),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("DeleteTaskQueueItems").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Return(jen.Id("q").Dot("ReleaseConcurrencyLocks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit(""))),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.Comment("Stop the running handler"),
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("cancel")).Op(":=").Range().Id("f").Dot("running").Index(jen.Id("id"))).Block(
+					jen.Id("cancel").Call(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled"), jen.Id("reason"))),
+				),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Id("f").Dot("signalRegion").Call(jen.Id("f").Dot("region").Call(jen.Id("fromState"))),
+				jen.Id("f").Dot("freeSpace").Call(),
+				jen.Line(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Cancelled task"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("reason"), jen.Id("reason")),
+				jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Qual("github.com/egoodhall/fsm", "StateCancelled")),
+				),
+				jen.Id("f").Dot("complete").Call(jen.Id("ctx"), jen.Id("id"), jen.Qual("github.com/egoodhall/fsm", "StateCancelled")),
+				jen.Do(func(s *jen.Statement) {
+					if len(model.InvokingStates()) > 0 {
+						s.Return(jen.Id("f").Dot("cancelChildren").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("reason")))
+					} else {
+						s.Return(jen.Nil())
+					}
+				}),
+			),
+	)
+
+	// Cancellation of the tasks of invoked FSMs
+	if len(model.InvokingStates()) > 0 {
+		code = append(code,
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id("cancelChildren").
+				Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("reason").String()).
+				Error().
+				Block(
+					jen.List(jen.Id("children"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetChildTasks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Var().Id("errs").Index().Error(),
+					jen.For(jen.List(jen.Id("_"), jen.Id("child")).Op(":=").Range().Id("children")).Block(
+						jen.Var().Err().Error(),
+						jen.Switch(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("child").Dot("State"))).BlockFunc(func(g *jen.Group) {
+							for _, state := range model.InvokingStates() {
+								g.Case(jen.Id(model.StateName(state))).Block(
+									jen.Err().Op("=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Cancel").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("child").Dot("ChildID")), jen.Id("reason")),
+								)
+							}
+						}),
+						jen.Comment("Children that already finished have nothing left to cancel"),
+						jen.If(jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("github.com/egoodhall/fsm", "ErrTaskFinished"))).Block(
+							jen.Id("errs").Op("=").Append(jen.Id("errs"), jen.Err()),
+						),
+					),
+					jen.Return(jen.Qual("errors", "Join").Call(jen.Id("errs").Op("..."))),
+				),
+		)
+	}
+
+	// Parked steps of invoking states are waiting on a running child, not
+	// scheduled for later
+	if len(model.InvokingStates()) > 0 {
+		code = append(code,
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id("parked").
+				Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+				Bool().
+				Block(
+					jen.List(jen.Id("children"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetChildTasks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to get child tasks"), jen.Lit("id"), jen.Id("id"), jen.Lit("error"), jen.Err()),
+						jen.Return(jen.False()),
+					),
+					jen.For(jen.List(jen.Id("_"), jen.Id("child")).Op(":=").Range().Id("children")).Block(
+						jen.If(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("child").Dot("State")).Op("!=").Id("state")).Block(
+							jen.Continue(),
+						),
+						jen.Var().Id("status").Qual("github.com/egoodhall/fsm", "TaskStatus"),
+						jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+							for _, state := range model.InvokingStates() {
+								g.Case(jen.Id(model.StateName(state))).Block(
+									jen.List(jen.Id("status"), jen.Err()).Op("=").Id("f").Dot(model.FsmStateChildInternalName(state)).Dot("Status").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("child").Dot("ChildID"))),
+								)
+							}
+						}),
+						jen.If(jen.Err().Op("!=").Nil()).Block(
+							jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to get child task status"), jen.Lit("id"), jen.Id("child").Dot("ChildID"), jen.Lit("error"), jen.Err()),
+						).Else().If(jen.Op("!").Id("status").Dot("Terminal")).Block(
+							jen.Return(jen.True()),
+						),
+					),
+					jen.Return(jen.False()),
+				),
+		)
+	}
+
+	// Last transition lookup, falling back to the entrypoint for tasks that
+	// have not transitioned yet
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("lastTransition").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "StateTransition"), jen.Error()).
+			Block(
+				jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("q").Dot("GetLastValidTransition").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+					jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("q").Dot("GetTask").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit(model.Name), jen.Id("f").Dot("namespace")), jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+						jen.Return(jen.Id("transition"), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskNotFound"), jen.Id("id"))),
+					).Else().If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Id("transition"), jen.Err()),
+					),
+					jen.Return(jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "StateTransition").Values(jen.Dict{
+						jen.Id("TaskID"):  jen.Int64().Call(jen.Id("id")),
+						jen.Id("ToState"): jen.String().Call(jen.Id(model.StateName(model.InitialState()))),
+					}), jen.Nil()),
+				),
+				jen.Return(jen.Id("transition"), jen.Err()),
+			),
+	)
+
+	// Running task tracking
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("startTask").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("context", "Context"), jen.Bool()).
+			Block(
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.List(jen.Id("ctx2"), jen.Id("cancel")).Op(":=").Qual("context", "WithCancelCause").Call(jen.Id("ctx")),
+				jen.If(jen.Id("f").Dot("running").Index(jen.Id("id")).Op("==").Nil()).Block(
+					jen.Id("f").Dot("running").Index(jen.Id("id")).Op("=").Make(jen.Map(jen.Qual("context", "Context")).Qual("context", "CancelCauseFunc")),
+				),
+				jen.Id("f").Dot("running").Index(jen.Id("id")).Index(jen.Id("ctx2")).Op("=").Id("cancel"),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.Comment("Cancel stops the handlers running when it commits, so handlers"),
+				jen.Comment("registered after that find the cancellation in the store"),
+				jen.If(jen.Id("f").Dot("isCancelled").Call(jen.Id("ctx"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("id"))).Block(
+					jen.Id("f").Dot("finishTask").Call(jen.Id("ctx2"), jen.Id("id")),
+					jen.Return(jen.Id("ctx"), jen.False()),
+				),
+				jen.Return(jen.Id("ctx2"), jen.True()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("finishTask").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Block(
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.Defer().Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.If(jen.List(jen.Id("cancel"), jen.Id("ok")).Op(":=").Id("f").Dot("running").Index(jen.Id("id")).Index(jen.Id("ctx")), jen.Id("ok")).Block(
+					jen.Id("cancel").Call(jen.Nil()),
+					jen.Delete(jen.Id("f").Dot("running").Index(jen.Id("id")), jen.Id("ctx")),
+				),
+				jen.If(jen.Len(jen.Id("f").Dot("running").Index(jen.Id("id"))).Op("==").Lit(0)).Block(
+					jen.Delete(jen.Id("f").Dot("running"), jen.Id("id")),
+				),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("isCancelled").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Bool().
+			Block(
+				jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to get last transition"), jen.Lit("id"), jen.Id("id"), jen.Lit("error"), jen.Err()),
+					jen.Return(jen.False()),
+				),
+				jen.Return(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")).Op("==").Qual("github.com/egoodhall/fsm", "StateCancelled")),
+			),
+	)
+
+	return code
+}
+
+func generatePauseMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Pause a single state
+	code = append(code,
+		jen.Comment("Pause and resume FSM dispatch"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Pause").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("stateError").Call(jen.Id("state")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("PauseState").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.String().Call(jen.Id("state"))), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Paused state"), jen.Lit("state"), jen.Id("state")),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Resume a single state
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Resume").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("stateError").Call(jen.Id("state")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ResumeState").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.String().Call(jen.Id("state"))), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Resumed state"), jen.Lit("state"), jen.Id("state")),
+				jen.Comment("Other processes pick the state's steps up when they next poll"),
+				jen.Id("f").Dot("signal").Call(jen.Id("state")),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Pause the whole FSM
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("PauseAll").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error().
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("PauseState").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Lit("")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Paused FSM")),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Resume the whole FSM, leaving paused states paused
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("ResumeAll").
+			Params(jen.Id("ctx").Qual("context", "Context")).
+			Error().
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("ResumeState").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Lit("")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Resumed FSM")),
+				jen.Comment("States paused on their own stay paused"),
+				jen.For(jen.List(jen.Id("_"), jen.Id("state")).Op(":=").Range().Index().Qual("github.com/egoodhall/fsm", "State").ValuesFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						g.Id(model.StateName(state))
+					}
+				})).Block(
+					jen.Id("f").Dot("signal").Call(jen.Id("state")),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Pause check
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Paused").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Params(jen.Bool(), jen.Error()).
+			Block(
+				jen.If(jen.Err().Op(":=").Id("f").Dot("stateError").Call(jen.Id("state")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.False(), jen.Err()),
+				),
+				jen.List(jen.Id("paused"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetPausedStates").Call(jen.Id("ctx"), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.False(), jen.Err()),
+				),
+				jen.Return(jen.Qual("slices", "Contains").Call(jen.Id("paused"), jen.Lit("")).Op("||").Qual("slices", "Contains").Call(jen.Id("paused"), jen.String().Call(jen.Id("state"))), jen.Nil()),
+			),
+	)
+
+	// State check
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("stateError").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			Block(
+				jen.Switch(jen.Id("state")).Block(
+					jen.CaseFunc(func(g *jen.Group) {
+						for _, state := range model.States {
+							g.Id(model.StateName(state))
+						}
+					}).Block(
+						jen.Return(jen.Nil()),
+					),
+				),
+				jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Qual("github.com/egoodhall/fsm", "ErrUnknownState"), jen.Id("state"))),
+			),
+	)
+
+	return code
+}
+
+func generateAdminMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Retry a failed step without waiting out its backoff
+	code = append(code,
+		jen.Comment("Administrative FSM task operations"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("RetryNow").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("operator").String()).
+			Error().
+			Block(
+				jen.If(jen.Id("operator").Op("==").Lit("")).Block(
+					jen.Return(jen.Qual("errors", "New").Call(jen.Lit("operator is required"))),
+				),
+				jen.Var().Id("state").Qual("github.com/egoodhall/fsm", "State"),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Id("state").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")),
+					jen.If(jen.Id("f").Dot("isTerminal").Call(jen.Id("state"))).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskFinished"), jen.Id("id"), jen.Id("state"))),
+					),
+					jen.List(jen.Id("item"), jen.Err()).Op(":=").Id("q").Dot("GetTaskQueueItem").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+					jen.If(jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Comment("Only failed steps that aren't running can be retried"),
+					jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("q").Dot("ExpediteQueueItem").Call(jen.Id("ctx"), jen.Id("item").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					).Else().If(jen.Id("n").Op("==").Lit(0)).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrNoPendingRetry"), jen.Id("id"), jen.Id("state"))),
+					),
+					jen.Id("state").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State")),
+					jen.Return(jen.Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+							g.Line().Id("Attempt").Op(":").Id("item").Dot("Attempt")
+							g.Line().Id("FromState").Op(":").Id("item").Dot("State")
+							g.Line().Id("ToState").Op(":").String().Call(jen.Qual("github.com/egoodhall/fsm", "StateRetried"))
+							g.Line().Id("Operator").Op(":").Op("&").Id("operator")
+							g.Line()
+						}),
+					)),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Retrying task now"), jen.Lit("id"), jen.Id("id"), jen.Lit("state"), jen.Id("state"), jen.Lit("operator"), jen.Id("operator")),
+				jen.Id("f").Dot("signal").Call(jen.Id("state")),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Force a task into a state, with typed inputs
+	for _, state := range model.ForcibleStates() {
+		code = append(code,
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id(model.ForceName(state.Name)).
+				ParamsFunc(func(g *jen.Group) {
+					g.Id("ctx").Qual("context", "Context")
+					g.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")
+					g.Id("operator").String()
+					for i, param := range state.Inputs {
+						g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, param))
+					}
+				}).
+				Error().
+				Block(
+					jen.Id("msg").Op(":=").Id(model.FsmStateMessageName(state)).ValuesFunc(func(g *jen.Group) {
+						g.Id("ID").Op(":").Id("id")
+						for i := range state.Inputs {
+							g.Id(fmt.Sprintf("P%d", i)).Op(":").Id(fmt.Sprintf("P%d", i))
+						}
+					}),
+					jen.Line(),
+					jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
+					jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Line(),
+					jen.Return(jen.Id("f").Dot("move").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("operator"), jen.Id(model.StateName(state)), jen.Id("buf").Dot("Bytes").Call())),
+				),
+		)
+	}
+
+	// Restart a task from a step in its history
+	unforcible := make([]jen.Code, 0)
+	for _, state := range model.States {
+		if !slices.ContainsFunc(model.ForcibleStates(), func(s StateModel) bool { return s.Name == state.Name }) {
+			unforcible = append(unforcible, jen.Id(model.StateName(state)))
+		}
+	}
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Restart").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("step").Int(), jen.Id("operator").String()).
+			Error().
+			Block(
+				jen.List(jen.Id("task"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetTask").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+					jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskNotFound"), jen.Id("id"))),
+				).Else().If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.Comment("Steps are numbered as in the task's history, starting from its submission"),
+				jen.List(jen.Id("toState"), jen.Id("data")).Op(":=").List(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id(model.StateName(model.InitialState()))), jen.Id("task").Dot("Data")),
+				jen.If(jen.Id("step").Op("!=").Lit(0)).Block(
+					jen.List(jen.Id("transitions"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetHistory").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Id("step").Op("<").Lit(0).Op("||").Id("step").Op(">").Len(jen.Id("transitions"))).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("task %d has no step %d"), jen.Id("id"), jen.Id("step"))),
+					),
+					jen.Id("toState").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transitions").Index(jen.Id("step").Op("-").Lit(1)).Dot("ToState")),
+					jen.Id("data").Op("=").Id("transitions").Index(jen.Id("step").Op("-").Lit(1)).Dot("Data"),
+				),
+				jen.Switch(jen.Id("toState")).Block(
+					jen.CaseFunc(func(g *jen.Group) {
+						g.Qual("github.com/egoodhall/fsm", "StateError")
+						g.Qual("github.com/egoodhall/fsm", "StateCancelled")
+						g.Qual("github.com/egoodhall/fsm", "StateRetried")
+						for _, state := range unforcible {
+							g.Add(state)
+						}
+					}).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("task %d can't restart from step %d in %s"), jen.Id("id"), jen.Id("step"), jen.Id("toState"))),
+					),
+				),
+				jen.Return(jen.Id("f").Dot("move").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("operator"), jen.Id("toState"), jen.Id("data"))),
+			),
+	)
+
+	// Replace a task's current step
+	code = append(code,
+		jen.Comment("move replaces the task's current step with a step in the given state,").Line().
+			Comment("reviving the task if it finished. A running handler loses its claim on").Line().
+			Comment("the replaced step, so it can't move the task on too.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("move").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("operator").String(), jen.Id("toState").Qual("github.com/egoodhall/fsm", "State"), jen.Id("data").Index().Byte()).
+			Error().
+			Block(
+				jen.If(jen.Id("operator").Op("==").Lit("")).Block(
+					jen.Return(jen.Qual("errors", "New").Call(jen.Lit("operator is required"))),
+				),
+				jen.Var().Id("fromState").Qual("github.com/egoodhall/fsm", "State"),
+				jen.Id("now").Op(":=").Qual("time", "Now").Call(),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Id("fromState").Op("=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")),
+					jen.If(jen.Id("fromState").Op("==").Qual("github.com/egoodhall/fsm", "StateCancelled")).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled"), jen.Id("id"))),
+					),
+					jen.Line(),
+					jen.Comment("The new step keeps the priority of the step it replaces"),
+					jen.Id("priority").Op(":=").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetPriority").Call(jen.Id("ctx"))),
+					jen.List(jen.Id("item"), jen.Err()).Op(":=").Id("q").Dot("GetTaskQueueItem").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+					jen.If(jen.Err().Op("==").Nil()).Block(
+						jen.Id("priority").Op("=").Id("item").Dot("Priority"),
+					).Else().If(jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("DeleteTaskQueueItems").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+							g.Line().Id("Attempt").Op(":").Id("item").Dot("Attempt")
+							g.Line().Id("FromState").Op(":").String().Call(jen.Id("fromState"))
+							g.Line().Id("ToState").Op(":").String().Call(jen.Id("toState"))
+							g.Line().Id("Data").Op(":").Id("data")
+							g.Line().Id("Operator").Op(":").Op("&").Id("operator")
+							g.Line()
+						}),
+					), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("ReleaseConcurrencyLocks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("f").Dot("region").Call(jen.Id("toState"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					generateEnqueue(model, jen.Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+						g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+						g.Line().Id("State").Op(":").String().Call(jen.Id("toState"))
+						g.Line().Id("Data").Op(":").Id("data")
+						g.Line().Id("ReadyAt").Op(":").Id("now").Dot("UnixMilli").Call()
+						g.Line().Id("Priority").Op(":").Id("priority")
+						g.Line()
+					})), jen.Int64().Call(jen.Id("id")), jen.Id("toState"), jen.Id("now")),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("cancel")).Op(":=").Range().Id("f").Dot("running").Index(jen.Id("id"))).Block(
+					jen.Id("cancel").Call(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, moved to %s by %s"), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"), jen.Id("id"), jen.Id("toState"), jen.Id("operator"))),
+				),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Moved task"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("toState"), jen.Lit("operator"), jen.Id("operator")),
+				jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Id("toState")),
+				),
+				jen.Id("f").Dot("signal").Call(jen.Id("toState")),
+				jen.Id("f").Dot("freeSpace").Call(),
+				jen.If(jen.Id("region").Op(":=").Id("f").Dot("region").Call(jen.Id("fromState")), jen.Id("region").Op("!=").Lit("").Op("&&").Id("region").Op("!=").Id("f").Dot("region").Call(jen.Id("toState"))).Block(
+					jen.Id("f").Dot("signalRegion").Call(jen.Id("region")),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateStatusMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Status method
+	code = append(code,
+		jen.Comment("Query FSM tasks"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Status").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskStatus"), jen.Error()).
+			Block(
+				jen.List(jen.Id("history"), jen.Err()).Op(":=").Id("f").Dot("History").Call(jen.Id("ctx"), jen.Id("id")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Qual("github.com/egoodhall/fsm", "TaskStatus").Values(), jen.Err()),
+				),
+				jen.Id("status").Op(":=").Qual("github.com/egoodhall/fsm", "NewTaskStatus").Call(jen.Id("id"), jen.Id("history")),
+				jen.Id("status").Dot("Terminal").Op("=").Id("f").Dot("isTerminal").Call(jen.Id("status").Dot("State")),
+				jen.List(jen.Id("metadata"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetTaskMetadata").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Qual("github.com/egoodhall/fsm", "TaskStatus").Values(), jen.Err()),
+				),
+				jen.If(jen.List(jen.Id("status").Dot("Metadata"), jen.Err()).Op("=").Qual("github.com/egoodhall/fsm", "DecodeMetadata").Call(jen.Id("metadata")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Qual("github.com/egoodhall/fsm", "TaskStatus").Values(), jen.Err()),
+				),
+				jen.Line(),
+				jen.Comment("Queued steps carry a priority, and steps that haven't been"),
+				jen.Comment("attempted yet may be scheduled for later"),
+				jen.List(jen.Id("item"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetTaskQueueItem").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+				jen.If(jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+					jen.Return(jen.Qual("github.com/egoodhall/fsm", "TaskStatus").Values(), jen.Err()),
+				).Else().If(jen.Err().Op("==").Nil()).Block(
+					jen.Id("status").Dot("Priority").Op("=").Int().Call(jen.Id("item").Dot("Priority")),
+					jen.If(jen.Id("at").Op(":=").Qual("time", "UnixMilli").Call(jen.Id("item").Dot("ReadyAt")), jen.Id("item").Dot("Attempt").Op("==").Lit(0).Op("&&").Id("item").Dot("LeaseOwner").Op("==").Nil().Op("&&").Id("at").Dot("After").Call(jen.Qual("time", "Now").Call()).Do(func(s *jen.Statement) {
+						if len(model.InvokingStates()) > 0 {
+							s.Op("&&").Op("!").Id("f").Dot("parked").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("status").Dot("State"))
+						}
+					})).Block(
+						jen.Id("status").Dot("ScheduledAt").Op("=").Id("at"),
+					),
+					generateStatusDeadline(model),
+				),
+				jen.Return(jen.Id("status"), jen.Nil()),
+			),
+	)
+
+	// History method
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("History").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Index().Qual("github.com/egoodhall/fsm", "Step"), jen.Error()).
+			Block(
+				jen.List(jen.Id("task"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetTask").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit(model.Name), jen.Id("f").Dot("namespace")),
+				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+					jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskNotFound"), jen.Id("id"))),
+				).Else().If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				),
+				jen.List(jen.Id("transitions"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetHistory").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				),
+				jen.Line(),
+				jen.Comment("Tasks are submitted without a transition, so the first step comes from the task itself"),
+				jen.List(jen.Id("params"), jen.Err()).Op(":=").Id("f").Dot("decodeParams").Call(jen.Id(model.StateName(model.InitialState())), jen.Id("task").Dot("Data")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				),
+				jen.Id("history").Op(":=").Make(jen.Index().Qual("github.com/egoodhall/fsm", "Step"), jen.Lit(0), jen.Len(jen.Id("transitions")).Op("+").Lit(1)),
+				jen.Id("history").Op("=").Append(jen.Id("history"), jen.Qual("github.com/egoodhall/fsm", "Step").Values(jen.Dict{
+					jen.Id("To"):        jen.Id(model.StateName(model.InitialState())),
+					jen.Id("Params"):    jen.Id("params"),
+					jen.Id("CreatedAt"): jen.Qual("time", "UnixMilli").Call(jen.Id("task").Dot("CreatedAt")),
+				})),
+				jen.For(jen.List(jen.Id("_"), jen.Id("transition")).Op(":=").Range().Id("transitions")).Block(
+					jen.Id("step").Op(":=").Qual("github.com/egoodhall/fsm", "Step").Values(jen.Dict{
+						jen.Id("Deadline"):  jen.Id("transition").Dot("Deadline"),
+						jen.Id("From"):      jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("FromState")),
+						jen.Id("To"):        jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")),
+						jen.Id("Attempt"):   jen.Int().Call(jen.Id("transition").Dot("Attempt")),
+						jen.Id("CreatedAt"): jen.Qual("time", "UnixMilli").Call(jen.Id("transition").Dot("CreatedAt")),
+					}),
+					jen.If(jen.Id("transition").Dot("Operator").Op("!=").Nil()).Block(
+						jen.Id("step").Dot("Operator").Op("=").Op("*").Id("transition").Dot("Operator"),
+					),
+					jen.Switch(jen.Id("step").Dot("To")).Block(
+						jen.Case(jen.Qual("github.com/egoodhall/fsm", "StateError")).Block(
+							jen.Id("step").Dot("Error").Op("=").String().Call(jen.Id("transition").Dot("Data")),
+							jen.If(jen.Id("transition").Dot("NextAttemptAt").Op("!=").Nil()).Block(
+								jen.Id("step").Dot("NextAttemptAt").Op("=").Qual("time", "UnixMilli").Call(jen.Op("*").Id("transition").Dot("NextAttemptAt")),
+							),
+						),
+						jen.Case(jen.Qual("github.com/egoodhall/fsm", "StateCancelled")).Block(
+							jen.Id("step").Dot("Reason").Op("=").String().Call(jen.Id("transition").Dot("Data")),
+						),
+						jen.Case(jen.Qual("github.com/egoodhall/fsm", "StateRetried")).Block(
+							jen.Comment("Retried steps keep the failed step's inputs"),
+						),
+						jen.Default().Block(
+							jen.If(jen.List(jen.Id("step").Dot("Params"), jen.Err()).Op("=").Id("f").Dot("decodeParams").Call(jen.Id("step").Dot("To"), jen.Id("transition").Dot("Data")), jen.Err().Op("!=").Nil()).Block(
+								jen.Return(jen.Nil(), jen.Err()),
+							),
+						),
+					),
+					jen.Id("history").Op("=").Append(jen.Id("history"), jen.Id("step")),
+				),
+				jen.Return(jen.Id("history"), jen.Nil()),
+			),
+	)
+
+	// Typed params decoding
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("decodeParams").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("data").Index().Byte()).
+			Params(jen.Any(), jen.Error()).
+			Block(
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if len(state.Inputs) == 0 {
+							// Gob can't decode into a struct without fields
+							g.Case(jen.Id(model.StateName(state))).Block(
+								jen.Return(jen.Id(model.ParamsTypeName(state)).Values(), jen.Nil()),
+							)
+							continue
+						}
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Var().Id("params").Id(model.ParamsTypeName(state)),
+							jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("data"))).Dot("Decode").Call(jen.Op("&").Id("params")), jen.Err().Op("!=").Nil()).Block(
+								jen.Return(jen.Nil(), jen.Err()),
+							),
+							jen.Return(jen.Id("params"), jen.Nil()),
+						)
+					}
+				}),
+				jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("unknown state: %s"), jen.Id("state"))),
+			),
+	)
+
+	// Terminal state check
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("isTerminal").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Bool().
+			Block(
+				jen.Switch(jen.Id("state")).Block(
+					jen.CaseFunc(func(g *jen.Group) {
+						for _, state := range model.States {
+							if state.Terminal {
+								g.Id(model.StateName(state))
+							}
+						}
+						g.Qual("github.com/egoodhall/fsm", "StateCancelled")
+					}).Block(
+						jen.Return(jen.True()),
+					),
+				),
+				jen.Return(jen.False()),
+			),
+	)
+
+	return code
+}
+
+func generateWaitMethods(model *FsmModel) []jen.Code {
+	code := make([]jen.Code, 0)
+
+	// Wait method
+	code = append(code,
+		jen.Comment("Wait for FSM tasks"),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("Wait").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID")).
+			Params(jen.Qual("github.com/egoodhall/fsm", "State"), jen.Error()).
+			Block(
+				jen.Id("waiter").Op(":=").Make(jen.Chan().Qual("github.com/egoodhall/fsm", "State"), jen.Lit(1)),
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.Id("f").Dot("waiters").Index(jen.Id("id")).Op("=").Append(jen.Id("f").Dot("waiters").Index(jen.Id("id")), jen.Id("waiter")),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Defer().Id("f").Dot("stopWaiting").Call(jen.Id("id"), jen.Id("waiter")),
+				jen.Line(),
+				jen.Comment("The task may have finished before we started waiting, or in another"),
+				jen.Comment("process sharing the store"),
+				jen.For().Block(
+					jen.List(jen.Id("transition"), jen.Err()).Op(":=").Id("f").Dot("lastTransition").Call(jen.Id("ctx"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("id")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Lit(""), jen.Err()),
+					),
+					jen.If(jen.Id("state").Op(":=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("transition").Dot("ToState")), jen.Id("f").Dot("isTerminal").Call(jen.Id("state"))).Block(
+						jen.Return(jen.Id("state"), jen.Nil()),
+					),
+					jen.Line(),
+					jen.Select().Block(
+						jen.Case(jen.Id("state").Op(":=").Op("<-").Id("waiter")).Block(
+							jen.Return(jen.Id("state"), jen.Nil()),
+						),
+						jen.Case(jen.Op("<-").Qual("time", "After").Call(jen.Id("f").Dot("pollInterval"))).Block(),
+						jen.Case(jen.Op("<-").Id("ctx").Dot("Done").Call()).Block(
+							jen.Return(jen.Lit(""), jen.Id("ctx").Dot("Err").Call()),
+						),
+					),
+				),
+			),
+	)
+
+	// SubmitAndWait method
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("SubmitAndWait").
+			ParamsFunc(func(g *jen.Group) {
+				g.Id("ctx").Qual("context", "Context")
+				for i, param := range model.InitialState().Inputs {
+					g.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(model.InitialState(), param))
+				}
+			}).
+			Params(jen.Qual("github.com/egoodhall/fsm", "TaskID"), jen.Qual("github.com/egoodhall/fsm", "State"), jen.Error()).
+			Block(
+				jen.List(jen.Id("id"), jen.Err()).Op(":=").Id("f").Dot("Submit").CallFunc(func(g *jen.Group) {
+					g.Id("ctx")
+					for i := range model.InitialState().Inputs {
+						g.Id(fmt.Sprintf("P%d", i))
+					}
+				}),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Lit(0), jen.Lit(""), jen.Err()),
+				),
+				jen.List(jen.Id("state"), jen.Err()).Op(":=").Id("f").Dot("Wait").Call(jen.Id("ctx"), jen.Id("id")),
+				jen.Return(jen.Id("id"), jen.Id("state"), jen.Err()),
+			),
+	)
+
+	// Completion notification
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("complete").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("state").Qual("github.com/egoodhall/fsm", "State")).
+			Block(
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.Id("waiters").Op(":=").Id("f").Dot("waiters").Index(jen.Id("id")),
+				jen.Delete(jen.Id("f").Dot("waiters"), jen.Id("id")),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("waiter")).Op(":=").Range().Id("waiters")).Block(
+					jen.Id("waiter").Op("<-").Id("state"),
+				),
+				jen.If(jen.Id("f").Dot("onCompletion").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onCompletion").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("state")),
+				),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("stopWaiting").
+			Params(jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("waiter").Chan().Qual("github.com/egoodhall/fsm", "State")).
+			Block(
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.Defer().Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.Id("waiters").Op(":=").Qual("slices", "DeleteFunc").Call(jen.Id("f").Dot("waiters").Index(jen.Id("id")), jen.Func().Params(jen.Id("w").Chan().Qual("github.com/egoodhall/fsm", "State")).Bool().Block(
+					jen.Return(jen.Id("w").Op("==").Id("waiter")),
+				)),
+				jen.If(jen.Len(jen.Id("waiters")).Op("==").Lit(0)).Block(
+					jen.Delete(jen.Id("f").Dot("waiters"), jen.Id("id")),
+				).Else().Block(
+					jen.Id("f").Dot("waiters").Index(jen.Id("id")).Op("=").Id("waiters"),
+				),
+			),
+	)
+
+	return code
+}
+
+// generateFSMStageParam renders the type a builder stage takes: the state's
+// handler, or the FSM it invokes.
+func generateFSMStageParam(model *FsmModel, state StateModel) jen.Code {
+	if state.Invoke != nil {
+		return jen.Id(state.Invoke.Child.FsmName())
+	}
+	return generateFSMStateMethodSignature(model, state)
+}
+
+func generateFSMStateMethodSignature(model *FsmModel, state StateModel) jen.Code {
+	params := []jen.Code{
+		jen.Qual("context", "Context"),
+	}
+	if !state.Terminal {
+		params = append(params, jen.Id(model.TransitionsParamTypeName(state)))
+	}
+	for _, param := range state.Inputs {
+		params = append(params, model.RenderInput(state, param))
+	}
+	return jen.Func().Params(params...).Error()
+}
+
+// generateCompensationSignature renders the type of a state's compensation
+// handler, which takes the inputs the state's handler completed with.
+func generateCompensationSignature(model *FsmModel, state StateModel) jen.Code {
+	params := []jen.Code{
+		jen.Qual("context", "Context"),
+	}
+	for _, param := range state.Inputs {
+		params = append(params, model.RenderInput(state, param))
+	}
+	return jen.Func().Params(params...).Error()
+}
+
+var overflowNames = map[Overflow]string{
+	OverflowBlock:  "OverflowBlock",
+	OverflowReject: "OverflowReject",
+	OverflowSpill:  "OverflowSpill",
+}
+
+var backoffTypeNames = map[BackoffType]string{
+	BackoffConstant:    "BackoffConstant",
+	BackoffLinear:      "BackoffLinear",
+	BackoffExponential: "BackoffExponential",
+}
+
+var jitterNames = map[Jitter]string{
+	JitterFull:         "JitterFull",
+	JitterDecorrelated: "JitterDecorrelated",
+}
+
+// generateDuration renders a duration in the largest unit that divides it.
+func generateDuration(d time.Duration) jen.Code {
+	for _, unit := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"Hour", time.Hour},
+		{"Minute", time.Minute},
+		{"Second", time.Second},
+		{"Millisecond", time.Millisecond},
+		{"Microsecond", time.Microsecond},
+	} {
+		if d%unit.d == 0 {
+			return jen.Lit(int(d/unit.d)).Op("*").Qual("time", unit.name)
+		}
+	}
+	return jen.Qual("time", "Duration").Call(jen.Lit(int64(d)))
+}
+
+// generateAckStep renders the acknowledgement of the step being handled,
+// which starts each transaction that moves a task on. It expects id,
+// fromState and itemID to be in scope.
+func generateAckStep() jen.Code {
+	return jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("q").Dot("AckQueueItem").Call(jen.Id("ctx"), jen.Id("itemID"), jen.Id("f").Dot("owner")), jen.Err().Op("!=").Nil()).Block(
+		jen.Return(jen.Err()),
+	).Else().If(jen.Id("n").Op("==").Lit(0).Op("&&").Id("f").Dot("isCancelled").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("id"))).Block(
+		jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled"), jen.Id("id"))),
+	).Else().If(jen.Id("n").Op("==").Lit(0)).Block(
+		jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"), jen.Id("id"), jen.Id("fromState"))),
+	)
+}
+
+// generateBranchStep renders the check that a step running in a branch
+// hasn't been abandoned by its join, which has to happen in the transaction
+// moving the branch on. It expects fromState to be in scope.
+func generateBranchStep(model *FsmModel) jen.Code {
+	if len(model.Fanouts()) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("branch"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetBranch").Call(jen.Id("ctx")), jen.Id("ok")).Block(
+		jen.List(jen.Id("fanout"), jen.Err()).Op(":=").Id("q").Dot("GetFanout").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("branch").Dot("Fanout")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Comment("Branches can't move on once their join has run"),
+		jen.If(jen.Id("fanout").Dot("JoinedAt").Op("!=").Nil()).Block(
+			jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, state = %s"), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"), jen.Id("id"), jen.Id("fromState"))),
+		),
+	)
+}
+
+// generateCompleteStep renders the recording of a completed step of a
+// compensated state, which has to happen before the step is acknowledged.
+// It expects itemID and fromState to be in scope.
+func generateCompleteStep(model *FsmModel, toState jen.Code) jen.Code {
+	if len(model.CompensatedStates()) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.Err().Op(":=").Id("f").Dot("completeStep").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("itemID"), jen.Id("fromState"), toState), jen.Err().Op("!=").Nil()).Block(
+		jen.Return(jen.Err()),
+	)
+}
+
+// generateEnqueue renders the enqueueing of a task's next step, which ends
+// each transaction that moves a task on, along with the step's deadline.
+func generateEnqueue(model *FsmModel, enqueue, id, state, at jen.Code) jen.Code {
+	if len(model.DeadlineStates()) == 0 {
+		return jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Add(enqueue), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		).Line().Return(jen.Nil())
+	}
+	return jen.List(jen.Id("step"), jen.Err()).Op(":=").Add(enqueue).Line().
+		If(jen.Err().Op("!=").Nil()).Block(
+		jen.Return(jen.Err()),
+	).Line().Return(jen.Id("f").Dot("scheduleDeadline").Call(jen.Id("ctx"), jen.Id("q"), id, jen.Id("step"), state, at))
+}
+
+// generateOptionError renders the rejection of a per-state option for a
+// state the FSM doesn't have, or one that doesn't take the setting. It
+// expects state to be in scope.
+func generateOptionError(setting string) []jen.Code {
+	return []jen.Code{
+		jen.If(jen.Err().Op(":=").Id("f").Dot("stateError").Call(jen.Id("state")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%s can't have a "+setting), jen.Id("state"))),
+	}
+}
+
+// generateStatusDeadline renders the lookup of the deadline of a task's
+// queued step. It expects status and item to be in scope.
+func generateStatusDeadline(model *FsmModel) jen.Code {
+	if len(model.DeadlineStates()) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("deadline"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetStepDeadline").Call(jen.Id("ctx"), jen.Id("item").Dot("ID")), jen.Err().Op("==").Nil().Op("&&").Id("deadline").Dot("FiredAt").Op("==").Nil()).Block(
+		jen.Id("status").Dot("DeadlineAt").Op("=").Qual("time", "UnixMilli").Call(jen.Id("deadline").Dot("FireAt")),
+	).Else().If(jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+		jen.Return(jen.Qual("github.com/egoodhall/fsm", "TaskStatus").Values(), jen.Err()),
+	)
+}
+
+func generateDeadlineMethods(model *FsmModel) []jen.Code {
+	states := model.DeadlineStates()
+	if len(states) == 0 {
+		return nil
+	}
+	code := make([]jen.Code, 0)
+
+	// Deadlines of steps entering states that have one
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("scheduleDeadline").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("id").Int64(), jen.Id("step").Int64(), jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("at").Qual("time", "Time")).
+			Error().
+			Block(
+				jen.Var().Id("after").Qual("time", "Duration"),
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range states {
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Id("after").Op("=").Id("f").Dot(model.FsmStateDeadlineInternalName(state)),
+						)
+					}
+				}),
+				jen.If(jen.Id("after").Op("<=").Lit(0)).Block(
+					jen.Return(jen.Nil()),
+				),
+				jen.Comment("Scheduled steps enter their state when they're due"),
+				jen.Return(jen.Id("q").Dot("ScheduleDeadline").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("step"), jen.String().Call(jen.Id("state")), jen.Id("at").Dot("Add").Call(jen.Id("after")).Dot("UnixMilli").Call())),
+			),
+	)
+
+	// Deadline poller
+	code = append(code,
+		jen.Comment("deadlines moves on the steps still in their state when its deadline").Line().
+			Comment("passes. Every process sharing the store polls, and each deadline is").Line().
+			Comment("fired in the same transaction that moves its step on, so it fires once.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("deadlines").
+			Params().
+			Block(
+				jen.For().Block(
+					jen.For(jen.List(jen.Id("_"), jen.Id("state")).Op(":=").Range().Index().Qual("github.com/egoodhall/fsm", "State").ValuesFunc(func(g *jen.Group) {
+						for _, state := range states {
+							g.Id(model.StateName(state))
+						}
+					})).Block(
+						jen.For(jen.Id("f").Dot("ctx").Dot("Err").Call().Op("==").Nil()).Block(
+							jen.List(jen.Id("deadline"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetDueDeadline").Call(jen.Id("f").Dot("ctx"), jen.String().Call(jen.Id("state")), jen.Lit(model.Name), jen.Id("f").Dot("namespace"), jen.Qual("time", "Now").Call().Dot("UnixMilli").Call()),
+							jen.If(jen.Err().Op("==").Nil()).Block(
+								jen.Err().Op("=").Id("f").Dot("fireDeadline").Call(jen.Id("f").Dot("ctx"), jen.Id("deadline")),
+							),
+							jen.If(jen.Err().Op("!=").Nil()).Block(
+								jen.If(jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows")).Op("&&").Id("f").Dot("ctx").Dot("Err").Call().Op("==").Nil()).Block(
+									jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("f").Dot("ctx")).Dot("Error").Call(jen.Lit("Failed to fire deadline"), jen.Lit("state"), jen.Id("state"), jen.Lit("error"), jen.Err()),
+								),
+								jen.Break(),
+							),
+						),
+					),
+					jen.Select().Block(
+						jen.Case(jen.Op("<-").Qual("time", "After").Call(jen.Id("f").Dot("pollInterval"))),
+						jen.Case(jen.Op("<-").Id("f").Dot("ctx").Dot("Done").Call()).Block(
+							jen.Return(),
+						),
+					),
+				),
+			),
+	)
+
+	// Firing a deadline, moving its step on to the deadline's state
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("fireDeadline").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("deadline").Qual("github.com/egoodhall/fsm/gen/sqlc", "TaskDeadline")).
+			Error().
+			Block(
+				jen.Var().Id("item").Qual("github.com/egoodhall/fsm/gen/sqlc", "QueueItem"),
+				jen.Var().Id("toState").Qual("github.com/egoodhall/fsm", "State"),
+				jen.Id("now").Op(":=").Qual("time", "Now").Call(),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Tx").Call(jen.Id("ctx"), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.Id("toState").Op("=").Lit(""),
+					jen.Var().Err().Error(),
+					jen.List(jen.Id("item"), jen.Err()).Op("=").Id("q").Dot("GetQueueItem").Call(jen.Id("ctx"), jen.Id("deadline").Dot("StepID")),
+					jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+						jen.Comment("The step moved on in time, or its task was cancelled"),
+						jen.Return(jen.Id("q").Dot("DeleteDeadline").Call(jen.Id("ctx"), jen.Id("deadline").Dot("ID"))),
+					).Else().If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Id("q").Dot("FireDeadline").Call(jen.Id("ctx"), jen.Id("deadline").Dot("ID")), jen.Err().Op("!=").Nil().Op("||").Id("n").Op("==").Lit(0)).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.List(jen.Id("to"), jen.Id("data"), jen.Err()).Op(":=").Id("f").Dot("deadlineTarget").Call(jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State")), jen.Id("item").Dot("Data")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Line(),
+					jen.Comment("A running handler loses its claim on the step, so it can't move it"),
+					jen.Comment("on too. Deadlines aren't held back by full queues."),
+					jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("q").Dot("DeleteQueueItem").Call(jen.Id("ctx"), jen.Id("item").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("RecordTransition").Call(
+						jen.Id("ctx"),
+						jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+							g.Line().Id("TaskID").Op(":").Id("item").Dot("TaskID")
+							g.Line().Id("Attempt").Op(":").Id("item").Dot("Attempt")
+							g.Line().Id("FromState").Op(":").Id("item").Dot("State")
+							g.Line().Id("ToState").Op(":").String().Call(jen.Id("to"))
+							g.Line().Id("Data").Op(":").Id("data")
+							g.Line().Id("Deadline").Op(":").True()
+							g.Line()
+						}),
+					), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("ReleaseConcurrencyLocks").Call(jen.Id("ctx"), jen.Id("item").Dot("TaskID"), jen.Id("f").Dot("region").Call(jen.Id("to"))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.List(jen.Id("step"), jen.Err()).Op(":=").Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+						g.Line().Id("TaskID").Op(":").Id("item").Dot("TaskID")
+						g.Line().Id("State").Op(":").String().Call(jen.Id("to"))
+						g.Line().Id("Data").Op(":").Id("data")
+						g.Line().Id("ReadyAt").Op(":").Id("now").Dot("UnixMilli").Call()
+						g.Line().Id("Priority").Op(":").Id("item").Dot("Priority")
+						g.Line()
+					})),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Id("toState").Op("=").Id("to"),
+					jen.Return(jen.Id("f").Dot("scheduleDeadline").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("item").Dot("TaskID"), jen.Id("step"), jen.Id("to"), jen.Id("now"))),
+				)), jen.Err().Op("!=").Nil().Op("||").Id("toState").Op("==").Lit("")).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Line(),
+				jen.List(jen.Id("id"), jen.Id("fromState")).Op(":=").List(jen.Qual("github.com/egoodhall/fsm", "TaskID").Call(jen.Id("item").Dot("TaskID")), jen.Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("item").Dot("State"))),
+				jen.Id("f").Dot("tasksLock").Dot("Lock").Call(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("cancel")).Op(":=").Range().Id("f").Dot("running").Index(jen.Id("id"))).Block(
+					jen.Id("cancel").Call(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d, deadline passed in %s"), jen.Qual("github.com/egoodhall/fsm", "ErrClaimLost"), jen.Id("id"), jen.Id("fromState"))),
+				),
+				jen.Id("f").Dot("tasksLock").Dot("Unlock").Call(),
+				jen.Line(),
+				jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Deadline passed"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("toState")),
+				jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Id("toState")),
+				),
+				jen.Id("f").Dot("signal").Call(jen.Id("toState")),
+				jen.Id("f").Dot("freeSpace").Call(),
+				jen.If(jen.Id("region").Op(":=").Id("f").Dot("region").Call(jen.Id("fromState")), jen.Id("region").Op("!=").Lit("").Op("&&").Id("region").Op("!=").Id("f").Dot("region").Call(jen.Id("toState"))).Block(
+					jen.Id("f").Dot("signalRegion").Call(jen.Id("region")),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Deadline targets, with their inputs mapped from the step's
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("deadlineTarget").
+			Params(jen.Id("state").Qual("github.com/egoodhall/fsm", "State"), jen.Id("data").Index().Byte()).
+			Params(jen.Qual("github.com/egoodhall/fsm", "State"), jen.Index().Byte(), jen.Error()).
+			Block(
+				jen.Var().Id("msg").Any(),
+				jen.Var().Id("to").Qual("github.com/egoodhall/fsm", "State"),
+				jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+					for _, state := range states {
+						target := model.GetState(state.Deadline.To)
+						mapping, _ := state.Deadline.Mapping(state, target)
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Var().Id("from").Id(model.FsmStateMessageName(state)),
+							jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("data"))).Dot("Decode").Call(jen.Op("&").Id("from")), jen.Err().Op("!=").Nil()).Block(
+								jen.Return(jen.Lit(""), jen.Nil(), jen.Err()),
+							),
+							jen.List(jen.Id("msg"), jen.Id("to")).Op("=").List(jen.Id(model.FsmStateMessageName(target)).ValuesFunc(func(g *jen.Group) {
+								g.Id("ID").Op(":").Id("from").Dot("ID")
+								for i, from := range mapping {
+									g.Id(fmt.Sprintf("P%d", i)).Op(":").Id("from").Dot(fmt.Sprintf("P%d", from))
+								}
+							}), jen.Id(model.StateName(target))),
+						)
+					}
+					g.Default().Block(
+						jen.Return(jen.Lit(""), jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("state %s has no deadline"), jen.Id("state"))),
+					)
+				}),
+				jen.Line(),
+				jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
+				jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Lit(""), jen.Nil(), jen.Err()),
+				),
+				jen.Return(jen.Id("to"), jen.Id("buf").Dot("Bytes").Call(), jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateCompensationMethods(model *FsmModel) []jen.Code {
+	compensated := model.CompensatedStates()
+	if len(compensated) == 0 {
+		return nil
+	}
+	code := make([]jen.Code, 0)
+
+	// Completed steps of compensated states, unless they failed over to a
+	// failure path
+	code = append(code,
+		jen.Comment("Steps of compensated states are recorded with their inputs as they").Line().
+			Comment("complete, unless they complete by moving the task onto a failure path").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("completeStep").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("itemID").Int64(), jen.List(jen.Id("fromState"), jen.Id("toState")).Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			Block(
+				jen.Switch(jen.Id("toState")).Block(
+					jen.CaseFunc(func(g *jen.Group) {
+						for _, state := range model.FailureStates() {
+							g.Id(model.StateName(state))
+						}
+					}).Block(
+						jen.Return(jen.Nil()),
+					),
+				),
+				jen.Switch(jen.Id("fromState")).Block(
+					jen.CaseFunc(func(g *jen.Group) {
+						for _, state := range compensated {
+							g.Id(model.StateName(state))
+						}
+					}).Block(
+						jen.Return(jen.Id("q").Dot("AddCompensation").Call(jen.Id("ctx"), jen.Id("itemID"), jen.Id("f").Dot("owner"))),
+					),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Compensations, most recent first
+	code = append(code,
+		jen.Comment("compensate undoes the task's completed steps, most recent first. Each").Line().
+			Comment("compensation is recorded as it finishes, so a failed one is retried").Line().
+			Comment("with the failure state's backoff, without repeating the others.").Line().
+			Comment("Compensations run through the middlewares, as the state they undo.").Line().
+			Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("compensate").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("attempt").Int()).
+			Error().
+			Block(
+				jen.List(jen.Id("compensations"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetPendingCompensations").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id"))),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.For(jen.List(jen.Id("_"), jen.Id("compensation")).Op(":=").Range().Id("compensations")).Block(
+					jen.Id("state").Op(":=").Qual("github.com/egoodhall/fsm", "State").Call(jen.Id("compensation").Dot("State")),
+					jen.Id("ctx").Op(":=").Qual("github.com/egoodhall/fsm", "PutState").Call(jen.Id("ctx"), jen.Id("state")),
+					jen.Switch(jen.Id("state")).BlockFunc(func(g *jen.Group) {
+						for _, state := range compensated {
+							g.Case(jen.Id(model.StateName(state))).BlockFunc(func(g *jen.Group) {
+								g.Var().Id("msg").Id(model.FsmStateMessageName(state))
+								g.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("compensation").Dot("Data"))).Dot("Decode").Call(jen.Op("&").Id("msg")), jen.Err().Op("!=").Nil()).Block(
+									jen.Return(jen.Err()),
+								)
+								handlerCtx := jen.Id("ctx")
+								if model.InBranch(state) {
+									handlerCtx = jen.Qual("github.com/egoodhall/fsm", "PutBranch").Call(jen.Id("ctx"), jen.Id("msg").Dot("Branch"))
+								}
+								g.Err().Op("=").Id("f").Dot("handle").Call(jen.Id("ctx"), jen.Id("state"), jen.Id("id"), jen.Id("attempt"), jen.Func().Params(jen.Id("ctx").Qual("context", "Context")).Error().Block(
+									jen.Return(jen.Id("f").Dot(model.FsmStateCompensationInternalName(state)).CallFunc(func(g *jen.Group) {
+										g.Add(handlerCtx)
+										for i := range state.Inputs {
+											g.Id("msg").Dot(fmt.Sprintf("P%d", i))
+										}
+									})),
+								))
+							})
+						}
+					}),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("compensating %s: %w"), jen.Id("state"), jen.Err())),
+					),
+					jen.If(jen.Err().Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("FinishCompensation").Call(jen.Id("ctx"), jen.Id("compensation").Dot("ID")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Compensated step"), jen.Lit("id"), jen.Id("id"), jen.Lit("state"), jen.Id("state")),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	return code
+}
+
+func generateFanoutMethods(model *FsmModel) []jen.Code {
+	fanouts := model.Fanouts()
+	if len(fanouts) == 0 {
+		return nil
+	}
+	code := make([]jen.Code, 0)
+
+	// Fan-out handlers, encoding the first step of each branch
+	for _, state := range fanouts {
+		params := []jen.Code{
+			jen.Id("ctx").Qual("context", "Context"),
+			jen.Id("transitions").Id(model.TransitionsParamTypeName(state)),
+		}
+		for i, input := range state.Inputs {
+			params = append(params, jen.Id(fmt.Sprintf("P%d", i)).Add(model.RenderInput(state, input)))
+		}
+		branch := func(index jen.Code) jen.Code {
+			return jen.Qual("github.com/egoodhall/fsm", "Branch").Values(jen.Dict{
+				jen.Id("Fanout"): jen.Id("item"),
+				jen.Id("Index"):  index,
+			})
+		}
+
+		code = append(code,
+			jen.Func().
+				Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+				Id(model.FsmStateFanoutName(state)).
+				Params(params...).
+				Error().
+				BlockFunc(func(g *jen.Group) {
+					g.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx"))
+					g.List(jen.Id("item"), jen.Id("_")).Op(":=").Qual("github.com/egoodhall/fsm", "GetQueueItem").Call(jen.Id("ctx"))
+					g.Line()
+					if each := state.Fanout.Each; each != "" {
+						g.Comment("One branch for each element")
+						g.Id("states").Op(":=").Make(jen.Index().Qual("github.com/egoodhall/fsm", "State"), jen.Len(jen.Id("P0")))
+						g.Id("msgs").Op(":=").Make(jen.Index().Any(), jen.Len(jen.Id("P0")))
+						g.For(jen.Id("i").Op(":=").Range().Id("P0")).Block(
+							jen.Id("states").Index(jen.Id("i")).Op("=").Id(model.StateName(model.GetState(each))),
+							jen.Id("msgs").Index(jen.Id("i")).Op("=").Id(model.FsmStateMessageName(model.GetState(each))).Values(jen.Dict{
+								jen.Id("ID"):     jen.Id("id"),
+								jen.Id("Branch"): branch(jen.Id("i")),
+								jen.Id("P0"):     jen.Id("P0").Index(jen.Id("i")),
+							}),
+						)
+					} else {
+						g.Id("states").Op(":=").Index().Qual("github.com/egoodhall/fsm", "State").ValuesFunc(func(g *jen.Group) {
+							for _, name := range state.Fanout.Branches {
+								g.Id(model.StateName(model.GetState(name)))
+							}
+						})
+						g.Id("msgs").Op(":=").Index().Any().ValuesFunc(func(g *jen.Group) {
+							for i, name := range state.Fanout.Branches {
+								g.Line().Id(model.FsmStateMessageName(model.GetState(name))).ValuesFunc(func(g *jen.Group) {
+									g.Id("ID").Op(":").Id("id")
+									g.Id("Branch").Op(":").Add(branch(jen.Lit(i)))
+									for i := range state.Inputs {
+										g.Id(fmt.Sprintf("P%d", i)).Op(":").Id(fmt.Sprintf("P%d", i))
+									}
+								})
+							}
+							g.Line()
+						})
+					}
+					g.Id("data").Op(":=").Make(jen.Index().Index().Byte(), jen.Len(jen.Id("msgs")))
+					g.For(jen.List(jen.Id("i"), jen.Id("msg")).Op(":=").Range().Id("msgs")).Block(
+						jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
+						jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.Id("data").Index(jen.Id("i")).Op("=").Id("buf").Dot("Bytes").Call(),
+					)
+					g.Return(jen.Id("f").Dot("fanout").Call(jen.Id("ctx"), jen.Id("states"), jen.Id("data"), jen.Id(model.StateName(model.GetState(state.Fanout.Join)))))
+				}),
+		)
+	}
+
+	recordTransition := func(to, data jen.Code) jen.Code {
+		return jen.Id("q").Dot("RecordTransition").Call(
+			jen.Id("ctx"),
+			jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "RecordTransitionParams").ValuesFunc(func(g *jen.Group) {
+				g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+				g.Line().Id("Attempt").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetAttempt").Call(jen.Id("ctx")))
+				g.Line().Id("FromState").Op(":").String().Call(jen.Qual("github.com/egoodhall/fsm", "GetState").Call(jen.Id("ctx")))
+				g.Line().Id("ToState").Op(":").String().Call(to)
+				g.Line().Id("Data").Op(":").Add(data)
+				g.Line()
+			}),
+		)
+	}
+	enqueueItem := func(state, data, at jen.Code) jen.Code {
+		return jen.Id("q").Dot("EnqueueItem").Call(jen.Id("ctx"), jen.Qual("github.com/egoodhall/fsm/gen/sqlc", "EnqueueItemParams").ValuesFunc(func(g *jen.Group) {
+			g.Line().Id("TaskID").Op(":").Int64().Call(jen.Id("id"))
+			g.Line().Id("State").Op(":").String().Call(state)
+			g.Line().Id("Data").Op(":").Add(data)
+			g.Line().Id("ReadyAt").Op(":").Add(at)
+			g.Line().Id("Priority").Op(":").Int64().Call(jen.Qual("github.com/egoodhall/fsm", "GetPriority").Call(jen.Id("ctx")))
+			g.Line()
+		}))
+	}
+	handlerChecks := func(to jen.Code) []jen.Code {
+		return []jen.Code{
+			jen.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx")),
+			jen.Id("fromState").Op(":=").Qual("github.com/egoodhall/fsm", "GetState").Call(jen.Id("ctx")),
+			jen.List(jen.Id("itemID"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetQueueItem").Call(jen.Id("ctx")),
+			jen.If(jen.Op("!").Id("ok")).Block(
+				jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("transition to %s outside of a task handler"), to)),
+			),
+			jen.If(jen.Id("f").Dot("isCancelled").Call(jen.Id("ctx"), jen.Id("f").Dot("store").Dot("Q").Call(), jen.Id("id"))).Block(
+				jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: id = %d"), jen.Qual("github.com/egoodhall/fsm", "ErrTaskCancelled"), jen.Id("id"))),
+			),
+		}
+	}
+
+	// Fan-outs, acknowledging the step and starting every branch atomically
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("fanout").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("states").Index().Qual("github.com/egoodhall/fsm", "State"), jen.Id("data").Index().Index().Byte(), jen.Id("join").Qual("github.com/egoodhall/fsm", "State")).
+			Error().
+			BlockFunc(func(g *jen.Group) {
+				for _, c := range handlerChecks(jen.Id("join")) {
+					g.Add(c)
+				}
+				g.Line()
+				g.Id("now").Op(":=").Qual("time", "Now").Call()
+				g.If(jen.Err().Op(":=").Id("f").Dot("admit").Call(jen.Id("ctx"), jen.False(), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					generateAckStep(),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("CreateFanout").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("itemID"), jen.Int64().Call(jen.Len(jen.Id("states")))), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.For(jen.List(jen.Id("i"), jen.Id("state")).Op(":=").Range().Id("states")).Block(
+						jen.If(jen.Err().Op(":=").Id("f").Dot("reserve").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("state")), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.If(jen.Err().Op(":=").Add(recordTransition(jen.Id("state"), jen.Id("data").Index(jen.Id("i")))), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+						jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Add(enqueueItem(jen.Id("state"), jen.Id("data").Index(jen.Id("i")), jen.Id("now").Dot("UnixMilli").Call())), jen.Err().Op("!=").Nil()).Block(
+							jen.Return(jen.Err()),
+						),
+					),
+					jen.Comment("Branches can't be serialized, so they hold no regions"),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("ReleaseConcurrencyLocks").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Lit("")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.If(jen.Len(jen.Id("states")).Op("==").Lit(0)).Block(
+						jen.Comment("Without branches, there is nothing to wait for"),
+						jen.Return(jen.Id("f").Dot("joinBranches").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("join"), jen.Id("itemID"), jen.Nil(), jen.Id("now"))),
+					),
+					jen.Return(jen.Nil()),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				)
+				g.Line()
+				g.If(jen.Len(jen.Id("states")).Op("==").Lit(0)).Block(
+					jen.Id("states").Op("=").Index().Qual("github.com/egoodhall/fsm", "State").Values(jen.Id("join")),
+				)
+				g.For(jen.List(jen.Id("_"), jen.Id("state")).Op(":=").Range().Id("states")).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Transitioned state"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("state")),
+					jen.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+						jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Id("state")),
+					),
+					jen.Id("f").Dot("signal").Call(jen.Id("state")),
+				)
+				g.Id("f").Dot("freeSpace").Call()
+				g.If(jen.Id("region").Op(":=").Id("f").Dot("region").Call(jen.Id("fromState")), jen.Id("region").Op("!=").Lit("")).Block(
+					jen.Id("f").Dot("signalRegion").Call(jen.Id("region")),
+				)
+				g.Return(jen.Nil())
+			}),
+	)
+
+	// Joins, finishing a branch and running the join once enough of its
+	// fan-out's branches have finished
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("join").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("join").Qual("github.com/egoodhall/fsm", "State"), jen.Id("output").Index().Byte(), jen.Id("at").Qual("time", "Time")).
+			Error().
+			BlockFunc(func(g *jen.Group) {
+				for _, c := range handlerChecks(jen.Id("join")) {
+					g.Add(c)
+				}
+				g.List(jen.Id("branch"), jen.Id("ok")).Op(":=").Qual("github.com/egoodhall/fsm", "GetBranch").Call(jen.Id("ctx"))
+				g.If(jen.Op("!").Id("ok")).Block(
+					jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("transition to %s outside of a branch"), jen.Id("join"))),
+				)
+				g.Line()
+				g.Var().Id("joined").Bool()
+				g.If(jen.Err().Op(":=").Id("f").Dot("admit").Call(jen.Id("ctx"), jen.False(), jen.Func().Params(jen.Id("q").Qual("github.com/egoodhall/fsm", "Q")).Error().Block(
+					jen.Id("joined").Op("=").False(),
+					generateCompleteStep(model, jen.Id("join")),
+					generateAckStep(),
+					jen.If(jen.Err().Op(":=").Id("q").Dot("FinishBranch").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("branch").Dot("Fanout"), jen.Int64().Call(jen.Id("branch").Dot("Index")), jen.Id("output")), jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.List(jen.Id("fanout"), jen.Err()).Op(":=").Id("q").Dot("GetFanout").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("branch").Dot("Fanout")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.List(jen.Id("branches"), jen.Err()).Op(":=").Id("q").Dot("GetFinishedBranches").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("branch").Dot("Fanout")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Return(jen.Err()),
+					),
+					jen.Comment("Branches finishing after the join ran are only recorded"),
+					jen.If(jen.Id("fanout").Dot("JoinedAt").Op("!=").Nil().Op("||").Len(jen.Id("branches")).Op("<").Id("f").Dot("joinConfig").Call(jen.Id("join")).Dot("Needed").Call(jen.Int().Call(jen.Id("fanout").Dot("Branches")))).Block(
+						jen.Return(jen.Nil()),
+					),
+					jen.Id("joined").Op("=").True(),
+					jen.Return(jen.Id("f").Dot("joinBranches").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("join"), jen.Id("branch").Dot("Fanout"), jen.Id("branches"), jen.Id("at"))),
+				)), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				)
+				g.Id("f").Dot("freeSpace").Call()
+				g.Line()
+				g.If(jen.Op("!").Id("joined")).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Finished branch"), jen.Lit("id"), jen.Id("id"), jen.Lit("branch"), jen.Id("branch").Dot("Index"), jen.Lit("from"), jen.Id("fromState")),
+					jen.Return(jen.Nil()),
+				)
+				g.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Debug").Call(jen.Lit("Transitioned state"), jen.Lit("id"), jen.Id("id"), jen.Lit("from"), jen.Id("fromState"), jen.Lit("to"), jen.Id("join"))
+				g.If(jen.Id("f").Dot("onTransition").Op("!=").Nil()).Block(
+					jen.Id("f").Dot("onTransition").Call(jen.Id("ctx"), jen.Id("id"), jen.Id("fromState"), jen.Id("join")),
+				)
+				g.Id("f").Dot("signalAt").Call(jen.Id("join"), jen.Id("at"))
+				g.Return(jen.Nil())
+			}),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("joinBranches").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("q").Qual("github.com/egoodhall/fsm", "Q"), jen.Id("join").Qual("github.com/egoodhall/fsm", "State"), jen.Id("fanout").Int64(), jen.Id("branches").Index().Qual("github.com/egoodhall/fsm/gen/sqlc", "TaskBranch"), jen.Id("at").Qual("time", "Time")).
+			Error().
+			Block(
+				jen.Id("id").Op(":=").Qual("github.com/egoodhall/fsm", "GetTaskID").Call(jen.Id("ctx")),
+				jen.List(jen.Id("data"), jen.Err()).Op(":=").Id("f").Dot("collect").Call(jen.Id("join"), jen.Id("branches")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Err().Op(":=").Id("f").Dot("reserve").Call(jen.Id("ctx"), jen.Id("q"), jen.Id("join")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Err().Op(":=").Id("q").Dot("JoinFanout").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("fanout")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.Err().Op(":=").Add(recordTransition(jen.Id("join"), jen.Id("data"))), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Add(enqueueItem(jen.Id("join"), jen.Id("data"), jen.Id("at").Dot("UnixMilli").Call())), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Err()),
+				),
+				jen.Return(jen.Nil()),
+			),
+	)
+
+	// Collection of branch outputs into join inputs, in branch order
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("collect").
+			Params(jen.Id("join").Qual("github.com/egoodhall/fsm", "State"), jen.Id("branches").Index().Qual("github.com/egoodhall/fsm/gen/sqlc", "TaskBranch")).
+			Params(jen.Index().Byte(), jen.Error()).
+			Block(
+				jen.Var().Id("msg").Any(),
+				jen.Switch(jen.Id("join")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if state.Join == nil {
+							continue
+						}
+						g.Case(jen.Id(model.StateName(state))).BlockFunc(func(g *jen.Group) {
+							g.Var().Id("collected").Id(model.FsmStateMessageName(state))
+							if len(state.Inputs) > 0 {
+								g.For(jen.List(jen.Id("_"), jen.Id("branch")).Op(":=").Range().Id("branches")).BlockFunc(func(g *jen.Group) {
+									g.Var().Id("output").Id(model.FsmStateMessageName(state))
+									g.If(jen.Err().Op(":=").Qual("encoding/gob", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("branch").Dot("Output"))).Dot("Decode").Call(jen.Op("&").Id("output")), jen.Err().Op("!=").Nil()).Block(
+										jen.Return(jen.Nil(), jen.Err()),
+									)
+									for i := range state.Inputs {
+										p := fmt.Sprintf("P%d", i)
+										g.Id("collected").Dot(p).Op("=").Append(jen.Id("collected").Dot(p), jen.Id("output").Dot(p).Op("..."))
+									}
+								})
+							}
+							g.Id("msg").Op("=").Id("collected")
+						})
+					}
+					g.Default().Block(
+						jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("unknown join: %s"), jen.Id("join"))),
+					)
+				}),
+				jen.Line(),
+				jen.Id("buf").Op(":=").New(jen.Qual("bytes", "Buffer")),
+				jen.If(jen.Err().Op(":=").Qual("encoding/gob", "NewEncoder").Call(jen.Id("buf")).Dot("Encode").Call(jen.Id("msg")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Nil(), jen.Err()),
+				),
+				jen.Return(jen.Id("buf").Dot("Bytes").Call(), jen.Nil()),
+			),
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("joinConfig").
+			Params(jen.Id("join").Qual("github.com/egoodhall/fsm", "State")).
+			Qual("github.com/egoodhall/fsm", "JoinConfig").
+			Block(
+				jen.Switch(jen.Id("join")).BlockFunc(func(g *jen.Group) {
+					for _, state := range model.States {
+						if state.Join == nil {
+							continue
+						}
+						config := state.Join.Config()
+						g.Case(jen.Id(model.StateName(state))).Block(
+							jen.Return(jen.Qual("github.com/egoodhall/fsm", "JoinConfig").Values(jen.DictFunc(func(d jen.Dict) {
+								if config.Mode != "" {
+									d[jen.Id("Mode")] = jen.Qual("github.com/egoodhall/fsm", joinModeNames[config.Mode])
+								}
+								if config.Quorum != 0 {
+									d[jen.Id("Quorum")] = jen.Lit(config.Quorum)
+								}
+							}))),
+						)
+					}
+				}),
+				jen.Return(jen.Qual("github.com/egoodhall/fsm", "JoinConfig").Values()),
+			),
+	)
+
+	// Branches left behind by a join that already ran
+	code = append(code,
+		jen.Func().
+			Params(jen.Id("f").Op("*").Id(model.FsmInternalName())).
+			Id("abandoned").
+			Params(jen.Id("ctx").Qual("context", "Context"), jen.Id("id").Qual("github.com/egoodhall/fsm", "TaskID"), jen.Id("branch").Qual("github.com/egoodhall/fsm", "Branch")).
+			Bool().
+			Block(
+				jen.List(jen.Id("fanout"), jen.Err()).Op(":=").Id("f").Dot("store").Dot("Q").Call().Dot("GetFanout").Call(jen.Id("ctx"), jen.Int64().Call(jen.Id("id")), jen.Id("branch").Dot("Fanout")),
+				jen.If(jen.Err().Op("!=").Nil()).Block(
+					jen.Qual("github.com/egoodhall/fsm", "Logger").Call(jen.Id("ctx")).Dot("Error").Call(jen.Lit("Failed to get fan-out"), jen.Lit("id"), jen.Id("id"), jen.Lit("error"), jen.Err()),
+					jen.Return(jen.False()),
+				),
+				jen.Return(jen.Id("fanout").Dot("JoinedAt").Op("!=").Nil()),
+			),
+	)
+
+	return code
+}
+
+var joinModeNames = map[JoinMode]string{
+	JoinAll:    "JoinAll",
+	JoinAny:    "JoinAny",
+	JoinQuorum: "JoinQuorum",
 }
@@ -0,0 +1,53 @@
+package fsm
+
+import "fmt"
+
+// JoinMode is how many of a fan-out's branches must finish before its join
+// state runs.
+type JoinMode string
+
+const (
+	// JoinAll waits for every branch. It is the default.
+	JoinAll JoinMode = "all"
+	// JoinAny runs the join as soon as one branch finishes.
+	JoinAny JoinMode = "any"
+	// JoinQuorum runs the join once Quorum branches have finished.
+	JoinQuorum JoinMode = "quorum"
+)
+
+// JoinConfig describes when a join state runs. Branches that are still
+// running when it does are abandoned: their steps are skipped, and their
+// outputs aren't collected.
+type JoinConfig struct {
+	Mode   JoinMode
+	Quorum int
+}
+
+func (c JoinConfig) Validate() error {
+	switch c.Mode {
+	case "", JoinAll, JoinAny:
+		if c.Quorum != 0 {
+			return fmt.Errorf("join quorum requires the %s mode", JoinQuorum)
+		}
+	case JoinQuorum:
+		if c.Quorum <= 0 {
+			return fmt.Errorf("join quorum must be positive, got %d", c.Quorum)
+		}
+	default:
+		return fmt.Errorf("unknown join mode %q", c.Mode)
+	}
+	return nil
+}
+
+// Needed returns how many of a fan-out's branches must finish before the
+// join runs. A quorum larger than the number of branches waits for all of
+// them.
+func (c JoinConfig) Needed(branches int) int {
+	switch c.Mode {
+	case JoinAny:
+		return min(1, branches)
+	case JoinQuorum:
+		return min(c.Quorum, branches)
+	}
+	return branches
+}
@@ -0,0 +1,34 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// MetadataExtractor captures values from the context of a submission, like
+// trace or request IDs, into the metadata of the submitted task.
+type MetadataExtractor func(ctx context.Context) map[string]string
+
+// MetadataInjector puts values from a task's metadata back onto the context
+// of its handlers.
+type MetadataInjector func(ctx context.Context, metadata map[string]string) context.Context
+
+// EncodeMetadata encodes a task's metadata for the store. Tasks without
+// metadata are stored without any.
+func EncodeMetadata(metadata map[string]string) ([]byte, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(metadata)
+}
+
+func DecodeMetadata(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE queue_items (
+    -- Never reuse ids, so a stale acknowledgement can't remove a newer item
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    state TEXT NOT NULL,
+    attempt INTEGER NOT NULL DEFAULT 0,
+    data BLOB NOT NULL,
+    claimed_at INTEGER DEFAULT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000)
+);
+CREATE INDEX queue_items_state_claimed_at ON queue_items(state, claimed_at);
+CREATE INDEX queue_items_task_id ON queue_items(task_id);
+
+-- Steps of tasks stored before queue items existed were only queued in
+-- memory, so each of them is resumed from its last transition once
+CREATE TABLE unqueued_tasks (
+    task_id INTEGER PRIMARY KEY REFERENCES tasks(id)
+);
+INSERT INTO unqueued_tasks (task_id) SELECT id FROM tasks;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE unqueued_tasks;
+DROP TABLE queue_items;
+-- +goose StatementEnd
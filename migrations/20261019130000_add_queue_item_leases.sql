@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+DROP INDEX queue_items_state_claimed_at;
+ALTER TABLE queue_items DROP COLUMN claimed_at;
+ALTER TABLE queue_items ADD COLUMN lease_owner TEXT DEFAULT NULL;
+ALTER TABLE queue_items ADD COLUMN lease_expires_at INTEGER DEFAULT NULL;
+CREATE INDEX queue_items_state_lease_expires_at ON queue_items(state, lease_expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX queue_items_state_lease_expires_at;
+ALTER TABLE queue_items DROP COLUMN lease_expires_at;
+ALTER TABLE queue_items DROP COLUMN lease_owner;
+ALTER TABLE queue_items ADD COLUMN claimed_at INTEGER DEFAULT NULL;
+CREATE INDEX queue_items_state_claimed_at ON queue_items(state, claimed_at);
+-- +goose StatementEnd
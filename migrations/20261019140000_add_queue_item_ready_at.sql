@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE queue_items ADD COLUMN ready_at INTEGER NOT NULL DEFAULT 0;
+DROP INDEX queue_items_state_lease_expires_at;
+CREATE INDEX queue_items_state_ready_at ON queue_items(state, ready_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX queue_items_state_ready_at;
+ALTER TABLE queue_items DROP COLUMN ready_at;
+CREATE INDEX queue_items_state_lease_expires_at ON queue_items(state, lease_expires_at);
+-- +goose StatementEnd
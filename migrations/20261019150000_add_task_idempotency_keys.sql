@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tasks ADD COLUMN idempotency_key TEXT DEFAULT NULL;
+CREATE UNIQUE INDEX tasks_idempotency_key ON tasks(idempotency_key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX tasks_idempotency_key;
+ALTER TABLE tasks DROP COLUMN idempotency_key;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tasks ADD COLUMN concurrency_key TEXT DEFAULT NULL;
+CREATE TABLE concurrency_locks (
+    concurrency_key TEXT NOT NULL,
+    region TEXT NOT NULL,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (concurrency_key, region)
+);
+CREATE INDEX concurrency_locks_task_id ON concurrency_locks(task_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE concurrency_locks;
+ALTER TABLE tasks DROP COLUMN concurrency_key;
+-- +goose StatementEnd
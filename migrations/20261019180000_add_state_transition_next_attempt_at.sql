@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE state_transitions ADD COLUMN next_attempt_at INTEGER DEFAULT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE state_transitions DROP COLUMN next_attempt_at;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE task_children (
+    parent_id INTEGER NOT NULL REFERENCES tasks(id),
+    state TEXT NOT NULL,
+    -- Child tasks may live in another store, so they aren't referenced
+    child_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (parent_id, state, child_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE task_children;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE task_fanouts (
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    -- The queue item of the step that fanned out
+    fanout_id INTEGER NOT NULL,
+    branches INTEGER NOT NULL,
+    joined_at INTEGER DEFAULT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (task_id, fanout_id)
+);
+CREATE TABLE task_branches (
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    fanout_id INTEGER NOT NULL,
+    branch INTEGER NOT NULL,
+    output BLOB NOT NULL,
+    finished_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (task_id, fanout_id, branch)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE task_branches;
+DROP TABLE task_fanouts;
+-- +goose StatementEnd
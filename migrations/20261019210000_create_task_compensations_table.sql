@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE task_compensations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    -- The queue item of the completed step, and the inputs it was handled with
+    step_id INTEGER NOT NULL UNIQUE,
+    state TEXT NOT NULL,
+    data BLOB NOT NULL,
+    compensated_at INTEGER DEFAULT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE task_compensations;
+-- +goose StatementEnd
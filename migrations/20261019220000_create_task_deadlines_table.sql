@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE task_deadlines (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    -- The queue item of the step that moves on when the deadline passes
+    step_id INTEGER NOT NULL UNIQUE,
+    state TEXT NOT NULL,
+    fire_at INTEGER NOT NULL,
+    fired_at INTEGER DEFAULT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000)
+);
+CREATE INDEX task_deadlines_state_fire_at ON task_deadlines (state, fire_at) WHERE fired_at IS NULL;
+ALTER TABLE state_transitions ADD COLUMN deadline BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE state_transitions DROP COLUMN deadline;
+DROP TABLE task_deadlines;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE paused_states (
+    fsm TEXT NOT NULL,
+    -- An empty state pauses every state of the FSM
+    state TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (fsm, state)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE paused_states;
+-- +goose StatementEnd
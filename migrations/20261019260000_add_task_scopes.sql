@@ -0,0 +1,75 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Tasks belong to an FSM, and optionally a namespace within it. Tasks stored
+-- before scoping belong to no FSM until the FSM the store served adopts them
+-- with WithUnscopedTasks, and other FSMs refuse to start until then.
+ALTER TABLE tasks ADD COLUMN fsm TEXT NOT NULL DEFAULT '';
+ALTER TABLE tasks ADD COLUMN namespace TEXT NOT NULL DEFAULT '';
+CREATE INDEX tasks_scope ON tasks(fsm, namespace);
+DROP INDEX tasks_idempotency_key;
+CREATE UNIQUE INDEX tasks_idempotency_key ON tasks(fsm, namespace, idempotency_key);
+
+CREATE TABLE scoped_concurrency_locks (
+    fsm TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    concurrency_key TEXT NOT NULL,
+    region TEXT NOT NULL,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (fsm, namespace, concurrency_key, region)
+);
+INSERT INTO scoped_concurrency_locks (fsm, namespace, concurrency_key, region, task_id, created_at)
+SELECT tasks.fsm, tasks.namespace, concurrency_locks.concurrency_key, concurrency_locks.region, concurrency_locks.task_id, concurrency_locks.created_at
+FROM concurrency_locks
+JOIN tasks ON tasks.id = concurrency_locks.task_id;
+DROP TABLE concurrency_locks;
+ALTER TABLE scoped_concurrency_locks RENAME TO concurrency_locks;
+CREATE INDEX concurrency_locks_task_id ON concurrency_locks(task_id);
+
+CREATE TABLE scoped_paused_states (
+    fsm TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    -- An empty state pauses every state of the FSM
+    state TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (fsm, namespace, state)
+);
+INSERT INTO scoped_paused_states (fsm, namespace, state, created_at)
+SELECT fsm, '', state, created_at FROM paused_states;
+DROP TABLE paused_states;
+ALTER TABLE scoped_paused_states RENAME TO paused_states;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE unscoped_paused_states (
+    fsm TEXT NOT NULL,
+    -- An empty state pauses every state of the FSM
+    state TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (fsm, state)
+);
+INSERT OR IGNORE INTO unscoped_paused_states (fsm, state, created_at)
+SELECT fsm, state, created_at FROM paused_states;
+DROP TABLE paused_states;
+ALTER TABLE unscoped_paused_states RENAME TO paused_states;
+
+CREATE TABLE unscoped_concurrency_locks (
+    concurrency_key TEXT NOT NULL,
+    region TEXT NOT NULL,
+    task_id INTEGER NOT NULL REFERENCES tasks(id),
+    created_at INTEGER NOT NULL DEFAULT(unixepoch('subsec') * 1000),
+    PRIMARY KEY (concurrency_key, region)
+);
+INSERT OR IGNORE INTO unscoped_concurrency_locks (concurrency_key, region, task_id, created_at)
+SELECT concurrency_key, region, task_id, created_at FROM concurrency_locks;
+DROP TABLE concurrency_locks;
+ALTER TABLE unscoped_concurrency_locks RENAME TO concurrency_locks;
+CREATE INDEX concurrency_locks_task_id ON concurrency_locks(task_id);
+
+DROP INDEX tasks_idempotency_key;
+CREATE UNIQUE INDEX tasks_idempotency_key ON tasks(idempotency_key);
+DROP INDEX tasks_scope;
+ALTER TABLE tasks DROP COLUMN namespace;
+ALTER TABLE tasks DROP COLUMN fsm;
+-- +goose StatementEnd
@@ -3,6 +3,8 @@ package fsm
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/dave/jennifer/jen"
 	"github.com/iancoleman/strcase"
@@ -32,6 +34,141 @@ func (s *FsmModel) GetState(name State) StateModel {
 	panic(fmt.Sprintf("state %s not found", name))
 }
 
+// InvokingStates returns the states that invoke another FSM.
+func (s *FsmModel) InvokingStates() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Invoke != nil {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// Fanouts returns the states that fan out into parallel branches.
+func (s *FsmModel) Fanouts() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Fanout != nil {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// Branches returns the states a fan-out's branches can run through before
+// they reach its join.
+func (s *FsmModel) Branches(fanout StateModel) []State {
+	var branches []State
+	pending := slices.Clone(fanout.Fanout.Starts())
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if name == fanout.Fanout.Join || slices.Contains(branches, name) {
+			continue
+		}
+		branches = append(branches, name)
+		if i := slices.IndexFunc(s.States, func(state StateModel) bool { return state.Name == name }); i >= 0 {
+			pending = append(pending, s.States[i].Transitions...)
+		}
+	}
+	return branches
+}
+
+// InBranch reports whether a state runs in the branches of a fan-out.
+func (s *FsmModel) InBranch(state StateModel) bool {
+	for _, fanout := range s.Fanouts() {
+		if slices.Contains(s.Branches(fanout), state.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectsInputs reports whether a state takes its inputs as slices: joins
+// collect them from branches, and dynamic fan-outs split them into branches.
+func (s *FsmModel) CollectsInputs(state StateModel) bool {
+	return state.Join != nil || (state.Fanout != nil && state.Fanout.Each != "")
+}
+
+// RenderInput renders the type of one of a state's inputs, as its handler
+// and params take it.
+func (s *FsmModel) RenderInput(state StateModel, name string) jen.Code {
+	if s.CollectsInputs(state) {
+		return jen.Index().Add(s.RenderType(name))
+	}
+	return s.RenderType(name)
+}
+
+// RenderTransitionInput renders the type of one of a state's inputs, as
+// transitions to it take it. Each branch transitions to a join with one of
+// the elements it collects.
+func (s *FsmModel) RenderTransitionInput(state StateModel, name string) jen.Code {
+	if state.Join != nil {
+		return s.RenderType(name)
+	}
+	return s.RenderInput(state, name)
+}
+
+// ForcibleStates returns the states an operator can force tasks into. Joins
+// and the branches of fan-outs are only entered through their fan-out.
+func (s *FsmModel) ForcibleStates() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Join == nil && !s.InBranch(state) {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// CompensatedStates returns the states whose completed steps are undone
+// by a compensation handler when their task enters a failure state.
+func (s *FsmModel) CompensatedStates() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Compensate {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// FailureStates returns the states that compensate their task's completed
+// steps before running their handler.
+func (s *FsmModel) FailureStates() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Failure {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// DeadlineStates returns the states whose steps move on by themselves when
+// they are still there after a deadline.
+func (s *FsmModel) DeadlineStates() []StateModel {
+	var states []StateModel
+	for _, state := range s.States {
+		if state.Deadline != nil {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// Regions returns the model's serialized regions, and the states in each.
+func (s *FsmModel) Regions() map[string][]StateModel {
+	regions := make(map[string][]StateModel)
+	for _, state := range s.States {
+		if state.Serialize != "" {
+			regions[state.Serialize] = append(regions[state.Serialize], state)
+		}
+	}
+	return regions
+}
+
 func (s *FsmModel) FsmName() string {
 	return strcase.ToCamel(s.Name) + "FSM"
 }
@@ -64,18 +201,66 @@ func (s *FsmModel) FsmBuilderStageMethodName(state StateModel) string {
 	return fmt.Sprintf("From%s", strcase.ToCamel(string(state.Name)))
 }
 
+func (s *FsmModel) FsmBuilderCompensationStageName(state StateModel) string {
+	return fmt.Sprintf("%s_%sCompensationStage", s.FsmBuilderName(), strcase.ToCamel(string(state.Name)))
+}
+
+func (s *FsmModel) FsmBuilderCompensationMethodName(state StateModel) string {
+	return fmt.Sprintf("Compensate%s", strcase.ToCamel(string(state.Name)))
+}
+
 func (s *FsmModel) FsmStateMessageName(state StateModel) string {
 	return fmt.Sprintf("%s_%sParams", s.FsmInternalName(), strcase.ToCamel(string(state.Name)))
 }
 
+func (s *FsmModel) ParamsTypeName(state StateModel) string {
+	return strcase.ToCamel(s.Name) + strcase.ToCamel(string(state.Name)) + "Params"
+}
+
 func (s *FsmModel) FsmStateInternalName(state StateModel) string {
 	return strcase.ToLowerCamel(string(state.Name)) + "State"
 }
 
+func (s *FsmModel) FsmStateCompensationInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Compensation"
+}
+
+func (s *FsmModel) FsmStateDeadlineInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Deadline"
+}
+
+func (s *FsmModel) FsmStateReadyInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Ready"
+}
+
+func (s *FsmModel) FsmStateLimiterInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Limiter"
+}
+
+func (s *FsmModel) FsmStateBreakerInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Breaker"
+}
+
+func (s *FsmModel) FsmStateBackoffInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Backoff"
+}
+
 func (s *FsmModel) FsmStateQueueInternalName(state StateModel) string {
 	return strcase.ToLowerCamel(string(state.Name)) + "Queue"
 }
 
+func (s *FsmModel) FsmStateChildInternalName(state StateModel) string {
+	return strcase.ToLowerCamel(string(state.Name)) + "Child"
+}
+
+func (s *FsmModel) FsmStateInvokeName(state StateModel) string {
+	return "invoke" + strcase.ToCamel(string(state.Name))
+}
+
+func (s *FsmModel) FsmStateFanoutName(state StateModel) string {
+	return "fanout" + strcase.ToCamel(string(state.Name))
+}
+
 func (s *FsmModel) FsmStateProcessorName(state StateModel) string {
 	return strcase.ToLowerCamel(string(state.Name)) + "Processor"
 }
@@ -96,6 +281,10 @@ func (s *FsmModel) TransitionToName(to State) string {
 	return fmt.Sprintf("To%s", strcase.ToCamel(string(to)))
 }
 
+func (s *FsmModel) ForceName(to State) string {
+	return fmt.Sprintf("Force%s", strcase.ToCamel(string(to)))
+}
+
 func (s *FsmModel) TransitionsParamTypeName(state StateModel) string {
 	return strcase.ToCamel(s.Name) + strcase.ToCamel(string(state.Name)) + "Transitions"
 }
@@ -106,13 +295,234 @@ type TypeModel struct {
 }
 
 type StateModel struct {
-	Name        State    `yaml:"name"`
-	Entrypoint  bool     `yaml:"entrypoint"`
-	Terminal    bool     `yaml:"terminal"`
-	Workers     int      `yaml:"workers"`
-	Queue       int      `yaml:"queue"`
-	Inputs      []string `yaml:"inputs"`
-	Transitions []State  `yaml:"transitions"`
+	Name        State          `yaml:"name"`
+	Entrypoint  bool           `yaml:"entrypoint"`
+	Terminal    bool           `yaml:"terminal"`
+	Workers     int            `yaml:"workers"`
+	Queue       int            `yaml:"queue"`
+	Overflow    Overflow       `yaml:"overflow"`
+	Serialize   string         `yaml:"serialize"`
+	Rate        string         `yaml:"rate"`
+	Burst       int            `yaml:"burst"`
+	Breaker     *BreakerModel  `yaml:"breaker"`
+	Backoff     *BackoffModel  `yaml:"backoff"`
+	Invoke      *InvokeModel   `yaml:"invoke"`
+	Fanout      *FanoutModel   `yaml:"fanout"`
+	Join        *JoinModel     `yaml:"join"`
+	Compensate  bool           `yaml:"compensate"`
+	Failure     bool           `yaml:"failure"`
+	Deadline    *DeadlineModel `yaml:"deadline"`
+	Inputs      []string       `yaml:"inputs"`
+	Transitions []State        `yaml:"transitions"`
+}
+
+// Handled reports whether the state runs a handler set through the builder.
+func (s StateModel) Handled() bool {
+	return !s.Terminal && s.Fanout == nil
+}
+
+func (s StateModel) QueueConfig() QueueConfig {
+	return QueueConfig{Capacity: s.Queue, Overflow: s.Overflow}
+}
+
+// InvokeModel makes a state run a task of another FSM generated into the
+// same package, and transition on the terminal state the child task
+// reaches. The state's inputs are the child's inputs, and each of the
+// child's terminal states maps to a state whose inputs are its result.
+type InvokeModel struct {
+	Machine string          `yaml:"machine"`
+	On      map[State]State `yaml:"on"`
+
+	// Set by LinkModels
+	Child *FsmModel `yaml:"-"`
+}
+
+// FanoutModel makes a state start parallel branches of its task instead of
+// running a handler, either one for each of a static list of states, which
+// take the state's inputs, or one for each element of the state's input,
+// which is a slice. Branches are chains of states that end by transitioning
+// to the join state.
+type FanoutModel struct {
+	Branches []State `yaml:"branches"`
+	Each     State   `yaml:"each"`
+	Join     State   `yaml:"join"`
+}
+
+// Starts returns the states the fan-out's branches start in.
+func (f *FanoutModel) Starts() []State {
+	if f.Each != "" {
+		return []State{f.Each}
+	}
+	return f.Branches
+}
+
+// JoinModel makes a state collect the outputs of a fan-out's branches. Its
+// inputs are the outputs of a single branch, and its handler receives them
+// as slices, in branch order.
+type JoinModel struct {
+	Wait   JoinMode `yaml:"wait"`
+	Quorum int      `yaml:"quorum"`
+}
+
+func (j *JoinModel) Config() JoinConfig {
+	return JoinConfig{Mode: j.Wait, Quorum: j.Quorum}
+}
+
+// DeadlineModel moves a state's step to another state if it is still in
+// the state once the deadline has passed since it was entered. Params maps
+// the target's inputs to the state's params, P0, P1 and so on, and may be
+// left out when the target takes the state's inputs as they are.
+type DeadlineModel struct {
+	After  string   `yaml:"after"`
+	To     State    `yaml:"to"`
+	Params []string `yaml:"params"`
+}
+
+func (d *DeadlineModel) Duration() (time.Duration, error) {
+	after, err := time.ParseDuration(d.After)
+	if err != nil {
+		return 0, fmt.Errorf("invalid deadline: %w", err)
+	}
+	if after <= 0 {
+		return 0, fmt.Errorf("deadline must be positive, got %s", after)
+	}
+	return after, nil
+}
+
+// Mapping returns the index of the state's input each of the target's
+// inputs is taken from.
+func (d *DeadlineModel) Mapping(state, target StateModel) ([]int, error) {
+	if d.Params == nil {
+		if !slices.Equal(state.Inputs, target.Inputs) {
+			return nil, fmt.Errorf("deadline of %s requires params, since %s takes different inputs", state.Name, target.Name)
+		}
+		mapping := make([]int, len(state.Inputs))
+		for i := range mapping {
+			mapping[i] = i
+		}
+		return mapping, nil
+	}
+
+	if len(d.Params) != len(target.Inputs) {
+		return nil, fmt.Errorf("deadline of %s maps %d params to the %d inputs of %s", state.Name, len(d.Params), len(target.Inputs), target.Name)
+	}
+	mapping := make([]int, len(d.Params))
+	for i, param := range d.Params {
+		var index int
+		if _, err := fmt.Sscanf(param, "P%d", &index); err != nil || fmt.Sprintf("P%d", index) != param || index < 0 || index >= len(state.Inputs) {
+			return nil, fmt.Errorf("deadline of %s maps unknown param %q", state.Name, param)
+		}
+		if state.Inputs[index] != target.Inputs[i] {
+			return nil, fmt.Errorf("deadline of %s maps %s, a %s, to input %d of %s, a %s", state.Name, param, state.Inputs[index], i, target.Name, target.Inputs[i])
+		}
+		mapping[i] = index
+	}
+	return mapping, nil
+}
+
+type BreakerModel struct {
+	Threshold float64 `yaml:"threshold"`
+	Window    int     `yaml:"window"`
+	Cooldown  string  `yaml:"cooldown"`
+	Probes    int     `yaml:"probes"`
+}
+
+func (b *BreakerModel) Config() (BreakerConfig, error) {
+	cooldown, err := time.ParseDuration(b.Cooldown)
+	if err != nil {
+		return BreakerConfig{}, fmt.Errorf("invalid breaker cooldown: %w", err)
+	}
+	config := BreakerConfig{
+		Threshold: b.Threshold,
+		Window:    b.Window,
+		Cooldown:  cooldown,
+		Probes:    b.Probes,
+	}
+	return config, config.Validate()
+}
+
+type BackoffModel struct {
+	Type   string `yaml:"type"`
+	Base   string `yaml:"base"`
+	Max    string `yaml:"max"`
+	Jitter string `yaml:"jitter"`
+}
+
+func (b *BackoffModel) Config() (BackoffConfig, error) {
+	base, err := time.ParseDuration(b.Base)
+	if err != nil {
+		return BackoffConfig{}, fmt.Errorf("invalid backoff base: %w", err)
+	}
+	var max time.Duration
+	if b.Max != "" {
+		if max, err = time.ParseDuration(b.Max); err != nil {
+			return BackoffConfig{}, fmt.Errorf("invalid backoff max: %w", err)
+		}
+	}
+	config := BackoffConfig{
+		Type:   BackoffType(b.Type),
+		Base:   base,
+		Max:    max,
+		Jitter: Jitter(b.Jitter),
+	}
+	return config, config.Validate()
+}
+
+// LinkModels resolves the FSMs invoked by states of models, which must all
+// be generated into the same package.
+func LinkModels(models []*FsmModel) error {
+	byName := make(map[string]*FsmModel, len(models))
+	for _, model := range models {
+		byName[model.Name] = model
+	}
+	for _, model := range models {
+		for i := range model.States {
+			state := &model.States[i]
+			if state.Invoke == nil {
+				continue
+			}
+			child, ok := byName[state.Invoke.Machine]
+			if !ok {
+				return fmt.Errorf("%s: state %s invokes unknown FSM %q", model.Name, state.Name, state.Invoke.Machine)
+			}
+			if child.CollectsInputs(child.InitialState()) || !sameInputs(model, state.Inputs, child, child.InitialState().Inputs) {
+				return fmt.Errorf("%s: state %s inputs must match the inputs of %s", model.Name, state.Name, child.Name)
+			}
+			state.Invoke.Child = child
+			state.Transitions = nil
+			for _, terminal := range child.States {
+				if !terminal.Terminal {
+					continue
+				}
+				to, ok := state.Invoke.On[terminal.Name]
+				if !ok {
+					return fmt.Errorf("%s: state %s has no transition for %s state %s", model.Name, state.Name, child.Name, terminal.Name)
+				}
+				target := slices.IndexFunc(model.States, func(s StateModel) bool { return s.Name == to })
+				if target < 0 {
+					return fmt.Errorf("%s: state %s transitions to unknown state %s", model.Name, state.Name, to)
+				}
+				if !sameInputs(model, model.States[target].Inputs, child, terminal.Inputs) {
+					return fmt.Errorf("%s: state %s inputs must match the inputs of %s state %s", model.Name, to, child.Name, terminal.Name)
+				}
+				if !slices.Contains(state.Transitions, to) {
+					state.Transitions = append(state.Transitions, to)
+				}
+			}
+			for from := range state.Invoke.On {
+				if i := slices.IndexFunc(child.States, func(s StateModel) bool { return s.Name == from }); i < 0 || !child.States[i].Terminal {
+					return fmt.Errorf("%s: state %s maps %s, which is not a terminal state of %s", model.Name, state.Name, from, child.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sameInputs(model *FsmModel, inputs []string, other *FsmModel, otherInputs []string) bool {
+	return slices.EqualFunc(inputs, otherInputs, func(a, b string) bool {
+		return a == b && model.Types[a] == other.Types[b]
+	})
 }
 
 func ParseModel(p *yaml.Decoder) (*FsmModel, error) {
@@ -138,8 +548,87 @@ func validateModel(model *FsmModel) error {
 		if state.Terminal && len(state.Transitions) > 0 {
 			return errors.New("terminal state cannot have transitions")
 		}
-		if state.Terminal && len(state.Inputs) > 0 {
-			return errors.New("terminal state cannot have inputs")
+		if state.Terminal && state.Serialize != "" {
+			return errors.New("terminal state cannot be serialized")
+		}
+		if state.Terminal && state.Rate != "" {
+			return errors.New("terminal state cannot be rate limited")
+		}
+		if state.Rate != "" {
+			if _, err := ParseRate(state.Rate); err != nil {
+				return err
+			}
+		} else if state.Burst != 0 {
+			return errors.New("burst requires a rate")
+		}
+		if state.Burst < 0 {
+			return errors.New("burst cannot be negative")
+		}
+		if state.Breaker != nil {
+			if state.Terminal {
+				return errors.New("terminal state cannot have a breaker")
+			}
+			if _, err := state.Breaker.Config(); err != nil {
+				return err
+			}
+		}
+		if state.Invoke != nil {
+			if state.Terminal {
+				return errors.New("terminal state cannot invoke an FSM")
+			}
+			if len(state.Transitions) > 0 {
+				return errors.New("invoking state takes its transitions from the invoked FSM's terminal states")
+			}
+		}
+		if state.Fanout != nil {
+			if state.Terminal {
+				return errors.New("terminal state cannot fan out")
+			}
+			if state.Invoke != nil || state.Join != nil {
+				return errors.New("fan-out state cannot invoke an FSM or join branches")
+			}
+			if len(state.Transitions) > 0 {
+				return errors.New("fan-out state takes its transitions from its branches")
+			}
+			if (len(state.Fanout.Branches) > 0) == (state.Fanout.Each != "") {
+				return errors.New("fan-out requires either branches or each")
+			}
+			if state.Fanout.Each != "" && len(state.Inputs) != 1 {
+				return errors.New("fan-out over each element requires exactly one input")
+			}
+		}
+		if state.Join != nil {
+			if state.Terminal || state.Entrypoint {
+				return errors.New("join state cannot be terminal or an entrypoint")
+			}
+			if state.Invoke != nil {
+				return errors.New("join state cannot invoke an FSM")
+			}
+			if err := state.Join.Config().Validate(); err != nil {
+				return err
+			}
+		}
+		if state.Compensate && (state.Terminal || state.Fanout != nil) {
+			return errors.New("terminal and fan-out states cannot be compensated")
+		}
+		if state.Failure && state.Terminal {
+			return errors.New("failure state cannot be terminal, since it compensates before its handler runs")
+		}
+		if state.Deadline != nil {
+			if state.Terminal || state.Fanout != nil || state.Invoke != nil {
+				return errors.New("terminal, fan-out and invoking states cannot have a deadline")
+			}
+			if _, err := state.Deadline.Duration(); err != nil {
+				return err
+			}
+		}
+		if state.Backoff != nil {
+			if state.Terminal {
+				return errors.New("terminal state cannot have a backoff")
+			}
+			if _, err := state.Backoff.Config(); err != nil {
+				return err
+			}
 		}
 		if state.Workers == 0 {
 			state.Workers = 1
@@ -147,8 +636,11 @@ func validateModel(model *FsmModel) error {
 		if state.Workers < 0 {
 			return errors.New("each state must have at least one worker")
 		}
-		if state.Queue < 0 {
-			state.Queue = 16
+		if state.Terminal && state.Queue != 0 {
+			return errors.New("terminal state cannot have a queue capacity")
+		}
+		if err := state.QueueConfig().Validate(); err != nil {
+			return err
 		}
 		if state.Entrypoint {
 			entrypoints++
@@ -163,5 +655,107 @@ func validateModel(model *FsmModel) error {
 	if terminals < 1 {
 		return errors.New("at least one terminal state is required")
 	}
+	if len(model.CompensatedStates()) > 0 && len(model.FailureStates()) == 0 {
+		return errors.New("compensated states require a failure state")
+	}
+	if err := validateDeadlines(model); err != nil {
+		return err
+	}
+	return validateFanouts(model)
+}
+
+// validateDeadlines checks that each deadline moves its state's steps to a
+// state that can take them, outside of any fan-out.
+func validateDeadlines(model *FsmModel) error {
+	for _, state := range model.DeadlineStates() {
+		i := slices.IndexFunc(model.States, func(s StateModel) bool { return s.Name == state.Deadline.To })
+		if i < 0 {
+			return fmt.Errorf("deadline of %s moves to unknown state %s", state.Name, state.Deadline.To)
+		}
+		target := model.States[i]
+		if model.CollectsInputs(state) || model.CollectsInputs(target) || model.InBranch(state) || model.InBranch(target) {
+			return fmt.Errorf("deadline of %s cannot move between fan-outs, joins and their branches", state.Name)
+		}
+		if _, err := state.Deadline.Mapping(state, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateFanouts checks that each fan-out's branches are only entered by
+// the fan-out, and only left through its join.
+func validateFanouts(model *FsmModel) error {
+	find := func(name State) (StateModel, bool) {
+		i := slices.IndexFunc(model.States, func(state StateModel) bool { return state.Name == name })
+		if i < 0 {
+			return StateModel{}, false
+		}
+		return model.States[i], true
+	}
+
+	joins := make(map[State]State)
+	inBranches := make(map[State]State)
+	for _, fanout := range model.Fanouts() {
+		join, ok := find(fanout.Fanout.Join)
+		if !ok || join.Join == nil {
+			return fmt.Errorf("fan-out %s requires a join state", fanout.Name)
+		}
+		if other, ok := joins[join.Name]; ok {
+			return fmt.Errorf("fan-outs %s and %s cannot share join %s", other, fanout.Name, join.Name)
+		}
+		joins[join.Name] = fanout.Name
+
+		for _, start := range fanout.Fanout.Starts() {
+			branch, ok := find(start)
+			if !ok {
+				return fmt.Errorf("fan-out %s branches into unknown state %s", fanout.Name, start)
+			}
+			if !slices.Equal(branch.Inputs, fanout.Inputs) {
+				return fmt.Errorf("fan-out %s branch %s inputs must match the fan-out's inputs", fanout.Name, start)
+			}
+		}
+		for _, name := range model.Branches(fanout) {
+			branch, ok := find(name)
+			if !ok {
+				return fmt.Errorf("fan-out %s branches into unknown state %s", fanout.Name, name)
+			}
+			if branch.Terminal || branch.Entrypoint || branch.Fanout != nil || branch.Join != nil {
+				return fmt.Errorf("fan-out %s branch state %s cannot be terminal, an entrypoint, a fan-out or a join", fanout.Name, name)
+			}
+			if branch.Serialize != "" {
+				return fmt.Errorf("fan-out %s branch state %s cannot be serialized", fanout.Name, name)
+			}
+			if branch.Failure {
+				return fmt.Errorf("fan-out %s branch state %s cannot be a failure state", fanout.Name, name)
+			}
+			if other, ok := inBranches[name]; ok {
+				return fmt.Errorf("state %s cannot be in the branches of both %s and %s", name, other, fanout.Name)
+			}
+			inBranches[name] = fanout.Name
+		}
+	}
+
+	for _, state := range model.States {
+		if state.Join != nil {
+			if _, ok := joins[state.Name]; !ok {
+				return fmt.Errorf("join %s is not joined by any fan-out", state.Name)
+			}
+		}
+		for _, to := range state.Transitions {
+			target, ok := find(to)
+			if !ok {
+				continue
+			}
+			// Branches carry their fan-out through every transition
+			fanout, fromBranch := inBranches[state.Name]
+			if target.Join != nil && (!fromBranch || joins[to] != fanout) {
+				return fmt.Errorf("state %s cannot transition to join %s outside of its fan-out's branches", state.Name, to)
+			}
+			if other, toBranch := inBranches[to]; toBranch && (!fromBranch || other != fanout) {
+				return fmt.Errorf("state %s cannot transition into the branches of fan-out %s", state.Name, other)
+			}
+		}
+	}
 	return nil
 }
@@ -2,18 +2,51 @@ package fsm
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"slices"
+	"time"
 )
 
 type TransitionListener func(ctx context.Context, id TaskID, from State, to State)
 type CompletionListener func(ctx context.Context, id TaskID, state State)
 
+// RateLimitListener is called each time a step in a rate limited state
+// takes a token, with how long it waited for it.
+type RateLimitListener func(ctx context.Context, id TaskID, state State, wait time.Duration)
+
+// BreakerListener is called each time a state's circuit breaker changes
+// state. It must not change the breaker's config.
+type BreakerListener func(ctx context.Context, state State, from BreakerState, to BreakerState)
+
+// Middleware wraps the handlers of an FSM's steps. It runs a step by
+// calling next, with the context the rest of the chain and the handler see,
+// and may skip it by returning without calling next.
+type Middleware func(ctx context.Context, fsm string, state State, id TaskID, attempt int, next func(ctx context.Context) error) error
+
 type SupportsOptions interface {
 	WithContext(update func(ctx context.Context) context.Context)
 	WithStore(store Store)
 	WithBackoff(backoff Backoff)
+	WithStateBackoff(state State, backoff Backoff) error
+	WithQueue(state State, config QueueConfig) error
 	WithTransitionListener(listener TransitionListener)
 	WithCompletionListener(listener CompletionListener)
+	WithLease(ttl time.Duration)
+	WithPollInterval(interval time.Duration)
+	WithPriorityAging(interval time.Duration)
+	WithBatchSize(size int)
+	WithNamespace(namespace string)
+	WithUnscopedTasks(adopt func(TaskID) bool)
+	WithRate(state State, rate Rate, burst int) error
+	WithRateLimitListener(listener RateLimitListener)
+	WithBreaker(state State, config BreakerConfig) error
+	WithBreakerListener(listener BreakerListener)
+	WithDeadline(state State, after time.Duration) error
+	WithMiddleware(middleware Middleware)
+	WithMetadataExtractor(extractor MetadataExtractor)
+	WithMetadataInjector(injector MetadataInjector)
 }
 
 type Option func(SupportsOptions) error
@@ -41,6 +74,20 @@ func WithCompletionListener(listener CompletionListener) Option {
 	}
 }
 
+func WithRateLimitListener(listener RateLimitListener) Option {
+	return func(s SupportsOptions) error {
+		s.WithRateLimitListener(listener)
+		return nil
+	}
+}
+
+func WithBreakerListener(listener BreakerListener) Option {
+	return func(s SupportsOptions) error {
+		s.WithBreakerListener(listener)
+		return nil
+	}
+}
+
 func WithBackoff(backoff Backoff) Option {
 	return func(s SupportsOptions) error {
 		s.WithBackoff(backoff)
@@ -48,6 +95,28 @@ func WithBackoff(backoff Backoff) Option {
 	}
 }
 
+// WithStateBackoff sets the backoff for retries of a state's steps,
+// overriding the backoff from the model and WithBackoff. A nil backoff
+// falls back to WithBackoff, and states the FSM doesn't have or that are
+// terminal are rejected.
+func WithStateBackoff(state State, backoff Backoff) Option {
+	return func(s SupportsOptions) error {
+		return s.WithStateBackoff(state, backoff)
+	}
+}
+
+// WithQueue bounds a state's queue, overriding the capacity and overflow
+// from the model. The zero config leaves it unbounded, and states the FSM
+// doesn't have or that are terminal are rejected.
+func WithQueue(state State, config QueueConfig) Option {
+	return func(s SupportsOptions) error {
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("invalid queue for %s: %w", state, err)
+		}
+		return s.WithQueue(state, config)
+	}
+}
+
 func WithStore(provider func() (Store, error)) Option {
 	return func(s SupportsOptions) error {
 		store, err := provider()
@@ -58,3 +127,175 @@ func WithStore(provider func() (Store, error)) Option {
 		return nil
 	}
 }
+
+// WithLease sets how long a worker's claim on a queued step lasts without a
+// heartbeat. Running steps renew their lease at a third of the TTL, and a
+// step whose lease expires, e.g. because its process died, can be claimed
+// again by any process sharing the store.
+func WithLease(ttl time.Duration) Option {
+	return func(s SupportsOptions) error {
+		if ttl <= 0 {
+			return fmt.Errorf("lease ttl must be positive, got %s", ttl)
+		}
+		s.WithLease(ttl)
+		return nil
+	}
+}
+
+// WithPollInterval sets how often idle workers check the store for steps
+// queued by other processes, or whose lease or retry delay has expired.
+func WithPollInterval(interval time.Duration) Option {
+	return func(s SupportsOptions) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval must be positive, got %s", interval)
+		}
+		s.WithPollInterval(interval)
+		return nil
+	}
+}
+
+// WithPriorityAging sets how quickly waiting steps gain priority. Each
+// interval a step spends waiting to be claimed counts as one more level of
+// priority, so low priority work is not starved by a steady stream of
+// higher priority work.
+func WithPriorityAging(interval time.Duration) Option {
+	return func(s SupportsOptions) error {
+		if interval <= 0 {
+			return fmt.Errorf("priority aging interval must be positive, got %s", interval)
+		}
+		s.WithPriorityAging(interval)
+		return nil
+	}
+}
+
+// WithBatchSize sets how many tasks a batch submission stores in each
+// transaction. Larger chunks commit less often, but hold the store's write
+// lock for longer.
+func WithBatchSize(size int) Option {
+	return func(s SupportsOptions) error {
+		if size <= 0 {
+			return fmt.Errorf("batch size must be positive, got %d", size)
+		}
+		s.WithBatchSize(size)
+		return nil
+	}
+}
+
+// WithNamespace scopes an FSM's tasks to a namespace, like a tenant or an
+// environment. FSMs sharing a store only see the tasks, pauses and
+// concurrency keys of their own FSM and namespace.
+func WithNamespace(namespace string) Option {
+	return func(s SupportsOptions) error {
+		if namespace == "" {
+			return errors.New("namespace must not be empty")
+		}
+		s.WithNamespace(namespace)
+		return nil
+	}
+}
+
+// WithUnscopedTasks adopts the tasks of a store upgraded from before tasks
+// were scoped to an FSM into the FSM being built, and its namespace. Only
+// tasks whose input and states fit the FSM are adopted, and of those, only
+// the ones adopt accepts; a nil adopt accepts all of them. FSMs with the same
+// states and inputs can't tell their tasks apart, so when several shared the
+// store, adopt has to pick out each FSM's own. Without the option, FSMs fail
+// to start with ErrUnscopedTasks while tasks that fit them exist.
+func WithUnscopedTasks(adopt func(TaskID) bool) Option {
+	return func(s SupportsOptions) error {
+		if adopt == nil {
+			adopt = func(TaskID) bool { return true }
+		}
+		s.WithUnscopedTasks(adopt)
+		return nil
+	}
+}
+
+// WithRate limits how often a state's handler runs, overriding the rate
+// from the model. The zero Rate removes the limit, and states the FSM doesn't
+// have or that are terminal are rejected. Generated FSMs also accept WithRate
+// while running, so the limit can be adjusted at runtime.
+func WithRate(state State, rate Rate, burst int) Option {
+	return func(s SupportsOptions) error {
+		if rate.Count < 0 || (rate.Count > 0 && rate.Per <= 0) {
+			return fmt.Errorf("invalid rate for %s: %s", state, rate)
+		}
+		if burst < 0 {
+			return fmt.Errorf("burst for %s must not be negative, got %d", state, burst)
+		}
+		return s.WithRate(state, rate, burst)
+	}
+}
+
+// WithBreaker sets a state's circuit breaker, overriding the breaker from
+// the model. The zero config removes it, and states the FSM doesn't have or
+// that are terminal are rejected.
+func WithBreaker(state State, config BreakerConfig) Option {
+	return func(s SupportsOptions) error {
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("invalid breaker for %s: %w", state, err)
+		}
+		return s.WithBreaker(state, config)
+	}
+}
+
+// WithDeadline sets how long a state's steps can stay in the state before
+// its deadline moves them on, overriding the duration from the model. Only
+// states with a deadline in the model have a state to move to, so other
+// states are rejected, and a zero duration turns the deadline off for steps
+// entering the state.
+func WithDeadline(state State, after time.Duration) Option {
+	return func(s SupportsOptions) error {
+		if after < 0 {
+			return fmt.Errorf("deadline for %s must not be negative, got %s", state, after)
+		}
+		return s.WithDeadline(state, after)
+	}
+}
+
+// WithMiddleware wraps step handlers in a middleware. Middlewares run in the
+// order they're added, each wrapping the ones added after it. Given states,
+// the middleware only wraps those states' handlers.
+func WithMiddleware(middleware Middleware, states ...State) Option {
+	return func(s SupportsOptions) error {
+		if middleware == nil {
+			return errors.New("middleware must not be nil")
+		}
+		if len(states) == 0 {
+			s.WithMiddleware(middleware)
+			return nil
+		}
+		s.WithMiddleware(func(ctx context.Context, fsm string, state State, id TaskID, attempt int, next func(ctx context.Context) error) error {
+			if !slices.Contains(states, state) {
+				return next(ctx)
+			}
+			return middleware(ctx, fsm, state, id, attempt, next)
+		})
+		return nil
+	}
+}
+
+// WithMetadataExtractor captures values from the context of each submission
+// into the task's metadata. Metadata attached with PutMetadata takes
+// precedence over extracted values.
+func WithMetadataExtractor(extractor MetadataExtractor) Option {
+	return func(s SupportsOptions) error {
+		if extractor == nil {
+			return errors.New("metadata extractor must not be nil")
+		}
+		s.WithMetadataExtractor(extractor)
+		return nil
+	}
+}
+
+// WithMetadataInjector puts values from a task's metadata back onto the
+// context of each of its handlers, before any middlewares run.
+func WithMetadataInjector(injector MetadataInjector) Option {
+	return func(s SupportsOptions) error {
+		if injector == nil {
+			return errors.New("metadata injector must not be nil")
+		}
+		s.WithMetadataInjector(injector)
+		return nil
+	}
+}
@@ -0,0 +1,17 @@
+-- name: AcquireConcurrencyLock :exec
+INSERT OR IGNORE INTO concurrency_locks (fsm, namespace, concurrency_key, region, task_id)
+SELECT fsm, namespace, concurrency_key, CAST(sqlc.arg(region) AS TEXT), id FROM tasks
+WHERE id = sqlc.arg(task_id)
+  AND concurrency_key IS NOT NULL;
+
+-- name: ReleaseConcurrencyLocks :exec
+DELETE FROM concurrency_locks
+WHERE task_id = sqlc.arg(task_id)
+  AND region != CAST(sqlc.arg(region) AS TEXT);
+
+-- name: AdoptUnscopedLocks :exec
+UPDATE concurrency_locks
+SET fsm = ?,
+    namespace = ?
+WHERE task_id = ?
+  AND fsm = '';
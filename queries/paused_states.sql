@@ -0,0 +1,15 @@
+-- name: PauseState :exec
+INSERT OR IGNORE INTO paused_states (fsm, namespace, state)
+VALUES (?, ?, ?);
+
+-- name: ResumeState :exec
+DELETE FROM paused_states
+WHERE fsm = ?
+  AND namespace = ?
+  AND state = ?;
+
+-- name: GetPausedStates :many
+SELECT state FROM paused_states
+WHERE fsm = ?
+  AND namespace = ?
+ORDER BY state ASC;
@@ -0,0 +1,106 @@
+-- name: EnqueueItem :one
+INSERT INTO queue_items (task_id, state, attempt, data, ready_at, priority)
+VALUES (?, ?, ?, ?, ?, ?)
+RETURNING id;
+
+-- name: ClaimQueueItem :one
+UPDATE queue_items
+SET lease_owner = CAST(sqlc.arg(owner) AS TEXT),
+    lease_expires_at = unixepoch('subsec') * 1000 + CAST(sqlc.arg(lease_ms) AS INTEGER)
+WHERE id = (
+    SELECT queue_items.id FROM queue_items
+    JOIN tasks ON tasks.id = queue_items.task_id
+    WHERE queue_items.state = sqlc.arg(state)
+      -- Machines sharing the store only claim their own tasks
+      AND tasks.fsm = CAST(sqlc.arg(fsm) AS TEXT)
+      AND tasks.namespace = CAST(sqlc.arg(namespace) AS TEXT)
+      AND queue_items.ready_at <= unixepoch('subsec') * 1000
+      AND (queue_items.lease_expires_at IS NULL OR queue_items.lease_expires_at <= unixepoch('subsec') * 1000)
+      -- Steps of paused states, or of a paused FSM, stay queued
+      AND NOT EXISTS (
+          SELECT 1 FROM paused_states
+          WHERE paused_states.fsm = tasks.fsm
+            AND paused_states.namespace = tasks.namespace
+            AND paused_states.state IN (queue_items.state, '')
+      )
+      -- Steps in a serialized region wait while another task holds their key
+      AND NOT EXISTS (
+          SELECT 1 FROM concurrency_locks
+          WHERE concurrency_locks.fsm = tasks.fsm
+            AND concurrency_locks.namespace = tasks.namespace
+            AND concurrency_locks.concurrency_key = tasks.concurrency_key
+            AND concurrency_locks.region = CAST(sqlc.arg(region) AS TEXT)
+            AND concurrency_locks.task_id != tasks.id
+      )
+    -- Every aging interval spent waiting counts as one level of priority
+    ORDER BY queue_items.priority + (unixepoch('subsec') * 1000 - queue_items.ready_at) / CAST(sqlc.arg(aging_ms) AS INTEGER) DESC, queue_items.id ASC
+    LIMIT 1
+)
+RETURNING *;
+
+-- name: RenewQueueItemLease :execrows
+UPDATE queue_items
+SET lease_expires_at = unixepoch('subsec') * 1000 + CAST(sqlc.arg(lease_ms) AS INTEGER)
+WHERE id = sqlc.arg(id)
+  AND lease_owner = CAST(sqlc.arg(owner) AS TEXT);
+
+-- name: AckQueueItem :execrows
+DELETE FROM queue_items
+WHERE id = sqlc.arg(id)
+  AND lease_owner = CAST(sqlc.arg(owner) AS TEXT);
+
+-- name: RetryQueueItem :execrows
+UPDATE queue_items
+SET attempt = sqlc.arg(attempt),
+    lease_owner = NULL,
+    lease_expires_at = NULL,
+    ready_at = sqlc.arg(ready_at)
+WHERE id = sqlc.arg(id)
+  AND lease_owner = CAST(sqlc.arg(owner) AS TEXT);
+
+-- name: ReleaseQueueItem :exec
+UPDATE queue_items
+SET lease_owner = NULL,
+    lease_expires_at = NULL
+WHERE id = sqlc.arg(id)
+  AND lease_owner = CAST(sqlc.arg(owner) AS TEXT);
+
+-- name: ExpediteQueueItem :execrows
+-- Failed steps waiting out their backoff are made ready right away
+UPDATE queue_items
+SET ready_at = unixepoch('subsec') * 1000
+WHERE id = ?
+  AND attempt > 0
+  AND (lease_expires_at IS NULL OR lease_expires_at <= unixepoch('subsec') * 1000);
+
+-- name: WakeQueueItem :execrows
+-- Parked steps are made ready once what they wait on is done
+UPDATE queue_items
+SET ready_at = unixepoch('subsec') * 1000
+WHERE id = ?
+  AND lease_owner IS NULL;
+
+-- name: GetQueueItem :one
+SELECT * FROM queue_items
+WHERE id = ?;
+
+-- name: GetTaskQueueItem :one
+SELECT * FROM queue_items
+WHERE task_id = ?
+ORDER BY id DESC
+LIMIT 1;
+
+-- name: CountQueueItems :one
+SELECT COUNT(*) FROM queue_items
+JOIN tasks ON tasks.id = queue_items.task_id
+WHERE queue_items.state = ?
+  AND tasks.fsm = ?
+  AND tasks.namespace = ?;
+
+-- name: DeleteQueueItem :execrows
+DELETE FROM queue_items
+WHERE id = ?;
+
+-- name: DeleteTaskQueueItems :exec
+DELETE FROM queue_items
+WHERE task_id = ?;
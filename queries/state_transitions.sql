@@ -1,23 +1,22 @@
 -- name: RecordTransition :exec
-INSERT INTO state_transitions (task_id, attempt, from_state, to_state, data)
-VALUES (?, ?, ?, ?, ?);
-
--- name: GetTaskState :one
-SELECT to_state FROM state_transitions
-WHERE task_id = ?
-  AND to_state != '__error__'
-ORDER BY created_at DESC
-LIMIT 1;
+INSERT INTO state_transitions (task_id, attempt, from_state, to_state, data, next_attempt_at, deadline, operator)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?);
 
 -- name: GetHistory :many
 SELECT * FROM state_transitions
 WHERE task_id = ?
-ORDER BY created_at ASC;
+ORDER BY created_at ASC, id ASC;
 
 -- name: GetLastValidTransition :one
 SELECT * FROM state_transitions
-WHERE task_id = ?
-  AND to_state != '__error__'
-ORDER BY created_at DESC
+WHERE task_id = sqlc.arg(task_id)
+  AND to_state NOT IN ('__error__', '__retried__')
+  -- Tasks of other FSMs and namespaces aren't visible
+  AND EXISTS (
+      SELECT 1 FROM tasks
+      WHERE tasks.id = state_transitions.task_id
+        AND tasks.fsm = CAST(sqlc.arg(fsm) AS TEXT)
+        AND tasks.namespace = CAST(sqlc.arg(namespace) AS TEXT)
+  )
+ORDER BY created_at DESC, id DESC
 LIMIT 1;
-
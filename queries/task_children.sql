@@ -0,0 +1,19 @@
+-- name: LinkChildTask :exec
+INSERT OR IGNORE INTO task_children (parent_id, state, child_id)
+VALUES (?, ?, ?);
+
+-- name: GetChildTasks :many
+SELECT * FROM task_children
+WHERE parent_id = ?
+ORDER BY created_at ASC, child_id ASC;
+
+-- name: ListParkedSteps :many
+-- Idle steps of invoking states, with the children they started
+SELECT queue_items.id, queue_items.state, task_children.child_id FROM queue_items
+JOIN tasks ON tasks.id = queue_items.task_id
+JOIN task_children ON task_children.parent_id = queue_items.task_id
+  AND task_children.state = queue_items.state
+  AND task_children.created_at >= queue_items.created_at
+WHERE tasks.fsm = ?
+  AND tasks.namespace = ?
+  AND queue_items.lease_owner IS NULL;
@@ -0,0 +1,16 @@
+-- name: AddCompensation :exec
+INSERT INTO task_compensations (task_id, step_id, state, data)
+SELECT task_id, id, state, data FROM queue_items
+WHERE id = sqlc.arg(id)
+  AND lease_owner = CAST(sqlc.arg(owner) AS TEXT);
+
+-- name: GetPendingCompensations :many
+SELECT * FROM task_compensations
+WHERE task_id = ?
+  AND compensated_at IS NULL
+ORDER BY id DESC;
+
+-- name: FinishCompensation :exec
+UPDATE task_compensations
+SET compensated_at = unixepoch('subsec') * 1000
+WHERE id = ?;
@@ -0,0 +1,35 @@
+-- name: ScheduleDeadline :exec
+INSERT INTO task_deadlines (task_id, step_id, state, fire_at)
+VALUES (?, ?, ?, ?);
+
+-- name: GetDueDeadline :one
+SELECT task_deadlines.* FROM task_deadlines
+JOIN tasks ON tasks.id = task_deadlines.task_id
+WHERE task_deadlines.state = ?
+  AND tasks.fsm = ?
+  AND tasks.namespace = ?
+  AND task_deadlines.fired_at IS NULL
+  AND task_deadlines.fire_at <= ?
+  -- Deadlines of paused states, or of a paused FSM, wait until resumed
+  AND NOT EXISTS (
+      SELECT 1 FROM paused_states
+      WHERE paused_states.fsm = tasks.fsm
+        AND paused_states.namespace = tasks.namespace
+        AND paused_states.state IN (task_deadlines.state, '')
+  )
+ORDER BY task_deadlines.fire_at ASC, task_deadlines.id ASC
+LIMIT 1;
+
+-- name: GetStepDeadline :one
+SELECT * FROM task_deadlines
+WHERE step_id = ?;
+
+-- name: FireDeadline :execrows
+UPDATE task_deadlines
+SET fired_at = unixepoch('subsec') * 1000
+WHERE id = ?
+  AND fired_at IS NULL;
+
+-- name: DeleteDeadline :exec
+DELETE FROM task_deadlines
+WHERE id = ?;
@@ -0,0 +1,21 @@
+-- name: CreateFanout :exec
+INSERT INTO task_fanouts (task_id, fanout_id, branches)
+VALUES (?, ?, ?);
+
+-- name: GetFanout :one
+SELECT * FROM task_fanouts
+WHERE task_id = ? AND fanout_id = ?;
+
+-- name: JoinFanout :exec
+UPDATE task_fanouts
+SET joined_at = unixepoch('subsec') * 1000
+WHERE task_id = ? AND fanout_id = ?;
+
+-- name: FinishBranch :exec
+INSERT OR IGNORE INTO task_branches (task_id, fanout_id, branch, output)
+VALUES (?, ?, ?, ?);
+
+-- name: GetFinishedBranches :many
+SELECT * FROM task_branches
+WHERE task_id = ? AND fanout_id = ?
+ORDER BY branch ASC;
@@ -1,13 +1,33 @@
--- name: CreateTaskWithID :one
-INSERT INTO tasks (id, data)
-VALUES (?, ?)
-RETURNING *;
-
 -- name: CreateTask :one
-INSERT INTO tasks (data)
-VALUES (?)
+INSERT INTO tasks (data, idempotency_key, concurrency_key, metadata, fsm, namespace)
+VALUES (?, ?, ?, ?, ?, ?)
 RETURNING *;
 
--- name: ListTasks :many
+-- name: GetTask :one
+SELECT * FROM tasks
+WHERE id = ?
+  AND fsm = ?
+  AND namespace = ?;
+
+-- name: GetTaskMetadata :one
+SELECT metadata FROM tasks
+WHERE id = ?;
+
+-- name: GetTaskByIdempotencyKey :one
+SELECT * FROM tasks
+WHERE fsm = ?
+  AND namespace = ?
+  AND idempotency_key = ?;
+
+-- name: ListUnscopedTasks :many
+-- Tasks stored before tasks were scoped belong to no FSM
 SELECT * FROM tasks
+WHERE fsm = ''
 ORDER BY id ASC;
+
+-- name: AdoptUnscopedTask :exec
+UPDATE tasks
+SET fsm = ?,
+    namespace = ?
+WHERE id = ?
+  AND fsm = '';
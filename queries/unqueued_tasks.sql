@@ -0,0 +1,10 @@
+-- name: ListUnqueuedTasks :many
+SELECT tasks.* FROM unqueued_tasks
+JOIN tasks ON tasks.id = unqueued_tasks.task_id
+WHERE tasks.fsm = ?
+  AND tasks.namespace = ?
+ORDER BY tasks.id ASC;
+
+-- name: DeleteUnqueuedTask :exec
+DELETE FROM unqueued_tasks
+WHERE task_id = ?;
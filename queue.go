@@ -0,0 +1,53 @@
+package fsm
+
+import "fmt"
+
+// Overflow is what happens to a step entering a state whose queue is at
+// capacity.
+type Overflow string
+
+const (
+	// OverflowBlock waits for the queue to have room, until the context of
+	// the submission is done. TrySubmit rejects instead, and so do
+	// transitions from handlers, which would otherwise hold their worker
+	// while they wait: they fail with a QueueFullError, and their step is
+	// retried with backoff.
+	OverflowBlock Overflow = "block"
+	// OverflowReject fails the submission or transition with a
+	// QueueFullError. Handlers that return it are retried with backoff.
+	OverflowReject Overflow = "reject"
+	// OverflowSpill doesn't enforce the capacity: steps past it are stored in
+	// the queue like any other, and are claimed once workers free up.
+	OverflowSpill Overflow = "spill"
+)
+
+// QueueConfig bounds the number of steps queued or running in a state. The
+// zero config leaves the queue unbounded.
+type QueueConfig struct {
+	Capacity int
+	Overflow Overflow // Defaults to OverflowBlock
+}
+
+func (c QueueConfig) Bounded() bool {
+	return c.Capacity > 0 && c.Overflow != OverflowSpill
+}
+
+// Blocks reports whether steps wait for room when the queue is full.
+func (c QueueConfig) Blocks() bool {
+	return c.Overflow == "" || c.Overflow == OverflowBlock
+}
+
+func (c QueueConfig) Validate() error {
+	if c.Capacity < 0 {
+		return fmt.Errorf("queue capacity must not be negative, got %d", c.Capacity)
+	}
+	switch c.Overflow {
+	case "", OverflowBlock, OverflowReject, OverflowSpill:
+	default:
+		return fmt.Errorf("unknown queue overflow %q", c.Overflow)
+	}
+	if c.Capacity == 0 && c.Overflow != "" {
+		return fmt.Errorf("queue overflow %s requires a capacity", c.Overflow)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a throughput limit of Count steps every Per. The zero Rate is
+// unlimited.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses a rate like "10/s", "600/m" or "5/100ms".
+func ParseRate(s string) (Rate, error) {
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q: expected <count>/<duration>", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: count must be a positive integer", s)
+	}
+	per = strings.TrimSpace(per)
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q: duration must be positive", s)
+	}
+	return Rate{n, d}, nil
+}
+
+// MustParseRate is like ParseRate, but panics if the rate is invalid.
+func MustParseRate(s string) Rate {
+	rate, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return rate
+}
+
+func (r Rate) String() string {
+	if r.Count == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+// Limiter is a token bucket, refilled at its rate and holding up to its
+// burst. It is safe for concurrent use, including changing its rate.
+type Limiter struct {
+	lock   sync.Mutex
+	rate   Rate
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate Rate, burst int) *Limiter {
+	l := new(Limiter)
+	l.SetRate(rate, burst)
+	return l
+}
+
+// SetRate changes the limiter's rate and burst. A burst below one allows
+// a single step at a time.
+func (l *Limiter) SetRate(rate Rate, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens, l.last = float64(max(burst, 1)), now
+	} else {
+		l.refill(now)
+	}
+	l.rate, l.burst = rate, max(burst, 1)
+	l.tokens = min(l.tokens, float64(l.burst))
+}
+
+// Limited reports whether the limiter has a rate.
+func (l *Limiter) Limited() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate.Count > 0
+}
+
+// Wait takes a token, waiting for one if the bucket is empty, and returns
+// how long it waited. Waiting doesn't reserve a token, so a token handed
+// back with Refund goes to the next waiter to look. If the context is done
+// first, the context's cause is returned.
+func (l *Limiter) Wait(ctx context.Context) (time.Duration, error) {
+	var start time.Time
+	for {
+		l.lock.Lock()
+		if l.rate.Count == 0 {
+			l.lock.Unlock()
+			return waited(start), nil
+		}
+		now := time.Now()
+		l.refill(now)
+		if l.tokens >= 1 {
+			l.tokens--
+			l.lock.Unlock()
+			return waited(start), nil
+		}
+		// Wait for the next token to be refilled, and look again
+		delay := time.Duration((1 - l.tokens) * float64(l.rate.Per) / float64(l.rate.Count))
+		l.lock.Unlock()
+
+		if start.IsZero() {
+			start = now
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return waited(start), context.Cause(ctx)
+		}
+	}
+}
+
+// Refund hands back a token taken by Wait that went unused.
+func (l *Limiter) Refund() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate.Count == 0 {
+		return
+	}
+	l.refill(time.Now())
+	l.tokens = min(l.tokens+1, float64(l.burst))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if l.rate.Count > 0 {
+		elapsed := float64(now.Sub(l.last)) / float64(l.rate.Per)
+		l.tokens = min(l.tokens+elapsed*float64(l.rate.Count), float64(l.burst))
+	}
+	l.last = now
+}
+
+func waited(start time.Time) time.Duration {
+	if start.IsZero() {
+		return 0
+	}
+	return time.Since(start)
+}
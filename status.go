@@ -0,0 +1,90 @@
+package fsm
+
+import "time"
+
+// Step is a single entry in a task's history. The first step of every
+// history is the task's submission into the entrypoint state.
+type Step struct {
+	From      State
+	To        State
+	Attempt   int
+	Params    any    // Typed inputs of the To state, for non-error steps
+	Error     string // Handler error, for StateError steps
+	Reason    string // Cancellation reason, for StateCancelled steps
+	CreatedAt time.Time
+
+	// NextAttemptAt is when the failed step is retried, for StateError
+	// steps recorded with a backoff.
+	NextAttemptAt time.Time
+
+	// Deadline reports whether the step was taken by the From state's
+	// deadline, rather than its handler.
+	Deadline bool
+
+	// Operator is who took the step, for steps taken by an administrative
+	// operation rather than the FSM itself.
+	Operator string
+}
+
+// TaskStatus describes the current state of a task.
+type TaskStatus struct {
+	ID        TaskID
+	State     State
+	Terminal  bool
+	Attempt   int    // Number of failed attempts in the current state
+	Params    any    // Typed inputs of the current state
+	Error     string // Most recent error in the current state, if any
+	Priority  int    // Priority of the current state's step, while it is queued
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// ScheduledAt is when the current state's step is scheduled to run, if
+	// it was submitted or transitioned to with a time in the future and
+	// hasn't run yet.
+	ScheduledAt time.Time
+
+	// NextAttemptAt is when the current state's step is retried after its
+	// most recent failure, if it has failed.
+	NextAttemptAt time.Time
+
+	// DeadlineAt is when the current state's deadline moves the task on, if
+	// the state has one and the task is still waiting for it.
+	DeadlineAt time.Time
+
+	// Metadata is what was captured from the context of the task's
+	// submission.
+	Metadata map[string]string
+}
+
+// Scheduled reports whether the task is waiting for a scheduled step.
+func (s TaskStatus) Scheduled() bool {
+	return !s.ScheduledAt.IsZero()
+}
+
+// NewTaskStatus folds a task's history into its current status.
+func NewTaskStatus(id TaskID, history []Step) TaskStatus {
+	status := TaskStatus{ID: id}
+	for i, step := range history {
+		if i == 0 {
+			status.CreatedAt = step.CreatedAt
+		}
+		status.UpdatedAt = step.CreatedAt
+
+		if step.To == StateError {
+			status.Attempt = step.Attempt
+			status.Error = step.Error
+			status.NextAttemptAt = step.NextAttemptAt
+			continue
+		}
+		if step.To == StateRetried {
+			status.NextAttemptAt = step.CreatedAt
+			continue
+		}
+		status.State = step.To
+		status.Attempt = 0
+		status.Params = step.Params
+		status.Error = ""
+		status.NextAttemptAt = time.Time{}
+	}
+	return status
+}
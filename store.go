@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/egoodhall/fsm/gen/sqlc"
 	"github.com/egoodhall/fsm/migrations"
@@ -23,6 +24,8 @@ type Q interface {
 type Store interface {
 	DB() *sql.DB
 	Q() Q
+	// Tx runs fn in a transaction, committing if it returns nil.
+	Tx(ctx context.Context, fn func(q Q) error) error
 }
 
 var _ Store = &store{}
@@ -39,6 +42,19 @@ func (p *store) Q() Q {
 	return sqlc.New(p.db)
 }
 
+func (p *store) Tx(ctx context.Context, fn func(q Q) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(sqlc.New(tx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func OnDisk(path string) func() (Store, error) {
 	return func() (Store, error) {
 		db, err := initDB(context.Background(), path)
@@ -49,8 +65,20 @@ func OnDisk(path string) func() (Store, error) {
 	}
 }
 
+// The in-memory database is shared by every store that uses it. Shared
+// cache connections fail on table locks instead of waiting for them, so all
+// access goes through a single connection.
+var inMemory = sync.OnceValues(func() (Store, error) {
+	s, err := OnDisk("file:fsm.db?mode=memory&cache=shared")()
+	if err != nil {
+		return nil, err
+	}
+	s.DB().SetMaxOpenConns(1)
+	return s, nil
+})
+
 func InMemory() func() (Store, error) {
-	return OnDisk("file:fsm.db?mode=memory&cache=shared")
+	return inMemory
 }
 
 // InitDB initializes a new SQLite database connection, runs migrations,
@@ -60,8 +88,9 @@ func initDB(ctx context.Context, dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("create data directory: %w", err)
 	}
 
-	// Open the SQLite database
-	db, err := sql.Open("sqlite3", dbPath)
+	// Open the SQLite database. Transactions take the write lock up front, so
+	// concurrent writers wait on the busy timeout instead of failing to upgrade.
+	db, err := sql.Open("sqlite3", withParam(dbPath, "_txlock", "immediate"))
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -82,3 +111,10 @@ func initDB(ctx context.Context, dbPath string) (*sql.DB, error) {
 	// Create and return the querier
 	return db, nil
 }
+
+func withParam(dsn, key, value string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + key + "=" + value
+	}
+	return dsn + "?" + key + "=" + value
+}
@@ -5,4 +5,12 @@ type State string
 // StateError is used to indicate an error during a state transition.
 const StateError State = "__error__"
 
+// StateCancelled is used to indicate that a task was cancelled before
+// reaching a terminal state.
+const StateCancelled State = "__cancelled__"
+
+// StateRetried is used to indicate that an operator retried a failed step
+// without waiting out its backoff.
+const StateRetried State = "__retried__"
+
 type TaskID int64